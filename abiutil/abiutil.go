@@ -0,0 +1,70 @@
+// Package abiutil converts the results of a commp.Calc to and from the
+// go-state-types abi types used throughout lotus, boost and curio. It lives
+// in a module of its own, as go-state-types is a heavy dependency.
+package abiutil
+
+import (
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-fil-commp-hashhash/cidutil"
+	"github.com/filecoin-project/go-state-types/abi"
+	"golang.org/x/xerrors"
+)
+
+// Digest is identical to (*commp.Calc).Digest(), except that it returns the
+// piece CID and padded piece size as an abi.PieceInfo.
+func Digest(cp *commp.Calc) (abi.PieceInfo, error) {
+	commP, paddedPieceSize, err := cp.Digest()
+	if err != nil {
+		return abi.PieceInfo{}, err
+	}
+	return pieceInfo(commP, paddedPieceSize)
+}
+
+// DigestPadded is identical to (*commp.Calc).DigestPadded(), except that the
+// target is given as an abi.UnpaddedPieceSize, as in deal proposals, and the
+// piece padded up to it is returned as an abi.PieceInfo. An invalid target
+// results in an error wrapping commp.ErrInvalidPieceSize, leaving the Calc
+// intact.
+func DigestPadded(cp *commp.Calc, target abi.UnpaddedPieceSize) (abi.PieceInfo, error) {
+	if err := target.Validate(); err != nil {
+		return abi.PieceInfo{}, xerrors.Errorf("target unpadded size %d: %s: %w", target, err, commp.ErrInvalidPieceSize)
+	}
+	commP, _, paddedTargetSize, err := cp.DigestPadded(uint64(target.Padded()))
+	if err != nil {
+		return abi.PieceInfo{}, err
+	}
+	return pieceInfo(commP, paddedTargetSize)
+}
+
+// FromPieceInfo converts a commp.PieceInfo to an abi.PieceInfo.
+func FromPieceInfo(pi commp.PieceInfo) (abi.PieceInfo, error) {
+	return pieceInfo(pi.CommP, pi.PaddedPieceSize)
+}
+
+// ToPieceInfo converts an abi.PieceInfo to a commp.PieceInfo, as taken by
+// commp.ComputeUnsealedCommD(), validating both the piece CID and the size.
+func ToPieceInfo(pi abi.PieceInfo) (commp.PieceInfo, error) {
+	if err := pi.Size.Validate(); err != nil {
+		return commp.PieceInfo{}, xerrors.Errorf("padded piece size %d: %s: %w", pi.Size, err, commp.ErrInvalidPieceSize)
+	}
+	commP, err := cidutil.ParsePieceCID(pi.PieceCID)
+	if err != nil {
+		return commp.PieceInfo{}, err
+	}
+	return commp.PieceInfo{
+		CommP:             commP,
+		PaddedPieceSize:   uint64(pi.Size),
+		UnpaddedPieceSize: uint64(pi.Size.Unpadded()),
+	}, nil
+}
+
+func pieceInfo(commP []byte, paddedPieceSize uint64) (abi.PieceInfo, error) {
+	pieceCID, err := cidutil.PieceCID(commP)
+	if err != nil {
+		return abi.PieceInfo{}, err
+	}
+	return abi.PieceInfo{
+		Size:     abi.PaddedPieceSize(paddedPieceSize),
+		PieceCID: pieceCID,
+	}, nil
+}
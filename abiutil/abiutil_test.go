@@ -0,0 +1,102 @@
+package abiutil
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-fil-commp-hashhash/cidutil"
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+func TestDigest(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xAB}, 5000)
+
+	cp := &commp.Calc{}
+	if _, err := cp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	pi, err := cp.DigestPiece()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp.Reset()
+	if _, err := cp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Digest(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := FromPieceInfo(pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Size != abi.PaddedPieceSize(pi.PaddedPieceSize) || got.PieceCID.String() != pi.CIDString() || !got.PieceCID.Equals(exp.PieceCID) {
+		t.Fatalf("unexpected piece info %+v, expected %s/%d", got, pi.CIDString(), pi.PaddedPieceSize)
+	}
+
+	back, err := ToPieceInfo(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(back.CommP, pi.CommP) || back.PaddedPieceSize != pi.PaddedPieceSize || back.UnpaddedPieceSize != pi.UnpaddedPieceSize {
+		t.Fatalf("unexpected piece info %+v, expected %+v", back, pi)
+	}
+}
+
+func TestDigestPadded(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xAB}, 5000)
+	cp := &commp.Calc{}
+	if _, err := cp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	// invalid targets leave the Calc intact
+	for _, target := range []abi.UnpaddedPieceSize{0, 1000, 127 * 3, 127 * 32} {
+		if _, err := DigestPadded(cp, target); !errors.Is(err, commp.ErrInvalidPieceSize) {
+			t.Fatalf("%d: unexpected error %v, expected %v", target, err, commp.ErrInvalidPieceSize)
+		}
+	}
+
+	const target = abi.UnpaddedPieceSize(127 << 10)
+	got, err := DigestPadded(cp, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp.Reset()
+	if _, err := cp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	commP, paddedSize, err := cp.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded, err := commp.PadCommP(commP, paddedSize, uint64(target.Padded()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := cidutil.PieceCID(padded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Size != target.Padded() || !got.PieceCID.Equals(exp) {
+		t.Fatalf("unexpected piece info %+v, expected %s/%d", got, exp, target.Padded())
+	}
+}
+
+func TestToPieceInfoInvalid(t *testing.T) {
+	pieceCID, err := cidutil.PieceCID(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ToPieceInfo(abi.PieceInfo{Size: 1000, PieceCID: pieceCID}); !errors.Is(err, commp.ErrInvalidPieceSize) {
+		t.Fatalf("unexpected error %v, expected %v", err, commp.ErrInvalidPieceSize)
+	}
+	if _, err := ToPieceInfo(abi.PieceInfo{Size: 1024}); !errors.Is(err, commp.ErrInvalidCommP) {
+		t.Fatalf("unexpected error %v, expected %v", err, commp.ErrInvalidCommP)
+	}
+}
@@ -0,0 +1,42 @@
+module github.com/filecoin-project/go-fil-commp-hashhash/abiutil
+
+go 1.22
+
+require (
+	github.com/filecoin-project/go-fil-commp-hashhash v0.3.0
+	github.com/filecoin-project/go-fil-commp-hashhash/cidutil v0.1.0
+	github.com/filecoin-project/go-state-types v0.13.3
+	golang.org/x/xerrors v0.0.0-20220907171357-04be3eba64a2
+)
+
+require (
+	github.com/filecoin-project/go-address v1.1.0 // indirect
+	github.com/filecoin-project/go-fil-commcid v0.1.0 // indirect
+	github.com/ipfs/go-block-format v0.0.3 // indirect
+	github.com/ipfs/go-cid v0.4.1 // indirect
+	github.com/ipfs/go-ipfs-util v0.0.2 // indirect
+	github.com/ipfs/go-ipld-cbor v0.0.6 // indirect
+	github.com/ipfs/go-ipld-format v0.0.2 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.4 // indirect
+	github.com/minio/blake2b-simd v0.0.0-20160723061019-3f5f724cb5b1 // indirect
+	github.com/minio/sha256-simd v1.0.1 // indirect
+	github.com/mr-tron/base58 v1.2.0 // indirect
+	github.com/multiformats/go-base32 v0.1.0 // indirect
+	github.com/multiformats/go-base36 v0.2.0 // indirect
+	github.com/multiformats/go-multibase v0.1.1 // indirect
+	github.com/multiformats/go-multihash v0.2.1 // indirect
+	github.com/multiformats/go-varint v0.0.7 // indirect
+	github.com/polydawn/refmt v0.0.0-20201211092308-30ac6d18308e // indirect
+	github.com/spaolacci/murmur3 v1.1.0 // indirect
+	github.com/whyrusleeping/cbor-gen v0.1.0 // indirect
+	golang.org/x/crypto v0.7.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
+	lukechampine.com/blake3 v1.1.7 // indirect
+)
+
+// kept in lockstep with the library it wraps, until released as described in
+// the Releasing section of the README
+replace (
+	github.com/filecoin-project/go-fil-commp-hashhash => ../
+	github.com/filecoin-project/go-fil-commp-hashhash/cidutil => ../cidutil
+)
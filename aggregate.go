@@ -0,0 +1,111 @@
+package commp
+
+import (
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// SubPiece is a sub-piece to aggregate with BuildAggregate(): either a payload
+// to digest, or a piece digested already.
+type SubPiece struct {
+	// Payload is read to its end and digested, unless nil
+	Payload io.Reader
+	// Piece is the sub-piece as digested already, used when Payload is nil
+	Piece PieceInfo
+}
+
+// AggregatedPiece is an aggregate piece built by BuildAggregate().
+type AggregatedPiece struct {
+	// Piece is the aggregate, its piece CID being Piece.CIDString()
+	Piece PieceInfo
+	// Segments are the sub-pieces as laid out within the aggregate, in the
+	// order they were given in
+	Segments []DataSegment
+	// Proofs are the inclusion proofs of Segments, one each, to be handed to
+	// the clients whose data the sub-pieces hold
+	Proofs []InclusionProof
+}
+
+// BuildAggregate builds an aggregate piece out of the given sub-pieces as
+// specified by FRC-0058, the complete aggregation path in one call. Payloads
+// are digested one after the other with a Calc constructed with opts. The
+// sub-pieces are laid out in order by PackDataSegments(), which leaves no
+// gaps between them when listed from the largest to the smallest, and are
+// followed by the data segment index describing them. A paddedSize of 0
+// selects the smallest aggregate holding both, otherwise NewAggregate()
+// validates that they fit.
+func BuildAggregate(paddedSize uint64, subPieces []SubPiece, opts ...Option) (*AggregatedPiece, error) {
+	if len(subPieces) == 0 {
+		return nil, xerrors.Errorf("an aggregate must contain at least one segment: %w", ErrInvalidLayout)
+	}
+
+	segs := make([]DataSegment, len(subPieces))
+	var cp *Calc
+	for i, sp := range subPieces {
+		pi := sp.Piece
+		if sp.Payload != nil {
+			if cp == nil {
+				cp = New(opts...)
+			} else {
+				cp.Reset()
+			}
+			if _, err := io.Copy(cp, sp.Payload); err != nil {
+				cp.Reset()
+				return nil, xerrors.Errorf("digesting the payload of sub-piece %d: %w", i, err)
+			}
+			var err error
+			if pi, err = cp.DigestPiece(); err != nil {
+				cp.Reset()
+				return nil, xerrors.Errorf("digesting the payload of sub-piece %d: %w", i, err)
+			}
+		} else if len(pi.CommP) != 32 {
+			return nil, xerrors.Errorf("sub-piece %d commP must be exactly 32 bytes long, got %d bytes instead: %w", i, len(pi.CommP), ErrInvalidCommP)
+		}
+		copy(segs[i].CommP[:], pi.CommP)
+		segs[i].PaddedSize = pi.PaddedPieceSize
+	}
+	segs = PackDataSegments(segs)
+
+	if paddedSize == 0 {
+		paddedSize = smallestAggregateSize(segs)
+	}
+	agg, err := NewAggregate(paddedSize, segs)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &AggregatedPiece{
+		Segments: segs,
+		Proofs:   make([]InclusionProof, len(segs)),
+	}
+	commP := agg.CommP()
+	res.Piece = PieceInfo{
+		CommP:             commP[:],
+		PaddedPieceSize:   paddedSize,
+		UnpaddedPieceSize: paddedSize / 128 * 127,
+	}
+	for i := range segs {
+		if res.Proofs[i], err = agg.ProveInclusion(i); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// smallestAggregateSize returns the smallest size of an aggregate holding
+// the packed segments along with their index, or MaxPieceSize should none,
+// for NewAggregate() to fail on.
+func smallestAggregateSize(segs []DataSegment) uint64 {
+	last := segs[len(segs)-1]
+	end := last.Offset + last.PaddedSize
+	size := uint64(minAggregateSize)
+	for size < MaxPieceSize {
+		indexStart := segmentIndexStart(size)
+		if end <= indexStart && uint64(len(segs)) <= (size-indexStart)/segmentIndexEntrySize {
+			break
+		}
+		size *= 2
+	}
+	return size
+}
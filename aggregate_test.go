@@ -0,0 +1,103 @@
+package commp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	randmath "math/rand"
+)
+
+func TestBuildAggregate(t *testing.T) {
+	t.Parallel()
+
+	var payloads [][]byte
+	var subPieces, digested []SubPiece
+	for i, size := range []int{127 * 64, 5000, 127 * 20, 100} {
+		payload := make([]byte, size)
+		randmath.New(randmath.NewSource(int64(i))).Read(payload)
+		payloads = append(payloads, payload)
+
+		commP, paddedSize := mustDigest(t, New(), payload)
+		subPieces = append(subPieces, SubPiece{Payload: bytes.NewReader(payload)})
+		digested = append(digested, SubPiece{Piece: PieceInfo{CommP: commP, PaddedPieceSize: paddedSize}})
+	}
+
+	// from the payloads, in the smallest aggregate holding them
+	res, err := BuildAggregate(0, subPieces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Piece.PaddedPieceSize != 32768 {
+		t.Fatalf("aggregate of padded size %d, expected the smallest of %d", res.Piece.PaddedPieceSize, 32768)
+	}
+
+	// the same from their pieces, matching an aggregate assembled by hand
+	fromPieces, err := BuildAggregate(0, digested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fromPieces.Piece.CommP, res.Piece.CommP) {
+		t.Fatalf("aggregate of the pieces 0x%X, expected 0x%X of the payloads", fromPieces.Piece.CommP, res.Piece.CommP)
+	}
+	segs := make([]DataSegment, len(digested))
+	for i, sp := range digested {
+		copy(segs[i].CommP[:], sp.Piece.CommP)
+		segs[i].PaddedSize = sp.Piece.PaddedPieceSize
+	}
+	agg, err := NewAggregate(32768, PackDataSegments(segs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := agg.CommP(); !bytes.Equal(res.Piece.CommP, exp[:]) {
+		t.Fatalf("aggregate 0x%X, expected 0x%X", res.Piece.CommP, exp)
+	}
+
+	// every proof resolves to the aggregate
+	if len(res.Segments) != len(payloads) || len(res.Proofs) != len(payloads) {
+		t.Fatalf("%d segments with %d proofs, expected %d", len(res.Segments), len(res.Proofs), len(payloads))
+	}
+	for i, s := range res.Segments {
+		if !bytes.Equal(s.CommP[:], digested[i].Piece.CommP) || s.PaddedSize != digested[i].Piece.PaddedPieceSize {
+			t.Fatalf("segment %d of commP 0x%X and size %d, expected 0x%X and %d", i, s.CommP, s.PaddedSize, digested[i].Piece.CommP, digested[i].Piece.PaddedPieceSize)
+		}
+		root, size, err := res.Proofs[i].AggregateCommP(s.CommP, s.PaddedSize)
+		if err != nil {
+			t.Fatalf("segment %d: %s", i, err)
+		}
+		if !bytes.Equal(root[:], res.Piece.CommP) || size != res.Piece.PaddedPieceSize {
+			t.Fatalf("segment %d proves inclusion in 0x%X of size %d, expected 0x%X of size %d", i, root, size, res.Piece.CommP, res.Piece.PaddedPieceSize)
+		}
+	}
+
+	// in an aggregate of a given size
+	large, err := BuildAggregate(1<<20, digested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if large.Piece.PaddedPieceSize != 1<<20 || bytes.Equal(large.Piece.CommP, res.Piece.CommP) {
+		t.Fatalf("aggregate 0x%X of padded size %d, expected another one of %d", large.Piece.CommP, large.Piece.PaddedPieceSize, 1<<20)
+	}
+}
+
+func TestBuildAggregateInvalid(t *testing.T) {
+	t.Parallel()
+
+	big := SubPiece{Piece: PieceInfo{CommP: make([]byte, 32), PaddedPieceSize: 8192}}
+	for _, tc := range []struct {
+		name       string
+		paddedSize uint64
+		subPieces  []SubPiece
+		exp        error
+	}{
+		{"no sub-pieces", 0, nil, ErrInvalidLayout},
+		{"too small", 8192, []SubPiece{big}, ErrInvalidLayout},
+		{"bad commP", 0, []SubPiece{{Piece: PieceInfo{CommP: make([]byte, 31), PaddedPieceSize: 128}}}, ErrInvalidCommP},
+		{"bad size", 0, []SubPiece{{Piece: PieceInfo{CommP: make([]byte, 32), PaddedPieceSize: 1000}}}, ErrInvalidPieceSize},
+		{"short payload", 0, []SubPiece{big, {Payload: bytes.NewReader(make([]byte, 10))}}, ErrBelowMinimumPayload},
+	} {
+		if _, err := BuildAggregate(tc.paddedSize, tc.subPieces); !errors.Is(err, tc.exp) {
+			t.Fatalf("%s: unexpected error %v, expected %v", tc.name, err, tc.exp)
+		}
+	}
+}
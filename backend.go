@@ -0,0 +1,96 @@
+package commp
+
+import (
+	"crypto/sha256"
+	"hash"
+	"os"
+	"sync"
+	"time"
+)
+
+// HashBackend identifies the SHA-256 implementation hashing the nodes of the
+// tree. All backends produce identical results, they only differ in speed,
+// which depends on the CPU and the version of Go.
+type HashBackend string
+
+const (
+	// HashBackendAuto selects DefaultHashBackend().
+	HashBackendAuto = HashBackend("auto")
+	// HashBackendSIMD is github.com/minio/sha256-simd, or crypto/sha256 in
+	// builds without assembly: with the purego build tag, or under TinyGo.
+	HashBackendSIMD = HashBackend("sha256-simd")
+	// HashBackendStdlib is crypto/sha256 from the Go standard library.
+	HashBackendStdlib = HashBackend("crypto/sha256")
+)
+
+// HashBackendEnvVar is the name of the environment variable overriding the
+// detection of DefaultHashBackend(). It is read once, on first use.
+const HashBackendEnvVar = "COMMP_HASH_BACKEND"
+
+var (
+	defaultBackendOnce sync.Once
+	defaultBackend     HashBackend
+)
+
+// DefaultHashBackend returns the backend used by every Calc not constructed
+// WithHashBackend(), and by all other functions of this package building
+// trees. It is taken from the environment variable named by
+// HashBackendEnvVar if set to a known backend, otherwise it is the faster one
+// as measured on first use, which takes about a millisecond.
+func DefaultHashBackend() HashBackend {
+	defaultBackendOnce.Do(func() {
+		switch b := HashBackend(os.Getenv(HashBackendEnvVar)); b {
+		case HashBackendSIMD, HashBackendStdlib:
+			defaultBackend = b
+		default:
+			defaultBackend = fastestHashBackend()
+		}
+	})
+	return defaultBackend
+}
+
+// new returns a hasher of the backend, with anything other than a known
+// backend standing for DefaultHashBackend().
+func (b HashBackend) new() hash.Hash {
+	switch b {
+	case HashBackendSIMD:
+		return newSIMD()
+	case HashBackendStdlib:
+		return sha256.New()
+	default:
+		return DefaultHashBackend().new()
+	}
+}
+
+// newHasher returns a hasher of DefaultHashBackend().
+func newHasher() hash.Hash { return DefaultHashBackend().new() }
+
+// fastestHashBackend times both backends reducing the same pairs of nodes, in
+// a few interleaved rounds to even out any noise.
+func fastestHashBackend() HashBackend {
+	if !hasSIMD {
+		return HashBackendStdlib
+	}
+
+	slab := make([]byte, 64<<10)
+	for i := range slab {
+		slab[i] = byte(i) // anything but zeroes, which are not hashed at all
+	}
+	var simd, stdlib time.Duration
+	for round := 0; round < 3; round++ {
+		for _, b := range []HashBackend{HashBackendSIMD, HashBackendStdlib} {
+			h := b.new()
+			t0 := time.Now()
+			hashSlab254(h, 0, slab)
+			if b == HashBackendSIMD {
+				simd += time.Since(t0)
+			} else {
+				stdlib += time.Since(t0)
+			}
+		}
+	}
+	if stdlib < simd {
+		return HashBackendStdlib
+	}
+	return HashBackendSIMD
+}
@@ -0,0 +1,43 @@
+package commp
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	randmath "math/rand"
+)
+
+func TestHashBackend(t *testing.T) {
+	t.Parallel()
+
+	if b := DefaultHashBackend(); b != HashBackendSIMD && b != HashBackendStdlib {
+		t.Fatalf("unexpected default backend %q", b)
+	}
+
+	for _, size := range []int{127, 1000, 3*bufferSize + 5} {
+		payload := make([]byte, size)
+		randmath.New(randmath.NewSource(int64(size))).Read(payload)
+		exp, expSize := mustDigest(t, &Calc{}, payload)
+
+		for _, b := range []HashBackend{HashBackendAuto, HashBackendSIMD, HashBackendStdlib, HashBackend("bogus")} {
+			t.Run(fmt.Sprintf("%d/%s", size, b), func(t *testing.T) {
+				cp := New(WithHashBackend(b))
+				if _, err := cp.Write(payload); err != nil {
+					t.Fatal(err)
+				}
+				snap, _, err := cp.SnapshotDigest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				commP, paddedSize, err := cp.Digest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(commP, exp) || !bytes.Equal(snap, exp) || paddedSize != expSize {
+					t.Fatalf("commP 0x%X/%d doesn't match expected 0x%X/%d", commP, paddedSize, exp, expSize)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package commp
+
+// BatchWriter collects small writes on behalf of a single caller, handing
+// them to its Calc a whole slab at a time. High-frequency writers such as
+// network handlers thereby take the lock of the Calc once per slab, instead
+// of once per Write(). A BatchWriter is not safe for concurrent use: every
+// writer feeding the same Calc needs its own, and the interleaving of their
+// input is then only determined at slab granularity.
+//
+// The Calc only sees batched bytes once they are flushed: Flush() before
+// invoking any method of the Calc itself, such as Digest() or BytesWritten().
+type BatchWriter struct {
+	cp  *Calc
+	buf []byte
+	err error
+}
+
+// NewBatchWriter returns a BatchWriter feeding cp.
+func NewBatchWriter(cp *Calc) *BatchWriter {
+	return &BatchWriter{cp: cp}
+}
+
+// Write buffers p, passing it on to the Calc whenever a slab worth of input
+// has accumulated. Errors of the Calc, such as ErrPayloadTooLarge or
+// ErrInvalidPadding, may therefore only surface on a later Write() or
+// Flush(), and stick from then on: the batched input is lost, and the Calc
+// must be Reset() before reuse, along with a new BatchWriter.
+func (bw *BatchWriter) Write(p []byte) (int, error) {
+	if bw.err != nil {
+		return 0, bw.err
+	}
+	if bw.buf == nil {
+		bw.buf = make([]byte, 0, bw.cp.slabSize())
+	}
+
+	// the fast path, not touching the Calc at all
+	if len(bw.buf)+len(p) < cap(bw.buf) {
+		bw.buf = append(bw.buf, p...)
+		return len(p), nil
+	}
+
+	written := len(p)
+	if len(bw.buf) > 0 {
+		fill := cap(bw.buf) - len(bw.buf)
+		bw.buf = append(bw.buf, p[:fill]...)
+		p = p[fill:]
+		if err := bw.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	// whatever is at least a slab goes through as-is
+	if len(p) >= cap(bw.buf) {
+		if _, err := bw.cp.Write(p); err != nil {
+			bw.err = err
+			return 0, err
+		}
+		p = nil
+	}
+
+	bw.buf = append(bw.buf, p...)
+	return written, nil
+}
+
+// Flush passes any batched input on to the Calc.
+func (bw *BatchWriter) Flush() error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if len(bw.buf) == 0 {
+		return nil
+	}
+	if _, err := bw.cp.Write(bw.buf); err != nil {
+		bw.err = err
+		return err
+	}
+	bw.buf = bw.buf[:0]
+	return nil
+}
@@ -0,0 +1,66 @@
+package commp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	randmath "math/rand"
+)
+
+func TestBatchWriter(t *testing.T) {
+	t.Parallel()
+
+	rnd := randmath.New(randmath.NewSource(1))
+	payload := make([]byte, 5*bufferSize+12345)
+	rnd.Read(payload)
+	exp, expSize := mustDigest(t, &Calc{}, payload)
+
+	cp := &Calc{}
+	bw := NewBatchWriter(cp)
+	for rest := payload; len(rest) > 0; {
+		// mostly small writes, the occasional one spanning several slabs,
+		// and some flushes in between
+		n := 1 + rnd.Intn(300)
+		if rnd.Intn(50) == 0 {
+			n = rnd.Intn(3 * bufferSize)
+		}
+		n = min(n, len(rest))
+		if written, err := bw.Write(rest[:n]); err != nil || written != n {
+			t.Fatalf("wrote %d out of %d bytes: %v", written, n, err)
+		}
+		rest = rest[n:]
+
+		if rnd.Intn(100) == 0 {
+			if err := bw.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if cp.BytesWritten() != uint64(len(payload)-len(rest)) {
+				t.Fatalf("calc holds %d bytes after a flush, expected %d", cp.BytesWritten(), len(payload)-len(rest))
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	commP, paddedSize, err := cp.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(commP, exp) || paddedSize != expSize {
+		t.Fatalf("produced commP 0x%X/%d doesn't match expected 0x%X/%d", commP, paddedSize, exp, expSize)
+	}
+
+	// errors of the Calc surface on flushing, and stick
+	bw = NewBatchWriter(New(WithPaddedInput()))
+	bad := bytes.Repeat([]byte{0xFF}, 128)
+	if _, err := bw.Write(bad); err != nil {
+		t.Fatalf("unexpected error %v before flushing", err)
+	}
+	if err := bw.Flush(); !errors.Is(err, ErrInvalidPadding) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInvalidPadding)
+	}
+	if _, err := bw.Write(make([]byte, 128)); !errors.Is(err, ErrInvalidPadding) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInvalidPadding)
+	}
+}
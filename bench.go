@@ -0,0 +1,111 @@
+package commp
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	randmath "math/rand"
+
+	"golang.org/x/xerrors"
+)
+
+// BenchResult is the outcome of a Bench() run.
+type BenchResult struct {
+	Size       uint64        // bytes of payload digested
+	Elapsed    time.Duration // wall time from the first Write() until Digest() returned
+	Throughput float64       // bytes of payload per second of Elapsed
+	Allocs     uint64        // heap allocations made meanwhile, by any goroutine
+	AllocBytes uint64        // heap bytes allocated meanwhile, by any goroutine
+
+	// Time spent in each stage of the Calc, summed over every goroutine
+	// involved: with the stages overlapping on multiple cores these add up to
+	// more than Elapsed. Expansion is the fr32 expansion of the payload on the
+	// goroutine calling Write(), Hashing the reduction of the tree by the
+	// tower including any node sink, and Transfer the time Write() was blocked
+	// handing slabs to the tower, waiting for it to catch up.
+	Expansion time.Duration
+	Hashing   time.Duration
+	Transfer  time.Duration
+}
+
+// stageTimes accumulates the time spent in each stage of a Calc, see
+// BenchResult. Its methods are no-ops on a nil receiver, the case outside of
+// Bench().
+type stageTimes [stageCount]atomic.Int64
+
+type stage int
+
+const (
+	stageExpansion stage = iota
+	stageHashing
+	stageTransfer
+	stageCount
+)
+
+func (st *stageTimes) start() time.Time {
+	if st == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (st *stageTimes) stop(s stage, start time.Time) {
+	if st != nil {
+		st[s].Add(int64(time.Since(start)))
+	}
+}
+
+// Bench digests size bytes of pseudo-random payload with a Calc constructed
+// with the supplied options, and reports how it went. This lets operators
+// validate tuning choices, such as WithMaxMemory() or a GOMAXPROCS setting,
+// on the machine at hand. The payload is generated ahead of time and reused,
+// so that it does not weigh on the result. Do not run anything else
+// meanwhile, as the allocation counts are process-wide.
+func Bench(size uint64, opts ...Option) (BenchResult, error) {
+	cp := New(opts...)
+	cp.cfg.stats = &stageTimes{}
+	if size < cp.minInput() || size > cp.maxInput() {
+		return BenchResult{}, xerrors.Errorf("benchmark size %d is not between %d and %d: %w", size, cp.minInput(), cp.maxInput(), ErrInvalidPieceSize)
+	}
+
+	chunk := make([]byte, 1<<20)
+	randmath.New(randmath.NewSource(1)).Read(chunk)
+	if cp.cfg.paddedInput {
+		// valid fr32 leaves only
+		for i := 31; i < len(chunk); i += 32 {
+			chunk[i] &= 0x3F
+		}
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	for rest := size; rest > 0; {
+		n := min(rest, uint64(len(chunk)))
+		if _, err := cp.Write(chunk[:n]); err != nil {
+			cp.Reset()
+			return BenchResult{}, err
+		}
+		rest -= n
+	}
+	if _, _, err := cp.Digest(); err != nil {
+		return BenchResult{}, err
+	}
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	return BenchResult{
+		Size:       size,
+		Elapsed:    elapsed,
+		Throughput: float64(size) / elapsed.Seconds(),
+		Allocs:     after.Mallocs - before.Mallocs,
+		AllocBytes: after.TotalAlloc - before.TotalAlloc,
+		Expansion:  time.Duration(cp.cfg.stats[stageExpansion].Load()),
+		Hashing:    time.Duration(cp.cfg.stats[stageHashing].Load()),
+		Transfer:   time.Duration(cp.cfg.stats[stageTransfer].Load()),
+	}, nil
+}
@@ -0,0 +1,34 @@
+package commp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBench(t *testing.T) {
+	t.Parallel()
+
+	const size = 3<<20 + 1000
+	for _, opts := range [][]Option{
+		nil,
+		{WithPaddedInput()},
+		{WithMaxMemory(64 << 10), WithScheduler(NewScheduler(1))},
+	} {
+		res, err := Bench(size, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Size != size || res.Elapsed <= 0 || res.Throughput <= 0 {
+			t.Fatalf("unexpected result %+v", res)
+		}
+		if res.Expansion <= 0 || res.Hashing <= 0 || res.Transfer < 0 {
+			t.Fatalf("unexpected stage timings %+v", res)
+		}
+	}
+
+	for _, size := range []uint64{0, MaxPiecePayload + 1} {
+		if _, err := Bench(size); !errors.Is(err, ErrInvalidPieceSize) {
+			t.Fatalf("%d: unexpected error %v, expected %v", size, err, ErrInvalidPieceSize)
+		}
+	}
+}
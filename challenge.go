@@ -0,0 +1,67 @@
+package commp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+
+	"golang.org/x/xerrors"
+)
+
+// Challenge is a single leaf of a piece selected for a spot-check.
+type Challenge struct {
+	// Leaf is the index of the challenged fr32-padded leaf
+	Leaf uint64
+	// PayloadOffset and PayloadLength describe the range of the original
+	// payload contributing to the leaf, as returned by LeafPayloadRange()
+	PayloadOffset uint64
+	PayloadLength uint64
+}
+
+// SampleChallenges deterministically derives count leaves of a piece of the
+// given padded size from seed, typically a randomness beacon value. The leaf
+// of challenge i is the first 8 bytes of sha256(seed || i), with i encoded as
+// a little-endian uint64, read as a little-endian uint64 and reduced modulo
+// the amount of leaves. As the amount of leaves is always a power of 2, the
+// selection is unbiased. Challenges may repeat.
+//
+// Challenged leaves past the end of the payload are valid and expected to be
+// zero, proving the piece is padded correctly.
+func SampleChallenges(seed []byte, paddedPieceSize uint64, count int) ([]Challenge, error) {
+	if bits.OnesCount64(paddedPieceSize) != 1 || paddedPieceSize < 128 || paddedPieceSize > MaxPieceSize {
+		return nil, xerrors.Errorf("padded piece size %d is not a power of 2 between 128 and %d: %w", paddedPieceSize, MaxPieceSize, ErrInvalidPieceSize)
+	}
+	if count < 0 {
+		return nil, xerrors.Errorf("invalid challenge count %d", count)
+	}
+
+	mask := paddedPieceSize/32 - 1
+	h := newSIMD()
+	var idx [8]byte
+	var digest [sha256.Size]byte
+
+	challenges := make([]Challenge, count)
+	for i := range challenges {
+		binary.LittleEndian.PutUint64(idx[:], uint64(i))
+		h.Reset()
+		h.Write(seed)
+		h.Write(idx[:])
+		h.Sum(digest[:0])
+
+		c := &challenges[i]
+		c.Leaf = binary.LittleEndian.Uint64(digest[:8]) & mask
+		c.PayloadOffset, c.PayloadLength = LeafPayloadRange(c.Leaf)
+	}
+	return challenges, nil
+}
+
+// LeafPayloadRange returns the range of payload bytes which contribute at
+// least one bit to the fr32-padded leaf at the given index. It is the inverse
+// of PayloadLeafRange(): the boundary bytes of the range are shared with the
+// adjacent leaves.
+func LeafPayloadRange(leafIndex uint64) (offset, length uint64) {
+	quad, inQuad := leafIndex/4, leafIndex%4
+	firstBit, lastBit := inQuad*254, inQuad*254+253
+	offset = quad*uint64(quadPayload) + firstBit/8
+	return offset, quad*uint64(quadPayload) + lastBit/8 + 1 - offset
+}
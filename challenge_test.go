@@ -0,0 +1,71 @@
+package commp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestSampleChallenges(t *testing.T) {
+	t.Parallel()
+
+	seed := []byte("a randomness beacon value")
+	const paddedSize = 1 << 20
+
+	cs, err := SampleChallenges(seed, paddedSize, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := SampleChallenges(seed, paddedSize, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cs, again) {
+		t.Fatal("challenges derived from the same seed differ")
+	}
+	other, err := SampleChallenges([]byte("another beacon value"), paddedSize, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(cs, other) {
+		t.Fatal("challenges derived from different seeds are identical")
+	}
+
+	for i, c := range cs {
+		d := sha256.Sum256(binary.LittleEndian.AppendUint64(append([]byte{}, seed...), uint64(i)))
+		if exp := binary.LittleEndian.Uint64(d[:]) % (paddedSize / 32); c.Leaf != exp {
+			t.Fatalf("challenge %d selected leaf %d, expected %d", i, c.Leaf, exp)
+		}
+		first, last, err := PayloadLeafRange(c.PayloadOffset, c.PayloadLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first > c.Leaf || last < c.Leaf || last-first > 2 {
+			t.Fatalf("challenge %d of leaf %d maps to payload %d+%d covering leaves %d-%d", i, c.Leaf, c.PayloadOffset, c.PayloadLength, first, last)
+		}
+	}
+
+	if _, err := SampleChallenges(seed, 3<<10, 1); err == nil {
+		t.Fatal("unexpected success sampling a piece of invalid size")
+	}
+}
+
+func TestLeafPayloadRange(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		leaf, offset, length uint64
+	}{
+		{0, 0, 32},
+		{1, 31, 33},
+		{2, 63, 33},
+		{3, 95, 32},
+		{4, 127, 32},
+		{MaxPieceSize/32 - 1, MaxPiecePayload - 32, 32},
+	} {
+		if offset, length := LeafPayloadRange(tc.leaf); offset != tc.offset || length != tc.length {
+			t.Errorf("leaf %d mapped to payload %d+%d, expected %d+%d", tc.leaf, offset, length, tc.offset, tc.length)
+		}
+	}
+}
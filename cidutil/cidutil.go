@@ -0,0 +1,56 @@
+// Package cidutil produces and parses piece CIDs as go-cid cid.Cid values,
+// for users who are fine with the go-cid dependency. It lives in a module of
+// its own so that the commp package itself stays dependency-light: the raw
+// forms are available there as PieceInfo.CIDBytes() and CIDString().
+// It also provides the fr32-sha256-trunc254-padbintree multihash, which can
+// be registered with go-multihash for use by generic multihash consumers.
+package cidutil
+
+import (
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// Digest is identical to (*commp.Calc).Digest(), except that it returns the
+// piece CID instead of the raw commP.
+func Digest(cp *commp.Calc) (pieceCID cid.Cid, paddedPieceSize uint64, err error) {
+	commP, paddedPieceSize, err := cp.Digest()
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	pieceCID, err = PieceCID(commP)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	return pieceCID, paddedPieceSize, nil
+}
+
+// PieceCID returns the v1 piece CID (fil-commitment-unsealed codec,
+// sha2-256-trunc254-padded multihash) of a raw 32 byte commP.
+func PieceCID(commP []byte) (cid.Cid, error) {
+	c, err := commcid.PieceCommitmentV1ToCID(commP)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("converting commP 0x%X: %s: %w", commP, err, commp.ErrInvalidCommP)
+	}
+	return c, nil
+}
+
+// FromPieceInfo returns the piece CID of pi.
+func FromPieceInfo(pi commp.PieceInfo) (cid.Cid, error) {
+	return PieceCID(pi.CommP)
+}
+
+// ParsePieceCID returns the raw commP carried by a v1 piece CID, or an error
+// wrapping commp.ErrInvalidCommP if c is anything else.
+func ParsePieceCID(c cid.Cid) ([]byte, error) {
+	if !c.Defined() {
+		return nil, xerrors.Errorf("undefined piece CID: %w", commp.ErrInvalidCommP)
+	}
+	commP, err := commcid.CIDToPieceCommitmentV1(c)
+	if err != nil {
+		return nil, xerrors.Errorf("parsing piece CID %s: %s: %w", c, err, commp.ErrInvalidCommP)
+	}
+	return commP, nil
+}
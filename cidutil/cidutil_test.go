@@ -0,0 +1,78 @@
+package cidutil
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+)
+
+func TestDigest(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xAB}, 1<<20)
+
+	cp := &commp.Calc{}
+	if _, err := cp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	pieceCID, paddedSize, err := Digest(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp = &commp.Calc{}
+	if _, err := cp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	pi, err := cp.DigestPiece()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paddedSize != pi.PaddedPieceSize {
+		t.Fatalf("padded size %d doesn't match expected %d", paddedSize, pi.PaddedPieceSize)
+	}
+	if !bytes.Equal(pieceCID.Bytes(), pi.CIDBytes()) || pieceCID.String() != pi.CIDString() {
+		t.Fatalf("piece CID %s doesn't match expected %s", pieceCID, pi.CIDString())
+	}
+	if c, err := FromPieceInfo(pi); err != nil || !c.Equals(pieceCID) {
+		t.Fatalf("unexpected piece CID %s (%v), expected %s", c, err, pieceCID)
+	}
+
+	commP, err := ParsePieceCID(pieceCID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(commP, pi.CommP) {
+		t.Fatalf("parsed commP 0x%X doesn't match expected 0x%X", commP, pi.CommP)
+	}
+
+	// errors of the Calc pass through unchanged
+	if _, _, err := Digest(&commp.Calc{}); !errors.Is(err, commp.ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected error %v, expected %v", err, commp.ErrBelowMinimumPayload)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := PieceCID(make([]byte, 31)); !errors.Is(err, commp.ErrInvalidCommP) {
+		t.Fatalf("unexpected error %v, expected %v", err, commp.ErrInvalidCommP)
+	}
+
+	pieceCID, err := PieceCID(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256CID, err := cid.Prefix{Version: 1, Codec: cid.FilCommitmentUnsealed, MhType: 0x12, MhLength: -1}.Sum([]byte("commp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []cid.Cid{
+		cid.Undef,
+		cid.NewCidV1(cid.Raw, pieceCID.Hash()), // wrong codec
+		sha256CID,                              // wrong multihash
+	} {
+		if _, err := ParsePieceCID(c); !errors.Is(err, commp.ErrInvalidCommP) {
+			t.Fatalf("%s: unexpected error %v, expected %v", c, err, commp.ErrInvalidCommP)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package cidutil
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/multiformats/go-multihash"
+	mhreg "github.com/multiformats/go-multihash/core"
+	"golang.org/x/xerrors"
+)
+
+// Fr32Sha256Trunc254PadBinTree is the multihash code of a commP together with
+// the shape of its piece, as carried by v2 piece CIDs. Its digest is the
+// uvarint amount of zero payload padding the piece was filled with, followed
+// by a single byte of tree height and the 32 byte root.
+const Fr32Sha256Trunc254PadBinTree = 0x1011
+
+// minMultihashDigest is the length of a digest with no padding.
+const minMultihashDigest = 1 + 1 + 32
+
+// RegisterMultihash makes NewMultihasher() available through the go-multihash
+// registry, so that generic code can compute piece multihashes with
+// multihash.Sum() or a cid.Prefix. Like multihash.Register() it has a global
+// effect, and is meant to be called at init time: importing the register
+// subpackage does exactly that.
+func RegisterMultihash() {
+	mhreg.RegisterVariableSize(Fr32Sha256Trunc254PadBinTree, func(sizeHint int) (hash.Hash, bool) {
+		// the digest cannot be truncated
+		return NewMultihasher(), sizeHint < 0 || sizeHint >= minMultihashDigest
+	})
+}
+
+// NewMultihasher returns a hash.Hash over a fresh commp.Calc whose Sum() is
+// the Fr32Sha256Trunc254PadBinTree digest of the payload written so far. As
+// with (*commp.Calc).Sum() it panics if less than commp.MinPiecePayload bytes
+// were written. Its Size() is that of the digest at the time of the call.
+func NewMultihasher() hash.Hash {
+	return &multihasher{}
+}
+
+type multihasher struct {
+	commp.Calc
+}
+
+func (mh *multihasher) Sum(buf []byte) []byte {
+	commP, paddedPieceSize, err := mh.SnapshotDigest()
+	if err != nil {
+		panic(err)
+	}
+	return appendMultihashDigest(buf, commP, paddedPieceSize, mh.BytesWritten())
+}
+
+func (mh *multihasher) Size() int {
+	payloadSize := max(mh.BytesWritten(), commp.MinPiecePayload)
+	return len(binary.AppendUvarint(nil, paddedPieceSize(payloadSize)/128*127-payloadSize)) + 1 + 32
+}
+
+func appendMultihashDigest(buf, commP []byte, paddedPieceSize, payloadSize uint64) []byte {
+	buf = binary.AppendUvarint(buf, paddedPieceSize/128*127-payloadSize)
+	buf = append(buf, byte(bits.TrailingZeros64(paddedPieceSize/32)))
+	return append(buf, commP...)
+}
+
+// paddedPieceSize returns the size of the smallest piece holding payloadSize
+// bytes of payload.
+func paddedPieceSize(payloadSize uint64) uint64 {
+	size := uint64(128)
+	for size/128*127 < payloadSize {
+		size *= 2
+	}
+	return size
+}
+
+// PieceMultihash returns the Fr32Sha256Trunc254PadBinTree multihash of a
+// commP calculated over payloadSize bytes of payload.
+func PieceMultihash(commP []byte, payloadSize uint64) (multihash.Multihash, error) {
+	if len(commP) != 32 {
+		return nil, xerrors.Errorf("commP of %d bytes instead of 32: %w", len(commP), commp.ErrInvalidCommP)
+	}
+	if payloadSize < commp.MinPiecePayload || payloadSize > commp.MaxPiecePayload {
+		return nil, xerrors.Errorf("payload size %d is not between %d and %d: %w", payloadSize, commp.MinPiecePayload, commp.MaxPiecePayload, commp.ErrInvalidPieceSize)
+	}
+	return multihash.Encode(appendMultihashDigest(nil, commP, paddedPieceSize(payloadSize), payloadSize), Fr32Sha256Trunc254PadBinTree)
+}
+
+// ParsePieceMultihash returns the commP, the padded piece size and the
+// payload size carried by a Fr32Sha256Trunc254PadBinTree multihash, or an
+// error wrapping commp.ErrInvalidCommP if mh is anything else.
+func ParsePieceMultihash(mh multihash.Multihash) (commP []byte, paddedPieceSize, payloadSize uint64, err error) {
+	dec, err := multihash.Decode(mh)
+	if err != nil {
+		return nil, 0, 0, xerrors.Errorf("decoding multihash: %s: %w", err, commp.ErrInvalidCommP)
+	}
+	if dec.Code != Fr32Sha256Trunc254PadBinTree {
+		return nil, 0, 0, xerrors.Errorf("unexpected multihash code 0x%x: %w", dec.Code, commp.ErrInvalidCommP)
+	}
+
+	padding, n := binary.Uvarint(dec.Digest)
+	if n <= 0 || len(dec.Digest) != n+1+32 {
+		return nil, 0, 0, xerrors.Errorf("malformed digest 0x%X: %w", dec.Digest, commp.ErrInvalidCommP)
+	}
+	height := uint(dec.Digest[n])
+	if height < 2 || height > commp.MaxLayers {
+		return nil, 0, 0, xerrors.Errorf("tree height %d is not between 2 and %d: %w", height, commp.MaxLayers, commp.ErrInvalidCommP)
+	}
+	paddedPieceSize = 32 << height
+	if padding >= paddedPieceSize/128*127 {
+		return nil, 0, 0, xerrors.Errorf("padding of %d bytes leaves no payload in a piece of %d bytes: %w", padding, paddedPieceSize, commp.ErrInvalidCommP)
+	}
+
+	return dec.Digest[n+1:], paddedPieceSize, paddedPieceSize/128*127 - padding, nil
+}
@@ -0,0 +1,95 @@
+package cidutil
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestMultihash(t *testing.T) {
+	RegisterMultihash()
+
+	for _, size := range []int{65, 127, 128, 1000, 1 << 20, 1<<20 + 1} {
+		payload := bytes.Repeat([]byte{0xCD}, size)
+
+		mh, err := multihash.Sum(payload, Fr32Sha256Trunc254PadBinTree, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cp := &commp.Calc{}
+		if _, err := cp.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+		commP, paddedSize, err := cp.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp, err := PieceMultihash(commP, uint64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(mh, exp) {
+			t.Fatalf("%d: multihash 0x%X doesn't match expected 0x%X", size, []byte(mh), []byte(exp))
+		}
+
+		gotCommP, gotPaddedSize, gotSize, err := ParsePieceMultihash(mh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gotCommP, commP) || gotPaddedSize != paddedSize || gotSize != uint64(size) {
+			t.Fatalf("%d: parsed 0x%X/%d/%d, expected 0x%X/%d/%d", size, gotCommP, gotPaddedSize, gotSize, commP, paddedSize, size)
+		}
+
+		// through a CID prefix, as generic verifiers do
+		c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: Fr32Sha256Trunc254PadBinTree, MhLength: -1}.Sum(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(c.Hash(), mh) {
+			t.Fatalf("%d: CID multihash 0x%X doesn't match expected 0x%X", size, []byte(c.Hash()), []byte(mh))
+		}
+	}
+
+	if _, err := multihash.Sum(make([]byte, 100), Fr32Sha256Trunc254PadBinTree, 32); err == nil {
+		t.Fatal("unexpected success truncating the digest")
+	}
+}
+
+func TestInvalidMultihash(t *testing.T) {
+	if _, err := PieceMultihash(make([]byte, 32), commp.MinPiecePayload-1); !errors.Is(err, commp.ErrInvalidPieceSize) {
+		t.Fatalf("unexpected error %v, expected %v", err, commp.ErrInvalidPieceSize)
+	}
+	if _, err := PieceMultihash(make([]byte, 31), 100); !errors.Is(err, commp.ErrInvalidCommP) {
+		t.Fatalf("unexpected error %v, expected %v", err, commp.ErrInvalidCommP)
+	}
+
+	sha256MH, err := multihash.Sum([]byte("commp"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, mh := range map[string][]byte{
+		"not a multihash": {0xFF},
+		"wrong code":      sha256MH,
+		"short digest":    mustEncode(t, make([]byte, 33)),
+		"low height":      mustEncode(t, append([]byte{0, 1}, make([]byte, 32)...)),
+		"high height":     mustEncode(t, append([]byte{0, byte(commp.MaxLayers + 1)}, make([]byte, 32)...)),
+		"all padding":     mustEncode(t, append([]byte{127, 2}, make([]byte, 32)...)),
+	} {
+		if _, _, _, err := ParsePieceMultihash(mh); !errors.Is(err, commp.ErrInvalidCommP) {
+			t.Fatalf("%s: unexpected error %v, expected %v", name, err, commp.ErrInvalidCommP)
+		}
+	}
+}
+
+func mustEncode(t *testing.T, digest []byte) multihash.Multihash {
+	mh, err := multihash.Encode(digest, Fr32Sha256Trunc254PadBinTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mh
+}
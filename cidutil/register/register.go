@@ -0,0 +1,13 @@
+// Package register has no purpose except registering the commP multihash
+// fr32-sha256-trunc254-padbintree with go-multihash, see
+// cidutil.RegisterMultihash(). It is meant to be used as a side-effecting
+// import:
+//
+//	import _ "github.com/filecoin-project/go-fil-commp-hashhash/cidutil/register"
+package register
+
+import "github.com/filecoin-project/go-fil-commp-hashhash/cidutil"
+
+func init() {
+	cidutil.RegisterMultihash()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// activation holds the sockets systemd passed on socket activation, by the
+// protocol they are for: http, grpc, metrics or fd.
+type activation map[string]net.Listener
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// socketActivation takes over the sockets passed via $LISTEN_FDS, as named
+// by the FileDescriptorName= of their socket units. A lone socket named
+// otherwise, such as after its unit by default, serves HTTP.
+func socketActivation() (activation, error) {
+	act := make(activation)
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return act, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return act, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// nothing started from here on is meant to take the sockets over as well
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		switch name {
+		case "http", "grpc", "metrics", "fd":
+		default:
+			if n > 1 {
+				return nil, fmt.Errorf("socket %q passed by systemd is not named after a protocol: set FileDescriptorName= to http, grpc, metrics or fd", name)
+			}
+			name = "http"
+		}
+		if act[name] != nil {
+			return nil, fmt.Errorf("more than one %s socket passed by systemd", name)
+		}
+
+		fh := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(fh)
+		fh.Close() // the listener holds a duplicate, closed on exec
+		if err != nil {
+			return nil, fmt.Errorf("the %s socket passed by systemd is not a listening stream socket: %w", name, err)
+		}
+		act[name] = ln
+	}
+	return act, nil
+}
+
+// wants tells whether the protocol name is to be served, on either a socket
+// passed by systemd or addr.
+func (act activation) wants(name, addr string) bool {
+	return act[name] != nil || addr != ""
+}
+
+// listen returns the socket systemd passed for the protocol name, or else
+// listens on addr.
+func (act activation) listen(name, network, addr string) (net.Listener, error) {
+	if ln := act[name]; ln != nil {
+		return ln, nil
+	}
+	if network == "unix" {
+		// a socket left behind by a previous run is in the way
+		if st, err := os.Lstat(addr); err == nil && st.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	return net.Listen(network, addr)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+	"github.com/pborman/getopt/v2"
+	"github.com/pborman/options"
+)
+
+type aggregateConfig struct {
+	Size uint64 `getopt:"--size=BYTES  Padded size of the aggregate, such as that of a sector; 0 for the smallest holding the pieces"`
+	Help bool   `getopt:"-h --help     Display help"`
+}
+
+// aggregatedPiece is a piece listed to aggregate.
+type aggregatedPiece struct {
+	pieceCID cid.Cid
+	commP    []byte
+	size     uint64 // padded
+}
+
+// aggregateMain runs `stream-commp aggregate`, computing the piece CID of the
+// pieces listed, one per line as PIECECID SIZE, laid out one after the other
+// in a single piece.
+func aggregateMain(args []string) {
+	opts := &aggregateConfig{}
+	set := getopt.New()
+	set.SetProgram("stream-commp aggregate")
+	set.SetParameters("[FILE]")
+	if err := options.RegisterSet("", opts, set); err != nil {
+		fatal(exitFailure, err)
+	}
+	if err := set.Getopt(args, nil); err != nil {
+		set.PrintUsage(os.Stderr)
+		usageError("%s", err)
+	}
+	if opts.Help {
+		set.PrintUsage(os.Stderr)
+		os.Exit(exitOK)
+	}
+	if set.NArgs() > 1 {
+		usageError("unexpected arguments: %q", set.Args()[1:])
+	}
+	if opts.Size != 0 {
+		if err := commp.PaddedPieceSize(opts.Size).Validate(); err != nil {
+			usageError("invalid aggregate size: %s", err)
+		}
+	}
+
+	path := "-"
+	if set.NArgs() == 1 {
+		path = set.Arg(0)
+	}
+	pieces, err := readPieceList(path)
+	if err != nil {
+		fatal(exitInputError, fmt.Errorf("reading piece list: %w", err))
+	}
+	if len(pieces) == 0 {
+		fatal(exitInputError, fmt.Errorf("no pieces listed in %s", path))
+	}
+
+	// laid out like the sub-pieces of ComputeUnsealedCommD(), each aligned
+	// to its own size
+	segs := make([]commp.DataSegment, len(pieces))
+	infos := make([]commp.PieceInfo, len(pieces))
+	for i, p := range pieces {
+		segs[i] = commp.DataSegment{PaddedSize: p.size}
+		infos[i] = commp.PieceInfo{CommP: p.commP, PaddedPieceSize: p.size}
+	}
+	segs = commp.PackDataSegments(segs)
+
+	size := opts.Size
+	if size == 0 {
+		last := segs[len(segs)-1]
+		rounded, err := commp.PaddedPieceSize(last.Offset + last.PaddedSize).RoundUp()
+		if err != nil {
+			fatal(exitTooLarge, fmt.Errorf("the pieces do not fit a single piece: %w", err))
+		}
+		size = uint64(rounded)
+	}
+	commD, err := commp.ComputeUnsealedCommD(size, infos)
+	if err != nil {
+		fatal(exitFailure, fmt.Errorf("the pieces do not fit an aggregate of %d bytes: %w", size, err))
+	}
+	pieceCID, err := commcid.DataCommitmentV1ToCID(commD)
+	if err != nil {
+		fatal(exitFailure, err)
+	}
+
+	fmt.Fprintf(os.Stdout, `CommPCid: %s
+Unpadded piece: % 12d bytes
+Padded piece:   % 12d bytes
+
+%20s %20s  %s
+`,
+		pieceCID,
+		size/128*127,
+		size,
+		"Offset", "Padded size", "Piece CID",
+	)
+	for i, p := range pieces {
+		fmt.Fprintf(os.Stdout, "%20d %20d  %s\n", segs[i].Offset, p.size, p.pieceCID)
+	}
+}
+
+// readPieceList reads the pieces listed one per line as PIECECID SIZE, the
+// padded size, separated by whitespace or a comma, in the file at path, or
+// stdin for "-".
+func readPieceList(path string) ([]aggregatedPiece, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+		r = fh
+	}
+
+	var pieces []aggregatedPiece
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.FieldsFunc(s.Text(), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		})
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected PIECECID SIZE, got %q", line, s.Text())
+		}
+
+		c, err := cid.Decode(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid piece CID %q: %w", line, fields[0], err)
+		}
+		commP, err := commcid.CIDToDataCommitmentV1(c)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid piece CID %q: %w", line, fields[0], err)
+		}
+		size, err := strconv.ParseUint(fields[1], 10, 64)
+		if err == nil {
+			err = commp.PaddedPieceSize(size).Validate()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid padded piece size %q: %w", line, fields[1], err)
+		}
+		pieces = append(pieces, aggregatedPiece{pieceCID: c, commP: commP, size: size})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return pieces, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// outcome is the result of digesting a single input of a batch.
+type outcome struct {
+	res  inputResult
+	err  error
+	done chan struct{}
+}
+
+// digestAll digests paths using up to workers inputs at a time, and calls fn
+// with the outcome of each in the order of paths, regardless of the order
+// they complete in.
+func digestAll(paths []string, opts *config, workers int, fn func(path string, res inputResult, err error)) {
+	outcomes := make([]outcome, len(paths))
+	for i := range outcomes {
+		outcomes[i].done = make(chan struct{})
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(paths); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				outcomes[i].res, outcomes[i].err = digestPath(paths[i], opts)
+				close(outcomes[i].done)
+			}
+		}()
+	}
+	go func() {
+		for i := range paths {
+			next <- i
+		}
+		close(next)
+	}()
+
+	for i := range outcomes {
+		<-outcomes[i].done
+		fn(paths[i], outcomes[i].res, outcomes[i].err)
+		// do not hold on to what was already reported
+		outcomes[i] = outcome{}
+	}
+	wg.Wait()
+}
+
+// readPathList reads the paths listed one per line in the file at path, or
+// stdin for "-". Empty lines are skipped.
+func readPathList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+		r = fh
+	}
+
+	var paths []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		p := strings.TrimSuffix(s.Text(), "\r")
+		if p == "" {
+			continue
+		}
+		if p == "-" && path == "-" {
+			return nil, fmt.Errorf("stdin listed as an input, while the list itself is read from it")
+		}
+		paths = append(paths, p)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+)
+
+// carStats describes the frames of a CARv1, as walked with --car-stats.
+type carStats struct {
+	headerSize   int64 // the length prefixed CBOR header
+	roots        []cid.Cid
+	blocks       int64
+	blockBytes   int64 // the data of the blocks, without their CIDs
+	minBlock     int64
+	maxBlock     int64
+	framingBytes int64            // the length prefixes and CIDs of the blocks
+	codecs       map[uint64]int64 // amount of blocks by the codec of their CID
+	problem      string           // why the walk stopped short, if it did
+}
+
+// walk reads every frame of a CARv1 whose header of headerSize bytes was
+// just read from streamBuf, returning the amount of bytes read. Malformed frames end the walk
+// with a problem, read errors with an error.
+func (cs *carStats) walk(streamBuf *bufio.Reader) (cnt int64, err error) {
+	cs.codecs = make(map[uint64]int64)
+	for {
+		maybeFrameLen, err := streamBuf.Peek(10)
+		if len(maybeFrameLen) == 0 {
+			if err == io.EOF {
+				return cnt, nil
+			}
+			return cnt, fmt.Errorf("unexpected read error at offset %d: %w", cs.headerSize+cnt, err)
+		}
+
+		frameLen, viLen := binary.Uvarint(maybeFrameLen)
+		if viLen <= 0 || frameLen == 0 || frameLen > math.MaxInt32 {
+			cs.problem = fmt.Sprintf("undecodeable frame length at offset %d", cs.headerSize+cnt)
+			return cnt, nil
+		}
+		streamBuf.Discard(viLen)
+		frameStart := cs.headerSize + cnt
+		cnt += int64(viLen)
+
+		rr := &readErrRecorder{r: streamBuf}
+		cidLen, c, err := cid.CidFromReader(rr)
+		cnt += int64(cidLen)
+		if rr.err != nil {
+			return cnt, fmt.Errorf("unexpected read error at offset %d: %w", cs.headerSize+cnt, rr.err)
+		}
+		if err != nil {
+			cs.problem = fmt.Sprintf("undecodeable CID in the frame at offset %d: %s", frameStart, err)
+			return cnt, nil
+		}
+		if uint64(cidLen) > frameLen {
+			cs.problem = fmt.Sprintf("the CID in the frame at offset %d is longer than the frame", frameStart)
+			return cnt, nil
+		}
+
+		dataLen := int64(frameLen) - int64(cidLen)
+		discarded, err := streamBuf.Discard(int(dataLen))
+		cnt += int64(discarded)
+		if err != nil {
+			if err != io.EOF {
+				return cnt, fmt.Errorf("unexpected read error at offset %d: %w", cs.headerSize+cnt, err)
+			}
+			cs.problem = fmt.Sprintf("truncated frame at offset %d: expected %d bytes but read %d", frameStart, frameLen, cs.headerSize+cnt-frameStart-int64(viLen))
+			return cnt, nil
+		}
+
+		if cs.blocks == 0 || dataLen < cs.minBlock {
+			cs.minBlock = dataLen
+		}
+		if dataLen > cs.maxBlock {
+			cs.maxBlock = dataLen
+		}
+		cs.blocks++
+		cs.blockBytes += dataLen
+		cs.framingBytes += int64(viLen) + int64(cidLen)
+		cs.codecs[c.Prefix().Codec]++
+	}
+}
+
+// readErrRecorder reads from a bufio.Reader, recording the first error
+// other than io.EOF, which the decoding of a CID would otherwise obscure.
+type readErrRecorder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (rr *readErrRecorder) record(err error) {
+	if err != nil && err != io.EOF && rr.err == nil {
+		rr.err = err
+	}
+}
+
+func (rr *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.record(err)
+	return n, err
+}
+
+func (rr *readErrRecorder) ReadByte() (byte, error) {
+	b, err := rr.r.ReadByte()
+	rr.record(err)
+	return b, err
+}
+
+// print writes the statistics out in the layout of printResult.
+func (cs *carStats) print(w io.Writer) {
+	roots := make([]string, len(cs.roots))
+	for i, r := range cs.roots {
+		roots[i] = r.String()
+	}
+
+	var avg int64
+	if cs.blocks > 0 {
+		avg = cs.blockBytes / cs.blocks
+	}
+
+	codecs := make([]uint64, 0, len(cs.codecs))
+	for c := range cs.codecs {
+		codecs = append(codecs, c)
+	}
+	// the most common codec first
+	sort.Slice(codecs, func(i, j int) bool {
+		if cs.codecs[codecs[i]] != cs.codecs[codecs[j]] {
+			return cs.codecs[codecs[i]] > cs.codecs[codecs[j]]
+		}
+		return codecs[i] < codecs[j]
+	})
+	dist := make([]string, len(codecs))
+	for i, c := range codecs {
+		dist[i] = fmt.Sprintf("%s %d", multicodec.Code(c), cs.codecs[c])
+	}
+
+	fmt.Fprintf(w, `
+CAR header:     % 12d bytes
+Roots:          %s
+Blocks:         % 12d
+Block data:     % 12d bytes
+Block sizes:    % 12d min, %d avg, %d max bytes
+Block framing:  % 12d bytes (lengths and CIDs)
+Codecs:         %s
+`,
+		cs.headerSize,
+		strings.Join(roots, ", "),
+		cs.blocks,
+		cs.blockBytes,
+		cs.minBlock, avg, cs.maxBlock,
+		cs.framingBytes,
+		strings.Join(dist, ", "),
+	)
+	if cs.problem != "" {
+		fmt.Fprintf(w, "Walk stopped:   %s\n", cs.problem)
+	}
+}
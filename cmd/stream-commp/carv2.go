@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// carV2Pragma is how every CARv2 starts: a CAR header of version 2, as a
+// varint length prefixed CBOR map.
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x02}
+
+// carV2HeaderSize is the size of the fixed header following the pragma: 16
+// bytes of characteristics, then the offset and size of the CARv1 data
+// payload and the offset of the index, as little-endian uint64s.
+const carV2HeaderSize = 40
+
+// unwrapCARv2 returns the CARv1 data payload of input should it be a CARv2,
+// along with a note on what was done, or else input as is.
+func unwrapCARv2(input io.Reader) (io.Reader, string, error) {
+	br := bufio.NewReader(input)
+	head, err := br.Peek(len(carV2Pragma) + carV2HeaderSize)
+	if !bytes.HasPrefix(head, carV2Pragma) {
+		return br, "", nil
+	}
+	if err != nil {
+		return nil, "", withExitCode(exitInputError, fmt.Errorf("truncated CARv2 header: %w", err))
+	}
+
+	hdr := head[len(carV2Pragma):]
+	dataOffset := binary.LittleEndian.Uint64(hdr[16:])
+	dataSize := binary.LittleEndian.Uint64(hdr[24:])
+	if dataOffset < uint64(len(head)) || dataSize == 0 || dataOffset > math.MaxInt64 || dataSize > math.MaxInt64-dataOffset {
+		return nil, "", withExitCode(exitInputError, fmt.Errorf("invalid CARv2 header: a data payload of %d bytes at offset %d", dataSize, dataOffset))
+	}
+	if _, err := io.CopyN(uDiscard, br, int64(dataOffset)); err != nil {
+		return nil, "", withExitCode(exitInputError, fmt.Errorf("CARv2 ends before its data payload at offset %d: %w", dataOffset, err))
+	}
+
+	note := fmt.Sprintf("CARv2 unwrapped: digested its CARv1 data payload of %d bytes at offset %d, leaving out the CARv2 header and index", dataSize, dataOffset)
+	return &carV2Payload{r: br, left: int64(dataSize), end: int64(dataOffset + dataSize)}, note, nil
+}
+
+// carV2Payload reads the data payload of a CARv2, failing should it be cut
+// short. The index following it is read through at the end without being
+// returned, so that the input is consumed in full, as --tee calls for.
+type carV2Payload struct {
+	r    io.Reader
+	left int64
+	end  int64
+}
+
+func (cp *carV2Payload) Read(p []byte) (int, error) {
+	if cp.left == 0 {
+		if _, err := io.Copy(uDiscard, cp.r); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > cp.left {
+		p = p[:cp.left]
+	}
+	n, err := cp.r.Read(p)
+	cp.left -= int64(n)
+	if err == io.EOF {
+		if cp.left > 0 {
+			return n, fmt.Errorf("CARv2 ends %d bytes short of the end of its data payload at offset %d: %w", cp.left, cp.end, io.ErrUnexpectedEOF)
+		}
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+)
+
+// checkpoint is the state of a digest in progress, persisted by --checkpoint
+// for --resume to continue from.
+type checkpoint struct {
+	Input      string    `json:"input"` // the absolute path of the file input
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+	Offset     int64     `json:"offset"` // the amount of bytes digested so far
+	Compressed string    `json:"compressed,omitempty"`
+	CarInfo    string    `json:"car_info,omitempty"`
+	CarRoots   []string  `json:"car_roots,omitempty"`
+	State      []byte    `json:"state"` // the serialized commp.Calc
+}
+
+// checkpointer passes everything written to it on to the hasher, persisting
+// the state of the digest every --checkpoint-interval along the way. Doing so
+// in between writes keeps the offset consistent with the state.
+type checkpointer struct {
+	path     string
+	interval time.Duration
+	cp       *commp.Calc
+	ck       checkpoint
+	armed    bool // the input has been scanned, completing the checkpoint
+	last     time.Time
+}
+
+func (c *checkpointer) Write(p []byte) (int, error) {
+	n, err := c.cp.Write(p)
+	c.ck.Offset += int64(n)
+	if c.armed && time.Since(c.last) >= c.interval {
+		c.save()
+	}
+	return n, err
+}
+
+// save persists the checkpoint, replacing the previous one atomically. A
+// failure to do so is not worth failing the digest over.
+func (c *checkpointer) save() {
+	c.last = time.Now()
+	if err := c.write(); err != nil {
+		log.Printf("writing checkpoint: %s", err)
+	}
+}
+
+func (c *checkpointer) write() error {
+	state, err := c.cp.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	c.ck.State = state
+	b, err := json.Marshal(c.ck)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, append(b, '\n'))
+}
+
+// writeFileAtomic writes b to a temporary file next to path, then renames it
+// over path, so that path is never seen half written.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// resume restores the state of the checkpoint at --checkpoint, provided it
+// was taken of the very same input, unchanged since. There being no
+// checkpoint yet is not an error: the digest simply starts from scratch.
+func (c *checkpointer) resume() (bool, error) {
+	b, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("reading checkpoint: %w", err)
+	}
+
+	var ck checkpoint
+	if err := json.Unmarshal(b, &ck); err != nil {
+		return false, fmt.Errorf("parsing checkpoint %s: %w", c.path, err)
+	}
+	if ck.Input != c.ck.Input || ck.Size != c.ck.Size || !ck.ModTime.Equal(c.ck.ModTime) {
+		return false, fmt.Errorf(
+			"checkpoint %s was taken of %s with %d bytes, modified at %s: remove it to start over",
+			c.path, ck.Input, ck.Size, ck.ModTime.Format(time.RFC3339),
+		)
+	}
+	if ck.Offset < 0 || ck.Offset > ck.Size {
+		return false, fmt.Errorf("checkpoint %s is at the invalid offset %d", c.path, ck.Offset)
+	}
+	if err := c.cp.UnmarshalBinary(ck.State); err != nil {
+		return false, fmt.Errorf("restoring checkpoint %s: %w", c.path, err)
+	}
+	c.ck = ck
+	return true, nil
+}
+
+// digestCheckpointed digests the file input fh at path like digestInput
+// does, checkpointing along the way, and resuming from the checkpoint first
+// with --resume. The checkpoint is removed once the digest is complete.
+func digestCheckpointed(path string, fh *os.File, opts *config) (inputResult, error) {
+	var res inputResult
+
+	st, err := fh.Stat()
+	if err != nil {
+		return res, withExitCode(exitInputError, err)
+	}
+	if !st.Mode().IsRegular() {
+		return res, withExitCode(exitInputError, errors.New("only regular files can be checkpointed"))
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return res, err
+	}
+
+	c := &checkpointer{
+		path:     opts.Checkpoint,
+		interval: opts.CheckpointInterval,
+		cp:       newCalc(),
+		ck:       checkpoint{Input: abs, Size: st.Size(), ModTime: st.ModTime()},
+		last:     time.Now(),
+	}
+	defer c.cp.Reset()
+
+	var resumed bool
+	if opts.Resume {
+		if resumed, err = c.resume(); err != nil {
+			return res, err
+		}
+	}
+	if resumed {
+		if _, err := fh.Seek(c.ck.Offset, io.SeekStart); err != nil {
+			return res, withExitCode(exitInputError, err)
+		}
+		for _, r := range c.ck.CarRoots {
+			root, err := cid.Decode(r)
+			if err != nil {
+				return res, fmt.Errorf("parsing checkpoint %s: %w", c.path, err)
+			}
+			res.carRoots = append(res.carRoots, root)
+		}
+		res.payloadSize = c.ck.Offset
+		res.compressed = c.ck.Compressed
+		res.carInfo = c.ck.CarInfo
+		infof("Resuming from the checkpoint at offset %d", c.ck.Offset)
+	}
+
+	fr := fileReader(fh, opts)
+	defer fr.Close()
+	streamBuf := bufio.NewReaderSize(
+		io.TeeReader(progress.wrap(throttle(fr)), c),
+		BufSize,
+	)
+
+	if !resumed {
+		head, _ := streamBuf.Peek(4)
+		res.compressed = compressionOf(head)
+
+		if !opts.DisableStreamScan {
+			n, carInfo, roots, err := scanInputStream(streamBuf, nil)
+			res.payloadSize += n
+			if err != nil {
+				return res, withExitCode(exitInputError, err)
+			}
+			res.carInfo = carInfo
+			res.carRoots = roots
+		}
+
+		c.ck.Compressed = res.compressed
+		c.ck.CarInfo = res.carInfo
+		for _, root := range res.carRoots {
+			c.ck.CarRoots = append(c.ck.CarRoots, root.String())
+		}
+	}
+	c.armed = true
+
+	n, err := io.Copy(uDiscard, streamBuf)
+	res.payloadSize += n
+	if err != nil {
+		// keep whatever was digested for the next attempt
+		c.save()
+		return res, withExitCode(exitInputError, fmt.Errorf("unexpected error at offset %d: %w", res.payloadSize, err))
+	}
+
+	if res.pieceCID, res.paddedSize, err = finishDigest(c.cp, opts); err != nil {
+		return res, err
+	}
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("removing checkpoint: %s", err)
+	}
+	return res, nil
+}
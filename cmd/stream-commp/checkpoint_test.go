@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	payload := testPayload(300001)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input")
+	if err := os.WriteFile(input, payload, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a run interrupted after digesting part of the input
+	c := &checkpointer{
+		path: filepath.Join(dir, "checkpoint"),
+		cp:   newCalc(),
+		ck:   checkpoint{Input: input, Size: st.Size(), ModTime: st.ModTime()},
+	}
+	if _, err := c.Write(payload[:123456]); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.write(); err != nil {
+		t.Fatal(err)
+	}
+	c.cp.Reset()
+
+	fh, err := os.Open(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	res, err := digestCheckpointed(input, fh, &config{
+		Checkpoint:         c.path,
+		CheckpointInterval: time.Minute,
+		Resume:             true,
+		DisableStreamScan:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := pieceCIDOf(t, payload); res.pieceCID.String() != exp || res.payloadSize != int64(len(payload)) {
+		t.Fatalf("resumed digest of %d bytes into %s, expected %d bytes into %s", res.payloadSize, res.pieceCID, len(payload), exp)
+	}
+	if _, err := os.Stat(c.path); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint left behind: %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.2
+// 	protoc        (unknown)
+// source: commp.proto
+
+package commppb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ComputeRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The next chunk of the payload, of any size up to the message size limit.
+	Data []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (x *ComputeRequest) Reset() {
+	*x = ComputeRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_commp_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ComputeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ComputeRequest) ProtoMessage() {}
+
+func (x *ComputeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_commp_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ComputeRequest.ProtoReflect.Descriptor instead.
+func (*ComputeRequest) Descriptor() ([]byte, []int) {
+	return file_commp_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ComputeRequest) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type PieceInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	PieceCid string `protobuf:"bytes,1,opt,name=piece_cid,json=pieceCid,proto3" json:"piece_cid,omitempty"`
+	// The raw 32 byte commitment the piece CID wraps.
+	Commp             []byte `protobuf:"bytes,2,opt,name=commp,proto3" json:"commp,omitempty"`
+	PayloadSize       uint64 `protobuf:"varint,3,opt,name=payload_size,json=payloadSize,proto3" json:"payload_size,omitempty"`
+	UnpaddedPieceSize uint64 `protobuf:"varint,4,opt,name=unpadded_piece_size,json=unpaddedPieceSize,proto3" json:"unpadded_piece_size,omitempty"`
+	PaddedPieceSize   uint64 `protobuf:"varint,5,opt,name=padded_piece_size,json=paddedPieceSize,proto3" json:"padded_piece_size,omitempty"`
+	// The roots of the CARv1 the payload was found to be, if any.
+	CarRoots []string `protobuf:"bytes,6,rep,name=car_roots,json=carRoots,proto3" json:"car_roots,omitempty"`
+	CarInfo  string   `protobuf:"bytes,7,opt,name=car_info,json=carInfo,proto3" json:"car_info,omitempty"`
+}
+
+func (x *PieceInfo) Reset() {
+	*x = PieceInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_commp_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PieceInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PieceInfo) ProtoMessage() {}
+
+func (x *PieceInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_commp_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PieceInfo.ProtoReflect.Descriptor instead.
+func (*PieceInfo) Descriptor() ([]byte, []int) {
+	return file_commp_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *PieceInfo) GetPieceCid() string {
+	if x != nil {
+		return x.PieceCid
+	}
+	return ""
+}
+
+func (x *PieceInfo) GetCommp() []byte {
+	if x != nil {
+		return x.Commp
+	}
+	return nil
+}
+
+func (x *PieceInfo) GetPayloadSize() uint64 {
+	if x != nil {
+		return x.PayloadSize
+	}
+	return 0
+}
+
+func (x *PieceInfo) GetUnpaddedPieceSize() uint64 {
+	if x != nil {
+		return x.UnpaddedPieceSize
+	}
+	return 0
+}
+
+func (x *PieceInfo) GetPaddedPieceSize() uint64 {
+	if x != nil {
+		return x.PaddedPieceSize
+	}
+	return 0
+}
+
+func (x *PieceInfo) GetCarRoots() []string {
+	if x != nil {
+		return x.CarRoots
+	}
+	return nil
+}
+
+func (x *PieceInfo) GetCarInfo() string {
+	if x != nil {
+		return x.CarInfo
+	}
+	return ""
+}
+
+var File_commp_proto protoreflect.FileDescriptor
+
+var file_commp_proto_rawDesc = []byte{
+	0x0a, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x08, 0x63,
+	0x6f, 0x6d, 0x6d, 0x70, 0x2e, 0x76, 0x31, 0x22, 0x24, 0x0a, 0x0e, 0x43, 0x6f, 0x6d, 0x70, 0x75,
+	0x74, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74,
+	0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x22, 0xf5, 0x01,
+	0x0a, 0x09, 0x50, 0x69, 0x65, 0x63, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x1b, 0x0a, 0x09, 0x70,
+	0x69, 0x65, 0x63, 0x65, 0x5f, 0x63, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08,
+	0x70, 0x69, 0x65, 0x63, 0x65, 0x43, 0x69, 0x64, 0x12, 0x14, 0x0a, 0x05, 0x63, 0x6f, 0x6d, 0x6d,
+	0x70, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x05, 0x63, 0x6f, 0x6d, 0x6d, 0x70, 0x12, 0x21,
+	0x0a, 0x0c, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x04, 0x52, 0x0b, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x53, 0x69, 0x7a,
+	0x65, 0x12, 0x2e, 0x0a, 0x13, 0x75, 0x6e, 0x70, 0x61, 0x64, 0x64, 0x65, 0x64, 0x5f, 0x70, 0x69,
+	0x65, 0x63, 0x65, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x04, 0x52, 0x11,
+	0x75, 0x6e, 0x70, 0x61, 0x64, 0x64, 0x65, 0x64, 0x50, 0x69, 0x65, 0x63, 0x65, 0x53, 0x69, 0x7a,
+	0x65, 0x12, 0x2a, 0x0a, 0x11, 0x70, 0x61, 0x64, 0x64, 0x65, 0x64, 0x5f, 0x70, 0x69, 0x65, 0x63,
+	0x65, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0f, 0x70, 0x61,
+	0x64, 0x64, 0x65, 0x64, 0x50, 0x69, 0x65, 0x63, 0x65, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x1b, 0x0a,
+	0x09, 0x63, 0x61, 0x72, 0x5f, 0x72, 0x6f, 0x6f, 0x74, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x09,
+	0x52, 0x08, 0x63, 0x61, 0x72, 0x52, 0x6f, 0x6f, 0x74, 0x73, 0x12, 0x19, 0x0a, 0x08, 0x63, 0x61,
+	0x72, 0x5f, 0x69, 0x6e, 0x66, 0x6f, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x63, 0x61,
+	0x72, 0x49, 0x6e, 0x66, 0x6f, 0x32, 0x43, 0x0a, 0x05, 0x43, 0x6f, 0x6d, 0x6d, 0x50, 0x12, 0x3a,
+	0x0a, 0x07, 0x43, 0x6f, 0x6d, 0x70, 0x75, 0x74, 0x65, 0x12, 0x18, 0x2e, 0x63, 0x6f, 0x6d, 0x6d,
+	0x70, 0x2e, 0x76, 0x31, 0x2e, 0x43, 0x6f, 0x6d, 0x70, 0x75, 0x74, 0x65, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x1a, 0x13, 0x2e, 0x63, 0x6f, 0x6d, 0x6d, 0x70, 0x2e, 0x76, 0x31, 0x2e, 0x50,
+	0x69, 0x65, 0x63, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x28, 0x01, 0x42, 0x4c, 0x5a, 0x4a, 0x67, 0x69,
+	0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x66, 0x69, 0x6c, 0x65, 0x63, 0x6f, 0x69,
+	0x6e, 0x2d, 0x70, 0x72, 0x6f, 0x6a, 0x65, 0x63, 0x74, 0x2f, 0x67, 0x6f, 0x2d, 0x66, 0x69, 0x6c,
+	0x2d, 0x63, 0x6f, 0x6d, 0x6d, 0x70, 0x2d, 0x68, 0x61, 0x73, 0x68, 0x68, 0x61, 0x73, 0x68, 0x2f,
+	0x63, 0x6d, 0x64, 0x2f, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x2d, 0x63, 0x6f, 0x6d, 0x6d, 0x70,
+	0x2f, 0x63, 0x6f, 0x6d, 0x6d, 0x70, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_commp_proto_rawDescOnce sync.Once
+	file_commp_proto_rawDescData = file_commp_proto_rawDesc
+)
+
+func file_commp_proto_rawDescGZIP() []byte {
+	file_commp_proto_rawDescOnce.Do(func() {
+		file_commp_proto_rawDescData = protoimpl.X.CompressGZIP(file_commp_proto_rawDescData)
+	})
+	return file_commp_proto_rawDescData
+}
+
+var file_commp_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_commp_proto_goTypes = []any{
+	(*ComputeRequest)(nil), // 0: commp.v1.ComputeRequest
+	(*PieceInfo)(nil),      // 1: commp.v1.PieceInfo
+}
+var file_commp_proto_depIdxs = []int32{
+	0, // 0: commp.v1.CommP.Compute:input_type -> commp.v1.ComputeRequest
+	1, // 1: commp.v1.CommP.Compute:output_type -> commp.v1.PieceInfo
+	1, // [1:2] is the sub-list for method output_type
+	0, // [0:1] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_commp_proto_init() }
+func file_commp_proto_init() {
+	if File_commp_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_commp_proto_msgTypes[0].Exporter = func(v any, i int) any {
+			switch v := v.(*ComputeRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_commp_proto_msgTypes[1].Exporter = func(v any, i int) any {
+			switch v := v.(*PieceInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_commp_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_commp_proto_goTypes,
+		DependencyIndexes: file_commp_proto_depIdxs,
+		MessageInfos:      file_commp_proto_msgTypes,
+	}.Build()
+	File_commp_proto = out.File
+	file_commp_proto_rawDesc = nil
+	file_commp_proto_goTypes = nil
+	file_commp_proto_depIdxs = nil
+}
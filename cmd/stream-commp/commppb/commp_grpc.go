@@ -0,0 +1,123 @@
+package commppb
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const CommP_Compute_FullMethodName = "/commp.v1.CommP/Compute"
+
+// CommPClient is the client API of the CommP service.
+type CommPClient interface {
+	// Compute digests the data of every request in the stream, in order, and
+	// answers with the piece once the client closes the stream.
+	Compute(ctx context.Context, opts ...grpc.CallOption) (CommP_ComputeClient, error)
+}
+
+type commPClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCommPClient(cc grpc.ClientConnInterface) CommPClient {
+	return &commPClient{cc}
+}
+
+func (c *commPClient) Compute(ctx context.Context, opts ...grpc.CallOption) (CommP_ComputeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &CommP_ServiceDesc.Streams[0], CommP_Compute_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &commPComputeClient{stream}, nil
+}
+
+// CommP_ComputeClient sends the chunks of a payload with Send, then
+// receives the piece with CloseAndRecv.
+type CommP_ComputeClient interface {
+	Send(*ComputeRequest) error
+	CloseAndRecv() (*PieceInfo, error)
+	grpc.ClientStream
+}
+
+type commPComputeClient struct {
+	grpc.ClientStream
+}
+
+func (x *commPComputeClient) Send(m *ComputeRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *commPComputeClient) CloseAndRecv() (*PieceInfo, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(PieceInfo)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CommPServer is the server API of the CommP service. Implementations must
+// embed UnimplementedCommPServer.
+type CommPServer interface {
+	Compute(CommP_ComputeServer) error
+	mustEmbedUnimplementedCommPServer()
+}
+
+// UnimplementedCommPServer answers every method with codes.Unimplemented.
+type UnimplementedCommPServer struct{}
+
+func (UnimplementedCommPServer) Compute(CommP_ComputeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Compute not implemented")
+}
+func (UnimplementedCommPServer) mustEmbedUnimplementedCommPServer() {}
+
+func RegisterCommPServer(s grpc.ServiceRegistrar, srv CommPServer) {
+	s.RegisterService(&CommP_ServiceDesc, srv)
+}
+
+func _CommP_Compute_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CommPServer).Compute(&commPComputeServer{stream})
+}
+
+// CommP_ComputeServer receives the chunks of a payload with Recv, until
+// io.EOF, then answers with the piece with SendAndClose.
+type CommP_ComputeServer interface {
+	SendAndClose(*PieceInfo) error
+	Recv() (*ComputeRequest, error)
+	grpc.ServerStream
+}
+
+type commPComputeServer struct {
+	grpc.ServerStream
+}
+
+func (x *commPComputeServer) SendAndClose(m *PieceInfo) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *commPComputeServer) Recv() (*ComputeRequest, error) {
+	m := new(ComputeRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CommP_ServiceDesc describes the CommP service to grpc.Server.RegisterService.
+var CommP_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "commp.v1.CommP",
+	HandlerType: (*CommPServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Compute",
+			Handler:       _CommP_Compute_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "commp.proto",
+}
@@ -0,0 +1,7 @@
+// Package commppb holds the gRPC service of `stream-commp serve
+// --grpc-listen`, computing the piece commitment of a payload streamed to it
+// in chunks. The messages are generated from commp.proto, the service glue in
+// commp_grpc.go is maintained alongside by hand.
+package commppb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative commp.proto
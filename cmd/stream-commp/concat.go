@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// concatPart records where an input went in a concatenated payload.
+type concatPart struct {
+	path   string
+	offset int64
+	size   int64
+}
+
+// openInput opens any kind of input for reading.
+func openInput(path string, opts *config) (io.ReadCloser, error) {
+	switch {
+	case path == "-":
+		return io.NopCloser(watchStall(os.Stdin, opts)), nil
+	case isURL(path):
+		return openURL(path, opts)
+	case isObjectURI(path):
+		return openObject(path, opts)
+	case isIPFSURI(path):
+		rc, _, err := openIPFS(path, opts)
+		return rc, err
+	default:
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, withExitCode(exitInputError, err)
+		}
+		return fh, nil
+	}
+}
+
+// digestConcat digests paths back to back as a single payload, each input
+// starting at a multiple of --concat-align bytes, zero-filling the gaps.
+// Every input is decompressed on its own if requested. The payload is not a
+// CAR even when its first input is, so it is not scanned for one.
+func digestConcat(paths []string, opts *config) (inputResult, error) {
+	pr, pw := io.Pipe()
+	var parts []concatPart
+	go func() {
+		pw.CloseWithError(writeConcat(pw, paths, opts, &parts))
+	}()
+
+	streamOpts := *opts
+	streamOpts.DisableStreamScan = true
+	streamOpts.Decompress = ""
+	streamOpts.UnwrapCARv2 = false
+	res, err := digestStream(pr, &streamOpts)
+	// unblock the writer when the digest bailed out early
+	pr.Close()
+	if err != nil {
+		return res, err
+	}
+	res.parts = parts
+	return res, nil
+}
+
+func writeConcat(w io.Writer, paths []string, opts *config, parts *[]concatPart) error {
+	var offset int64
+	for _, path := range paths {
+		if gap := offset % opts.ConcatAlign; gap != 0 {
+			n, err := io.CopyN(w, zeroReader{}, opts.ConcatAlign-gap)
+			offset += n
+			if err != nil {
+				return err
+			}
+		}
+
+		rc, err := openInput(path, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		input, release, err := decompress(rc, opts)
+		if err == nil && opts.UnwrapCARv2 {
+			if input, _, err = unwrapCARv2(input); err != nil {
+				release()
+			}
+		}
+		if err != nil {
+			rc.Close()
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		n, err := io.Copy(w, input)
+		release()
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		*parts = append(*parts, concatPart{path: path, offset: offset, size: n})
+		offset += n
+	}
+	return nil
+}
+
+// concatLabel is how a concatenated payload is referred to in the results.
+func concatLabel(paths []string) string {
+	return strings.Join(paths, "+")
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// dealParams is what boost's offline deal commands need to know about a
+// piece, the keys matching their flags of the same names. PayloadCID is the
+// single root of the CARv1 digested, and is left out if there is no such
+// root.
+type dealParams struct {
+	Path       string `json:"path,omitempty"` // batch runs only
+	PayloadCID string `json:"payload-cid,omitempty"`
+	CommP      string `json:"commp"`
+	PieceSize  uint64 `json:"piece-size"`
+	CarSize    int64  `json:"car-size"`
+}
+
+func newDealParams(path string, res inputResult) dealParams {
+	dp := dealParams{
+		Path:      path,
+		CommP:     res.pieceCID.String(),
+		PieceSize: res.paddedSize,
+		CarSize:   res.payloadSize,
+	}
+	if len(res.carRoots) == 1 {
+		dp.PayloadCID = res.carRoots[0].String()
+	}
+	return dp
+}
+
+// writeDealJSON writes the deal parameters to path, or stdout for "-": a
+// single object for a lone input, an array of them for a batch run.
+func writeDealJSON(path string, batch bool, params []dealParams) error {
+	var doc interface{} = params
+	if !batch {
+		doc = params[0]
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressionMagic maps the leading bytes of compressed streams to the
+// --decompress method handling them.
+var compressionMagic = []struct {
+	method string
+	magic  []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// compressionOf returns the compression method of a stream starting with
+// head, if any.
+func compressionOf(head []byte) string {
+	for _, cm := range compressionMagic {
+		if bytes.HasPrefix(head, cm.magic) {
+			return cm.method
+		}
+	}
+	return ""
+}
+
+func validDecompressMethod(method string) bool {
+	return method == "auto" || method == "gzip" || method == "zstd"
+}
+
+// decompress returns the decompressed contents of input, as selected by
+// --decompress: with "auto" an input not recognized as compressed is
+// returned as is. The returned function releases the decompressor.
+func decompress(input io.Reader, opts *config) (io.Reader, func(), error) {
+	method := opts.Decompress
+	if method == "" {
+		return input, func() {}, nil
+	}
+
+	br := bufio.NewReader(input)
+	if method == "auto" {
+		head, _ := br.Peek(4)
+		if method = compressionOf(head); method == "" {
+			return br, func() {}, nil
+		}
+	}
+
+	switch method {
+	case "gzip":
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, withExitCode(exitInputError, fmt.Errorf("decompressing gzip: %w", err))
+		}
+		return zr, func() { zr.Close() }, nil
+	default:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, withExitCode(exitInputError, fmt.Errorf("decompressing zstd: %w", err))
+		}
+		return zr, zr.Close, nil
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// directAlign is the alignment O_DIRECT reads are done at, in file offset,
+// length and memory alike: that of the largest logical block size in use.
+const directAlign = 4096
+
+// directReader reads a file sequentially with O_DIRECT, bypassing the page
+// cache, via a buffer meeting the alignment requirements of such reads.
+type directReader struct {
+	fh     *os.File
+	buf    []byte
+	pos, n int
+	eof    bool
+}
+
+// newDirectReader reopens the regular file or block device fh with O_DIRECT,
+// to be read from its current offset on in chunks of bufSize bytes.
+func newDirectReader(fh *os.File, bufSize int) (io.ReadCloser, error) {
+	st, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !st.Mode().IsRegular() && !isBlockDevice(st) {
+		return nil, errors.New("O_DIRECT reads are only supported on regular files and block devices")
+	}
+	start, err := fh.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if start%directAlign != 0 {
+		return nil, fmt.Errorf("O_DIRECT reads can not start at the unaligned offset %d", start)
+	}
+
+	// going through /proc covers stdin as well as any path
+	dfh, err := os.OpenFile(fmt.Sprintf("/proc/self/fd/%d", fh.Fd()), os.O_RDONLY|unix.O_DIRECT, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening with O_DIRECT failed: %w", err)
+	}
+	if _, err := dfh.Seek(start, io.SeekStart); err != nil {
+		dfh.Close()
+		return nil, err
+	}
+
+	bufSize -= bufSize % directAlign
+	raw := make([]byte, bufSize+directAlign)
+	off := directAlign - int(uintptr(unsafe.Pointer(&raw[0]))%directAlign)
+	return &directReader{fh: dfh, buf: raw[off : off+bufSize]}, nil
+}
+
+func (dr *directReader) Read(p []byte) (int, error) {
+	for dr.pos == dr.n {
+		if dr.eof {
+			return 0, io.EOF
+		}
+		n, err := dr.fh.Read(dr.buf)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		dr.pos, dr.n = 0, n
+		// a short read is the end: reading on from the unaligned offset
+		// it leaves off at would fail anyway
+		dr.eof = n < len(dr.buf)
+	}
+	n := copy(p, dr.buf[dr.pos:dr.n])
+	dr.pos += n
+	return n, nil
+}
+
+func (dr *directReader) Close() error {
+	return dr.fh.Close()
+}
+
+// blockDeviceSize returns the size of the block device fh.
+func blockDeviceSize(fh *os.File) (int64, error) {
+	var size uint64
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fh.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, fmt.Errorf("BLKGETSIZE64 failed: %w", errno)
+	}
+	return int64(size), nil
+}
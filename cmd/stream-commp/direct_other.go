@@ -0,0 +1,27 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+func newDirectReader(*os.File, int) (io.ReadCloser, error) {
+	return nil, errors.New("O_DIRECT is only available on Linux")
+}
+
+// blockDeviceSize returns the size of the block device fh, as far as seeking
+// to its end tells.
+func blockDeviceSize(fh *os.File) (int64, error) {
+	cur, err := fh.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	size, err := fh.Seek(0, io.SeekEnd)
+	if _, serr := fh.Seek(cur, io.SeekStart); err == nil {
+		err = serr
+	}
+	return size, err
+}
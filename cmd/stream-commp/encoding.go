@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multibase"
+)
+
+// digestEncoder renders the result in the encoding selected by --encoding,
+// if any.
+var digestEncoder func(cid.Cid) string
+
+// newDigestEncoder returns the encoder of the named encoding: hex or base64
+// of the raw 32 byte commP, the hex of its multihash, or the piece CID in the
+// named multibase.
+func newDigestEncoder(name string) (func(cid.Cid) string, error) {
+	switch name {
+	case "hex":
+		return func(c cid.Cid) string { return hex.EncodeToString(rawCommP(c)) }, nil
+	case "base64":
+		return func(c cid.Cid) string { return base64.StdEncoding.EncodeToString(rawCommP(c)) }, nil
+	case "multihash":
+		return func(c cid.Cid) string { return hex.EncodeToString(c.Hash()) }, nil
+	}
+
+	enc, err := multibase.EncoderByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown encoding %q: neither hex, base64, multihash nor a multibase: %w", name, err)
+	}
+	return func(c cid.Cid) string { return c.Encode(enc) }, nil
+}
+
+// rawCommP returns the commP carried by a piece CID, the trailing 32 bytes
+// of its multihash.
+func rawCommP(c cid.Cid) []byte {
+	mh := c.Hash()
+	return mh[len(mh)-32:]
+}
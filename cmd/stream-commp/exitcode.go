@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+)
+
+// The exit codes of stream-commp, a contract with the scripts and
+// orchestration systems running it: see the README. A batch run in which
+// inputs failed for different reasons exits with exitFailure.
+const (
+	exitOK            = 0
+	exitFailure       = 1  // any failure not covered below
+	exitMalformedCAR  = 2  // the input looks like a CARv1, but not a sound one: the result is still reported
+	exitMismatch      = 3  // the result does not match the expected one
+	exitTooLarge      = 4  // the input exceeds the maximum piece payload
+	exitTooSmall      = 5  // the input is shorter than the minimum piece payload
+	exitInputError    = 6  // the input could not be opened or read
+	exitUnexpectedCAR = 7  // the input is a CAR of a version other than 1, e.g. a CARv2: the result is still reported
+	exitUsage         = 64 // invalid option values
+)
+
+// jsonErrors is set by --json-errors.
+var jsonErrors bool
+
+// codedError is an error carrying the exit code it maps to.
+type codedError struct {
+	code int
+	err  error
+}
+
+func (ce *codedError) Error() string { return ce.err.Error() }
+func (ce *codedError) Unwrap() error { return ce.err }
+
+func withExitCode(code int, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// exitCodeOf returns the exit code err maps to.
+func exitCodeOf(err error) int {
+	var ce *codedError
+	switch {
+	case errors.As(err, &ce):
+		return ce.code
+	case errors.Is(err, commp.ErrPayloadTooLarge):
+		return exitTooLarge
+	case errors.Is(err, commp.ErrBelowMinimumPayload):
+		return exitTooSmall
+	default:
+		return exitFailure
+	}
+}
+
+// errorReport is the JSON form of an error on stderr, with --json-errors.
+type errorReport struct {
+	Path  string `json:"path,omitempty"` // batch runs only
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+	Fatal bool   `json:"fatal"`
+}
+
+// reportError reports the failure of the input at path, without exiting.
+func reportError(path string, err error) {
+	if jsonErrors {
+		writeErrorReport(errorReport{Path: path, Error: err.Error(), Code: exitCodeOf(err)})
+		return
+	}
+	log.Printf("%s: %s", path, err)
+}
+
+// fatal reports err on the event stream and stderr, and exits with the
+// supplied code.
+func fatal(code int, err error) {
+	progress.fail(err.Error())
+	if jsonErrors {
+		writeErrorReport(errorReport{Error: err.Error(), Code: code, Fatal: true})
+	} else {
+		log.Print(err)
+	}
+	os.Exit(code)
+}
+
+// usageError exits on an invalid option value.
+func usageError(format string, args ...interface{}) {
+	fatal(exitUsage, fmt.Errorf(format, args...))
+}
+
+func writeErrorReport(r errorReport) {
+	b, _ := json.Marshal(r)
+	os.Stderr.Write(append(b, '\n'))
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fdMaxRequest bounds the length of a request line of --fd-listen.
+const fdMaxRequest = 64 << 10
+
+// fdRequest is a request line of --fd-listen, sent along with the file
+// descriptor of the file to digest as SCM_RIGHTS ancillary data.
+type fdRequest struct {
+	ID string `json:"id"`
+}
+
+// fdResponse is the JSON line answering an fdRequest, with either the fields
+// of a serveResult or of a serveError.
+type fdResponse struct {
+	ID string `json:"id"`
+	*serveResult
+	*serveError
+}
+
+// fdServer digests the files whose descriptors are passed to it over a unix
+// socket, reading them in place rather than having them copied through a
+// pipe or request body.
+type fdServer struct {
+	s       *server
+	ln      *net.UnixListener
+	mu      sync.Mutex
+	conns   map[*net.UnixConn]struct{}
+	closing bool
+	active  sync.WaitGroup // of the connections
+}
+
+func newFDServer(s *server, ln net.Listener) (*fdServer, error) {
+	uln, ok := ln.(*net.UnixListener)
+	if !ok {
+		return nil, fmt.Errorf("file descriptors can only be received on a unix socket, not on %s", ln.Addr())
+	}
+	return &fdServer{s: s, ln: uln, conns: make(map[*net.UnixConn]struct{})}, nil
+}
+
+// serve accepts connections until shutdown, then returns once the requests
+// in flight are answered.
+func (fs *fdServer) serve() error {
+	for {
+		conn, err := fs.ln.AcceptUnix()
+		if err != nil {
+			fs.mu.Lock()
+			closing := fs.closing
+			fs.mu.Unlock()
+			if closing {
+				fs.active.Wait()
+				return nil
+			}
+			return err
+		}
+
+		fs.mu.Lock()
+		if fs.closing {
+			fs.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		fs.conns[conn] = struct{}{}
+		fs.mu.Unlock()
+		fs.active.Add(1)
+		go fs.handle(conn)
+	}
+}
+
+// shutdown stops accepting connections and reading requests, leaving those
+// in flight to be answered. Expiring the read deadline of a connection
+// wakes up a read blocked on it.
+func (fs *fdServer) shutdown() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.closing = true
+	fs.ln.Close()
+	for conn := range fs.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// handle answers the requests of a connection in order. Every request line
+// is paired with the next file descriptor received, regardless of the
+// message it arrived with.
+func (fs *fdServer) handle(conn *net.UnixConn) {
+	var fds []*os.File
+	defer func() {
+		for _, fh := range fds {
+			fh.Close()
+		}
+		fs.mu.Lock()
+		delete(fs.conns, conn)
+		fs.mu.Unlock()
+		conn.Close()
+		fs.active.Done()
+	}()
+
+	enc := json.NewEncoder(conn)
+	var line []byte
+	buf := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(16*4))
+	for {
+		n, oobn, flags, err := recvmsg(conn, buf, oob)
+		if oobn > 0 || flags&unix.MSG_CTRUNC != 0 {
+			received, perr := parseRights(oob[:oobn])
+			if perr == nil && flags&unix.MSG_CTRUNC != 0 {
+				perr = fmt.Errorf("more than %d bytes of ancillary data, some file descriptors were dropped", len(oob))
+			}
+			if perr != nil {
+				for _, fh := range received {
+					fh.Close()
+				}
+				log.Printf("receiving file descriptors: %s", perr)
+				return
+			}
+			fds = append(fds, received...)
+		}
+		if n > 0 {
+			line = append(line, buf[:n]...)
+		}
+
+		for {
+			i := bytes.IndexByte(line, '\n')
+			if i < 0 {
+				break
+			}
+			var fh *os.File
+			if len(fds) > 0 {
+				fh, fds = fds[0], fds[1:]
+			}
+			resp := fs.answer(line[:i], fh)
+			line = line[i+1:]
+			if err := enc.Encode(resp); err != nil {
+				return
+			}
+		}
+		if len(line) > fdMaxRequest {
+			enc.Encode(fdResponse{serveError: &serveError{
+				Error: fmt.Sprintf("request exceeds the maximum of %d bytes", fdMaxRequest),
+				Code:  exitUsage,
+			}})
+			return
+		}
+
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("reading requests: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// recvmsg reads from conn like its ReadMsgUnix(), but with MSG_CMSG_CLOEXEC
+// set explicitly, so that no file descriptor received ever leaks into a child
+// process, whatever the net package does.
+func recvmsg(conn *net.UnixConn, buf, oob []byte) (n, oobn, flags int, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if rerr := rc.Read(func(fd uintptr) bool {
+		for {
+			n, oobn, flags, _, err = unix.Recvmsg(int(fd), buf, oob, unix.MSG_CMSG_CLOEXEC)
+			if err != unix.EINTR {
+				return err != unix.EAGAIN
+			}
+		}
+	}); rerr != nil {
+		return 0, 0, 0, rerr
+	}
+	if err != nil {
+		return 0, 0, 0, os.NewSyscallError("recvmsg", err)
+	}
+	if n == 0 && oobn == 0 {
+		return 0, 0, flags, io.EOF
+	}
+	return n, oobn, flags, nil
+}
+
+// parseRights returns the file descriptors passed in the ancillary data oob.
+func parseRights(oob []byte) ([]*os.File, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []*os.File
+	for i := range msgs {
+		rights, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue // not SCM_RIGHTS
+		}
+		for _, fd := range rights {
+			fds = append(fds, os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd)))
+		}
+	}
+	return fds, nil
+}
+
+// answer digests the file fh for the request line, closing fh.
+func (fs *fdServer) answer(line []byte, fh *os.File) fdResponse {
+	fail := func(id string, code int, err error) fdResponse {
+		return fdResponse{ID: id, serveError: &serveError{Error: err.Error(), Code: code}}
+	}
+
+	var req fdRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		if fh != nil {
+			fh.Close()
+		}
+		return fail("", exitUsage, fmt.Errorf("parsing request: %w", err))
+	}
+	if fh == nil {
+		return fail(req.ID, exitUsage, errors.New("no file descriptor was passed along with the request"))
+	}
+	defer fh.Close()
+
+	if err := fs.s.acquire(context.Background(), "fd"); err != nil {
+		return fail(req.ID, exitFailure, err)
+	}
+	defer fs.s.release()
+
+	st, err := fh.Stat()
+	if err != nil {
+		return fail(req.ID, exitInputError, err)
+	}
+	if st.Mode().IsRegular() && st.Size() > fs.s.maxBody {
+		return fail(req.ID, exitTooLarge, fmt.Errorf("the file of %d bytes exceeds the maximum of %d bytes", st.Size(), fs.s.maxBody))
+	}
+	// the file is digested from its start, whatever the offset it was passed
+	// at, which is shared with the sender
+	if st.Mode().IsRegular() || isBlockDevice(st) {
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			return fail(req.ID, exitInputError, err)
+		}
+	}
+
+	fr := fileReader(fh, fs.s.opts)
+	defer fr.Close()
+	// files other than regular ones can only be measured by reading them
+	start := time.Now()
+	res, err := digestReader(countHashed(io.LimitReader(fr, fs.s.maxBody+1)), BufSize, fs.s.opts)
+	if err == nil && res.payloadSize > fs.s.maxBody {
+		err = withExitCode(exitTooLarge, fmt.Errorf("the file exceeds the maximum of %d bytes", fs.s.maxBody))
+	}
+	observeDigest("fd", start, res.payloadSize, err)
+	if err != nil {
+		_, code, err := digestFailure(err)
+		return fail(req.ID, code, err)
+	}
+	sr := newServeResult(res)
+	return fdResponse{ID: req.ID, serveResult: &sr}
+}
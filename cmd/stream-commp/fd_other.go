@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+type fdServer struct{}
+
+func newFDServer(*server, net.Listener) (*fdServer, error) {
+	return nil, errors.New("receiving file descriptors is only available on Linux")
+}
+
+func (*fdServer) serve() error { return nil }
+
+func (*fdServer) shutdown() {}
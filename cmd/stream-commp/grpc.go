@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-fil-commp-hashhash/cmd/stream-commp/commppb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer digests the payloads streamed to the CommP service of
+// commppb/commp.proto, within the limits of the HTTP server it stands beside.
+type grpcServer struct {
+	commppb.UnimplementedCommPServer
+	s *server
+}
+
+func newGRPCServer(s *server) *grpc.Server {
+	gsrv := grpc.NewServer()
+	commppb.RegisterCommPServer(gsrv, &grpcServer{s: s})
+	return gsrv
+}
+
+func (g *grpcServer) Compute(stream commppb.CommP_ComputeServer) error {
+	if err := g.s.acquire(stream.Context(), "grpc"); err != nil {
+		code := codes.Unavailable
+		var be *busyError
+		if errors.As(err, &be) && be.status == http.StatusTooManyRequests {
+			code = codes.ResourceExhausted
+		}
+		return status.Error(code, err.Error())
+	}
+	defer g.s.release()
+
+	// the chunks of the stream are fed to the digest as they arrive, ending
+	// it with io.EOF once the client closes its side
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err == io.EOF {
+				pw.Close()
+				return
+			} else if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := pw.Write(req.GetData()); err != nil {
+				// the digest is over, having failed
+				return
+			}
+		}
+	}()
+
+	// passing no ResponseWriter limits the size all the same
+	start := time.Now()
+	res, err := digestReader(countHashed(http.MaxBytesReader(nil, pr, g.s.maxBody)), BufSize, g.s.opts)
+	observeDigest("grpc", start, res.payloadSize, err)
+	if err != nil {
+		if st, ok := status.FromError(err); ok {
+			// the stream itself failed, likely cancelled by the client
+			return st.Err()
+		}
+		httpStatus, _, err := digestFailure(err)
+		return status.Error(grpcCode(httpStatus), err.Error())
+	}
+
+	commP, err := commcid.CIDToPieceCommitmentV1(res.pieceCID)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	pi := &commppb.PieceInfo{
+		PieceCid:          res.pieceCID.String(),
+		Commp:             commP,
+		PayloadSize:       uint64(res.payloadSize),
+		UnpaddedPieceSize: res.paddedSize / 128 * 127,
+		PaddedPieceSize:   res.paddedSize,
+		CarInfo:           res.carInfo,
+	}
+	for _, root := range res.carRoots {
+		pi.CarRoots = append(pi.CarRoots, root.String())
+	}
+	return stream.SendAndClose(pi)
+}
+
+// grpcCode maps the HTTP status digestFailure answers with to its gRPC code.
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusRequestEntityTooLarge:
+		return codes.ResourceExhausted
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	default:
+		return codes.Internal
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// isIPFSURI tells whether an input path is an ipfs://CID URI instead.
+func isIPFSURI(path string) bool {
+	return strings.HasPrefix(path, "ipfs://")
+}
+
+// digestIPFS digests the CARv1 export of the DAG rooted at the CID of uri.
+func digestIPFS(uri string, opts *config) (inputResult, error) {
+	input, root, err := openIPFS(uri, opts)
+	if err != nil {
+		return inputResult{}, err
+	}
+	defer input.Close()
+
+	res, err := digestStream(input, opts)
+	if err != nil {
+		return res, err
+	}
+	if !opts.DisableStreamScan && (len(res.carRoots) != 1 || !res.carRoots[0].Equals(root)) {
+		return res, withExitCode(exitInputError, fmt.Errorf("the export is not a CARv1 rooted at %s", root))
+	}
+	return res, nil
+}
+
+// openIPFS starts the CARv1 export of the DAG rooted at the CID of uri,
+// streamed from the Kubo RPC API of --ipfs-api, or else the trustless
+// gateway of --ipfs-gateway. Either exports blocks in depth-first order
+// without duplicates, so the same DAG always yields the same piece.
+func openIPFS(uri string, opts *config) (io.ReadCloser, cid.Cid, error) {
+	root, err := cid.Decode(strings.TrimSuffix(strings.TrimPrefix(uri, "ipfs://"), "/"))
+	if err != nil {
+		return nil, cid.Undef, withExitCode(exitInputError, fmt.Errorf("expected ipfs://CID: %w", err))
+	}
+
+	var req *http.Request
+	if opts.IPFSAPI != "" {
+		req, err = http.NewRequest(http.MethodPost, strings.TrimSuffix(opts.IPFSAPI, "/")+"/api/v0/dag/export?arg="+url.QueryEscape(root.String()), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodGet, strings.TrimSuffix(opts.IPFSGateway, "/")+"/ipfs/"+root.String(), nil)
+		if req != nil {
+			req.Header.Set("Accept", "application/vnd.ipld.car;version=1;order=dfs;dups=n")
+		}
+	}
+	if err != nil {
+		return nil, cid.Undef, withExitCode(exitInputError, err)
+	}
+	req.Header.Set("User-Agent", "stream-commp")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, cid.Undef, withExitCode(exitInputError, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		resp.Body.Close()
+		return nil, cid.Undef, withExitCode(exitInputError, fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, strings.TrimSpace(string(msg))))
+	}
+	if opts.IPFSAPI == "" {
+		// a gateway free to pick any other order would not yield a
+		// reproducible piece
+		_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if params["order"] != "dfs" || params["dups"] != "n" {
+			resp.Body.Close()
+			return nil, cid.Undef, withExitCode(exitInputError, fmt.Errorf(
+				"the gateway responded with %q instead of a CARv1 in depth-first order without duplicates",
+				resp.Header.Get("Content-Type"),
+			))
+		}
+	}
+
+	return &readCloser{&exportReader{resp}, resp.Body.Close}, root, nil
+}
+
+// exportReader reads the body of an export response, turning an error the
+// Kubo RPC API reports in the X-Stream-Error trailer, once the export is
+// underway, into a read error.
+type exportReader struct {
+	resp *http.Response
+}
+
+func (er *exportReader) Read(p []byte) (int, error) {
+	n, err := er.resp.Body.Read(p)
+	if err == io.EOF {
+		if msg := er.resp.Trailer.Get("X-Stream-Error"); msg != "" {
+			return n, fmt.Errorf("export failed: %s", msg)
+		}
+	}
+	return n, err
+}
@@ -7,12 +7,15 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	commcid "github.com/filecoin-project/go-fil-commcid"
 	commp "github.com/filecoin-project/go-fil-commp-hashhash"
 	"github.com/ipfs/go-cid"
 	cbor "github.com/ipfs/go-ipld-cbor"
 	"github.com/mattn/go-isatty"
+	"github.com/pborman/getopt/v2"
 	"github.com/pborman/options"
 )
 
@@ -20,47 +23,598 @@ const BufSize = ((16 << 20) / 128 * 127)
 
 var ioOptimizations []func(os.FileInfo, *os.File) error
 
+type config struct {
+	DisableStreamScan  bool          `getopt:"-d --disable-stream-scan If set do not try to scan the contents of the stream for a potential .car stream, otherwise exiting with 2 on a malformed CARv1 and 7 on a CAR of another version"`
+	PadPieceSize       uint64        `getopt:"-p --pad-piece-size      Optional target power-of-two piece size, larger than the original input, one would like to pad to"`
+	Workers            int           `getopt:"--workers=N              Amount of layer workers hashing at the same time, across all inputs; 0 for one per CPU of each input"`
+	BufferSize         int           `getopt:"--buffer-size=BYTES      Memory every input may hold in flight within the hasher, trading memory for throughput; 0 for the default of about 1MiB"`
+	IoUring            bool          `getopt:"--io-uring               Read a regular file input via io_uring (Linux only), falling back to regular reads when unavailable"`
+	IoUringDepth       int           `getopt:"--io-uring-depth=N       Amount of 1MiB reads kept in flight when reading via io_uring"`
+	DirectIO           bool          `getopt:"--direct-io              Read a regular file or block device input with O_DIRECT (Linux only), bypassing the page cache, falling back to regular reads when unavailable"`
+	ProgressFd         int           `getopt:"--progress-fd=FD         Emit NDJSON progress events, followed by the final result or error, on this already open file descriptor"`
+	ProgressInterval   time.Duration `getopt:"--progress-interval=DUR  Interval between progress events"`
+	Manifest           string        `getopt:"--manifest=PATH          Record one row per input (path, payload bytes, piece sizes, piece CID, status) in this file, replaced atomically once all inputs are done"`
+	ManifestFormat     string        `getopt:"--manifest-format=FMT    Format of the manifest: csv or tsv"`
+	ManifestAppend     bool          `getopt:"--manifest-append        Add the rows to those of an existing manifest, instead of replacing it"`
+	Sidecar            bool          `getopt:"--sidecar                Write a FILE.commp sidecar next to every file input, recording its name, size, piece CID, piece size and a timestamp"`
+	SkipHashed         bool          `getopt:"--skip-hashed            Take the result of file inputs from their sidecar instead, when it is still current"`
+	DealJSON           string        `getopt:"--deal-json=PATH         Write the parameters of boost's offline deal commands (payload-cid, commp, piece-size, car-size) as JSON to this file, or - for stdout"`
+	JSONErrors         bool          `getopt:"--json-errors            Report errors on stderr as JSON objects with the exit code they map to, one per line"`
+	Jobs               int           `getopt:"-j --jobs=N              Amount of inputs digested concurrently; results are reported in the order the inputs were given regardless"`
+	FromFile           string        `getopt:"--from-file=PATH         Also digest the inputs listed one per line in this file, or - for stdin"`
+	HTTPConnections    int           `getopt:"--http-connections=N     Amount of ranges of a URL or object storage input downloaded concurrently, when the server supports range requests"`
+	HTTPChunkSize      int64         `getopt:"--http-chunk-size=BYTES  Size of the ranges a URL or object storage input is downloaded in"`
+	IPFSGateway        string        `getopt:"--ipfs-gateway=URL       Trustless gateway to export the DAG of an ipfs://CID input from as a CARv1"`
+	IPFSAPI            string        `getopt:"--ipfs-api=URL           Kubo RPC API to export the DAG of an ipfs://CID input from instead of the gateway, e.g. http://127.0.0.1:5001"`
+	Decompress         string        `getopt:"--decompress=METHOD      Digest the decompressed contents of compressed inputs: gzip, zstd, or auto (the default when given without a method) to detect either"`
+	Verify             string        `getopt:"--verify=PIECECID        Compare the result with this expected piece CID, failing with exit code 3 should it differ"`
+	VerifySize         uint64        `getopt:"--verify-size=BYTES      Also compare the padded piece size with this expected one; needs --verify"`
+	Checkpoint         string        `getopt:"--checkpoint=PATH        Persist the state of the digest of a file input in this file every --checkpoint-interval, removing it once done"`
+	CheckpointInterval time.Duration `getopt:"--checkpoint-interval=DUR Interval between checkpoints"`
+	Resume             bool          `getopt:"--resume                 Continue from the --checkpoint of an interrupted run, skipping the bytes it already digested"`
+	StallTimeout       time.Duration `getopt:"--stall-timeout=DUR      Fail should stdin deliver no data for this long, as when whatever feeds it died without closing it"`
+	RateLimit          int64         `getopt:"--rate-limit=BYTES       Read the inputs at no more than this many bytes per second, all together, to leave the bandwidth of shared storage to others"`
+	CARStats           bool          `getopt:"--car-stats              Walk every block of a CARv1 input, reporting its header size, roots, block count, block sizes and codecs"`
+	UnwrapCARv2        bool          `getopt:"--unwrap-carv2           Digest only the CARv1 data payload of CARv2 inputs, leaving out the CARv2 header and index"`
+	Tee                bool          `getopt:"--tee                    Copy stdin to stdout unchanged while digesting it, to sit in the middle of a pipeline"`
+	Concat             bool          `getopt:"--concat                 Digest all inputs back to back as a single payload, reporting the offset of each"`
+	ConcatAlign        int64         `getopt:"--concat-align=BYTES     Start every concatenated input at a multiple of this many bytes, zero-filling the gaps; implies --concat"`
+	Tar                bool          `getopt:"--tar                    Treat inputs as tar archives, digesting every regular file in them on its own"`
+	TarWhole           bool          `getopt:"--tar-whole              Also digest every tar archive as a whole; implies --tar"`
+	Pack               bool          `getopt:"--pack                   Pack directory inputs into a UnixFS CARv1 and digest that, reporting its root CID along with the piece"`
+	PackOut            string        `getopt:"--pack-out=DIR           Also save the CARv1 of every packed directory in this directory, as PIECECID.car; implies --pack"`
+	Quiet              bool          `getopt:"-q --quiet               Do not print informational messages, such as notes on CAR streams: only the result and errors"`
+	Output             string        `getopt:"--output=STREAM          Where to print the result: stdout or stderr"`
+	Verbose            bool          `getopt:"-v --verbose             Also print how much of the padded piece is padding"`
+	WarnPadding        float64       `getopt:"--warn-padding=PERCENT  Warn should padding make up more than this share of the padded piece, as when a payload just exceeds a power of two"`
+	Encoding           string        `getopt:"--encoding=ENC           Also print the result as hex, base64 (of the raw commP), multihash (hex), or as the piece CID in the named multibase, e.g. base58btc"`
+	Help               options.Help  `getopt:"-h --help                Display help"`
+}
+
+var (
+	// quiet is set by --quiet.
+	quiet bool
+
+	// resultOut receives the results, as chosen by --output.
+	resultOut io.Writer = os.Stderr
+
+	// verbose is set by --verbose.
+	verbose bool
+
+	// warnPadding is the share of padding in percent above which a result
+	// is warned about, as set by --warn-padding.
+	warnPadding float64
+
+	// calcOptions are those every commp.Calc is constructed with, as set by
+	// --workers and --buffer-size.
+	calcOptions []commp.Option
+)
+
+// newCalc returns a commp.Calc configured as requested on the command line.
+func newCalc() *commp.Calc {
+	return commp.New(calcOptions...)
+}
+
+// infof logs a message which is of no consequence to the result, unless
+// --quiet.
+func infof(format string, args ...interface{}) {
+	if !quiet {
+		log.Printf(format, args...)
+	}
+}
+
+// inputResult is the outcome of digesting a single input.
+type inputResult struct {
+	payloadSize int64
+	paddedSize  uint64
+	pieceCID    cid.Cid
+	carInfo     string
+	carRoots    []cid.Cid // as found in a CARv1 header
+	fromSidecar bool      // not digested, but taken from a current sidecar
+	packed      bool      // a directory packed into a CARv1
+	compressed  string    // the compression the input looks to be in, when not decompressed
+	unwrapped   string    // the note on the CARv2 the input was unwrapped from, if any
+	carStats    *carStats // the CARv1 walked with --car-stats
+	members     []tarMember
+	parts       []concatPart // the inputs making up a concatenated payload
+}
+
 func main() {
 
-	opts := &struct {
-		DisableStreamScan bool         `getopt:"-d --disable-stream-scan If set do not try to scan the contents of the stream for a potential .car stream"`
-		PadPieceSize      uint64       `getopt:"-p --pad-piece-size      Optional target power-of-two piece size, larger than the original input, one would like to pad to"`
-		Help              options.Help `getopt:"-h --help                Display help"`
-	}{}
-	options.RegisterAndParse(opts)
+	opts := &config{
+		IoUringDepth:       8,
+		ProgressFd:         -1,
+		ProgressInterval:   time.Second,
+		CheckpointInterval: time.Minute,
+		ManifestFormat:     "csv",
+		Output:             "stderr",
+		Jobs:               1,
+		HTTPConnections:    4,
+		HTTPChunkSize:      16 << 20,
+		IPFSGateway:        "http://127.0.0.1:8080",
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serveMain(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		planMain(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "aggregate" {
+		aggregateMain(os.Args[1:])
+		return
+	}
+
+	options.SetParameters("[FILE...]")
+	options.Register(opts)
+	getopt.Lookup("decompress").SetOptional()
+	// unlike getopt.Parse() this does not exit 1 on a bad command line
+	err := getopt.CommandLine.Getopt(os.Args, nil)
+	jsonErrors = opts.JSONErrors
+	if err != nil {
+		if !jsonErrors {
+			getopt.PrintUsage(os.Stderr)
+		}
+		usageError("%s", err)
+	}
+	paths := getopt.Args()
+
+	if opts.IoUringDepth < 1 {
+		usageError("invalid io_uring depth %d", opts.IoUringDepth)
+	}
+	if opts.DirectIO && opts.IoUring {
+		usageError("--direct-io can not be combined with --io-uring")
+	}
+	if opts.Jobs < 1 {
+		usageError("invalid amount of jobs %d", opts.Jobs)
+	}
+	if opts.HTTPConnections < 1 {
+		usageError("invalid amount of HTTP connections %d", opts.HTTPConnections)
+	}
+	if opts.HTTPChunkSize < 1 {
+		usageError("invalid HTTP chunk size %d", opts.HTTPChunkSize)
+	}
+	if opts.Workers < 0 {
+		usageError("invalid amount of workers %d", opts.Workers)
+	} else if opts.Workers > 0 {
+		// a single Scheduler bounds the workers of all inputs together
+		calcOptions = append(calcOptions, commp.WithScheduler(commp.NewScheduler(opts.Workers)))
+	}
+	if opts.BufferSize < 0 {
+		usageError("invalid buffer size %d", opts.BufferSize)
+	} else if opts.BufferSize > 0 {
+		calcOptions = append(calcOptions, commp.WithMaxMemory(opts.BufferSize))
+	}
+	if opts.CARStats && opts.DisableStreamScan {
+		usageError("--car-stats can not be combined with --disable-stream-scan")
+	}
+	if opts.StallTimeout < 0 {
+		usageError("invalid stall timeout %s", opts.StallTimeout)
+	}
+	if opts.RateLimit < 0 {
+		usageError("invalid rate limit %d", opts.RateLimit)
+	} else if opts.RateLimit > 0 {
+		setRateLimit(opts.RateLimit)
+	}
+	if opts.WarnPadding < 0 || opts.WarnPadding >= 100 {
+		usageError("invalid padding warning threshold %g%%", opts.WarnPadding)
+	}
+	warnPadding = opts.WarnPadding
+	verbose = opts.Verbose
+	if opts.ProgressInterval <= 0 {
+		usageError("invalid progress interval %s", opts.ProgressInterval)
+	}
+	switch opts.Output {
+	case "stderr":
+	case "stdout":
+		if opts.DealJSON == "-" {
+			usageError("--output=stdout can not be combined with --deal-json=-")
+		}
+		resultOut = os.Stdout
+	default:
+		usageError("invalid output %q: expected stdout or stderr", opts.Output)
+	}
+	quiet = opts.Quiet
+	if getopt.IsSet("decompress") && opts.Decompress == "" {
+		opts.Decompress = "auto"
+	}
+	if opts.Decompress != "" && !validDecompressMethod(opts.Decompress) {
+		usageError("invalid decompression method %q: expected gzip, zstd or auto", opts.Decompress)
+	}
+	if opts.PackOut != "" {
+		opts.Pack = true
+	}
+	if opts.TarWhole {
+		opts.Tar = true
+	}
+	if opts.ConcatAlign < 0 {
+		usageError("invalid concatenation alignment %d", opts.ConcatAlign)
+	} else if opts.ConcatAlign > 0 {
+		opts.Concat = true
+	} else {
+		opts.ConcatAlign = 1
+	}
+	if opts.Concat && (opts.Tar || opts.Pack) {
+		usageError("--concat can not be combined with --tar or --pack")
+	}
+	if opts.Tee {
+		if len(paths) > 0 || opts.FromFile != "" {
+			usageError("--tee passes stdin through: it takes no inputs")
+		}
+		if opts.Output == "stdout" || opts.DealJSON == "-" {
+			usageError("--tee leaves stdout to the input: it can not be combined with --output=stdout or --deal-json=-")
+		}
+		if opts.Tar || opts.Concat {
+			usageError("--tee can not be combined with --tar or --concat")
+		}
+	}
+
+	if opts.Encoding != "" {
+		var err error
+		if digestEncoder, err = newDigestEncoder(opts.Encoding); err != nil {
+			usageError("%s", err)
+		}
+	}
+
+	var mf *manifest
+	if opts.Manifest != "" {
+		var err error
+		if mf, err = openManifest(opts.Manifest, opts.ManifestFormat, opts.ManifestAppend); err != nil {
+			fatal(exitFailure, fmt.Errorf("opening manifest: %w", err))
+		}
+	}
+
+	if opts.FromFile != "" {
+		listed, err := readPathList(opts.FromFile)
+		if err != nil {
+			fatal(exitInputError, fmt.Errorf("reading input list: %w", err))
+		}
+		if len(paths) == 0 && len(listed) == 0 {
+			fatal(exitInputError, fmt.Errorf("no inputs listed in %s", opts.FromFile))
+		}
+		paths = append(paths, listed...)
+	}
+
+	var expected *expectation
+	if opts.Verify != "" {
+		if len(paths) > 1 && !opts.Concat || opts.Tar {
+			usageError("--verify applies to a single input")
+		}
+		var err error
+		if expected, err = parseExpectation(opts.Verify, opts.VerifySize); err != nil {
+			usageError("%s", err)
+		}
+	} else if opts.VerifySize != 0 {
+		usageError("--verify-size needs --verify")
+	}
+
+	if opts.Checkpoint != "" {
+		if len(paths) != 1 || paths[0] == "-" || isURL(paths[0]) || isObjectURI(paths[0]) || isIPFSURI(paths[0]) {
+			usageError("--checkpoint applies to a single file input")
+		}
+		if opts.Tar || opts.Concat || opts.Pack || opts.Decompress != "" || opts.UnwrapCARv2 || opts.CARStats {
+			usageError("--checkpoint can not be combined with --tar, --concat, --pack, --decompress, --unwrap-carv2 or --car-stats")
+		}
+		if opts.CheckpointInterval <= 0 {
+			usageError("invalid checkpoint interval %s", opts.CheckpointInterval)
+		}
+	} else if opts.Resume {
+		usageError("--resume needs --checkpoint")
+	}
+
+	// without any paths, read a single stream from stdin
+	batch := len(paths) > 0
+	if !batch {
+		paths = []string{"-"}
+	}
+
+	if opts.ProgressFd >= 0 {
+		var total int64
+		for _, path := range paths {
+			if size, ok := inputSize(path); ok {
+				total += size
+			}
+		}
+		progress = newProgressReporter(opts.ProgressFd, opts.ProgressInterval, total)
+	}
+
+	var total, failed int
+	var lastErr error
+	var deals []dealParams
+	codes := make(map[int]bool)
+	report := func(path string, res inputResult, err error) {
+		total++
+		if err == nil && expected != nil {
+			err = expected.check(res)
+		}
+		if err != nil {
+			failed++
+			lastErr = err
+			codes[exitCodeOf(err)] = true
+			if batch {
+				reportError(path, err)
+			}
+		} else {
+			// a lone stdin input is reported exactly as before batch runs
+			label := path
+			if !batch {
+				label = ""
+			}
+			printResult(label, res)
+			if expected != nil {
+				infof("Verified: the piece is the expected one")
+			}
+			progress.result(label, res)
+			deals = append(deals, newDealParams(label, res))
+			if code := carExitCode(res.carInfo); code != exitOK {
+				codes[code] = true
+			}
+		}
+		if mf != nil {
+			mf.add(path, res, err)
+		}
+	}
+	if opts.Tar {
+		// every member is an input in its own right
+		batch = true
+	}
+	if opts.Concat {
+		res, err := digestConcat(paths, opts)
+		report(concatLabel(paths), res, err)
+	} else {
+		digestAll(paths, opts, opts.Jobs, func(path string, res inputResult, err error) {
+			for _, m := range res.members {
+				name := m.name
+				if path != "-" {
+					name = path + ":" + m.name
+				}
+				report(name, m.res, m.err)
+			}
+			if err != nil || !opts.Tar || opts.TarWhole {
+				report(path, res, err)
+			}
+		})
+	}
+
+	if mf != nil {
+		if err := mf.commit(); err != nil {
+			mf.abort()
+			fatal(exitFailure, fmt.Errorf("writing manifest: %w", err))
+		}
+	}
+	if opts.DealJSON != "" && failed < total {
+		if err := writeDealJSON(opts.DealJSON, batch, deals); err != nil {
+			fatal(exitFailure, fmt.Errorf("writing deal parameters: %w", err))
+		}
+	}
+
+	code := exitFailure
+	if len(codes) == 1 {
+		for c := range codes {
+			code = c
+		}
+	}
+	switch {
+	case failed > 0 && !batch:
+		fatal(code, lastErr)
+	case failed > 0:
+		fatal(code, fmt.Errorf("%d out of %d inputs failed", failed, total))
+	case len(codes) > 0:
+		// every input was digested, but some are suspect
+		progress.close()
+		os.Exit(code)
+	}
+	progress.close()
+}
+
+// digestPath digests the file at path, stdin for "-", or the contents of
+// an http(s) URL, an s3:// or gs:// object, or the CARv1 export of an
+// ipfs:// DAG.
+func digestPath(path string, opts *config) (inputResult, error) {
+	if path == "-" && !opts.Tar {
+		if isatty.IsTerminal(os.Stdin.Fd()) || isatty.IsCygwinTerminal(os.Stdin.Fd()) {
+			infof("Reading from the TTY...")
+		} else if err := optimizeIO(os.Stdin); err != nil {
+			log.Printf("unexpected failure to optimize input: %s", err)
+		}
+		return digestInput(os.Stdin, opts)
+	}
 
-	inputFH := os.Stdin
+	if opts.Tar {
+		return digestTarPath(path, opts)
+	}
+	if isURL(path) {
+		return digestURL(path, opts)
+	}
+	if isObjectURI(path) {
+		return digestObject(path, opts)
+	}
+	if isIPFSURI(path) {
+		return digestIPFS(path, opts)
+	}
 
-	if isatty.IsTerminal(inputFH.Fd()) || isatty.IsCygwinTerminal(inputFH.Fd()) {
-		log.Println("Reading from the TTY...")
-	} else if err := optimizeIO(inputFH); err != nil {
-		log.Printf("unexpected failure to optimize input: %s", err)
+	if opts.Pack {
+		if st, err := os.Stat(path); err == nil && st.IsDir() {
+			return packDir(path, opts)
+		}
 	}
 
-	cp := new(commp.Calc)
+	if opts.SkipHashed {
+		res, ok, err := readSidecar(path, opts)
+		if err != nil {
+			return res, err
+		}
+		if ok {
+			return res, nil
+		}
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return inputResult{}, withExitCode(exitInputError, err)
+	}
+	defer fh.Close()
+
+	if err := optimizeIO(fh); err != nil {
+		log.Printf("%s: unexpected failure to optimize input: %s", path, err)
+	}
+	var res inputResult
+	if opts.Checkpoint != "" {
+		res, err = digestCheckpointed(path, fh, opts)
+	} else {
+		res, err = digestInput(fh, opts)
+	}
+	if err != nil {
+		return res, err
+	}
+
+	if opts.Sidecar {
+		if err := writeSidecar(path, res); err != nil {
+			return res, fmt.Errorf("writing sidecar: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// inputSize returns the size of the regular file or block device at path, or
+// stdin for "-", when known upfront.
+func inputSize(path string) (int64, bool) {
+	st, err := os.Stdin.Stat()
+	if path != "-" {
+		st, err = os.Stat(path)
+	}
+	if err != nil {
+		return 0, false
+	}
+	if st.Mode().IsRegular() {
+		return st.Size(), true
+	}
+	if !isBlockDevice(st) {
+		return 0, false
+	}
+
+	fh := os.Stdin
+	if path != "-" {
+		if fh, err = os.Open(path); err != nil {
+			return 0, false
+		}
+		defer fh.Close()
+	}
+	size, err := blockDeviceSize(fh)
+	return size, err == nil
+}
+
+func isBlockDevice(st os.FileInfo) bool {
+	return st.Mode()&os.ModeDevice != 0 && st.Mode()&os.ModeCharDevice == 0
+}
+
+// fileReader returns what to read fh through from its current offset on:
+// the O_DIRECT or io_uring reader requested, or else fh itself. It is to be
+// closed once done with, leaving fh open.
+func fileReader(fh *os.File, opts *config) io.ReadCloser {
+	if opts.DirectIO {
+		if dr, err := newDirectReader(fh, 16<<20); err != nil {
+			infof("falling back to regular reads: %s", err)
+		} else {
+			return dr
+		}
+	} else if opts.IoUring {
+		if ur, err := newRingReader(fh, opts.IoUringDepth, 1<<20); err != nil {
+			infof("falling back to regular reads: %s", err)
+		} else {
+			return ur
+		}
+	}
+	return io.NopCloser(fh)
+}
+
+func digestInput(inputFH *os.File, opts *config) (inputResult, error) {
+	fr := fileReader(inputFH, opts)
+	defer fr.Close()
+
+	var input io.Reader = fr
+	if inputFH == os.Stdin {
+		input = watchStall(input, opts)
+	}
+	if !opts.Tee {
+		return digestStream(input, opts)
+	}
+
+	// the input is passed through in full even should the digest fail, so
+	// the rest of the pipeline is not cut short
+	input = io.TeeReader(input, os.Stdout)
+	res, err := digestStream(input, opts)
+	if err != nil {
+		io.Copy(uDiscard, input)
+	}
+	return res, err
+}
+
+// digestStream digests everything read from input.
+func digestStream(input io.Reader, opts *config) (inputResult, error) {
+	input, release, err := decompress(progress.wrap(throttle(input)), opts)
+	if err != nil {
+		return inputResult{}, err
+	}
+	defer release()
+	return digestReader(input, BufSize, opts)
+}
+
+// digestReader digests everything read from input, buffering up to bufSize
+// bytes of it at a time.
+func digestReader(input io.Reader, bufSize int, opts *config) (inputResult, error) {
+	var res inputResult
+
+	if opts.UnwrapCARv2 {
+		var err error
+		if input, res.unwrapped, err = unwrapCARv2(input); err != nil {
+			return res, err
+		}
+	}
+
+	cp := newCalc()
+	// stops the goroutines of cp should it not be digested, a no-op otherwise
+	defer cp.Reset()
 	streamBuf := bufio.NewReaderSize(
-		io.TeeReader(inputFH, cp),
-		BufSize,
+		io.TeeReader(input, cp),
+		bufSize,
 	)
 
-	var streamLen int64
+	if opts.Decompress == "" {
+		head, _ := streamBuf.Peek(4)
+		res.compressed = compressionOf(head)
+	}
 
-	var readRes string
 	if !opts.DisableStreamScan {
-		var n int64
-		n, readRes = scanInputStream(streamBuf)
-		streamLen += n
+		if opts.CARStats {
+			res.carStats = new(carStats)
+		}
+		n, carInfo, roots, err := scanInputStream(streamBuf, res.carStats)
+		res.payloadSize += n
+		if err != nil {
+			return res, withExitCode(exitInputError, err)
+		}
+		res.carInfo = carInfo
+		res.carRoots = roots
 	}
 	// read out remainder from above into the hasher, if any
 	n, err := io.Copy(uDiscard, streamBuf)
-	streamLen += n
+	res.payloadSize += n
 	if err != nil && err != io.EOF {
-		log.Fatalf("unexpected error at offset %d: %s", streamLen, err)
+		return res, withExitCode(exitInputError, fmt.Errorf("unexpected error at offset %d: %w", res.payloadSize, err))
 	}
 
+	res.pieceCID, res.paddedSize, err = finishDigest(cp, opts)
+	return res, err
+}
+
+// finishDigest returns the piece CID and padded piece size of everything
+// written to cp, padded to --pad-piece-size if requested.
+func finishDigest(cp *commp.Calc, opts *config) (cid.Cid, uint64, error) {
 	rawCommP, paddedSize, err := cp.Digest()
 	if err != nil {
-		log.Fatal(err)
+		return cid.Undef, 0, err
 	}
 
 	if opts.PadPieceSize > 0 {
@@ -70,30 +624,107 @@ func main() {
 			opts.PadPieceSize,
 		)
 		if err != nil {
-			log.Fatal(err)
+			return cid.Undef, 0, err
 		}
 		paddedSize = opts.PadPieceSize
 	}
 
-	commCid, err := commcid.DataCommitmentV1ToCID(rawCommP)
+	pieceCID, err := commcid.DataCommitmentV1ToCID(rawCommP)
 	if err != nil {
-		log.Fatal(err)
+		return cid.Undef, 0, err
 	}
+	return pieceCID, paddedSize, nil
+}
 
-	fmt.Fprintf(os.Stderr, `
+func printResult(path string, res inputResult) {
+	if path != "" {
+		fmt.Fprintf(resultOut, "\nInput: %s", path)
+	}
+	fmt.Fprintf(resultOut, `
 CommPCid: %s
 Payload:        % 12d bytes
 Unpadded piece: % 12d bytes
 Padded piece:   % 12d bytes
 `,
-		commCid,
-		streamLen,
-		paddedSize/128*127,
-		paddedSize,
+		res.pieceCID,
+		res.payloadSize,
+		res.paddedSize/128*127,
+		res.paddedSize,
 	)
+	padding := paddingPercent(res)
+	warn := warnPadding > 0 && padding > warnPadding
+	if verbose || warn {
+		fmt.Fprintf(resultOut, "Padding:        % 12d bytes (the payload fills %.2f%% of the padded piece)\n", res.paddedSize-uint64(res.payloadSize), 100-padding)
+	}
+	if digestEncoder != nil {
+		fmt.Fprintf(resultOut, "Digest:         %s\n", digestEncoder(res.pieceCID))
+	}
+	if res.packed && len(res.carRoots) == 1 {
+		fmt.Fprintf(resultOut, "Root CID:       %s\n", res.carRoots[0])
+	}
+	if len(res.parts) > 0 {
+		fmt.Fprintf(resultOut, "\n%20s %20s  %s\n", "Offset", "Bytes", "Input")
+		for _, p := range res.parts {
+			fmt.Fprintf(resultOut, "%20d %20d  %s\n", p.offset, p.size, p.path)
+		}
+	}
 
-	if readRes != "" {
-		fmt.Fprintf(os.Stderr, "\n%s\n\n", readRes)
+	if res.carStats != nil && res.carStats.headerSize > 0 {
+		res.carStats.print(resultOut)
+	}
+	if res.unwrapped != "" {
+		fmt.Fprintf(resultOut, "\n%s\n", res.unwrapped)
+	}
+	if warn {
+		fmt.Fprintf(resultOut, "\nWARNING: padding makes up %.2f%% of the piece, over the %g%% of --warn-padding", padding, warnPadding)
+		if half := res.paddedSize / 2; half >= 128 && uint64(res.payloadSize) > half/128*127 {
+			fmt.Fprintf(resultOut, ": %d bytes less payload would have made for a piece of half the size", uint64(res.payloadSize)-half/128*127)
+		}
+		fmt.Fprintln(resultOut)
+	}
+	if res.compressed != "" {
+		fmt.Fprintf(resultOut, "\nWARNING: the input looks %s-compressed: this is the piece of the compressed data, --decompress digests what it contains instead\n", res.compressed)
+	}
+
+	if quiet {
+		return
+	}
+
+	if res.fromSidecar {
+		fmt.Fprintf(resultOut, "\nTaken from %s%s\n\n", path, sidecarSuffix)
+	}
+	if res.carInfo != "" {
+		fmt.Fprintf(resultOut, "\n%s\n\n", res.carInfo)
+	}
+}
+
+// paddingPercent returns the share of the padded piece of res taken by
+// padding, fr32 included.
+func paddingPercent(res inputResult) float64 {
+	return float64(res.paddedSize-uint64(res.payloadSize)) / float64(res.paddedSize) * 100
+}
+
+// maxCARHeaderSize is the largest CAR header scanInputStream reads, as
+// enforced by go-car as well.
+const maxCARHeaderSize = 32 << 20
+
+// carV1Detected is the note on an input found to be a sound CARv1.
+const carV1Detected = "CARv1 detected in stream"
+
+// carUnexpected starts the note on an input found to be a CAR of a version
+// other than 1.
+const carUnexpected = "*UNEXPECTED*"
+
+// carExitCode returns the exit code the CAR note of an input maps to,
+// exitOK for a sound CARv1 or none at all.
+func carExitCode(carInfo string) int {
+	switch {
+	case carInfo == "" || carInfo == carV1Detected:
+		return exitOK
+	case strings.HasPrefix(carInfo, carUnexpected):
+		return exitUnexpectedCAR
+	default:
+		return exitMalformedCAR
 	}
 }
 
@@ -102,15 +733,19 @@ type CarHeader struct {
 	Version uint64
 }
 
-func scanInputStream(streamBuf *bufio.Reader) (cnt int64, res string) {
-
+func init() {
 	cbor.RegisterCborType(CarHeader{})
+}
+
+func scanInputStream(streamBuf *bufio.Reader, stats *carStats) (cnt int64, res string, roots []cid.Cid, readErr error) {
 
 	// pretend the stream is a car and try to parse it
 	// everything is opportunistic - keep descending on every err == nil
 	if maybeHeaderLen, err := streamBuf.Peek(10); err == nil {
 
-		if hdrLen, viLen := binary.Uvarint(maybeHeaderLen); viLen > 0 && hdrLen > 0 {
+		// a length beyond any sane header is no CAR, and must not be
+		// allocated for either
+		if hdrLen, viLen := binary.Uvarint(maybeHeaderLen); viLen > 0 && hdrLen > 0 && hdrLen <= maxCARHeaderSize {
 			actualViLen, err := io.CopyN(uDiscard, streamBuf, int64(viLen))
 			cnt += actualViLen
 			if err == nil {
@@ -127,38 +762,57 @@ func scanInputStream(streamBuf *bufio.Reader) (cnt int64, res string) {
 					}
 
 					if carHdr.Version != 1 {
-						log.Printf("detected a CARv%d header: using the CommP of such an input is almost certainly a mistake", carHdr.Version)
-						res = fmt.Sprintf("*UNEXPECTED* CARv%d detected in stream", carHdr.Version)
+						if carHdr.Version == 2 {
+							infof("detected a CARv2 header: using the CommP of such an input is almost certainly a mistake, --unwrap-carv2 digests its inner CARv1 instead")
+						} else {
+							infof("detected a CARv%d header: using the CommP of such an input is almost certainly a mistake", carHdr.Version)
+						}
+						res = fmt.Sprintf("%s CARv%d detected in stream", carUnexpected, carHdr.Version)
 						return
 					}
 
+					if stats != nil {
+						// walk every frame instead of checking the first one only
+						stats.headerSize = cnt
+						stats.roots = carHdr.Roots
+						n, err := stats.walk(streamBuf)
+						cnt += n
+						if err != nil {
+							return cnt, "", nil, err
+						}
+						if stats.problem != "" {
+							infof("aborting car stream parse: %s", stats.problem)
+							return cnt, "*MALFORMED* CARv1 detected in stream", nil, nil
+						}
+						return cnt, carV1Detected, carHdr.Roots, nil
+					}
+
 					//
 					// Assume CARv1: I know how to decode this!
 					// Check the *first* block only, if any at all
 					//
 					maybeNextFrameLen, err := streamBuf.Peek(10)
 					if err == io.EOF {
-						res = "CARv1 detected in stream"
+						res = carV1Detected
+						roots = carHdr.Roots
 						return
 					}
 
 					if err != nil && err != bufio.ErrBufferFull {
-						log.Fatalf("unexpected read error at offset %d: %s", cnt, err)
-						return
+						return cnt, "", nil, fmt.Errorf("unexpected read error at offset %d: %w", cnt, err)
 					}
 
 					// from here on assume everything is malformed, unless we say otherwise
 					res = "*MALFORMED* CARv1 detected in stream"
 
 					if len(maybeNextFrameLen) == 0 {
-						log.Fatalf("impossible 0-length peek without io.EOF at offset %d", cnt)
-						return
+						return cnt, "", nil, fmt.Errorf("impossible 0-length peek without io.EOF at offset %d", cnt)
 					}
 
 					frameLen, viLen := binary.Uvarint(maybeNextFrameLen)
 					if viLen <= 0 {
 						// car file with trailing garbage behind it
-						log.Printf("aborting car stream parse: undecodeable varint at offset %d", cnt)
+						infof("aborting car stream parse: undecodeable varint at offset %d", cnt)
 						return
 					}
 
@@ -166,14 +820,15 @@ func scanInputStream(streamBuf *bufio.Reader) (cnt int64, res string) {
 					cnt += actualFrameLen
 					if err != nil {
 						if err != io.EOF {
-							log.Fatalf("unexpected error at offset %d: %s", cnt-actualFrameLen, err)
+							return cnt, "", nil, fmt.Errorf("unexpected error at offset %d: %w", cnt-actualFrameLen, err)
 						}
-						log.Printf("aborting car stream parse: truncated frame at offset %d: expected %d bytes but read %d: %s", cnt-actualFrameLen, frameLen, actualFrameLen, err)
+						infof("aborting car stream parse: truncated frame at offset %d: expected %d bytes but read %d: %s", cnt-actualFrameLen, frameLen, actualFrameLen, err)
 						return
 					}
 
 					// all looks healthy
-					res = "CARv1 detected in stream"
+					res = carV1Detected
+					roots = carHdr.Roots
 				}
 			}
 		}
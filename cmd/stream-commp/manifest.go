@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var manifestHeader = []string{"path", "payload_bytes", "unpadded_piece_size", "padded_piece_size", "piece_cid", "status"}
+
+// manifest accumulates one row per input in a temporary file next to its
+// destination, which is only replaced by a rename once all inputs are done:
+// readers of the destination never observe a partial manifest, even if the
+// run is interrupted. When appending, the rows already present are copied
+// over first.
+type manifest struct {
+	path string
+	mode os.FileMode
+	tmp  *os.File
+	w    *csv.Writer
+}
+
+func openManifest(path, format string, appendTo bool) (*manifest, error) {
+	var comma rune
+	switch format {
+	case "csv":
+		comma = ','
+	case "tsv":
+		comma = '\t'
+	default:
+		return nil, fmt.Errorf("unknown manifest format %q", format)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{path: path, mode: 0o644, tmp: tmp, w: csv.NewWriter(tmp)}
+	m.w.Comma = comma
+
+	var existing int64
+	if st, err := os.Stat(path); err == nil {
+		m.mode = st.Mode().Perm()
+		if appendTo {
+			if existing, err = m.copyFrom(path); err != nil {
+				m.abort()
+				return nil, err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		m.abort()
+		return nil, err
+	}
+
+	if existing == 0 {
+		m.w.Write(manifestHeader) // errors stick, surfacing on commit()
+	}
+	return m, nil
+}
+
+func (m *manifest) copyFrom(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(m.tmp, f)
+}
+
+// add records the outcome of digesting the input at path.
+func (m *manifest) add(path string, res inputResult, err error) {
+	row := []string{path, strconv.FormatInt(res.payloadSize, 10), "", "", "", "ok"}
+	if err != nil {
+		row[5] = "error: " + err.Error()
+	} else {
+		row[2] = strconv.FormatUint(res.paddedSize/128*127, 10)
+		row[3] = strconv.FormatUint(res.paddedSize, 10)
+		row[4] = res.pieceCID.String()
+		if res.fromSidecar {
+			row[5] = "ok (sidecar)"
+		}
+	}
+	m.w.Write(row) // errors stick, surfacing on commit()
+}
+
+// commit atomically replaces the destination with the accumulated rows.
+func (m *manifest) commit() error {
+	m.w.Flush()
+	if err := m.w.Error(); err != nil {
+		return err
+	}
+	if err := m.tmp.Chmod(m.mode); err != nil {
+		return err
+	}
+	if err := m.tmp.Sync(); err != nil {
+		return err
+	}
+	if err := m.tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(m.tmp.Name(), m.path); err != nil {
+		return err
+	}
+	m.tmp = nil
+	return nil
+}
+
+// abort discards the accumulated rows, unless they were committed.
+func (m *manifest) abort() {
+	if m.tmp != nil {
+		m.tmp.Close()
+		os.Remove(m.tmp.Name())
+		m.tmp = nil
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics of `stream-commp serve`, exposed at /metrics. The protocol
+// label is one of http, grpc, fd or session.
+var (
+	metricBytesHashed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "stream_commp_bytes_hashed_total",
+		Help: "Bytes of payload fed to the hasher, counted as they arrive.",
+	})
+	metricInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "stream_commp_requests_in_flight",
+		Help: "Requests being digested, out of --max-concurrent.",
+	})
+	metricQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "stream_commp_requests_queued",
+		Help: "Requests waiting for a slot, out of --max-queued.",
+	})
+	metricRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stream_commp_requests_total",
+		Help: "Requests digested, successfully or not.",
+	}, []string{"protocol"})
+	metricRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stream_commp_requests_rejected_total",
+		Help: "Requests turned away, finding neither a slot free nor room in the queue, or timing out in it.",
+	}, []string{"protocol"})
+	metricErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stream_commp_errors_total",
+		Help: "Requests failing, by the exit code the failure maps to.",
+	}, []string{"protocol", "code"})
+	metricDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "stream_commp_request_duration_seconds",
+		Help:    "Time taken to digest a request.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10), // up to about 45 minutes
+	}, []string{"protocol"})
+	metricThroughput = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "stream_commp_throughput_bytes_per_second",
+		Help:    "Rate at which the payload of a successful request was digested.",
+		Buckets: prometheus.ExponentialBuckets(1<<20, 2, 14), // 1MiB/s to 8GiB/s
+	}, []string{"protocol"})
+)
+
+// registerSessionsMetric exposes the amount of sessions kept in dir.
+func registerSessionsMetric(dir string) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "stream_commp_sessions",
+		Help: "Resumable upload sessions of --sessions-dir, neither finalized nor removed yet.",
+	}, func() float64 {
+		paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		return float64(len(paths))
+	})
+}
+
+// observeDigest records a request of protocol digesting size bytes since
+// start, and its failure, if any.
+func observeDigest(protocol string, start time.Time, size int64, err error) {
+	took := time.Since(start).Seconds()
+	metricRequests.WithLabelValues(protocol).Inc()
+	metricDuration.WithLabelValues(protocol).Observe(took)
+	if err != nil {
+		_, code, _ := digestFailure(err)
+		metricErrors.WithLabelValues(protocol, strconv.Itoa(code)).Inc()
+	} else if took > 0 {
+		metricThroughput.WithLabelValues(protocol).Observe(float64(size) / took)
+	}
+}
+
+// countHashed counts everything read from r into the bytes hashed.
+func countHashed(r io.Reader) io.Reader { return &hashedCounter{r} }
+
+type hashedCounter struct{ r io.Reader }
+
+func (hc *hashedCounter) Read(p []byte) (int, error) {
+	n, err := hc.r.Read(p)
+	metricBytesHashed.Add(float64(n))
+	return n, err
+}
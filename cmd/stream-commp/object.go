@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// isObjectURI tells whether an input path is an s3:// or gs:// URI instead.
+func isObjectURI(path string) bool {
+	return strings.HasPrefix(path, "s3://") || strings.HasPrefix(path, "gs://")
+}
+
+// digestObject digests the object storage object at uri.
+func digestObject(uri string, opts *config) (inputResult, error) {
+	input, err := openObject(uri, opts)
+	if err != nil {
+		return inputResult{}, err
+	}
+	defer input.Close()
+	return digestStream(input, opts)
+}
+
+// openObject starts the download of the object storage object at uri, up
+// to --http-connections ranges of it at a time. Credentials are taken from
+// the standard chain of the respective SDK: the environment, the shared
+// configuration files, and the metadata service of the instance.
+func openObject(uri string, opts *config) (io.ReadCloser, error) {
+	scheme, rest, _ := strings.Cut(uri, "://")
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" || key == "" {
+		return nil, withExitCode(exitInputError, fmt.Errorf("expected %s://BUCKET/KEY", scheme))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var size int64
+	var fetch rangeFetcher
+	var err error
+	if scheme == "s3" {
+		size, fetch, err = s3Object(ctx, bucket, key)
+	} else {
+		size, fetch, err = gcsObject(ctx, bucket, key)
+	}
+	if err != nil {
+		cancel()
+		return nil, withExitCode(exitInputError, err)
+	}
+
+	rr := newRangeReader(ctx, size, opts, fetch)
+	return &readCloser{rr, func() error {
+		cancel()
+		return nil
+	}}, nil
+}
+
+// The clients are set up once, on the first input needing them, and shared
+// by all inputs of a batch.
+var (
+	awsConfigOnce sync.Once
+	awsConfig     aws.Config
+	awsConfigErr  error
+
+	gcsClientOnce sync.Once
+	gcsClient     *storage.Client
+	gcsClientErr  error
+)
+
+// s3Object returns the size of an S3 object, and a fetcher of its ranges
+// failing should the object change.
+func s3Object(ctx context.Context, bucket, key string) (int64, rangeFetcher, error) {
+	awsConfigOnce.Do(func() {
+		awsConfig, awsConfigErr = awsconfig.LoadDefaultConfig(context.Background())
+	})
+	if awsConfigErr != nil {
+		return 0, nil, awsConfigErr
+	}
+	client := s3.NewFromConfig(awsConfig)
+	if awsConfig.Region == "" {
+		region, err := manager.GetBucketRegion(ctx, client, bucket, func(o *s3.Options) { o.Region = "us-east-1" })
+		if err != nil {
+			return 0, nil, fmt.Errorf("locating bucket %s: %w", bucket, err)
+		}
+		if region == "" {
+			return 0, nil, fmt.Errorf("the region of bucket %s is unknown: set AWS_REGION", bucket)
+		}
+		client = s3.NewFromConfig(awsConfig, func(o *s3.Options) { o.Region = region })
+	}
+
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return aws.ToInt64(head.ContentLength), func(ctx context.Context, offset, length int64) ([]byte, error) {
+		obj, err := client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(key),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+			IfMatch: head.ETag,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("range at offset %d: %w", offset, err)
+		}
+		defer obj.Body.Close()
+		return readFullRange(obj.Body, offset, length)
+	}, nil
+}
+
+// gcsObject returns the size of a GCS object, and a fetcher of the ranges of
+// its current generation.
+func gcsObject(ctx context.Context, bucket, key string) (int64, rangeFetcher, error) {
+	gcsClientOnce.Do(func() {
+		gcsClient, gcsClientErr = storage.NewClient(context.Background())
+	})
+	if gcsClientErr != nil {
+		return 0, nil, gcsClientErr
+	}
+	obj := gcsClient.Bucket(bucket).Object(key)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	obj = obj.Generation(attrs.Generation)
+
+	return attrs.Size, func(ctx context.Context, offset, length int64) ([]byte, error) {
+		r, err := obj.NewRangeReader(ctx, offset, length)
+		if err != nil {
+			return nil, fmt.Errorf("range at offset %d: %w", offset, err)
+		}
+		defer r.Close()
+		return readFullRange(r, offset, length)
+	}, nil
+}
+
+// readFullRange reads the length bytes of the range at offset from r.
+func readFullRange(r io.Reader, offset, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("range at offset %d: %w", offset, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	chunker "github.com/ipfs/boxo/chunker"
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	ft "github.com/ipfs/boxo/ipld/unixfs"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-multihash"
+)
+
+// The parameters of the UnixFS DAG a directory is packed into: any change to
+// them changes the root and piece CIDs of every packed directory.
+const packChunkSize = 1 << 20
+
+var packCidBuilder = cid.V1Builder{Codec: cid.DagProtobuf, MhType: multihash.SHA2_256}
+
+// packDir packs the directory at path into a UnixFS CARv1, and digests it.
+//
+// The root CID goes into the CARv1 header, ahead of the blocks, so the
+// directory is imported twice: once to find the root, then once more to
+// stream the CARv1 into the hasher, which keeps neither the blocks in memory
+// nor the CARv1 on disk, unless saved with --pack-out.
+func packDir(path string, opts *config) (inputResult, error) {
+	root, err := packUnixFS(path, &carSink{})
+	if err != nil {
+		return inputResult{}, withExitCode(exitInputError, fmt.Errorf("packing: %w", err))
+	}
+
+	var out *os.File
+	if opts.PackOut != "" {
+		if out, err = os.CreateTemp(opts.PackOut, ".pack-*.car"); err != nil {
+			return inputResult{}, err
+		}
+		defer func() {
+			if out != nil {
+				out.Close()
+				os.Remove(out.Name())
+			}
+		}()
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.Writer = pw
+		if out != nil {
+			w = io.MultiWriter(pw, out)
+		}
+		pw.CloseWithError(writePackedCAR(w, path, root))
+	}()
+	res, err := digestStream(pr, opts)
+	// unblock the writer when the digest bailed out early
+	pr.Close()
+	if err != nil {
+		return res, err
+	}
+	res.packed = true
+
+	if out != nil {
+		dst := filepath.Join(opts.PackOut, res.pieceCID.String()+".car")
+		if err := out.Sync(); err != nil {
+			return res, fmt.Errorf("saving packed CAR: %w", err)
+		}
+		if err := out.Close(); err != nil {
+			return res, fmt.Errorf("saving packed CAR: %w", err)
+		}
+		if err := os.Rename(out.Name(), dst); err != nil {
+			return res, fmt.Errorf("saving packed CAR: %w", err)
+		}
+		out = nil
+	}
+	return res, nil
+}
+
+// writePackedCAR writes the CARv1 of the directory at path to w, expecting
+// its root to still be root.
+func writePackedCAR(w io.Writer, path string, root cid.Cid) error {
+	hdr, err := cbor.DumpObject(&CarHeader{Roots: []cid.Cid{root}, Version: 1})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(hdr)))); err != nil {
+		return err
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+
+	again, err := packUnixFS(path, &carSink{w: w, seen: make(map[cid.Cid]struct{})})
+	if err != nil {
+		return fmt.Errorf("packing: %w", err)
+	}
+	if !again.Equals(root) {
+		return fmt.Errorf("the directory changed while being packed")
+	}
+	return nil
+}
+
+// packUnixFS imports the file or directory at path into ds, and returns the
+// CID of its root.
+func packUnixFS(path string, ds ipld.DAGService) (cid.Cid, error) {
+	nd, err := packNode(context.Background(), path, ds)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+func packNode(ctx context.Context, path string, ds ipld.DAGService) (ipld.Node, error) {
+	st, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case st.Mode().IsRegular():
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+		dbp := helpers.DagBuilderParams{
+			Maxlinks:   helpers.DefaultLinksPerBlock,
+			RawLeaves:  true,
+			CidBuilder: packCidBuilder,
+			Dagserv:    ds,
+		}
+		db, err := dbp.New(chunker.NewSizeSplitter(fh, packChunkSize))
+		if err != nil {
+			return nil, err
+		}
+		return balanced.Layout(db)
+
+	case st.IsDir():
+		// os.ReadDir() sorts the entries, keeping the DAG deterministic
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		dir := uio.NewDirectory(ds)
+		dir.SetCidBuilder(packCidBuilder)
+		for _, e := range entries {
+			child, err := packNode(ctx, filepath.Join(path, e.Name()), ds)
+			if err != nil {
+				return nil, err
+			}
+			if err := dir.AddChild(ctx, e.Name(), child); err != nil {
+				return nil, err
+			}
+		}
+		nd, err := dir.GetNode()
+		if err != nil {
+			return nil, err
+		}
+		return nd, ds.Add(ctx, nd)
+
+	case st.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ft.SymlinkData(target)
+		if err != nil {
+			return nil, err
+		}
+		nd := dag.NodeWithData(data)
+		if err := nd.SetCidBuilder(packCidBuilder); err != nil {
+			return nil, err
+		}
+		return nd, ds.Add(ctx, nd)
+
+	default:
+		return nil, fmt.Errorf("%s: unsupported file type %s", path, st.Mode().Type())
+	}
+}
+
+// carSink is an ipld.DAGService writing every block added to it once, as a
+// CARv1 block frame. Without a writer it merely discards them. Importing
+// never reads blocks back, so none are kept.
+type carSink struct {
+	w    io.Writer
+	seen map[cid.Cid]struct{}
+}
+
+var _ ipld.DAGService = (*carSink)(nil)
+
+func (cs *carSink) Add(_ context.Context, nd ipld.Node) error {
+	if cs.w == nil {
+		return nil
+	}
+	if _, dup := cs.seen[nd.Cid()]; dup {
+		return nil
+	}
+	cs.seen[nd.Cid()] = struct{}{}
+
+	c, data := nd.Cid().Bytes(), nd.RawData()
+	if _, err := cs.w.Write(binary.AppendUvarint(nil, uint64(len(c)+len(data)))); err != nil {
+		return err
+	}
+	if _, err := cs.w.Write(c); err != nil {
+		return err
+	}
+	_, err := cs.w.Write(data)
+	return err
+}
+
+func (cs *carSink) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		if err := cs.Add(ctx, nd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cs *carSink) Get(_ context.Context, c cid.Cid) (ipld.Node, error) {
+	return nil, ipld.ErrNotFound{Cid: c}
+}
+
+func (cs *carSink) GetMany(_ context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	ch := make(chan *ipld.NodeOption, len(cids))
+	for _, c := range cids {
+		ch <- &ipld.NodeOption{Err: ipld.ErrNotFound{Cid: c}}
+	}
+	close(ch)
+	return ch
+}
+
+func (cs *carSink) Remove(context.Context, cid.Cid) error { return nil }
+
+func (cs *carSink) RemoveMany(context.Context, []cid.Cid) error { return nil }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/pborman/getopt/v2"
+	"github.com/pborman/options"
+)
+
+type planConfig struct {
+	PieceSize uint64 `getopt:"--piece-size=BYTES  Padded size of the pieces to fill, a power of two; larger files get pieces of their own"`
+	FromFile  string `getopt:"--from-file=PATH    Also plan the files listed in this file, or - for stdin, one per line as SIZE PATH, such as du -ab prints"`
+	Help      bool   `getopt:"-h --help           Display help"`
+}
+
+// plannedFile is a file to pack into a piece.
+type plannedFile struct {
+	path string
+	size uint64
+}
+
+// planMain runs `stream-commp plan`, suggesting how to group files into
+// pieces with as little padding as possible, without reading any of them.
+func planMain(args []string) {
+	opts := &planConfig{
+		PieceSize: 32 << 30,
+	}
+	set := getopt.New()
+	set.SetProgram("stream-commp plan")
+	set.SetParameters("[FILE|DIR...]")
+	if err := options.RegisterSet("", opts, set); err != nil {
+		fatal(exitFailure, err)
+	}
+	if err := set.Getopt(args, nil); err != nil {
+		set.PrintUsage(os.Stderr)
+		usageError("%s", err)
+	}
+	if opts.Help {
+		set.PrintUsage(os.Stderr)
+		os.Exit(exitOK)
+	}
+	if err := commp.PaddedPieceSize(opts.PieceSize).Validate(); err != nil {
+		usageError("invalid piece size: %s", err)
+	}
+
+	var files []plannedFile
+	for _, path := range set.Args() {
+		found, err := statFiles(path)
+		if err != nil {
+			fatal(exitInputError, err)
+		}
+		files = append(files, found...)
+	}
+	if opts.FromFile != "" {
+		listed, err := readSizeList(opts.FromFile)
+		if err != nil {
+			fatal(exitInputError, fmt.Errorf("reading file list: %w", err))
+		}
+		files = append(files, listed...)
+	}
+	if len(files) == 0 {
+		usageError("no files to plan: give them as arguments or with --from-file")
+	}
+
+	sizes := make([]uint64, len(files))
+	for i, f := range files {
+		if f.size > commp.MaxPiecePayload {
+			fatal(exitTooLarge, fmt.Errorf("%s: %d bytes exceed the maximum piece payload of %d bytes", f.path, f.size, commp.MaxPiecePayload))
+		}
+		sizes[i] = f.size
+	}
+	pieces, err := commp.PlanPieces(sizes, []uint64{opts.PieceSize})
+	if err != nil {
+		fatal(exitCodeOf(err), err)
+	}
+	printPlan(os.Stdout, pieces, files)
+}
+
+// statFiles returns the size of the file at path, or of every regular file
+// below it should it be a directory.
+func statFiles(path string) ([]plannedFile, error) {
+	var files []plannedFile
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, plannedFile{path: p, size: uint64(info.Size())})
+		return nil
+	})
+	return files, err
+}
+
+// readSizeList reads the files listed one per line as SIZE PATH in the file
+// at path, or stdin for "-".
+func readSizeList(path string) ([]plannedFile, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+		r = fh
+	}
+
+	var files []plannedFile
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		l := strings.TrimSuffix(s.Text(), "\r")
+		if l == "" {
+			continue
+		}
+		size, name, ok := strings.Cut(strings.TrimLeft(l, " \t"), "\t")
+		if !ok {
+			size, name, ok = strings.Cut(size, " ")
+		}
+		n, err := strconv.ParseUint(size, 10, 64)
+		if !ok || err != nil || name == "" {
+			return nil, fmt.Errorf("line %d: expected SIZE PATH, got %q", line, l)
+		}
+		files = append(files, plannedFile{path: name, size: n})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// printPlan prints every piece along with its files, and the totals.
+func printPlan(w io.Writer, pieces []commp.PlannedPiece, files []plannedFile) {
+	var payload, padded uint64
+	for i, p := range pieces {
+		payload += p.PayloadSize
+		padded += p.PaddedPieceSize
+		note := ""
+		if p.Oversized {
+			note = fmt.Sprintf(", larger than --piece-size for %s", files[p.Payloads[0].Index].path)
+		}
+		fmt.Fprintf(w, "Piece %d: %d bytes padded, %d bytes of payload in %d files, %d bytes of padding (%.2f%%)%s\n",
+			i+1, p.PaddedPieceSize, p.PayloadSize, len(p.Payloads), p.PaddedPieceSize-p.PayloadSize, wastePercent(p.PayloadSize, p.PaddedPieceSize), note)
+		for _, pl := range p.Payloads {
+			fmt.Fprintf(w, "\t%d\t%s\n", pl.Size, files[pl.Index].path)
+		}
+	}
+	fmt.Fprintf(w, "Total: %d pieces, %d bytes padded, %d bytes of payload, %d bytes of padding (%.2f%%)\n",
+		len(pieces), padded, payload, padded-payload, wastePercent(payload, padded))
+}
+
+// wastePercent returns the share of padded taken by padding, fr32 included.
+func wastePercent(payload, padded uint64) float64 {
+	return float64(padded-payload) / float64(padded) * 100
+}
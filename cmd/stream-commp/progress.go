@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressEvent is a single line of the NDJSON event stream enabled by
+// --progress-fd. Optional fields are omitted when not applicable. A result
+// event is emitted for every input digested, its bytes being the total read
+// so far across all inputs, and an error event ends the stream on a fatal
+// error.
+type progressEvent struct {
+	Event      string  `json:"event"` // "progress", "result" or "error"
+	Bytes      int64   `json:"bytes"`
+	Elapsed    float64 `json:"elapsed_seconds"`
+	Throughput float64 `json:"bytes_per_second"`
+
+	// progress, when the size of the input is known
+	Total int64    `json:"total_bytes,omitempty"`
+	ETA   *float64 `json:"eta_seconds,omitempty"`
+
+	// result
+	Path              string `json:"path,omitempty"`
+	PayloadSize       int64  `json:"payload_bytes,omitempty"`
+	PieceCID          string `json:"piece_cid,omitempty"`
+	Digest            string `json:"digest,omitempty"` // as selected by --encoding
+	UnpaddedPieceSize uint64 `json:"unpadded_piece_size,omitempty"`
+	PaddedPieceSize   uint64 `json:"padded_piece_size,omitempty"`
+
+	// error
+	Error string `json:"error,omitempty"`
+}
+
+// progress is the reporter of the current run, if any.
+var progress *progressReporter
+
+// progressReporter counts the bytes read from the inputs it wraps, and
+// periodically reports them on the event stream. A nil *progressReporter, the
+// case without --progress-fd, ignores all calls.
+type progressReporter struct {
+	read  atomic.Int64
+	total int64
+	start time.Time
+
+	mu       sync.Mutex
+	enc      *json.Encoder
+	stop     chan struct{}
+	done     chan struct{}
+	finished sync.Once
+}
+
+func newProgressReporter(fd int, interval time.Duration, total int64) *progressReporter {
+	pr := &progressReporter{
+		total: total,
+		start: time.Now(),
+		enc:   json.NewEncoder(os.NewFile(uintptr(fd), "progress")),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(pr.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-pr.stop:
+				return
+			case <-t.C:
+				pr.emit(pr.progress())
+			}
+		}
+	}()
+
+	return pr
+}
+
+// wrap returns r, counting the bytes read from it.
+func (pr *progressReporter) wrap(r io.Reader) io.Reader {
+	if pr == nil {
+		return r
+	}
+	return &countingReader{r, &pr.read}
+}
+
+type countingReader struct {
+	io.Reader
+	read *atomic.Int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.read.Add(int64(n))
+	return n, err
+}
+
+func (pr *progressReporter) progress() progressEvent {
+	ev := pr.event("progress")
+	if pr.total > 0 {
+		ev.Total = pr.total
+		if ev.Throughput > 0 && ev.Bytes <= pr.total {
+			eta := float64(pr.total-ev.Bytes) / ev.Throughput
+			ev.ETA = &eta
+		}
+	}
+	return ev
+}
+
+func (pr *progressReporter) event(kind string) progressEvent {
+	ev := progressEvent{
+		Event:   kind,
+		Bytes:   pr.read.Load(),
+		Elapsed: time.Since(pr.start).Seconds(),
+	}
+	if ev.Elapsed > 0 {
+		ev.Throughput = float64(ev.Bytes) / ev.Elapsed
+	}
+	return ev
+}
+
+func (pr *progressReporter) emit(ev progressEvent) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	// a consumer going away must not fail the run
+	_ = pr.enc.Encode(ev)
+}
+
+// close stops the periodic reports, and emits the final event if any. Only
+// the first call has any effect.
+func (pr *progressReporter) close(final ...progressEvent) {
+	if pr == nil {
+		return
+	}
+	pr.finished.Do(func() {
+		close(pr.stop)
+		<-pr.done
+		for _, ev := range final {
+			pr.emit(ev)
+		}
+	})
+}
+
+// result reports the outcome of digesting an input: its path is left empty
+// when reading from stdin.
+func (pr *progressReporter) result(path string, res inputResult) {
+	if pr == nil {
+		return
+	}
+	ev := pr.event("result")
+	ev.Path = path
+	ev.PayloadSize = res.payloadSize
+	ev.PieceCID = res.pieceCID.String()
+	if digestEncoder != nil {
+		ev.Digest = digestEncoder(res.pieceCID)
+	}
+	ev.PaddedPieceSize = res.paddedSize
+	ev.UnpaddedPieceSize = res.paddedSize / 128 * 127
+	pr.emit(ev)
+}
+
+func (pr *progressReporter) fail(err string) {
+	if pr == nil {
+		return
+	}
+	ev := pr.event("error")
+	ev.Error = err
+	pr.close(ev)
+}
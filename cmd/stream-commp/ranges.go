@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// rangeRetries is the amount of times the download of a range is retried.
+const rangeRetries = 3
+
+// rangeFetcher downloads length bytes of a remote object at offset.
+type rangeFetcher func(ctx context.Context, offset, length int64) ([]byte, error)
+
+// rangeChunk is the outcome of downloading a single range.
+type rangeChunk struct {
+	data []byte
+	err  error
+}
+
+// rangeReader reads a remote object of a known size, downloading up to
+// --http-connections consecutive ranges of it ahead of the reader at any
+// time.
+type rangeReader struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	fetch     rangeFetcher
+	size      int64
+	chunkSize int64
+
+	next    int64 // offset of the next range to download
+	pending []chan rangeChunk
+	cur     []byte
+	err     error
+}
+
+func newRangeReader(ctx context.Context, size int64, opts *config, fetch rangeFetcher) *rangeReader {
+	ctx, cancel := context.WithCancel(ctx)
+	rr := &rangeReader{
+		ctx:       ctx,
+		cancel:    cancel,
+		fetch:     fetch,
+		size:      size,
+		chunkSize: opts.HTTPChunkSize,
+	}
+	for len(rr.pending) < opts.HTTPConnections && rr.next < rr.size {
+		rr.schedule()
+	}
+	return rr
+}
+
+func (rr *rangeReader) Read(p []byte) (int, error) {
+	for len(rr.cur) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		if len(rr.pending) == 0 {
+			return 0, io.EOF
+		}
+		c := <-rr.pending[0]
+		rr.pending = rr.pending[1:]
+		if c.err != nil {
+			rr.err = c.err
+			rr.cancel()
+			return 0, rr.err
+		}
+		rr.cur = c.data
+		if rr.next < rr.size {
+			rr.schedule()
+		}
+	}
+
+	n := copy(p, rr.cur)
+	rr.cur = rr.cur[n:]
+	return n, nil
+}
+
+// Close abandons all downloads in flight.
+func (rr *rangeReader) Close() error {
+	rr.cancel()
+	return nil
+}
+
+// schedule starts the download of the next range.
+func (rr *rangeReader) schedule() {
+	offset := rr.next
+	length := min(rr.chunkSize, rr.size-offset)
+	rr.next += length
+
+	ch := make(chan rangeChunk, 1)
+	go func() {
+		var c rangeChunk
+		for attempt := 0; attempt <= rangeRetries; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-rr.ctx.Done():
+					ch <- rangeChunk{err: rr.ctx.Err()}
+					return
+				case <-time.After(time.Duration(attempt) * time.Second):
+				}
+			}
+			c.data, c.err = rr.fetch(rr.ctx, offset, length)
+			if c.err == nil || rr.ctx.Err() != nil {
+				break
+			}
+		}
+		ch <- c
+	}()
+	rr.pending = append(rr.pending, ch)
+}
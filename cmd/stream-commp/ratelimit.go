@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// limiter paces the reading of all inputs together, as set by --rate-limit.
+var limiter *rate.Limiter
+
+// setRateLimit has the inputs read at no more than bytesPerSec, allowing for
+// bursts of at most 1MiB.
+func setRateLimit(bytesPerSec int64) {
+	burst := 1 << 20
+	if bytesPerSec < int64(burst) {
+		burst = int(bytesPerSec)
+	}
+	limiter = rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// throttle returns r, read no faster than --rate-limit, when set.
+func throttle(r io.Reader) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &throttledReader{r}
+}
+
+type throttledReader struct{ r io.Reader }
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	// a read is paid for once done, so may be no larger than a burst
+	if len(p) > limiter.Burst() {
+		p = p[:limiter.Burst()]
+	}
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if werr := limiter.WaitN(context.Background(), n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
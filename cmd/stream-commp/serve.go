@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/pborman/getopt/v2"
+	"github.com/pborman/options"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+)
+
+type serveConfig struct {
+	Listen            string        `getopt:"--listen=ADDR            Address to listen on for requests, empty to serve only gRPC or file descriptors"`
+	GRPCListen        string        `getopt:"--grpc-listen=ADDR       Address to serve the gRPC CommP service of commppb/commp.proto on, if any"`
+	FDListen          string        `getopt:"--fd-listen=PATH         Unix socket to receive the file descriptors of files to digest on (Linux only), if any"`
+	MaxBodySize       int64         `getopt:"--max-body-size=BYTES    Largest request body or file digested, larger ones are rejected with 413"`
+	MaxConcurrent     int           `getopt:"--max-concurrent=N       Amount of requests digested at the same time, more are turned away with 503 unless queued"`
+	MaxQueued         int           `getopt:"--max-queued=N           Amount of requests waiting for one of the --max-concurrent slots to free up, more are turned away with 429"`
+	QueueTimeout      time.Duration `getopt:"--queue-timeout=DUR      Longest a queued request waits for a slot, before being turned away with 503"`
+	DisableStreamScan bool          `getopt:"-d --disable-stream-scan If set do not try to scan request bodies for a potential .car stream"`
+	Workers           int           `getopt:"--workers=N              Amount of layer workers hashing at the same time, across all requests; 0 for one per CPU of each request"`
+	MetricsListen     string        `getopt:"--metrics-listen=ADDR    Address to serve the Prometheus metrics of /metrics on, besides --listen"`
+	SessionsDir       string        `getopt:"--sessions-dir=DIR       Directory to keep resumable upload sessions in, enabling them under /sessions"`
+	SessionMaxPending int64         `getopt:"--session-max-pending=BYTES Most bytes a session may hold in ranges received ahead of its offset, more are rejected with 413"`
+	SessionTimeout    time.Duration `getopt:"--session-timeout=DUR    Time after which a session not uploaded to is discarded; 0 to keep sessions until finalized or removed"`
+	BufferSize        int           `getopt:"--buffer-size=BYTES      Memory every request may hold in flight within the hasher; 0 for the default of about 1MiB"`
+	IoUring           bool          `getopt:"--io-uring               Read the files of --fd-listen via io_uring, falling back to regular reads when unavailable"`
+	DirectIO          bool          `getopt:"--direct-io              Read the files of --fd-listen with O_DIRECT, bypassing the page cache, falling back to regular reads when unavailable"`
+	Quiet             bool          `getopt:"-q --quiet               Do not log informational messages, such as notes on CAR streams"`
+	Help              bool          `getopt:"-h --help                Display help"`
+}
+
+// serveResult is the JSON response to a digested request body, its fields
+// named like those of the result events of --progress-fd.
+type serveResult struct {
+	PieceCID          string   `json:"piece_cid"`
+	PayloadSize       int64    `json:"payload_bytes"`
+	UnpaddedPieceSize uint64   `json:"unpadded_piece_size"`
+	PaddedPieceSize   uint64   `json:"padded_piece_size"`
+	CarRoots          []string `json:"car_roots,omitempty"`
+	CarInfo           string   `json:"car_info,omitempty"`
+}
+
+// serveError is the JSON response to a request failing, with the exit code
+// the failure would map to on the command line.
+type serveError struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// serveMain runs `stream-commp serve`, digesting the payloads of requests over
+// HTTP, gRPC and a unix socket.
+func serveMain(args []string) {
+	opts := &serveConfig{
+		Listen:        "127.0.0.1:8000",
+		MaxBodySize:   int64(commp.MaxPiecePayload),
+		MaxConcurrent: runtime.GOMAXPROCS(0),
+		QueueTimeout:  time.Minute,
+
+		SessionMaxPending: 4 << 30,
+		SessionTimeout:    24 * time.Hour,
+	}
+	set := getopt.New()
+	set.SetProgram("stream-commp serve")
+	set.SetParameters("")
+	if err := options.RegisterSet("", opts, set); err != nil {
+		fatal(exitFailure, err)
+	}
+	if err := set.Getopt(args, nil); err != nil {
+		set.PrintUsage(os.Stderr)
+		usageError("%s", err)
+	}
+	if opts.Help {
+		set.PrintUsage(os.Stderr)
+		os.Exit(exitOK)
+	}
+	if set.NArgs() > 0 {
+		usageError("unexpected arguments: %q", set.Args())
+	}
+
+	if opts.MaxBodySize < 1 {
+		usageError("invalid maximum body size %d", opts.MaxBodySize)
+	}
+	if opts.MaxConcurrent < 1 {
+		usageError("invalid amount of concurrent requests %d", opts.MaxConcurrent)
+	}
+	if opts.MaxQueued < 0 {
+		usageError("invalid amount of queued requests %d", opts.MaxQueued)
+	}
+	if opts.QueueTimeout <= 0 {
+		usageError("invalid queue timeout %s", opts.QueueTimeout)
+	}
+	if opts.SessionMaxPending < 0 {
+		usageError("invalid maximum of pending session bytes %d", opts.SessionMaxPending)
+	}
+	if opts.SessionTimeout < 0 {
+		usageError("invalid session timeout %s", opts.SessionTimeout)
+	}
+	if opts.Workers < 0 {
+		usageError("invalid amount of workers %d", opts.Workers)
+	} else if opts.Workers > 0 {
+		calcOptions = append(calcOptions, commp.WithScheduler(commp.NewScheduler(opts.Workers)))
+	}
+	if opts.BufferSize < 0 {
+		usageError("invalid buffer size %d", opts.BufferSize)
+	} else if opts.BufferSize > 0 {
+		calcOptions = append(calcOptions, commp.WithMaxMemory(opts.BufferSize))
+	}
+	if opts.DirectIO && opts.IoUring {
+		usageError("--direct-io and --io-uring are mutually exclusive")
+	}
+	quiet = opts.Quiet
+
+	act, err := socketActivation()
+	if err != nil {
+		fatal(exitFailure, err)
+	}
+	if len(act) > 0 && !set.IsSet("listen") {
+		// the sockets passed by systemd take the place of the default
+		opts.Listen = ""
+	}
+	if !act.wants("http", opts.Listen) && !act.wants("grpc", opts.GRPCListen) && !act.wants("fd", opts.FDListen) {
+		usageError("nothing to listen on without --listen, --grpc-listen or --fd-listen")
+	}
+	if opts.SessionsDir != "" && !act.wants("http", opts.Listen) {
+		usageError("--sessions-dir requires --listen")
+	}
+
+	// all protocols share the slots of the one server
+	s := newServer(opts)
+	if opts.SessionsDir != "" {
+		if s.sessions, err = newSessions(s, opts); err != nil {
+			fatal(exitFailure, err)
+		}
+		registerSessionsMetric(opts.SessionsDir)
+	}
+	var (
+		srv  *http.Server
+		msrv *http.Server
+		gsrv *grpc.Server
+		fsrv *fdServer
+		errs = make(chan error, 4) // of the servers running
+	)
+	if act.wants("http", opts.Listen) {
+		ln, err := act.listen("http", "tcp", opts.Listen)
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		srv = &http.Server{
+			Handler:           s,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		infof("Listening on http://%s", ln.Addr())
+		go func() {
+			if err := srv.Serve(ln); err != http.ErrServerClosed {
+				errs <- err
+				return
+			}
+			errs <- nil
+		}()
+	}
+	if act.wants("metrics", opts.MetricsListen) {
+		ln, err := act.listen("metrics", "tcp", opts.MetricsListen)
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		msrv = &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		infof("Serving metrics on http://%s/metrics", ln.Addr())
+		go func() {
+			if err := msrv.Serve(ln); err != http.ErrServerClosed {
+				errs <- err
+				return
+			}
+			errs <- nil
+		}()
+	}
+	if act.wants("grpc", opts.GRPCListen) {
+		ln, err := act.listen("grpc", "tcp", opts.GRPCListen)
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		gsrv = newGRPCServer(s)
+		infof("Serving gRPC on %s", ln.Addr())
+		go func() { errs <- gsrv.Serve(ln) }()
+	}
+	if act.wants("fd", opts.FDListen) {
+		ln, err := act.listen("fd", "unix", opts.FDListen)
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		if fsrv, err = newFDServer(s, ln); err != nil {
+			fatal(exitFailure, err)
+		}
+		infof("Receiving file descriptors on %s", ln.Addr())
+		go func() { errs <- fsrv.serve() }()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// a second signal ends the process right away
+		stop()
+		infof("Shutting down, waiting for the requests in flight")
+		if srv != nil {
+			srv.Shutdown(context.Background())
+		}
+		if msrv != nil {
+			msrv.Shutdown(context.Background())
+		}
+		if gsrv != nil {
+			gsrv.GracefulStop()
+		}
+		if fsrv != nil {
+			fsrv.shutdown()
+		}
+	}()
+
+	// either server failing ends the process, the other one included
+	running := 0
+	if srv != nil {
+		running++
+	}
+	if msrv != nil {
+		running++
+	}
+	if gsrv != nil {
+		running++
+	}
+	if fsrv != nil {
+		running++
+	}
+	for ; running > 0; running-- {
+		if err := <-errs; err != nil {
+			fatal(exitFailure, err)
+		}
+	}
+}
+
+// server digests the bodies of the POST requests it is handed, up to
+// --max-concurrent of them at a time, with up to --max-queued more waiting
+// their turn.
+type server struct {
+	maxBody      int64
+	slots        chan struct{}
+	queue        chan struct{}
+	queueTimeout time.Duration
+	opts         *config // those of digestReader
+	// the resumable uploads of --sessions-dir, if enabled
+	sessions *sessions
+}
+
+func newServer(opts *serveConfig) *server {
+	return &server{
+		maxBody:      opts.MaxBodySize,
+		slots:        make(chan struct{}, opts.MaxConcurrent),
+		queue:        make(chan struct{}, opts.MaxQueued),
+		queueTimeout: opts.QueueTimeout,
+		opts: &config{
+			DisableStreamScan: opts.DisableStreamScan,
+			IoUring:           opts.IoUring,
+			IoUringDepth:      8,
+			DirectIO:          opts.DirectIO,
+		},
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/metrics" {
+		promhttp.Handler().ServeHTTP(w, r)
+		return
+	}
+	if s.sessions != nil && (r.URL.Path == "/sessions" || strings.HasPrefix(r.URL.Path, "/sessions/")) {
+		s.sessions.mux.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeServeError(w, http.StatusMethodNotAllowed, exitUsage, errors.New("only POST requests are digested"))
+		return
+	}
+
+	if err := s.acquire(r.Context(), "http"); err != nil {
+		writeBusy(w, err)
+		return
+	}
+	defer s.release()
+
+	start := time.Now()
+	res, err := digestReader(countHashed(http.MaxBytesReader(w, r.Body, s.maxBody)), BufSize, s.opts)
+	observeDigest("http", start, res.payloadSize, err)
+	if err != nil {
+		status, code, err := digestFailure(err)
+		writeServeError(w, status, code, err)
+		return
+	}
+
+	writeServeJSON(w, http.StatusOK, newServeResult(res))
+}
+
+func newServeResult(res inputResult) serveResult {
+	sr := serveResult{
+		PieceCID:          res.pieceCID.String(),
+		PayloadSize:       res.payloadSize,
+		UnpaddedPieceSize: res.paddedSize / 128 * 127,
+		PaddedPieceSize:   res.paddedSize,
+		CarInfo:           res.carInfo,
+	}
+	for _, root := range res.carRoots {
+		sr.CarRoots = append(sr.CarRoots, root.String())
+	}
+	return sr
+}
+
+// busyError turns a request away for want of a free slot.
+type busyError struct {
+	status int // that of HTTP to answer with
+	msg    string
+}
+
+func (e *busyError) Error() string { return e.msg }
+
+// acquire takes one of the --max-concurrent slots for a request of protocol,
+// waiting in the queue for one to free up should none be, unless the queue is
+// full as well. The error returned otherwise is to be answered with.
+func (s *server) acquire(ctx context.Context, protocol string) error {
+	select {
+	case s.slots <- struct{}{}:
+		metricInFlight.Inc()
+		return nil
+	default:
+	}
+
+	select {
+	case s.queue <- struct{}{}:
+	default:
+		metricRejected.WithLabelValues(protocol).Inc()
+		if cap(s.queue) == 0 {
+			return &busyError{http.StatusServiceUnavailable, fmt.Sprintf("already digesting the maximum of %d requests", cap(s.slots))}
+		}
+		return &busyError{http.StatusTooManyRequests, fmt.Sprintf("already digesting the maximum of %d requests, with %d more queued", cap(s.slots), cap(s.queue))}
+	}
+	metricQueued.Inc()
+	defer func() {
+		<-s.queue
+		metricQueued.Dec()
+	}()
+
+	timer := time.NewTimer(s.queueTimeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		metricInFlight.Inc()
+		return nil
+	case <-timer.C:
+		metricRejected.WithLabelValues(protocol).Inc()
+		return &busyError{http.StatusServiceUnavailable, fmt.Sprintf("no slot freed up within %s", s.queueTimeout)}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *server) release() {
+	<-s.slots
+	metricInFlight.Dec()
+}
+
+// writeBusy answers a request turned away by acquire.
+func writeBusy(w http.ResponseWriter, err error) {
+	status := http.StatusServiceUnavailable
+	var be *busyError
+	if errors.As(err, &be) {
+		status = be.status
+	}
+	w.Header().Set("Retry-After", "1")
+	writeServeError(w, status, exitFailure, err)
+}
+
+// digestFailure maps an error of digesting a request body to the HTTP status
+// and exit code to answer with, and the error to describe.
+func digestFailure(err error) (int, int, error) {
+	var mbe *http.MaxBytesError
+	switch {
+	case errors.As(err, &mbe):
+		return http.StatusRequestEntityTooLarge, exitTooLarge, fmt.Errorf("the body exceeds the maximum of %d bytes", mbe.Limit)
+	case errors.Is(err, commp.ErrPayloadTooLarge):
+		return http.StatusRequestEntityTooLarge, exitTooLarge, err
+	case errors.Is(err, commp.ErrBelowMinimumPayload):
+		return http.StatusBadRequest, exitTooSmall, err
+	case exitCodeOf(err) == exitInputError:
+		return http.StatusBadRequest, exitInputError, err
+	default:
+		return http.StatusInternalServerError, exitCodeOf(err), err
+	}
+}
+
+func writeServeError(w http.ResponseWriter, status, code int, err error) {
+	writeServeJSON(w, status, serveError{Error: err.Error(), Code: code})
+}
+
+func writeServeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
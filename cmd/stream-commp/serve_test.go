@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+)
+
+// newTestServer returns an httptest.Server in front of a server configured
+// by opts, with the defaults of `stream-commp serve` for what opts leaves out.
+func newTestServer(t *testing.T, opts serveConfig) (*server, *httptest.Server) {
+	t.Helper()
+	if opts.MaxBodySize == 0 {
+		opts.MaxBodySize = 1 << 30
+	}
+	if opts.MaxConcurrent == 0 {
+		opts.MaxConcurrent = 4
+	}
+	if opts.QueueTimeout == 0 {
+		opts.QueueTimeout = time.Minute
+	}
+	s := newServer(&opts)
+	if opts.SessionsDir != "" {
+		var err error
+		if s.sessions, err = newSessions(s, &opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// postPayload posts body to url, returning the status and the decoded JSON
+// response, a serveResult or a serveError.
+func postPayload(t *testing.T, url string, body []byte) (int, serveResult, serveError) {
+	t.Helper()
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var res serveResult
+	var serr serveError
+	dec := json.NewDecoder(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		err = dec.Decode(&res)
+	} else {
+		err = dec.Decode(&serr)
+	}
+	if err != nil {
+		t.Fatalf("decoding the response of status %d: %s", resp.StatusCode, err)
+	}
+	return resp.StatusCode, res, serr
+}
+
+// request sends a request of method to url with body, if any, decoding the
+// JSON response into v, if any, and returning its status.
+func request(t *testing.T, method, url string, body []byte, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("decoding the response of status %d: %s", resp.StatusCode, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestServeOversizedCARHeader(t *testing.T) {
+	_, ts := newTestServer(t, serveConfig{})
+
+	// a header length of 64TiB, which must not be allocated for
+	body := binary.AppendUvarint(nil, 1<<46)
+	body = append(body, make([]byte, 210-len(body))...)
+
+	status, res, serr := postPayload(t, ts.URL, body)
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, serr.Error)
+	}
+	if res.PayloadSize != 210 || res.CarInfo != "" {
+		t.Fatalf("digested %d bytes noted as %q, expected 210 bytes of no CAR", res.PayloadSize, res.CarInfo)
+	}
+}
+
+// pieceCIDOf returns the piece CID of payload as digested by the library.
+func pieceCIDOf(t *testing.T, payload []byte) string {
+	t.Helper()
+	cp := commp.New()
+	cp.Write(payload)
+	pi, err := cp.DigestPiece()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pi.CIDString()
+}
+
+// testPayload returns size bytes of random data, as no CAR stream.
+func testPayload(size int) []byte {
+	payload := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(payload)
+	return payload
+}
+
+func TestServeDigest(t *testing.T) {
+	_, ts := newTestServer(t, serveConfig{})
+
+	payload := testPayload(300001)
+	status, res, serr := postPayload(t, ts.URL, payload)
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, serr.Error)
+	}
+	if exp := pieceCIDOf(t, payload); res.PieceCID != exp || res.PayloadSize != 300001 || res.PaddedPieceSize != 512<<10 || res.UnpaddedPieceSize != 512<<10/128*127 {
+		t.Fatalf("unexpected result %+v, expected piece %s", res, exp)
+	}
+
+	if status := request(t, http.MethodGet, ts.URL, nil, nil); status != http.StatusMethodNotAllowed {
+		t.Fatalf("GET: status %d, expected %d", status, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestServeBusy(t *testing.T) {
+	payload := testPayload(1000)
+
+	// without a queue, a request finding no free slot is turned away outright
+	s, ts := newTestServer(t, serveConfig{MaxConcurrent: 1})
+	s.slots <- struct{}{}
+	if status, _, serr := postPayload(t, ts.URL, payload); status != http.StatusServiceUnavailable {
+		t.Fatalf("no slot free: status %d (%s), expected %d", status, serr.Error, http.StatusServiceUnavailable)
+	}
+	<-s.slots
+	if status, _, serr := postPayload(t, ts.URL, payload); status != http.StatusOK {
+		t.Fatalf("slot freed: status %d: %s", status, serr.Error)
+	}
+
+	// with one, after waiting for --queue-timeout, or right away when full
+	s, ts = newTestServer(t, serveConfig{MaxConcurrent: 1, MaxQueued: 1, QueueTimeout: 50 * time.Millisecond})
+	s.slots <- struct{}{}
+	began := time.Now()
+	if status, _, serr := postPayload(t, ts.URL, payload); status != http.StatusServiceUnavailable {
+		t.Fatalf("queue timed out: status %d (%s), expected %d", status, serr.Error, http.StatusServiceUnavailable)
+	} else if took := time.Since(began); took < 50*time.Millisecond {
+		t.Fatalf("turned away after %s, before the queue timeout", took)
+	}
+	s.queue <- struct{}{}
+	if status, _, serr := postPayload(t, ts.URL, payload); status != http.StatusTooManyRequests {
+		t.Fatalf("queue full: status %d (%s), expected %d", status, serr.Error, http.StatusTooManyRequests)
+	}
+	<-s.queue
+
+	// a queued request proceeds once the slot frees up
+	done := make(chan int)
+	go func() {
+		resp, err := http.Post(ts.URL, "application/octet-stream", bytes.NewReader(payload))
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	time.Sleep(10 * time.Millisecond)
+	<-s.slots
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("queued request: status %d", status)
+	}
+}
+
+func TestServeMaxBodySize(t *testing.T) {
+	_, ts := newTestServer(t, serveConfig{MaxBodySize: 1000})
+
+	if status, _, serr := postPayload(t, ts.URL, testPayload(1000)); status != http.StatusOK {
+		t.Fatalf("body at the maximum: status %d: %s", status, serr.Error)
+	}
+	status, _, serr := postPayload(t, ts.URL, testPayload(1001))
+	if status != http.StatusRequestEntityTooLarge || serr.Code != exitTooLarge {
+		t.Fatalf("body over the maximum: status %d with code %d (%s), expected %d with %d", status, serr.Code, serr.Error, http.StatusRequestEntityTooLarge, exitTooLarge)
+	}
+}
+
+func TestServeTooSmallReleasesCalc(t *testing.T) {
+	_, ts := newTestServer(t, serveConfig{})
+
+	goroutines := func() int {
+		http.DefaultClient.CloseIdleConnections()
+		ts.CloseClientConnections()
+		time.Sleep(50 * time.Millisecond)
+		return runtime.NumGoroutine()
+	}
+	before := goroutines()
+	for i := 0; i < 50; i++ {
+		status, _, serr := postPayload(t, ts.URL, testPayload(10))
+		if status != http.StatusBadRequest || serr.Code != exitTooSmall {
+			t.Fatalf("body below the minimum: status %d with code %d (%s), expected %d with %d", status, serr.Code, serr.Error, http.StatusBadRequest, exitTooSmall)
+		}
+	}
+	// allow for some unrelated goroutines coming and going
+	if after := goroutines(); after > before+5 {
+		t.Fatalf("%d goroutines after 50 payloads below the minimum, %d before", after, before)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	_, ts := newTestServer(t, serveConfig{})
+	if status, _, serr := postPayload(t, ts.URL, testPayload(1000)); status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, serr.Error)
+	}
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	for _, exp := range []string{
+		"stream_commp_bytes_hashed_total ",
+		"stream_commp_requests_in_flight 0",
+		`stream_commp_requests_total{protocol="http"} `,
+		`stream_commp_request_duration_seconds_count{protocol="http"} `,
+	} {
+		if !strings.Contains(string(body), exp) {
+			t.Fatalf("no %q in the metrics scraped:\n%s", exp, body)
+		}
+	}
+}
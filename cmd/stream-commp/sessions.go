@@ -0,0 +1,477 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+)
+
+// session is the persisted state of a resumable upload of --sessions-dir,
+// kept in ID.json. Ranges received ahead of the offset are kept next to it
+// in ID.OFFSET.part files, until the data before them arrives.
+type session struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Offset  int64     `json:"offset"` // the amount of bytes digested so far
+	State   []byte    `json:"state"`  // the serialized commp.Calc
+}
+
+// sessionStatus is the JSON response describing the progress of a session.
+type sessionStatus struct {
+	ID      string         `json:"id"`
+	Offset  int64          `json:"offset"`
+	Pending []sessionRange `json:"pending,omitempty"`
+}
+
+// sessionRange is a range received ahead of the offset of its session.
+type sessionRange struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// errTooMuchPending is returned for a range which would take the ranges put
+// aside for its session beyond --session-max-pending.
+var errTooMuchPending = errors.New("too much data pending ahead of the offset of the session")
+
+// sessions serves the resumable uploads of --sessions-dir. All of their state
+// lives in the directory, so that they survive a restart of the server.
+type sessions struct {
+	s          *server
+	dir        string
+	maxPending int64         // bytes put aside per session
+	timeout    time.Duration // of idle sessions, 0 for none
+	mux        *http.ServeMux
+	mu         sync.Mutex
+	locks      map[string]*sync.Mutex // of the sessions, held by the request at hand
+}
+
+func newSessions(s *server, opts *serveConfig) (*sessions, error) {
+	dir := opts.SessionsDir
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	ss := &sessions{
+		s:          s,
+		dir:        dir,
+		maxPending: opts.SessionMaxPending,
+		timeout:    opts.SessionTimeout,
+		mux:        http.NewServeMux(),
+		locks:      make(map[string]*sync.Mutex),
+	}
+	ss.mux.HandleFunc("POST /sessions", ss.create)
+	ss.mux.HandleFunc("GET /sessions/{id}", ss.withSession(ss.status))
+	ss.mux.HandleFunc("PUT /sessions/{id}", ss.withSession(ss.upload))
+	ss.mux.HandleFunc("POST /sessions/{id}/finalize", ss.withSession(ss.finalize))
+	ss.mux.HandleFunc("DELETE /sessions/{id}", ss.withSession(ss.remove))
+	if ss.timeout > 0 {
+		go ss.reap()
+	}
+	return ss, nil
+}
+
+func (ss *sessions) path(id string) string { return filepath.Join(ss.dir, id+".json") }
+
+func (ss *sessions) partPath(id string, offset int64) string {
+	return filepath.Join(ss.dir, fmt.Sprintf("%s.%d.part", id, offset))
+}
+
+func (ss *sessions) create(w http.ResponseWriter, r *http.Request) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		writeServeError(w, http.StatusInternalServerError, exitFailure, err)
+		return
+	}
+	sess := &session{ID: hex.EncodeToString(id), Created: time.Now().UTC()}
+	if err := ss.save(sess, newCalc()); err != nil {
+		writeServeError(w, http.StatusInternalServerError, exitFailure, err)
+		return
+	}
+	w.Header().Set("Location", "/sessions/"+sess.ID)
+	writeServeJSON(w, http.StatusCreated, sessionStatus{ID: sess.ID})
+}
+
+// withSession loads the session of the request for handler, turning away
+// concurrent requests of the same session.
+func (ss *sessions) withSession(handler func(http.ResponseWriter, *http.Request, *session)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+			writeServeError(w, http.StatusNotFound, exitUsage, fmt.Errorf("no session %q", id))
+			return
+		}
+
+		ss.mu.Lock()
+		lock := ss.locks[id]
+		if lock == nil {
+			lock = new(sync.Mutex)
+			ss.locks[id] = lock
+		}
+		ss.mu.Unlock()
+		if !lock.TryLock() {
+			writeServeError(w, http.StatusConflict, exitFailure, fmt.Errorf("session %s is busy with another request", id))
+			return
+		}
+		defer func() {
+			ss.mu.Lock()
+			// the lock goes with the session, once finalized or removed
+			if _, err := os.Stat(ss.path(id)); os.IsNotExist(err) {
+				delete(ss.locks, id)
+			}
+			lock.Unlock()
+			ss.mu.Unlock()
+		}()
+
+		b, err := os.ReadFile(ss.path(id))
+		if os.IsNotExist(err) {
+			writeServeError(w, http.StatusNotFound, exitUsage, fmt.Errorf("no session %q", id))
+			return
+		} else if err != nil {
+			writeServeError(w, http.StatusInternalServerError, exitFailure, err)
+			return
+		}
+		sess := new(session)
+		if err := json.Unmarshal(b, sess); err != nil {
+			writeServeError(w, http.StatusInternalServerError, exitFailure, fmt.Errorf("parsing session %s: %w", id, err))
+			return
+		}
+		handler(w, r, sess)
+	}
+}
+
+func (ss *sessions) status(w http.ResponseWriter, r *http.Request, sess *session) {
+	st, err := ss.statusOf(sess)
+	if err != nil {
+		writeServeError(w, http.StatusInternalServerError, exitFailure, err)
+		return
+	}
+	writeServeJSON(w, http.StatusOK, st)
+}
+
+func (ss *sessions) statusOf(sess *session) (sessionStatus, error) {
+	parts, err := ss.parts(sess.ID)
+	return sessionStatus{ID: sess.ID, Offset: sess.Offset, Pending: parts}, err
+}
+
+// upload receives the range of the body starting at ?offset=N. A range at or
+// before the offset of the session is digested right away, the part of it
+// already digested being skipped, while one ahead of it is put aside until the
+// data before it arrives.
+func (ss *sessions) upload(w http.ResponseWriter, r *http.Request, sess *session) {
+	start, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || start < 0 {
+		writeServeError(w, http.StatusBadRequest, exitUsage, fmt.Errorf("invalid offset %q", r.URL.Query().Get("offset")))
+		return
+	}
+	if start >= ss.s.maxBody {
+		writeServeError(w, http.StatusRequestEntityTooLarge, exitTooLarge, fmt.Errorf("offset %d is beyond the maximum of %d bytes", start, ss.s.maxBody))
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, ss.s.maxBody-start)
+
+	if err := ss.s.acquire(r.Context(), "session"); err != nil {
+		writeBusy(w, err)
+		return
+	}
+	defer ss.s.release()
+
+	if start > sess.Offset {
+		err := ss.putAside(sess.ID, start, body)
+		if errors.Is(err, errTooMuchPending) {
+			writeServeError(w, http.StatusRequestEntityTooLarge, exitTooLarge, err)
+			return
+		} else if err != nil {
+			status, code, err := digestFailure(err)
+			writeServeError(w, status, code, err)
+			return
+		}
+		ss.status(w, r, sess)
+		return
+	}
+
+	cp, err := ss.restore(sess)
+	if err != nil {
+		writeServeError(w, http.StatusInternalServerError, exitFailure, err)
+		return
+	}
+	defer cp.Reset()
+
+	began, from := time.Now(), sess.Offset
+	// whatever arrives is digested and kept, even should the body be cut
+	// short, for the client to carry on from the offset reported
+	_, err = io.CopyN(io.Discard, body, sess.Offset-start)
+	if err == nil {
+		var n int64
+		n, err = io.Copy(cp, countHashed(body))
+		sess.Offset += n
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	var drained []string
+	if err == nil {
+		drained, err = ss.drain(sess, cp)
+	}
+	observeDigest("session", began, sess.Offset-from, err)
+	if serr := ss.save(sess, cp); serr != nil {
+		writeServeError(w, http.StatusInternalServerError, exitFailure, serr)
+		return
+	}
+	for _, part := range drained {
+		os.Remove(part)
+	}
+	if err != nil {
+		status, code, err := digestFailure(err)
+		writeServeError(w, status, code, err)
+		return
+	}
+	ss.status(w, r, sess)
+}
+
+// putAside stores the range at start, which is ahead of the offset of its
+// session. Only a range received in full is kept, and only as long as the
+// ranges put aside for the session stay within --session-max-pending.
+func (ss *sessions) putAside(id string, start int64, body io.Reader) error {
+	parts, err := ss.parts(id)
+	if err != nil {
+		return err
+	}
+	room := ss.maxPending
+	for _, part := range parts {
+		room -= part.Size
+	}
+	if room <= 0 {
+		return fmt.Errorf("%w: the maximum of %d bytes is reached", errTooMuchPending, ss.maxPending)
+	}
+
+	path := ss.partPath(id, start)
+	tmp, err := os.CreateTemp(ss.dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	n, err := io.Copy(tmp, io.LimitReader(body, room+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return withExitCode(exitInputError, fmt.Errorf("receiving the range at offset %d: %w", start, err))
+	}
+	if n > room {
+		return fmt.Errorf("%w: the range at offset %d exceeds the remaining %d of %d bytes", errTooMuchPending, start, room, ss.maxPending)
+	}
+
+	// of two ranges at the same offset the longer one is kept
+	if st, err := os.Stat(path); err == nil && st.Size() >= n {
+		return nil
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// parts lists the ranges put aside for the session id, by offset.
+func (ss *sessions) parts(id string) ([]sessionRange, error) {
+	paths, err := filepath.Glob(filepath.Join(ss.dir, id+".*.part"))
+	if err != nil {
+		return nil, err
+	}
+	var parts []sessionRange
+	for _, path := range paths {
+		offset, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), id+"."), ".part"), 10, 64)
+		if err != nil {
+			continue
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, sessionRange{Offset: offset, Size: st.Size()})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Offset < parts[j].Offset })
+	return parts, nil
+}
+
+// drain digests the ranges put aside that the offset of sess has caught up
+// with, returning the paths of those to remove once sess is saved.
+func (ss *sessions) drain(sess *session, cp *commp.Calc) ([]string, error) {
+	parts, err := ss.parts(sess.ID)
+	if err != nil {
+		return nil, err
+	}
+	var drained []string
+	for _, part := range parts {
+		if part.Offset > sess.Offset {
+			break
+		}
+		path := ss.partPath(sess.ID, part.Offset)
+		if end := part.Offset + part.Size; end > sess.Offset {
+			fh, err := os.Open(path)
+			if err != nil {
+				return drained, err
+			}
+			n, err := io.Copy(cp, countHashed(io.NewSectionReader(fh, sess.Offset-part.Offset, end-sess.Offset)))
+			fh.Close()
+			sess.Offset += n
+			if err != nil {
+				return drained, err
+			}
+		}
+		drained = append(drained, path)
+	}
+	return drained, nil
+}
+
+// finalize digests the session, provided no range is missing, and removes it.
+func (ss *sessions) finalize(w http.ResponseWriter, r *http.Request, sess *session) {
+	parts, err := ss.parts(sess.ID)
+	if err != nil {
+		writeServeError(w, http.StatusInternalServerError, exitFailure, err)
+		return
+	}
+	if len(parts) > 0 {
+		writeServeError(w, http.StatusConflict, exitInputError, fmt.Errorf("missing the range from offset %d to %d", sess.Offset, parts[0].Offset))
+		return
+	}
+
+	if err := ss.s.acquire(r.Context(), "session"); err != nil {
+		writeBusy(w, err)
+		return
+	}
+	defer ss.s.release()
+
+	cp, err := ss.restore(sess)
+	if err != nil {
+		writeServeError(w, http.StatusInternalServerError, exitFailure, err)
+		return
+	}
+	defer cp.Reset()
+
+	// the session is kept should the payload be too small, to upload more
+	res := inputResult{payloadSize: sess.Offset}
+	if res.pieceCID, res.paddedSize, err = finishDigest(cp, ss.s.opts); err != nil {
+		status, code, err := digestFailure(err)
+		writeServeError(w, status, code, err)
+		return
+	}
+	if err := os.Remove(ss.path(sess.ID)); err != nil {
+		log.Printf("removing session %s: %s", sess.ID, err)
+	}
+	writeServeJSON(w, http.StatusOK, newServeResult(res))
+}
+
+func (ss *sessions) remove(w http.ResponseWriter, r *http.Request, sess *session) {
+	if err := ss.discard(sess.ID); err != nil {
+		writeServeError(w, http.StatusInternalServerError, exitFailure, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// discard removes the session id along with the ranges put aside for it.
+func (ss *sessions) discard(id string) error {
+	parts, err := ss.parts(id)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		os.Remove(ss.partPath(id, part.Offset))
+	}
+	return os.Remove(ss.path(id))
+}
+
+// reap discards the sessions idle for --session-timeout, checking on them
+// every fraction of it.
+func (ss *sessions) reap() {
+	ticker := time.NewTicker(max(ss.timeout/4, time.Second))
+	defer ticker.Stop()
+	for {
+		ss.reapIdle(time.Now())
+		<-ticker.C
+	}
+}
+
+// reapIdle discards the sessions last uploaded to or created before now minus
+// --session-timeout, leaving alone those a request is busy with.
+func (ss *sessions) reapIdle(now time.Time) {
+	paths, err := filepath.Glob(filepath.Join(ss.dir, "*.json"))
+	if err != nil {
+		log.Printf("listing sessions: %s", err)
+		return
+	}
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+			continue
+		}
+		ss.mu.Lock()
+		lock := ss.locks[id]
+		if lock == nil {
+			lock = new(sync.Mutex)
+			ss.locks[id] = lock
+		}
+		if lock.TryLock() {
+			if ss.idle(id, now) {
+				if !quiet {
+					log.Printf("discarding session %s, idle for over %s", id, ss.timeout)
+				}
+				if err := ss.discard(id); err != nil {
+					log.Printf("discarding session %s: %s", id, err)
+				}
+			}
+			// the lock goes with the session, as in withSession()
+			if _, err := os.Stat(ss.path(id)); os.IsNotExist(err) {
+				delete(ss.locks, id)
+			}
+			lock.Unlock()
+		}
+		ss.mu.Unlock()
+	}
+}
+
+// idle tells whether neither the session id nor any range put aside for it
+// was written to since now minus --session-timeout.
+func (ss *sessions) idle(id string, now time.Time) bool {
+	paths, _ := filepath.Glob(filepath.Join(ss.dir, id+".*.part"))
+	for _, path := range append(paths, ss.path(id)) {
+		st, err := os.Stat(path)
+		if err != nil || now.Sub(st.ModTime()) < ss.timeout {
+			return false
+		}
+	}
+	return true
+}
+
+func (ss *sessions) restore(sess *session) (*commp.Calc, error) {
+	cp := newCalc()
+	if err := cp.UnmarshalBinary(sess.State); err != nil {
+		return nil, fmt.Errorf("restoring session %s: %w", sess.ID, err)
+	}
+	return cp, nil
+}
+
+// save persists sess along with the state of cp.
+func (ss *sessions) save(sess *session, cp *commp.Calc) error {
+	state, err := cp.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	sess.State = state
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ss.path(sess.ID), append(b, '\n'))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSession creates a session on ts, returning its URL.
+func newTestSession(t *testing.T, ts string) string {
+	t.Helper()
+	var st sessionStatus
+	if status := request(t, http.MethodPost, ts+"/sessions", nil, &st); status != http.StatusCreated {
+		t.Fatalf("creating a session: status %d", status)
+	}
+	return ts + "/sessions/" + st.ID
+}
+
+func TestSessionMaxPending(t *testing.T) {
+	_, ts := newTestServer(t, serveConfig{SessionsDir: t.TempDir(), SessionMaxPending: 1000})
+	sess := newTestSession(t, ts.URL)
+
+	for _, tc := range []struct {
+		offset, size int
+		exp          int
+	}{
+		{500, 600, http.StatusOK},
+		{2000, 500, http.StatusRequestEntityTooLarge}, // 400 bytes left
+		{3000, 400, http.StatusOK},
+		{4000, 1, http.StatusRequestEntityTooLarge}, // none left
+	} {
+		var serr serveError
+		status := request(t, http.MethodPut, fmt.Sprintf("%s?offset=%d", sess, tc.offset), make([]byte, tc.size), &serr)
+		if status != tc.exp {
+			t.Fatalf("%d bytes at offset %d: status %d (%s), expected %d", tc.size, tc.offset, status, serr.Error, tc.exp)
+		}
+	}
+
+	var st sessionStatus
+	request(t, http.MethodGet, sess, nil, &st)
+	if len(st.Pending) != 2 {
+		t.Fatalf("%d ranges pending, expected the 2 accepted", len(st.Pending))
+	}
+
+	// catching up releases the pending bytes
+	if status := request(t, http.MethodPut, sess+"?offset=0", make([]byte, 3000), nil); status != http.StatusOK {
+		t.Fatalf("catching up: status %d", status)
+	}
+	if status := request(t, http.MethodPut, sess+"?offset=5000", make([]byte, 1000), nil); status != http.StatusOK {
+		t.Fatalf("after catching up: status %d", status)
+	}
+}
+
+func TestSessionAheadNeedsSlot(t *testing.T) {
+	s, ts := newTestServer(t, serveConfig{SessionsDir: t.TempDir(), SessionMaxPending: 1 << 20, MaxConcurrent: 1})
+	sess := newTestSession(t, ts.URL)
+
+	s.slots <- struct{}{}
+	if status := request(t, http.MethodPut, sess+"?offset=1000", make([]byte, 100), nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("range ahead with no slot free: status %d, expected %d", status, http.StatusServiceUnavailable)
+	}
+	<-s.slots
+	if status := request(t, http.MethodPut, sess+"?offset=1000", make([]byte, 100), nil); status != http.StatusOK {
+		t.Fatalf("range ahead: status %d", status)
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	s, ts := newTestServer(t, serveConfig{SessionsDir: t.TempDir(), SessionMaxPending: 1 << 20, SessionTimeout: time.Hour})
+	sess := newTestSession(t, ts.URL)
+	if status := request(t, http.MethodPut, sess+"?offset=1000", make([]byte, 100), nil); status != http.StatusOK {
+		t.Fatalf("range ahead: status %d", status)
+	}
+
+	s.sessions.reapIdle(time.Now().Add(30 * time.Minute))
+	if status := request(t, http.MethodGet, sess, nil, nil); status != http.StatusOK {
+		t.Fatalf("session reaped before its timeout: status %d", status)
+	}
+
+	s.sessions.reapIdle(time.Now().Add(2 * time.Hour))
+	if status := request(t, http.MethodGet, sess, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("session idle past its timeout: status %d, expected %d", status, http.StatusNotFound)
+	}
+	if parts, _ := s.sessions.parts(sess[len(sess)-32:]); len(parts) != 0 {
+		t.Fatalf("%d ranges of the reaped session left", len(parts))
+	}
+}
+
+func TestSessionOutOfOrder(t *testing.T) {
+	payload := testPayload(300001)
+	_, ts := newTestServer(t, serveConfig{SessionsDir: t.TempDir(), SessionMaxPending: 1 << 20})
+	sess := newTestSession(t, ts.URL)
+
+	// the last range first, then one overlapping the first, then the first
+	for _, r := range []struct{ from, to int }{
+		{200000, 300001},
+		{50000, 210000},
+		{0, 100000},
+	} {
+		var st sessionStatus
+		if status := request(t, http.MethodPut, fmt.Sprintf("%s?offset=%d", sess, r.from), payload[r.from:r.to], &st); status != http.StatusOK {
+			t.Fatalf("range %d-%d: status %d", r.from, r.to, status)
+		}
+	}
+
+	var st sessionStatus
+	request(t, http.MethodGet, sess, nil, &st)
+	if st.Offset != int64(len(payload)) || len(st.Pending) != 0 {
+		t.Fatalf("session at offset %d with %d ranges pending, expected all %d bytes digested", st.Offset, len(st.Pending), len(payload))
+	}
+
+	var res serveResult
+	if status := request(t, http.MethodPost, sess+"/finalize", nil, &res); status != http.StatusOK {
+		t.Fatalf("finalizing: status %d", status)
+	}
+	if exp := pieceCIDOf(t, payload); res.PieceCID != exp || res.PayloadSize != int64(len(payload)) {
+		t.Fatalf("session digested %d bytes into %s, expected %d bytes into %s", res.PayloadSize, res.PieceCID, len(payload), exp)
+	}
+	if status := request(t, http.MethodGet, sess, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("finalized session: status %d, expected %d", status, http.StatusNotFound)
+	}
+}
+
+func TestSessionRestart(t *testing.T) {
+	payload := testPayload(300001)
+	dir := t.TempDir()
+	_, ts := newTestServer(t, serveConfig{SessionsDir: dir, SessionMaxPending: 1 << 20})
+	sess := newTestSession(t, ts.URL)
+	if status := request(t, http.MethodPut, sess+"?offset=0", payload[:150000], nil); status != http.StatusOK {
+		t.Fatalf("first range: status %d", status)
+	}
+	ts.Close()
+
+	// the session carries on from its state on disk in another server
+	_, ts = newTestServer(t, serveConfig{SessionsDir: dir, SessionMaxPending: 1 << 20})
+	sess = ts.URL + sess[strings.LastIndex(sess, "/sessions/"):]
+	var st sessionStatus
+	if status := request(t, http.MethodGet, sess, nil, &st); status != http.StatusOK || st.Offset != 150000 {
+		t.Fatalf("restored session: status %d at offset %d, expected %d", status, st.Offset, 150000)
+	}
+	if status := request(t, http.MethodPut, sess+"?offset=150000", payload[150000:], nil); status != http.StatusOK {
+		t.Fatalf("second range: status %d", status)
+	}
+	var res serveResult
+	if status := request(t, http.MethodPost, sess+"/finalize", nil, &res); status != http.StatusOK {
+		t.Fatalf("finalizing: status %d", status)
+	}
+	if exp := pieceCIDOf(t, payload); res.PieceCID != exp {
+		t.Fatalf("restored session digested into %s, expected %s", res.PieceCID, exp)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// sidecarSuffix is appended to the path of an input to form that of its
+// sidecar.
+const sidecarSuffix = ".commp"
+
+// sidecar is the content of the small JSON file written next to an input by
+// --sidecar, recording the outcome of digesting it.
+type sidecar struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	PieceCID  string    `json:"piece_cid"`
+	PieceSize uint64    `json:"piece_size"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// writeSidecar records res as the sidecar of the input at path, replacing
+// any previous one atomically.
+func writeSidecar(path string, res inputResult) error {
+	b, err := json.MarshalIndent(sidecar{
+		Name:      filepath.Base(path),
+		Size:      res.payloadSize,
+		PieceCID:  res.pieceCID.String(),
+		PieceSize: res.paddedSize,
+		Timestamp: time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+sidecarSuffix+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path+sidecarSuffix)
+}
+
+// readSidecar returns the result recorded by the sidecar of the input at
+// path, provided it is still current: it is for an input of the same name
+// and size, not modified since, and the piece size matches what
+// --pad-piece-size would produce. ok is false otherwise, including when
+// there is no sidecar at all.
+func readSidecar(path string, opts *config) (res inputResult, ok bool, err error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return res, false, err
+	}
+	b, err := os.ReadFile(path + sidecarSuffix)
+	if os.IsNotExist(err) {
+		return res, false, nil
+	} else if err != nil {
+		return res, false, err
+	}
+
+	var sc sidecar
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return res, false, fmt.Errorf("parsing sidecar %s: %w", path+sidecarSuffix, err)
+	}
+	if sc.Name != filepath.Base(path) || sc.Size != st.Size() || st.ModTime().After(sc.Timestamp) {
+		return res, false, nil
+	}
+
+	expSize := opts.PadPieceSize
+	if expSize == 0 {
+		// the natural piece size of the payload
+		expSize = 128
+		for expSize/128*127 < uint64(sc.Size) {
+			expSize *= 2
+		}
+	}
+	if sc.PieceSize != expSize {
+		return res, false, nil
+	}
+
+	if res.pieceCID, err = cid.Decode(sc.PieceCID); err != nil {
+		return res, false, fmt.Errorf("parsing sidecar %s: %w", path+sidecarSuffix, err)
+	}
+	res.payloadSize = sc.Size
+	res.paddedSize = sc.PieceSize
+	res.fromSidecar = true
+	return res, true, nil
+}
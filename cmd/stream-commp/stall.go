@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// stallChunk is the outcome of a single read in the background.
+type stallChunk struct {
+	b   []byte
+	err error
+}
+
+// stallReader reads from an input in the background, failing should no data
+// arrive for --stall-timeout. A read blocked on a pipe can not be
+// interrupted, so it is simply left behind, as the process is about to end.
+type stallReader struct {
+	timeout time.Duration
+	chunks  chan stallChunk
+	free    chan []byte // buffers for the background reads to reuse
+	cur     stallChunk
+	pos     int
+	err     error
+}
+
+// watchStall returns r, failing reads of it should no data arrive for
+// --stall-timeout, when set.
+func watchStall(r io.Reader, opts *config) io.Reader {
+	if opts.StallTimeout <= 0 {
+		return r
+	}
+
+	sr := &stallReader{
+		timeout: opts.StallTimeout,
+		chunks:  make(chan stallChunk, 1),
+		free:    make(chan []byte, 2),
+	}
+	sr.free <- make([]byte, 1<<20)
+	sr.free <- make([]byte, 1<<20)
+	go func() {
+		for buf := range sr.free {
+			n, err := r.Read(buf)
+			sr.chunks <- stallChunk{b: buf[:n], err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return sr
+}
+
+func (sr *stallReader) Read(p []byte) (int, error) {
+	for sr.pos == len(sr.cur.b) {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		if sr.cur.b != nil {
+			sr.free <- sr.cur.b[:cap(sr.cur.b)]
+			sr.cur.b, sr.pos = nil, 0
+		}
+
+		timer := time.NewTimer(sr.timeout)
+		select {
+		case c := <-sr.chunks:
+			timer.Stop()
+			sr.cur, sr.pos = c, 0
+			sr.err = c.err
+		case <-timer.C:
+			sr.err = withExitCode(exitInputError, fmt.Errorf("no data arrived for %s: whatever feeds the input is likely stuck", sr.timeout))
+		}
+	}
+
+	n := copy(p, sr.cur.b[sr.pos:])
+	sr.pos += n
+	return n, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+)
+
+// tarMember is the outcome of digesting a single member of a tar input.
+type tarMember struct {
+	name string
+	res  inputResult
+	err  error
+}
+
+// digestTarPath digests the members of the tar archive at path, or stdin
+// for "-".
+func digestTarPath(path string, opts *config) (inputResult, error) {
+	if path == "-" {
+		return digestTar(watchStall(os.Stdin, opts), opts)
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return inputResult{}, withExitCode(exitInputError, err)
+	}
+	defer fh.Close()
+	return digestTar(fh, opts)
+}
+
+// digestTar digests every regular file in the tar archive read from input
+// on its own, failing members not failing the others. With --tar-whole the
+// archive itself is digested along the way, and makes for the result,
+// otherwise only its members are of interest.
+func digestTar(input io.Reader, opts *config) (inputResult, error) {
+	var res inputResult
+
+	input, release, err := decompress(progress.wrap(throttle(input)), opts)
+	if err != nil {
+		return res, err
+	}
+	defer release()
+
+	if opts.Decompress == "" {
+		br := bufio.NewReader(input)
+		head, _ := br.Peek(4)
+		if method := compressionOf(head); method != "" {
+			return res, withExitCode(exitInputError, fmt.Errorf("the archive looks %s-compressed: use --decompress", method))
+		}
+		input = br
+	}
+
+	var whole *commp.Calc
+	if opts.TarWhole {
+		whole = newCalc()
+		defer whole.Reset()
+		input = io.TeeReader(input, whole)
+	}
+	counted := &countingReader{Reader: input, read: new(atomic.Int64)}
+	tr := tar.NewReader(counted)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			res.payloadSize = counted.read.Load()
+			return res, withExitCode(exitInputError, fmt.Errorf("reading tar archive at offset %d: %w", res.payloadSize, err))
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		bufSize := BufSize
+		if hdr.Size < int64(bufSize) {
+			bufSize = int(max(hdr.Size, 16))
+		}
+		m := tarMember{name: hdr.Name}
+		m.res, m.err = digestReader(tr, bufSize, opts)
+
+		// the archive can not be read any further after a read error
+		if m.err != nil && exitCodeOf(m.err) == exitInputError {
+			return res, fmt.Errorf("reading member %s: %w", hdr.Name, m.err)
+		}
+		res.members = append(res.members, m)
+	}
+
+	if whole == nil {
+		return res, nil
+	}
+	// the zero blocks ending the archive belong to it as well
+	if _, err := io.Copy(uDiscard, counted); err != nil {
+		return res, withExitCode(exitInputError, err)
+	}
+	res.payloadSize = counted.read.Load()
+	res.pieceCID, res.paddedSize, err = finishDigest(whole, opts)
+	return res, err
+}
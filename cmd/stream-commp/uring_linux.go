@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The subset of the io_uring ABI in use below, not exposed by x/sys/unix
+const (
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringOpReadFixed = 4
+	uringOpRead      = 22
+
+	uringEnterGetEvents   = 1
+	uringRegisterBuffers  = 0
+	uringSQESize          = 64
+	uringCQESize          = 16
+	uringParamsStructSize = 120
+)
+
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        struct {
+		head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+		userAddr                                                        uint64
+	}
+	cqOff struct {
+		head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+		userAddr                                                        uint64
+	}
+}
+
+// ringReader reads a regular file sequentially, keeping depth reads of
+// chunkSize bytes in flight via io_uring. Completions are consumed strictly in
+// file order, regardless of the order the kernel delivers them in.
+type ringReader struct {
+	fh     *os.File
+	fd     int
+	fixed  bool // whether bufs are registered with the ring
+	bufs   [][]byte
+	done   []bool
+	res    []int32
+	offset []int64
+
+	next      int   // slot holding the next chunk in file order
+	pos       int   // read position within the buffer of the next slot
+	submitOff int64 // file offset of the next read to submit
+	eof       bool
+	err       error
+
+	sqRing, cqRing, sqes    []byte
+	sqTail, sqMask, sqArray unsafe.Pointer
+	cqHead, cqTail, cqMask  unsafe.Pointer
+	cqes                    unsafe.Pointer
+	toSubmit                uint32
+}
+
+func newRingReader(fh *os.File, depth, chunkSize int) (io.ReadCloser, error) {
+	st, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, errors.New("io_uring reads are only supported on regular files")
+	}
+	start, err := fh.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	var p uringParams
+	if unsafe.Sizeof(p) != uringParamsStructSize {
+		panic("unexpected io_uring_params layout")
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(depth), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup failed: %w", errno)
+	}
+
+	r := &ringReader{
+		fh:        fh,
+		fd:        int(fd),
+		bufs:      make([][]byte, depth),
+		done:      make([]bool, depth),
+		res:       make([]int32, depth),
+		offset:    make([]int64, depth),
+		submitOff: start,
+	}
+	if err := r.mapRings(&p); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	iovecs := make([]unix.Iovec, depth)
+	for i := range r.bufs {
+		r.bufs[i] = make([]byte, chunkSize)
+		iovecs[i].Base = &r.bufs[i][0]
+		iovecs[i].SetLen(chunkSize)
+	}
+	// registration is subject to RLIMIT_MEMLOCK on older kernels: plain
+	// reads into the same buffers are fine as well
+	_, _, errno = unix.Syscall6(unix.SYS_IO_URING_REGISTER, fd, uringRegisterBuffers, uintptr(unsafe.Pointer(&iovecs[0])), uintptr(depth), 0, 0)
+	r.fixed = errno == 0
+
+	for i := range r.bufs {
+		r.queue(i)
+	}
+	return r, nil
+}
+
+func (r *ringReader) mapRings(p *uringParams) (err error) {
+	if r.sqRing, err = unix.Mmap(r.fd, uringOffSQRing, int(p.sqOff.array+p.sqEntries*4), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		return fmt.Errorf("mapping the submission ring failed: %w", err)
+	}
+	if r.cqRing, err = unix.Mmap(r.fd, uringOffCQRing, int(p.cqOff.cqes+p.cqEntries*uringCQESize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		return fmt.Errorf("mapping the completion ring failed: %w", err)
+	}
+	if r.sqes, err = unix.Mmap(r.fd, uringOffSQEs, int(p.sqEntries*uringSQESize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		return fmt.Errorf("mapping the submission entries failed: %w", err)
+	}
+
+	sq := unsafe.Pointer(&r.sqRing[0])
+	r.sqTail = unsafe.Add(sq, p.sqOff.tail)
+	r.sqMask = unsafe.Add(sq, p.sqOff.ringMask)
+	r.sqArray = unsafe.Add(sq, p.sqOff.array)
+
+	cq := unsafe.Pointer(&r.cqRing[0])
+	r.cqHead = unsafe.Add(cq, p.cqOff.head)
+	r.cqTail = unsafe.Add(cq, p.cqOff.tail)
+	r.cqMask = unsafe.Add(cq, p.cqOff.ringMask)
+	r.cqes = unsafe.Add(cq, p.cqOff.cqes)
+	return nil
+}
+
+// queue prepares a read of the next chunk into the buffer of slot, to be
+// submitted on the next io_uring_enter.
+func (r *ringReader) queue(slot int) {
+	tail := atomic.LoadUint32((*uint32)(r.sqTail))
+	idx := tail & *(*uint32)(r.sqMask)
+
+	sqe := r.sqes[idx*uringSQESize : (idx+1)*uringSQESize]
+	clear(sqe)
+	sqe[0] = uringOpRead
+	if r.fixed {
+		sqe[0] = uringOpReadFixed
+		*(*uint16)(unsafe.Pointer(&sqe[40])) = uint16(slot)
+	}
+	*(*int32)(unsafe.Pointer(&sqe[4])) = int32(r.fh.Fd())
+	*(*uint64)(unsafe.Pointer(&sqe[8])) = uint64(r.submitOff)
+	*(*uint64)(unsafe.Pointer(&sqe[16])) = uint64(uintptr(unsafe.Pointer(&r.bufs[slot][0])))
+	*(*uint32)(unsafe.Pointer(&sqe[24])) = uint32(len(r.bufs[slot]))
+	*(*uint64)(unsafe.Pointer(&sqe[32])) = uint64(slot)
+
+	*(*uint32)(unsafe.Add(r.sqArray, 4*idx)) = idx
+	atomic.StoreUint32((*uint32)(r.sqTail), tail+1)
+
+	r.done[slot] = false
+	r.offset[slot] = r.submitOff
+	r.submitOff += int64(len(r.bufs[slot]))
+	r.toSubmit++
+}
+
+// await submits everything queued and reaps completions until the slot is
+// done.
+func (r *ringReader) await(slot int) error {
+	for !r.done[slot] {
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(r.toSubmit), 1, uringEnterGetEvents, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		} else if errno != 0 {
+			return fmt.Errorf("io_uring_enter failed: %w", errno)
+		}
+		r.toSubmit = 0
+
+		head := atomic.LoadUint32((*uint32)(r.cqHead))
+		tail := atomic.LoadUint32((*uint32)(r.cqTail))
+		mask := *(*uint32)(r.cqMask)
+		for ; head != tail; head++ {
+			cqe := unsafe.Add(r.cqes, uintptr(head&mask)*uringCQESize)
+			s := int(*(*uint64)(cqe))
+			r.res[s] = *(*int32)(unsafe.Add(cqe, 8))
+			r.done[s] = true
+		}
+		atomic.StoreUint32((*uint32)(r.cqHead), head)
+	}
+	return nil
+}
+
+func (r *ringReader) Read(p []byte) (int, error) {
+	for {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		slot := r.next
+		if err := r.await(slot); err != nil {
+			r.err = err
+			continue
+		}
+
+		res := int(r.res[slot])
+		if res < 0 {
+			r.err = fmt.Errorf("read at offset %d failed: %w", r.offset[slot], unix.Errno(-res))
+			continue
+		}
+
+		// a short read is the end of the file, unless it grew since: read
+		// the rest of the chunk synchronously to find out, every later
+		// chunk in flight is discarded after that
+		if res < len(r.bufs[slot]) && !r.eof {
+			for res < len(r.bufs[slot]) {
+				n, err := unix.Pread(int(r.fh.Fd()), r.bufs[slot][res:], r.offset[slot]+int64(res))
+				if err != nil {
+					r.err = err
+					break
+				}
+				if n == 0 {
+					r.eof = true
+					break
+				}
+				res += n
+			}
+			r.res[slot] = int32(res)
+			if r.err != nil {
+				continue
+			}
+		}
+
+		if r.pos < res {
+			n := copy(p, r.bufs[slot][r.pos:res])
+			r.pos += n
+			return n, nil
+		}
+		if r.eof {
+			r.err = io.EOF
+			continue
+		}
+
+		// slot fully consumed: reuse it for the next chunk beyond the ones in
+		// flight, and move on to the next one in file order
+		r.pos = 0
+		r.queue(slot)
+		r.next = (r.next + 1) % len(r.bufs)
+	}
+}
+
+// Close waits for the reads still in flight, as the kernel would otherwise
+// keep writing into the buffers, and tears down the ring.
+func (r *ringReader) Close() error {
+	if r.cqRing != nil && r.sqes != nil {
+		for slot := range r.bufs {
+			if r.bufs[slot] != nil && r.await(slot) != nil {
+				break
+			}
+		}
+	}
+	for _, m := range [][]byte{r.sqes, r.cqRing, r.sqRing} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+	return unix.Close(r.fd)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+func newRingReader(*os.File, int, int) (io.ReadCloser, error) {
+	return nil, errors.New("io_uring is only available on Linux")
+}
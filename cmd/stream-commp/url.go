@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// isURL tells whether an input path is an http(s) URL instead.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// digestURL downloads and digests the contents of url.
+func digestURL(url string, opts *config) (inputResult, error) {
+	input, err := openURL(url, opts)
+	if err != nil {
+		return inputResult{}, err
+	}
+	defer input.Close()
+	return digestStream(input, opts)
+}
+
+// openURL starts the download of the contents of url. When the server
+// supports range requests and reports the size, up to --http-connections
+// ranges are downloaded concurrently, and read in order.
+func openURL(url string, opts *config) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+		return nil, withExitCode(exitInputError, err)
+	}
+	req.Header.Set("User-Agent", "stream-commp")
+	if opts.HTTPConnections > 1 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", opts.HTTPChunkSize-1))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, withExitCode(exitInputError, err)
+	}
+	closeAll := func() error {
+		cancel()
+		return resp.Body.Close()
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// the entire body, whether it was asked for or not
+		return &readCloser{resp.Body, closeAll}, nil
+	case http.StatusPartialContent:
+		size, err := contentRangeSize(resp.Header.Get("Content-Range"))
+		if err != nil {
+			closeAll()
+			return nil, withExitCode(exitInputError, err)
+		}
+		validator := resp.Header.Get("ETag")
+		if validator == "" || strings.HasPrefix(validator, "W/") {
+			validator = resp.Header.Get("Last-Modified")
+		}
+		first := resp
+		rr := newRangeReader(ctx, size, opts, func(ctx context.Context, offset, length int64) ([]byte, error) {
+			// the first range is at hand already, it is requested anew on retries only
+			if first != nil {
+				r := first
+				first = nil
+				return readRange(r, offset, length)
+			}
+			return fetchRange(ctx, url, validator, offset, length)
+		})
+		return &readCloser{rr, closeAll}, nil
+	default:
+		closeAll()
+		return nil, withExitCode(exitInputError, fmt.Errorf("unexpected HTTP status %s", resp.Status))
+	}
+}
+
+// readCloser pairs a reader with the function releasing it.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc *readCloser) Close() error { return rc.close() }
+
+// contentRangeSize returns the complete length from a Content-Range header.
+func contentRangeSize(cr string) (int64, error) {
+	_, total, ok := strings.Cut(cr, "/")
+	if !ok || !strings.HasPrefix(cr, "bytes ") {
+		return 0, fmt.Errorf("malformed Content-Range %q", cr)
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Content-Range %q without a usable size: %w", cr, err)
+	}
+	return size, nil
+}
+
+// fetchRange downloads length bytes of url at offset, provided it still
+// matches validator, its ETag or Last-Modified.
+func fetchRange(ctx context.Context, url, validator string, offset, length int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "stream-commp")
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		// a 200 in response to If-Range means the object is not the same anymore
+		return nil, fmt.Errorf("range at offset %d: unexpected HTTP status %s", offset, resp.Status)
+	}
+	return readRange(resp, offset, length)
+}
+
+// readRange reads the body of the response to the request of length bytes at
+// offset.
+func readRange(resp *http.Response, offset, length int64) ([]byte, error) {
+	want := fmt.Sprintf("bytes %d-%d/", offset, offset+length-1)
+	if cr := resp.Header.Get("Content-Range"); !strings.HasPrefix(cr, want) {
+		return nil, fmt.Errorf("range at offset %d: unexpected Content-Range %q", offset, cr)
+	}
+	return readFullRange(resp.Body, offset, length)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/ipfs/go-cid"
+)
+
+// expectation is the result an input is verified against, with --verify.
+type expectation struct {
+	pieceCID  cid.Cid
+	pieceSize uint64 // the padded piece size, 0 when not given
+}
+
+func parseExpectation(pieceCID string, pieceSize uint64) (*expectation, error) {
+	c, err := cid.Decode(pieceCID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expected piece CID %q: %w", pieceCID, err)
+	}
+	if _, err := commcid.CIDToDataCommitmentV1(c); err != nil {
+		return nil, fmt.Errorf("invalid expected piece CID %q: %w", pieceCID, err)
+	}
+	if pieceSize != 0 && (pieceSize < 128 || pieceSize&(pieceSize-1) != 0) {
+		return nil, fmt.Errorf("invalid expected piece size %d: not a power of two of at least 128", pieceSize)
+	}
+	return &expectation{pieceCID: c, pieceSize: pieceSize}, nil
+}
+
+// check fails with exitMismatch should res not be the expected result,
+// telling both apart.
+func (e *expectation) check(res inputResult) error {
+	var mismatches []string
+	if !res.pieceCID.Equals(e.pieceCID) {
+		mismatches = append(mismatches, fmt.Sprintf("piece CID %s, expected %s", res.pieceCID, e.pieceCID))
+	}
+	if e.pieceSize != 0 && res.paddedSize != e.pieceSize {
+		mismatches = append(mismatches, fmt.Sprintf("piece size %d, expected %d", res.paddedSize, e.pieceSize))
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+	return withExitCode(exitMismatch, fmt.Errorf("verification failed: %s", strings.Join(mismatches, "; ")))
+}
@@ -0,0 +1,48 @@
+package commp
+
+import (
+	"math/bits"
+
+	"golang.org/x/xerrors"
+)
+
+// ComputeUnsealedCommD returns the unsealed sector commitment (commD) of a
+// sector of the given padded size holding the given pieces, as would be
+// returned by GenerateUnsealedCID() of filecoin-ffi. Pieces are laid out in
+// order, each preceded by as much zero padding as needed to align it to its
+// own size, with the remainder of the sector filled with zeroes. An empty
+// list of pieces results in the commD of an all-zero sector.
+func ComputeUnsealedCommD(sectorPaddedSize uint64, pieces []PieceInfo) ([]byte, error) {
+	if bits.OnesCount64(sectorPaddedSize) != 1 || sectorPaddedSize < 128 || sectorPaddedSize > MaxPieceSize {
+		return nil, xerrors.Errorf("sector padded size %d is not a power of 2 between 128 and %d: %w", sectorPaddedSize, MaxPieceSize, ErrInvalidPieceSize)
+	}
+
+	st := newSparseTree(uint(bits.TrailingZeros64(sectorPaddedSize / 32)))
+
+	var pos uint64
+	for i, p := range pieces {
+		if len(p.CommP) != 32 {
+			return nil, xerrors.Errorf("piece %d commP must be exactly 32 bytes long, got %d bytes instead: %w", i, len(p.CommP), ErrInvalidCommP)
+		}
+		if bits.OnesCount64(p.PaddedPieceSize) != 1 || p.PaddedPieceSize < 128 {
+			return nil, xerrors.Errorf("piece %d padded size %d is not a power of 2 of at least 128: %w", i, p.PaddedPieceSize, ErrInvalidPieceSize)
+		}
+
+		if p.PaddedPieceSize > sectorPaddedSize {
+			return nil, xerrors.Errorf("piece %d of padded size %d is larger than the sector: %w", i, p.PaddedPieceSize, ErrInvalidLayout)
+		}
+		pos = alignUp(pos, p.PaddedPieceSize)
+		if pos+p.PaddedPieceSize > sectorPaddedSize {
+			return nil, xerrors.Errorf("piece %d of padded size %d does not fit in the sector once aligned to offset %d: %w", i, p.PaddedPieceSize, pos, ErrInvalidLayout)
+		}
+
+		var n [32]byte
+		copy(n[:], p.CommP)
+		st.set(uint(bits.TrailingZeros64(p.PaddedPieceSize/32)), pos/p.PaddedPieceSize, n)
+		pos += p.PaddedPieceSize
+	}
+	st.build()
+
+	root := st.root()
+	return root[:], nil
+}
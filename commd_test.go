@@ -0,0 +1,68 @@
+package commp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	randmath "math/rand"
+)
+
+func TestComputeUnsealedCommD(t *testing.T) {
+	t.Parallel()
+
+	const sectorSize = 1 << 16
+
+	// fr32 padding operates on independent 127 byte quads, so the unpadded
+	// form of the sector is simply the concatenation of the zero-extended
+	// piece payloads and zero-filled alignment gaps
+	unpadded := make([]byte, 0, sectorSize/128*127)
+	var pieces []PieceInfo
+	for i, size := range []int{127, 1000, 100, 127 * 40, 5000} {
+		payload := make([]byte, size)
+		randmath.New(randmath.NewSource(int64(i))).Read(payload)
+
+		cp := &Calc{}
+		cp.Write(payload)
+		pi, err := cp.DigestPiece()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pieces = append(pieces, pi)
+
+		for uint64(len(unpadded))%pi.UnpaddedPieceSize != 0 {
+			unpadded = append(unpadded, 0)
+		}
+		unpadded = append(unpadded, payload...)
+		unpadded = append(unpadded, make([]byte, int(pi.UnpaddedPieceSize)-size)...)
+	}
+	unpadded = append(unpadded, make([]byte, cap(unpadded)-len(unpadded))...)
+
+	exp, paddedSize := mustDigest(t, &Calc{}, unpadded)
+	if paddedSize != sectorSize {
+		t.Fatalf("unexpected reference sector size %d", paddedSize)
+	}
+
+	commD, err := ComputeUnsealedCommD(sectorSize, pieces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(commD, exp) {
+		t.Fatalf("commD 0x%X doesn't match expected 0x%X", commD, exp)
+	}
+
+	zero, _ := mustDigest(t, &Calc{}, make([]byte, sectorSize/128*127))
+	if commD, err := ComputeUnsealedCommD(sectorSize, nil); err != nil || !bytes.Equal(commD, zero) {
+		t.Fatalf("commD 0x%X of an empty sector doesn't match expected 0x%X: %v", commD, zero, err)
+	}
+	if _, err := ComputeUnsealedCommD(MaxPieceSize, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ComputeUnsealedCommD(sectorSize, append(pieces, PieceInfo{CommP: make([]byte, 32), PaddedPieceSize: sectorSize})); !errors.Is(err, ErrInvalidLayout) {
+		t.Fatalf("unexpected result for pieces overflowing the sector: %v", err)
+	}
+	if _, err := ComputeUnsealedCommD(sectorSize, []PieceInfo{{CommP: make([]byte, 32), PaddedPieceSize: 100}}); !errors.Is(err, ErrInvalidPieceSize) {
+		t.Fatalf("unexpected result for an invalid piece size: %v", err)
+	}
+}
@@ -4,32 +4,83 @@
 //
 // The returned digest is a 32-byte raw commitment payload. Use something like
 // https://pkg.go.dev/github.com/filecoin-project/go-fil-commcid#DataCommitmentV1ToCID
-// in order to convert it to a proper cid.Cid.
+// in order to convert it to a proper cid.Cid, or use DigestPiece() which
+// returns a PieceInfo capable of rendering the piece CID directly.
 //
 // The output of this library is 100% identical to https://github.com/filecoin-project/filecoin-ffi/blob/d82899449741ce19/proofs.go#L177-L196
 package commp
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"hash"
 	"math/bits"
 	"sync"
+	"sync/atomic"
+	"unsafe"
 
-	sha256simd "github.com/minio/sha256-simd"
 	"golang.org/x/xerrors"
 )
 
 // Calc is an implementation of a commP "hash" calculator, implementing the
 // familiar hash.Hash interface. The zero-value of this object is ready to
-// accept Write()s without further initialization.
+// accept Write()s without further initialization. Once Digest()ed it must be
+// Reset() before it accepts anything again, see State().
 type Calc struct {
 	state
-	mu sync.Mutex
+	cfg       config
+	mu        sync.Mutex
+	finalized bool // successfully digested, survives the reset of state
 }
+
+// CalcState is the lifecycle state of a Calc, as returned by State().
+type CalcState int
+
+const (
+	// CalcReady is the state of a Calc which holds no data: freshly
+	// constructed or Reset().
+	CalcReady CalcState = iota
+	// CalcAccumulating is the state of a Calc which was written to.
+	CalcAccumulating
+	// CalcFinalized is the state of a Calc which was successfully Digest()ed.
+	// Anything but Reset() or UnmarshalBinary() fails with an error wrapping
+	// ErrFinalized, instead of silently starting a new piece.
+	CalcFinalized
+)
+
+func (s CalcState) String() string {
+	switch s {
+	case CalcReady:
+		return "ready"
+	case CalcAccumulating:
+		return "accumulating"
+	case CalcFinalized:
+		return "finalized"
+	default:
+		return "unknown"
+	}
+}
+
 type state struct {
 	quadsEnqueued uint64
-	layerQueues   [MaxLayers + 2]chan []byte // one extra layer for the initial leaves, one more for the dummy never-to-use channel
+	work          chan *job             // jobs for the reducers, nil with a nodeSink
+	order         chan *job             // every job in order of submission, for the folder
+	jobs          chan *job             // free jobs, bounding the amount in flight
+	layerTwins    [MaxLayers + 1][]byte // pending per-layer nodes as of the last sync(), or to resume from
 	resultCommP   chan []byte
-	buffer        []byte
+	syncDone      chan struct{}
+	buffer        []byte      // carry ring of slabSize() bytes, allocated once and never outgrown
+	bufStart      int         // position in buffer of the first byte carried
+	bufLen        int         // amount of bytes carried
+	mem           *memLimiter // bounds the bytes of slabs in flight
+
+	workers  sync.WaitGroup
+	aborting atomic.Bool   // set when tearing down without a Digest(), nodes collapsed past this point are meaningless
+	failed   chan struct{} // closed on the first internal failure of any layer worker
+	failOnce sync.Once
+	failure  error
+
+	slabsInFlight atomic.Int64 // accounted for by mem, for the Metrics
 }
 
 var _ hash.Hash = &Calc{} // make sure we are hash.Hash compliant
@@ -51,22 +102,43 @@ const MaxPiecePayload = MaxPieceSize / 128 * 127
 const MinPiecePayload = uint64(65)
 
 const (
-	commpDigestSize = sha256simd.Size
+	commpDigestSize = sha256.Size
 	quadPayload     = int(127)
-	bufferSize      = 256 * quadPayload // FIXME: tune better, chosen by rough experiment
 )
 
 var (
-	layerQueueDepth   = 32 // FIXME: tune better, chosen by rough experiment
-	stackedNulPadding [MaxLayers][]byte
+	// bufferSize is the amount of payload digested in one go, and the
+	// capacity of the carry buffer. fullSlabSize is the size of every slab
+	// digestQuads() sends down the tower, other than the few trailing ones
+	// produced by Digest(). Both are derived from the machine by tune().
+	bufferSize   = defaultSlabQuads * quadPayload
+	fullSlabSize = defaultSlabQuads * 128
+
+	layerQueueDepth   = defaultQueueDepth // set by tune()
+	stackedNulPadding [MaxLayers + 1][]byte
+
+	// Every buffer travelling up the tower is drawn from one of these pools,
+	// one for each power of 2 size from a 64-byte twin buffer up to the
+	// largest slab, shared by all layers of all Calcs. It is returned to its
+	// pool by the folder once reduced to a single node. The pools hold a
+	// pointer to the first byte rather than a slice, as the latter would cost
+	// an allocation on every Put().
+	//
+	// A Calc fed faster than it can hash pins its carry buffer, one twin
+	// buffer per layer, and slabs queued for or being reduced by the tower
+	// worth at most as many bytes as layerQueueDepth+1 full slabs (~1MiB
+	// with the default sizes), or as set WithMaxMemory().
+	slabPools [maxSlabQuadsLog2 + 7 - 6 + 1]sync.Pool
 )
 
 // initialize the nul padding stack (cheap to do upfront, just MaxLayers loops)
 func init() {
-	h := sha256simd.New()
+	tune()
+
+	h := newSIMD()
 
 	stackedNulPadding[0] = make([]byte, commpDigestSize)
-	for i := uint(1); i < MaxLayers; i++ {
+	for i := uint(1); i <= MaxLayers; i++ {
 		h.Reset()
 		h.Write(stackedNulPadding[i-1]) // yes, got to...
 		h.Write(stackedNulPadding[i-1]) // ...do it twice
@@ -77,8 +149,70 @@ func init() {
 
 // BlockSize is the amount of bytes consumed by the commP algorithm in one go.
 // Write()ing data in multiples of BlockSize would obviate the need to maintain
-// an internal carry buffer. The BlockSize of this module is 127 bytes.
-func (cp *Calc) BlockSize() int { return quadPayload }
+// an internal carry buffer. The BlockSize of this module is 127 bytes, or 128
+// bytes when constructed WithPaddedInput().
+func (cp *Calc) BlockSize() int { return cp.quadSize() }
+
+// quadSize is the amount of input bytes making up a single quad: 127 bytes
+// of payload, or 128 bytes of already fr32-padded input.
+func (cp *Calc) quadSize() int {
+	if cp.cfg.paddedInput {
+		return 128
+	}
+	return quadPayload
+}
+
+// slabSize is the amount of input bytes digested in one go.
+func (cp *Calc) slabSize() int { return cp.slabQuads() * cp.quadSize() }
+
+// slabQuads is the amount of quads in a full slab: as tuned for the machine,
+// but small enough for the carry buffer and two slabs in flight to fit
+// WithMaxMemory(), or along with the pending nodes WithMemoryCeiling(), if
+// set.
+func (cp *Calc) slabQuads() int {
+	quads := bufferSize / quadPayload
+	if cp.cfg.maxMemory > 0 {
+		var fixed int
+		if cp.cfg.strictMemory {
+			fixed = pendingNodesSize
+		}
+		for quads > minSlabQuads && quads*(cp.quadSize()+2*128)+fixed > cp.cfg.maxMemory {
+			quads >>= 1
+		}
+	}
+	return quads
+}
+
+// largestSlabQuads is the amount of quads in the largest slab digestQuads()
+// produces: the largest size the pools cater for, small enough for two such
+// slabs to be in flight at the same time.
+func (cp *Calc) largestSlabQuads() uint64 {
+	quads := maxSlabQuads
+	for quads > cp.slabQuads() && 2*quads*128 > cp.mem.max {
+		quads >>= 1
+	}
+	return uint64(quads)
+}
+
+// maxBufferSize is the amount of input bytes the carry buffer of a serialized
+// state is allowed to hold, regardless of the slab size of this process.
+func (cp *Calc) maxBufferSize() int { return maxSlabQuads*cp.quadSize() - 1 }
+
+// maxInput and minInput are the bounds of the total amount of input bytes
+// accepted by the accumulator.
+func (cp *Calc) maxInput() uint64 {
+	if cp.cfg.paddedInput {
+		return MaxPieceSize
+	}
+	return MaxPiecePayload
+}
+
+func (cp *Calc) minInput() uint64 {
+	if cp.cfg.paddedInput {
+		return 128
+	}
+	return MinPiecePayload
+}
 
 // Size is the amount of bytes returned on Sum()/Digest(), which is 32 bytes
 // for this module.
@@ -86,89 +220,291 @@ func (cp *Calc) Size() int { return commpDigestSize }
 
 // Reset re-initializes the accumulator object, clearing its state and
 // terminating all background goroutines. It is safe to Reset() an accumulator
-// in any state.
+// in any state, and it is the only way to rearm a finalized one.
 func (cp *Calc) Reset() {
 	cp.mu.Lock()
+	cp.reset()
+	cp.mu.Unlock()
+}
+
+// State returns the lifecycle state of the accumulator.
+func (cp *Calc) State() CalcState {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	switch {
+	case cp.finalized:
+		return CalcFinalized
+	case cp.buffer != nil:
+		return CalcAccumulating
+	default:
+		return CalcReady
+	}
+}
+
+// checkFinalized rejects any use of a finalized accumulator.
+func (cp *Calc) checkFinalized() error {
+	if cp.finalized {
+		return xerrors.Errorf("accumulator must be Reset() after a Digest(): %w", ErrFinalized)
+	}
+	return nil
+}
+
+func (cp *Calc) reset() {
 	if cp.buffer != nil {
 		// we are resetting without digesting: close everything out to terminate
 		// the layer workers
-		close(cp.layerQueues[0])
-		<-cp.resultCommP
+		cp.aborting.Store(true)
+		cp.closeTower()
+		select {
+		case <-cp.resultCommP:
+		case <-cp.failed:
+		}
+		cp.workers.Wait()
+		cp.dropSlabsInFlight()
 	}
 	cp.state = state{} // reset
-	cp.mu.Unlock()
+	cp.finalized = false
 }
 
-// Sum is a thin wrapper around Digest() and is provided solely to satisfy
-// the hash.Hash interface. It panics on errors returned from Digest().
-// Note that unlike classic (hash.Hash).Sum(), calling this method is
-// destructive: the internal state is reset and all goroutines kicked off
-// by Write() are terminated.
+// Sum is a thin wrapper around SnapshotDigest() and is provided solely to
+// satisfy the hash.Hash interface. It panics on errors returned from
+// SnapshotDigest(). Like a classic (hash.Hash).Sum(), calling this method
+// does not change the underlying state: more data can be Write()n afterwards.
 func (cp *Calc) Sum(buf []byte) []byte {
-	commP, _, err := cp.Digest()
+	commP, _, err := cp.SnapshotDigest()
 	if err != nil {
 		panic(err)
 	}
 	return append(buf, commP...)
 }
 
+// SnapshotDigest returns the raw 32 bytes of commP and the padded piece size
+// of the data accumulated so far, exactly as Digest() would. Unlike Digest()
+// the internal state is left intact, and one can continue to Write() more
+// data to the accumulator afterwards.
+func (cp *Calc) SnapshotDigest() (commP []byte, paddedPieceSize uint64, err error) {
+	// collapse a copy instead, leaving the original pipeline untouched
+	// n.b. the copy does not inherit the node sink, as there is no need to
+	// emit the nodes of this temporary tree, nor the tracer and metrics
+	cfg := cp.cfg
+	cfg.nodeSink = nil
+	cfg.tracer = nil
+	cfg.metrics = nil
+	snap := cp.fork(cfg)
+	defer snap.Reset() // no-op on success, terminates the workers on error
+
+	return snap.Digest()
+}
+
+// Clone returns an independent copy of the accumulator, including all data
+// still in flight within the digest tower. Both the original and the clone
+// can continue to accept Write()s, each with its own set of background
+// goroutines: each must be Digest()ed or Reset() separately.
+func (cp *Calc) Clone() *Calc {
+	return cp.fork(cp.cfg)
+}
+
+func (cp *Calc) fork(cfg config) *Calc {
+	cp.mu.Lock()
+	fs, err := cp.freeze()
+	cp.mu.Unlock()
+
+	c := &Calc{cfg: cfg}
+	if err != nil {
+		// nothing to copy from, hand back an equally broken accumulator
+		c.initPipeline()
+		c.fail(err)
+		return c
+	}
+	if err := c.thaw(fs); err != nil {
+		c.fail(err)
+	}
+	return c
+}
+
 // Digest collapses the internal hash state and returns the resulting raw 32
 // bytes of commP and the padded piece size, or alternatively an error in
-// case of insufficient accumulated state. On success invokes Reset(), which
-// terminates all goroutines kicked off by Write().
+// case of insufficient accumulated state. On success terminates all
+// goroutines kicked off by Write(), and finalizes the accumulator: it must be
+// Reset() before reuse. When the digest tower suffered an internal failure
+// the accumulator is Reset() instead, and the failure is returned as an error
+// instead of crashing the process.
 func (cp *Calc) Digest() (commP []byte, paddedPieceSize uint64, err error) {
 	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.tracedDigest()
+}
 
-	defer func() {
-		// reset only if we did succeed
-		if err == nil {
-			cp.state = state{}
-		}
-		cp.mu.Unlock()
-	}()
+// DigestPadded is identical to Digest() followed by PadCommP(), returning the
+// commP of the piece padded up to targetPaddedSize, along with the padded size
+// of the piece itself and of the target. The target is validated before the
+// accumulated state is consumed: if it is not a power of 2 able to hold the
+// piece an error wrapping ErrInvalidPieceSize is returned, and the Calc can
+// still be Digest()ed or written to.
+func (cp *Calc) DigestPadded(targetPaddedSize uint64) (commP []byte, paddedPieceSize, paddedTargetSize uint64, err error) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
 
-	if processed := cp.quadsEnqueued*uint64(quadPayload) + uint64(len(cp.buffer)); processed < MinPiecePayload {
+	if err := cp.checkFinalized(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	if bits.OnesCount64(targetPaddedSize) != 1 || targetPaddedSize > MaxPieceSize {
+		return nil, 0, 0, xerrors.Errorf("target padded size %d is not a power of 2 up to %d: %w", targetPaddedSize, MaxPieceSize, ErrInvalidPieceSize)
+	}
+	if projected := cp.projectedPaddedPieceSize(); projected > targetPaddedSize {
+		return nil, 0, 0, xerrors.Errorf("target padded size %d is smaller than the padded size %d of the accumulated piece: %w", targetPaddedSize, projected, ErrInvalidPieceSize)
+	}
+
+	if commP, paddedPieceSize, err = cp.tracedDigest(); err != nil {
+		return nil, 0, 0, err
+	}
+	if commP, err = PadCommP(commP, paddedPieceSize, targetPaddedSize); err != nil {
+		return nil, 0, 0, err
+	}
+	return commP, paddedPieceSize, targetPaddedSize, nil
+}
+
+// tracedDigest is digest() within a SpanDigest.
+func (cp *Calc) tracedDigest() (commP []byte, paddedPieceSize uint64, err error) {
+	span := cp.startSpan(SpanDigest)
+	span.SetAttribute(AttrBytes, int64(cp.bytesWritten()))
+	commP, paddedPieceSize, err = cp.digest()
+	if err == nil {
+		span.SetAttribute(AttrPaddedPieceSize, int64(paddedPieceSize))
+	}
+	span.End(err)
+	return commP, paddedPieceSize, err
+}
+
+func (cp *Calc) digest() (commP []byte, paddedPieceSize uint64, err error) {
+	if err = cp.checkFinalized(); err != nil {
+		return nil, 0, err
+	}
+	if err = cp.err(); err != nil {
+		cp.reset()
+		return nil, 0, err
+	}
+
+	if processed := cp.bytesWritten(); processed < cp.minInput() {
 		err = xerrors.Errorf(
-			"insufficient state accumulated: commP is not defined for inputs shorter than %d bytes, but only %d processed so far",
-			MinPiecePayload, processed,
+			"commP is not defined for inputs shorter than %d bytes, but only %d processed so far: %w",
+			cp.minInput(), processed, ErrBelowMinimumPayload,
 		)
 		return
 	}
 
 	// If any, flush remaining bytes padded up with zeroes
-	if len(cp.buffer) > 0 {
-		if mod := len(cp.buffer) % quadPayload; mod != 0 {
-			cp.buffer = append(cp.buffer, make([]byte, quadPayload-mod)...)
+	if cp.bufLen > 0 {
+		qs := cp.quadSize()
+		if mod := cp.bufLen % qs; mod != 0 {
+			// both bufStart and slabSize() are multiples of qs, the padding
+			// always fits
+			n := cp.bufLen
+			cp.bufLen += qs - mod
+			clear(cp.carried()[n:])
 		}
-		for len(cp.buffer) > 0 {
-			// FIXME: there is a smarter way to do this instead of 127-at-a-time,
-			// but that's for another PR
-			cp.digestQuads(cp.buffer[:127])
-			cp.buffer = cp.buffer[127:]
+		// the remaining quads go out in as few aligned slabs as possible,
+		// one per set bit of their count at most
+		if err = cp.digestQuads(cp.carried()); err != nil {
+			cp.reset()
+			return nil, 0, err
 		}
+		cp.bufLen = 0
+	}
+
+	// This is how we signal to the tower that we are done, which in turn
+	// collapses the rest all the way to resultCommP
+	cp.closeTower()
+
+	select {
+	case commP = <-cp.resultCommP:
+		paddedPieceSize = paddedSizeForQuads(cp.quadsEnqueued)
+	case <-cp.failed:
+		err = cp.failure
+	}
+
+	cp.workers.Wait()
+	cp.dropSlabsInFlight()
+	cp.state = state{}
+	cp.finalized = err == nil
+
+	return commP, paddedPieceSize, err
+}
+
+// BytesWritten returns the total amount of payload bytes accepted by Write()
+// since the accumulator was last reset.
+func (cp *Calc) BytesWritten() uint64 {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.bytesWritten()
+}
+
+// QuadsEnqueued returns the amount of 127-byte payload quads that have been
+// fr32-expanded and sent to the digest tower so far. Any remainder is held
+// in the carry buffer until more data arrives, or until Digest() is called.
+func (cp *Calc) QuadsEnqueued() uint64 {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.quadsEnqueued
+}
+
+// ProjectedPaddedPieceSize returns the padded piece size Digest() would
+// report if it were invoked right now, or 0 if less than MinPiecePayload bytes
+// have been written so far.
+func (cp *Calc) ProjectedPaddedPieceSize() uint64 {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.projectedPaddedPieceSize()
+}
+
+func (cp *Calc) projectedPaddedPieceSize() uint64 {
+	processed := cp.bytesWritten()
+	if processed < cp.minInput() {
+		return 0
 	}
+	return paddedSizeForQuads((processed + uint64(cp.quadSize()) - 1) / uint64(cp.quadSize()))
+}
+
+func (cp *Calc) bytesWritten() uint64 {
+	return cp.quadsEnqueued*uint64(cp.quadSize()) + uint64(cp.bufLen)
+}
+
+// carried returns the bytes held in the carry ring.
+func (cp *Calc) carried() []byte {
+	return cp.buffer[cp.bufStart : cp.bufStart+cp.bufLen]
+}
 
-	// This is how we signal to the bottom of the stack that we are done
-	// which in turn collapses the rest all the way to resultCommP
-	close(cp.layerQueues[0])
+// carry copies input into the carry ring, at the position of the offset of
+// the stream it continues modulo the size of the ring. The ring is flushed
+// whenever the stream reaches that size, input must therefore not cross it.
+// Must be called with cp.mu held.
+func (cp *Calc) carry(input []byte) {
+	if cp.bufLen == 0 {
+		cp.bufStart = int(cp.bytesWritten() % uint64(len(cp.buffer)))
+	}
+	cp.bufLen += copy(cp.buffer[cp.bufStart+cp.bufLen:], input)
+}
 
-	paddedPieceSize = cp.quadsEnqueued * 128
+func paddedSizeForQuads(quads uint64) uint64 {
+	paddedPieceSize := quads * 128
 	// hacky round-up-to-next-pow2
 	if bits.OnesCount64(paddedPieceSize) != 1 {
 		paddedPieceSize = 1 << uint(64-bits.LeadingZeros64(paddedPieceSize))
 	}
-
-	return <-cp.resultCommP, paddedPieceSize, nil
+	return paddedPieceSize
 }
 
 // Write adds bytes to the accumulator, for a subsequent Digest(). Upon the
 // first call of this method a few goroutines are started in the background to
-// service each layer of the digest tower. If you wrote some data and then
+// service the layers of the digest tower. If you wrote some data and then
 // decide to abandon the object without invoking Digest(), you need to call
-// Reset() to terminate all remaining background workers. Unlike a typical
-// (hash.Hash).Write, calling this method can return an error when the total
-// amount of bytes is about to go over the maximum currently supported by
-// Filecoin.
+// Reset() to terminate all remaining background workers. These carry the
+// pprof labels commp.stage and commp.layer, in place of the labels of the
+// goroutine starting them. Unlike a typical (hash.Hash).Write, calling this
+// method can return an error when the total amount of bytes is about to go
+// over the maximum currently supported by Filecoin, or when the digest tower
+// suffered an internal failure.
 func (cp *Calc) Write(input []byte) (int, error) {
 	if len(input) == 0 {
 		return 0, nil
@@ -177,170 +513,472 @@ func (cp *Calc) Write(input []byte) (int, error) {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
 
-	if MaxPiecePayload <
-		(cp.quadsEnqueued*uint64(quadPayload))+
-			uint64(len(input)) {
+	span := cp.startSpan(SpanWrite)
+	n, err := cp.validatedWrite(input)
+	span.SetAttribute(AttrBytes, int64(n))
+	span.End(err)
+	return n, err
+}
+
+// WriteChunks Write()s every chunk produced by seq, an iter.Seq[[]byte], while
+// taking the lock of the Calc only once. It stops at the first error, and
+// returns the total amount of bytes written. Every other method of the Calc
+// blocks until seq is exhausted, including the time it spends waiting for
+// the next chunk. Chunks must not be modified by seq once yielded, until it
+// resumes.
+func (cp *Calc) WriteChunks(seq func(yield func([]byte) bool)) (written int64, err error) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	span := cp.startSpan(SpanWrite)
+	defer func() {
+		span.SetAttribute(AttrBytes, written)
+		span.End(err)
+	}()
+
+	seq(func(chunk []byte) bool {
+		var n int
+		n, err = cp.validatedWrite(chunk)
+		written += int64(n)
+		return err == nil
+	})
+	return written, err
+}
+
+// WriteVec Write()s the concatenation of bufs, such as a net.Buffers, without
+// actually concatenating them: quads spanning buffer boundaries are
+// assembled as the buffers are consumed. The lock of the Calc is taken only
+// once, and a total size that would exceed the maximum piece payload is
+// rejected with ErrPayloadTooLarge before any of it is written. Otherwise it
+// stops at the first error, returning the total amount of bytes written.
+func (cp *Calc) WriteVec(bufs [][]byte) (written int64, err error) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	span := cp.startSpan(SpanWrite)
+	defer func() {
+		span.SetAttribute(AttrBytes, written)
+		span.End(err)
+	}()
+
+	var total uint64
+	for _, b := range bufs {
+		total += uint64(len(b))
+	}
+	if cp.maxInput() < cp.bytesWritten()+total {
 		return 0, xerrors.Errorf(
-			"writing additional %d bytes to the accumulator would overflow the maximum supported unpadded piece size %d",
-			len(input), MaxPiecePayload,
+			"writing additional %d bytes to the accumulator would overflow the maximum supported piece input size %d: %w",
+			total, cp.maxInput(), ErrPayloadTooLarge,
 		)
 	}
 
-	// just starting: initialize internal state, start first background layer-goroutine
-	if cp.buffer == nil {
-		cp.buffer = make([]byte, 0, bufferSize)
-		cp.resultCommP = make(chan []byte, 1)
-		cp.layerQueues[0] = make(chan []byte, layerQueueDepth)
-		cp.addLayer(0)
+	for _, b := range bufs {
+		var n int
+		n, err = cp.validatedWrite(b)
+		written += int64(n)
+		if err != nil {
+			break
+		}
 	}
+	return written, err
+}
+
+// validatedWrite is Write() with cp.mu held.
+func (cp *Calc) validatedWrite(input []byte) (int, error) {
+	if len(input) == 0 {
+		return 0, nil
+	}
+	if err := cp.checkFinalized(); err != nil {
+		return 0, err
+	}
+	if err := cp.err(); err != nil {
+		return 0, err
+	}
+	if err := cp.checkMemoryCeiling(); err != nil {
+		return 0, err
+	}
+
+	if cp.maxInput() < cp.bytesWritten()+uint64(len(input)) {
+		return 0, xerrors.Errorf(
+			"writing additional %d bytes to the accumulator would overflow the maximum supported piece input size %d: %w",
+			len(input), cp.maxInput(), ErrPayloadTooLarge,
+		)
+	}
+
+	if cp.cfg.paddedInput {
+		if err := checkPadding(input, cp.bytesWritten()); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := cp.write(input)
+	cp.cfg.metrics.addBytes(uint64(n))
+	return n, err
+}
+
+// write is Write() without any of the validation, must be called with cp.mu
+// held.
+func (cp *Calc) write(input []byte) (int, error) {
+	cp.ensurePipeline()
+
+	slabSize := cp.slabSize()
+
+	// the carry buffer is flushed whenever the input reaches a multiple of
+	// slabSize, rather than whenever it is full: the two only differ when
+	// resuming a state serialized with a different slab size, and the former
+	// keeps every subsequent slab aligned to its own size
+	toSplice := slabSize - int(cp.bytesWritten()%uint64(slabSize))
 
 	// short Write() - just buffer it
-	if len(cp.buffer)+len(input) < bufferSize {
-		cp.buffer = append(cp.buffer, input...)
+	if len(input) < toSplice {
+		cp.carry(input)
 		return len(input), nil
 	}
 
 	totalInputBytes := len(input)
 
-	if toSplice := bufferSize - len(cp.buffer); toSplice < bufferSize {
-		cp.buffer = append(cp.buffer, input[:toSplice]...)
+	if toSplice < slabSize {
+		cp.carry(input[:toSplice])
 		input = input[toSplice:]
 
-		cp.digestQuads(cp.buffer)
-		cp.buffer = cp.buffer[:0]
+		if err := cp.digestQuads(cp.carried()); err != nil {
+			return 0, err
+		}
+		cp.bufLen = 0
 	}
 
-	// FIXME: suboptimal, limits each slab to a buffer size, but could go exponentially larger
-	for len(input) >= bufferSize {
-		cp.digestQuads(input[:bufferSize])
-		input = input[bufferSize:]
+	// digest as much as possible straight from the input, which for large
+	// Write()s makes for fewer, larger slabs
+	if whole := len(input) / slabSize * slabSize; whole > 0 {
+		if err := cp.digestQuads(input[:whole]); err != nil {
+			return 0, err
+		}
+		input = input[whole:]
 	}
 
 	if len(input) > 0 {
-		cp.buffer = append(cp.buffer, input...)
+		cp.carry(input)
 	}
 
 	return totalInputBytes, nil
 }
 
-// always called with power-of-2 amount of quads
-func (cp *Calc) digestQuads(inSlab []byte) {
+// WriteZeroes is equivalent to Write()ing n zero bytes, but much faster for
+// long runs: zero quads aligned to a power of 2 are not expanded and hashed,
+// the corresponding precomputed null-padding subtree is slotted into the tree
+// instead. The shortcut is not available on accumulators with a node sink,
+// which receive every node as usual.
+func (cp *Calc) WriteZeroes(n uint64) error {
+	if n == 0 {
+		return nil
+	}
 
-	quadsCount := len(inSlab) / 127
-	cp.quadsEnqueued += uint64(quadsCount)
-	outSlab := make([]byte, quadsCount*128)
-
-	for j := 0; j < quadsCount; j++ {
-		// Cycle over four(4) 31-byte groups, leaving 1 byte in between:
-		// 31 + 1 + 31 + 1 + 31 + 1 + 31 = 127
-		input := inSlab[j*127 : (j+1)*127]
-		expander := outSlab[j*128 : (j+1)*128]
-		inputPlus1, expanderPlus1 := input[1:], expander[1:]
-
-		// First 31 bytes + 6 bits are taken as-is (trimmed later)
-		// Note that copying them into the expansion buffer is mandatory:
-		// we will be feeding it to the workers which reuse the bottom half
-		// of the chunk for the result
-		copy(expander[:], input[:32])
-
-		// first 2-bit "shim" forced into the otherwise identical bitstream
-		expander[31] &= 0x3F
-
-		//  In: {{ C[7] C[6] }} X[7] X[6] X[5] X[4] X[3] X[2] X[1] X[0] Y[7] Y[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] Z[7] Z[6] Z[5]...
-		// Out:                 X[5] X[4] X[3] X[2] X[1] X[0] C[7] C[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] X[7] X[6] Z[5] Z[4] Z[3]...
-		for i := 31; i < 63; i++ {
-			expanderPlus1[i] = inputPlus1[i]<<2 | input[i]>>6
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if err := cp.checkFinalized(); err != nil {
+		return err
+	}
+	if err := cp.err(); err != nil {
+		return err
+	}
+	if err := cp.checkMemoryCeiling(); err != nil {
+		return err
+	}
+
+	if cp.maxInput() < cp.bytesWritten()+n {
+		return xerrors.Errorf(
+			"writing additional %d zero bytes to the accumulator would overflow the maximum supported piece input size %d: %w",
+			n, cp.maxInput(), ErrPayloadTooLarge,
+		)
+	}
+
+	if err := cp.writeZeroes(n); err != nil {
+		return err
+	}
+	cp.cfg.metrics.addBytes(n)
+	return nil
+}
+
+// writeZeroes hands the subtree roots directly to the folder, bypassing the
+// layers below. Must be called with cp.mu held.
+func (cp *Calc) writeZeroes(n uint64) error {
+	slabSize := uint64(cp.slabSize())
+	zeroes := make([]byte, min(n, slabSize))
+
+	if cp.cfg.nodeSink != nil {
+		for n > 0 {
+			chunk := min(n, slabSize)
+			if _, err := cp.write(zeroes[:chunk]); err != nil {
+				return err
+			}
+			n -= chunk
+		}
+		return nil
+	}
+
+	// fill up to a slab boundary, leaving the buffer empty
+	if rem := cp.bytesWritten() % slabSize; rem != 0 {
+		fill := min(n, slabSize-rem)
+		if _, err := cp.write(zeroes[:fill]); err != nil {
+			return err
 		}
+		n -= fill
+	}
 
-		// next 2-bit shim
-		expander[63] &= 0x3F
+	quadSize := uint64(cp.quadSize())
+	for n >= slabSize {
+		// the largest subtree fitting both the alignment and the run
+		quads := n / quadSize
+		if cp.quadsEnqueued != 0 {
+			quads = min(quads, cp.quadsEnqueued&-cp.quadsEnqueued)
+		}
+		quads = 1 << (bits.Len64(quads) - 1)
+		layer := uint(bits.TrailingZeros64(quads)) + 2 // 4 leaves per quad
 
-		//  In: {{ C[7] C[6] C[5] C[4] }} X[7] X[6] X[5] X[4] X[3] X[2] X[1] X[0] Y[7] Y[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] Z[7] Z[6] Z[5]...
-		// Out:                           X[3] X[2] X[1] X[0] C[7] C[6] C[5] C[4] Y[3] Y[2] Y[1] Y[0] X[7] X[6] X[5] X[4] Z[3] Z[2] Z[1]...
-		for i := 63; i < 95; i++ {
-			expanderPlus1[i] = inputPlus1[i]<<4 | input[i]>>4
+		cp.ensurePipeline()
+		if err := cp.submit(newTwin(stackedNulPadding[layer]), layer, (cp.quadsEnqueued*4)>>layer); err != nil {
+			return err
 		}
 
-		// next 2-bit shim
-		expander[95] &= 0x3F
+		cp.enqueue(quads)
+		n -= quads * quadSize
+	}
 
-		//  In: {{ C[7] C[6] C[5] C[4] C[3] C[2] }} X[7] X[6] X[5] X[4] X[3] X[2] X[1] X[0] Y[7] Y[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] Z[7] Z[6] Z[5]...
-		// Out:                                     X[1] X[0] C[7] C[6] C[5] C[4] C[3] C[2] Y[1] Y[0] X[7] X[6] X[5] X[4] X[3] X[2] Z[1] Z[0] Y[7]...
-		for i := 95; i < 126; i++ {
-			expanderPlus1[i] = inputPlus1[i]<<6 | input[i]>>2
+	if n > 0 {
+		if _, err := cp.write(zeroes[:n]); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// ensurePipeline initializes the internal state and starts the tower, unless
+// already running.
+func (cp *Calc) ensurePipeline() {
+	if cp.buffer == nil {
+		cp.initPipeline()
+		cp.startTower()
+	}
+}
+
+func (cp *Calc) initPipeline() {
+	cp.buffer = make([]byte, cp.slabSize())
+	cp.resultCommP = make(chan []byte, 1)
+	cp.syncDone = make(chan struct{})
+	cp.failed = make(chan struct{})
+	cp.order = make(chan *job, layerQueueDepth)
+	if cp.cfg.nodeSink == nil && !inlineReduce {
+		cp.work = make(chan *job, layerQueueDepth)
+	}
+	cp.jobs = make(chan *job, layerQueueDepth)
+	jobs := make([]job, layerQueueDepth)
+	for i := range jobs {
+		jobs[i].done = make(chan struct{}, 1)
+		cp.jobs <- &jobs[i]
+	}
+
+	cp.mem = newMemLimiter(cp.slabBudget())
+}
+
+// fail records the first internal failure and signals all layer workers to
+// bail out. Safe to call from any goroutine.
+func (cp *Calc) fail(err error) {
+	cp.failOnce.Do(func() {
+		cp.failure = err
+		close(cp.failed)
+	})
+}
+
+// err returns the internal failure recorded via fail(), if any.
+func (cp *Calc) err() error {
+	select {
+	case <-cp.failed:
+		return cp.failure
+	default:
+		return nil
+	}
+}
 
-		// the final 6 bit remainder is exactly the value of the last expanded byte
-		expander[127] = input[126] >> 2
+// sync pushes a barrier through the tower and waits for it to reach the
+// folder. Upon return every slab enqueued so far is fully
+// reduced, and the workers are idle until the next digestQuads(): the only
+// remaining tree state is what is held in layerTwins.
+func (cp *Calc) sync() error {
+	if cp.buffer == nil {
+		return nil
+	}
+	if err := cp.submit(nil, 0, 0); err != nil {
+		return err
 	}
+	select {
+	case <-cp.syncDone:
+		return nil
+	case <-cp.failed:
+		return cp.failure
+	}
+}
 
-	cp.layerQueues[0] <- outSlab
+// digestQuads sends a whole amount of quads down the tower, split into slabs
+// of a power of 2 amount of quads each aligned to its own size: the workers
+// would otherwise pair up nodes of one slab which are not siblings. The slabs
+// are as large as the alignment allows, up to largestSlabQuads().
+func (cp *Calc) digestQuads(in []byte) error {
+	qs := cp.quadSize()
+	largest := cp.largestSlabQuads()
+	for len(in) > 0 {
+		quads := min(uint64(len(in)/qs), largest)
+		if cp.quadsEnqueued != 0 {
+			quads = min(quads, cp.quadsEnqueued&-cp.quadsEnqueued)
+		}
+		quads = 1 << (bits.Len64(quads) - 1)
+
+		if err := cp.digestSlab(in[:quads*uint64(qs)]); err != nil {
+			return err
+		}
+		in = in[quads*uint64(qs):]
+	}
+	return nil
 }
 
-func (cp *Calc) addLayer(myIdx uint) {
-	// the next layer channel, which we might *not* use
-	if cp.layerQueues[myIdx+1] != nil {
-		panic("addLayer called more than once with identical idx argument")
+// always called with power-of-2 amount of quads
+func (cp *Calc) digestSlab(inSlab []byte) error {
+
+	// every slab is accounted for until the worker reducing it to a single
+	// node hands it back via recycle()
+	start := cp.transferStart()
+	if !cp.mem.acquire(len(inSlab)/cp.quadSize()*128, cp.failed) {
+		return cp.failure
 	}
-	cp.layerQueues[myIdx+1] = make(chan []byte, layerQueueDepth)
+	cp.transferStop(start)
+	cp.slabsInFlight.Add(1)
+	cp.cfg.metrics.addSlabs(1)
+	start = cp.cfg.stats.start()
 
-	go func() {
-		s256 := sha256simd.New()
-		var twinHold []byte
+	if cp.cfg.paddedInput {
+		// the workers reduce slabs in-place: never hand them the caller's input
+		cp.enqueue(uint64(len(inSlab) / 128))
+		outSlab := getSlab(len(inSlab))
+		copy(outSlab, inSlab)
+		cp.cfg.stats.stop(stageExpansion, start)
+		return cp.submit(outSlab, 0, (cp.quadsEnqueued-uint64(len(inSlab)/128))*4)
+	}
 
-		for {
-			slab, queueIsOpen := <-cp.layerQueues[myIdx]
+	quadsCount := len(inSlab) / 127
+	cp.enqueue(uint64(quadsCount))
+	outSlab := getSlab(quadsCount * 128)
 
-			// the dream is collapsing
-			if !queueIsOpen {
-				defer func() { twinHold = nil }()
+	// the expansion of zeroes is more zeroes
+	if isZero(inSlab[:quadsCount*127]) {
+		clear(outSlab)
+	} else {
+		padQuads(outSlab, inSlab[:quadsCount*127])
+	}
+	cp.cfg.stats.stop(stageExpansion, start)
 
-				// I am last
-				if myIdx == MaxLayers || cp.layerQueues[myIdx+2] == nil {
-					cp.resultCommP <- append(make([]byte, 0, 32), twinHold[0:32]...)
-					return
-				}
+	return cp.submit(outSlab, 0, (cp.quadsEnqueued-uint64(quadsCount))*4)
+}
 
-				if twinHold != nil {
-					copy(twinHold[32:64], stackedNulPadding[myIdx])
-					cp.hashSlab254(s256, 0, twinHold[0:64])
-					cp.layerQueues[myIdx+1] <- twinHold[0:64:64]
-				}
+// getSlab returns a buffer of the given size, recycled from the pool of the
+// matching size class if there is one. Its contents are undefined.
+func getSlab(size int) []byte {
+	class := slabClass(size)
+	if class < 0 {
+		return make([]byte, size)
+	}
+	if p, ok := slabPools[class].Get().(unsafe.Pointer); ok {
+		return unsafe.Slice((*byte)(p), size)
+	}
+	return make([]byte, size)
+}
 
-				// signal the next in line that they are done too
-				close(cp.layerQueues[myIdx+1])
-				return
-			}
+// putSlab returns a buffer obtained from getSlab() to the pool of its size
+// class, once nothing references it anymore. It is identified by its
+// capacity, hence it must never be called with anything else with the same
+// capacity as a size class.
+func putSlab(slab []byte) {
+	if class := slabClass(cap(slab)); class >= 0 {
+		slabPools[class].Put(unsafe.Pointer(unsafe.SliceData(slab)))
+	}
+}
 
-			switch {
-			case uint64(len(slab)) > uint64(1<<(5+myIdx)): // uint64 cast needed on 32-bit systems
-				cp.hashSlab254(s256, myIdx, slab)
-				cp.layerQueues[myIdx+1] <- slab
-			case twinHold != nil:
-				copy(twinHold[32:64], slab[0:32])
-				cp.hashSlab254(s256, 0, twinHold[0:64])
-				cp.layerQueues[myIdx+1] <- twinHold[0:32:64]
-				twinHold = nil
-			default:
-				twinHold = slab[0:32:64]
-				// avoid code below
-				continue
-			}
+// slabClass returns the index within slabPools of the given buffer size, or
+// -1 if there is no pool for it.
+func slabClass(size int) int {
+	if size < 64 || size&(size-1) != 0 {
+		return -1
+	}
+	if class := bits.TrailingZeros(uint(size)) - 6; class < len(slabPools) {
+		return class
+	}
+	return -1
+}
 
-			// Check whether we need another worker for what we just pushed
-			//
-			// n.b. we will not blow out of the preallocated layerQueues array,
-			// as we disallow Write()s above a certain threshold
-			if cp.layerQueues[myIdx+2] == nil {
-				cp.addLayer(myIdx + 1)
-			}
+// recycle returns a slab reduced to a single node to its pool, releasing it
+// from the accounting of WithMaxMemory(). Slabs produced by digestSlab() are
+// told apart from twin buffers pushed up the tower by their capacity, as
+// these are always larger.
+func (cp *Calc) recycle(slab []byte) {
+	if cap(slab) > 64 {
+		cp.mem.release(cap(slab))
+		cp.slabsInFlight.Add(-1)
+		cp.cfg.metrics.addSlabs(-1)
+	}
+	putSlab(slab)
+}
+
+// newTwin returns a twin buffer holding a copy of node, with room for the
+// twin to be appended in-place.
+func newTwin(node []byte) []byte {
+	twin := getSlab(64)[:32]
+	copy(twin, node)
+	return twin
+}
+
+// scheduled runs fn while holding a slot of the configured Scheduler, if any.
+// It returns false without running fn if the tower failed while waiting.
+func (cp *Calc) scheduled(fn func()) bool {
+	if !cp.cfg.scheduler.acquire(cp.failed) {
+		return false
+	}
+	defer cp.cfg.scheduler.release()
+	start := cp.cfg.stats.start()
+	fn()
+	cp.cfg.stats.stop(stageHashing, start)
+	return true
+}
+
+// emitNodes hands every node in slab, spaced stride bytes apart, to the
+// configured nodeSink, if any.
+func (cp *Calc) emitNodes(layer uint, firstIdx uint64, slab []byte, stride int) {
+	if cp.cfg.nodeSink == nil || cp.aborting.Load() {
+		return
+	}
+	var idx uint64
+	defer func() {
+		if r := recover(); r != nil {
+			panic(sinkPanic{layer, idx, r})
 		}
 	}()
+	for i := 0; i < len(slab); i += stride {
+		idx = firstIdx + uint64(i/stride)
+		cp.cfg.nodeSink(layer, idx, [32]byte(slab[i:i+32]))
+	}
 }
 
-func (cp *Calc) hashSlab254(h hash.Hash, layerIdx uint, slab []byte) {
+// hashSlab254 reduces every pair of siblings in slab, spaced stride bytes
+// apart, into their parent in place of the left sibling.
+func hashSlab254(h hash.Hash, layerIdx uint, slab []byte) {
 	stride := 1 << (5 + layerIdx)
+	nul := stackedNulPadding[layerIdx]
 	for i := 0; len(slab) > i+stride; i += 2 * stride {
+		// zero-run fast path: the parent of two all-zero subtrees is known
+		// upfront, no need to hash it again
+		if bytes.Equal(slab[i:i+32], nul) && bytes.Equal(slab[i+stride:i+stride+32], nul) {
+			copy(slab[i:i+32], stackedNulPadding[layerIdx+1])
+			continue
+		}
+
 		h.Reset()
 		h.Write(slab[i : i+32])
 		h.Write(slab[i+stride : 32+i+stride])
@@ -348,46 +986,120 @@ func (cp *Calc) hashSlab254(h hash.Hash, layerIdx uint, slab []byte) {
 	}
 }
 
-// PadCommP is experimental, do not use it.
+// ZeroPieceCommP returns the commP of a piece of the given padded size
+// consisting entirely of zeroes, derived instantly from a precomputed tower.
+func ZeroPieceCommP(paddedPieceSize uint64) ([]byte, error) {
+	if err := PaddedPieceSize(paddedPieceSize).Validate(); err != nil {
+		return nil, err
+	}
+	return append(make([]byte, 0, 32), stackedNulPadding[bits.TrailingZeros64(paddedPieceSize)-5]...), nil
+}
+
+// PadCommP returns the commP of a piece of targetPaddedSize, consisting of
+// the piece described by sourceCommP at its start followed by zeroes. This is
+// how a piece is expanded to the padded size of the deal it is stored in. The
+// returned slice never aliases sourceCommP.
 func PadCommP(sourceCommP []byte, sourcePaddedSize, targetPaddedSize uint64) ([]byte, error) {
+	steps, err := PadCommPSteps(sourceCommP, sourcePaddedSize, targetPaddedSize)
+	if err != nil {
+		return nil, err
+	}
+	return steps[len(steps)-1], nil
+}
+
+// PadCommPUnpadded is identical to PadCommP(), except that the target is
+// given as an unpadded piece size, which must be a power of 2 multiple of 127.
+func PadCommPUnpadded(sourceCommP []byte, sourcePaddedSize, targetUnpaddedSize uint64) ([]byte, error) {
+	if err := UnpaddedPieceSize(targetUnpaddedSize).Validate(); err != nil {
+		return nil, xerrors.Errorf("invalid target: %w", err)
+	}
+	return PadCommP(sourceCommP, sourcePaddedSize, uint64(UnpaddedPieceSize(targetUnpaddedSize).Padded()))
+}
+
+// PadCommPSteps is identical to PadCommP(), except that it returns the commP at
+// every power of 2 size on the way up: the first element is a copy of
+// sourceCommP, the element at index i is the commP of the piece padded to
+// sourcePaddedSize << i, and the last one is the commP at targetPaddedSize.
+func PadCommPSteps(sourceCommP []byte, sourcePaddedSize, targetPaddedSize uint64) ([][]byte, error) {
 
 	if len(sourceCommP) != 32 {
-		return nil, xerrors.Errorf("provided commP must be exactly 32 bytes long, got %d bytes instead", len(sourceCommP))
+		return nil, xerrors.Errorf("provided commP must be exactly 32 bytes long, got %d bytes instead: %w", len(sourceCommP), ErrInvalidCommP)
 	}
 	if bits.OnesCount64(sourcePaddedSize) != 1 {
-		return nil, xerrors.Errorf("source padded size %d is not a power of 2", sourcePaddedSize)
+		return nil, xerrors.Errorf("source padded size %d is not a power of 2: %w", sourcePaddedSize, ErrInvalidPieceSize)
 	}
 	if bits.OnesCount64(targetPaddedSize) != 1 {
-		return nil, xerrors.Errorf("target padded size %d is not a power of 2", targetPaddedSize)
+		return nil, xerrors.Errorf("target padded size %d is not a power of 2: %w", targetPaddedSize, ErrInvalidPieceSize)
 	}
 	if sourcePaddedSize > targetPaddedSize {
-		return nil, xerrors.Errorf("source padded size %d larger than target padded size %d", sourcePaddedSize, targetPaddedSize)
+		return nil, xerrors.Errorf("source padded size %d larger than target padded size %d: %w", sourcePaddedSize, targetPaddedSize, ErrInvalidPieceSize)
 	}
 	if sourcePaddedSize < 128 {
-		return nil, xerrors.Errorf("source padded size %d smaller than the minimum of 128 bytes", sourcePaddedSize)
+		return nil, xerrors.Errorf("source padded size %d smaller than the minimum of 128 bytes: %w", sourcePaddedSize, ErrInvalidPieceSize)
 	}
 	if targetPaddedSize > MaxPieceSize {
-		return nil, xerrors.Errorf("target padded size %d larger than Filecoin maximum of %d bytes", targetPaddedSize, MaxPieceSize)
+		return nil, xerrors.Errorf("target padded size %d larger than Filecoin maximum of %d bytes: %w", targetPaddedSize, MaxPieceSize, ErrInvalidPieceSize)
 	}
 
-	// noop
-	if sourcePaddedSize == targetPaddedSize {
-		return sourceCommP, nil
+	s := bits.TrailingZeros64(sourcePaddedSize)
+	t := bits.TrailingZeros64(targetPaddedSize)
+
+	steps := make([][]byte, 1, t-s+1)
+	steps[0] = append(make([]byte, 0, 32), sourceCommP...)
+
+	h := newHasher()
+	for ; s < t; s++ {
+		h.Reset()
+		h.Write(steps[len(steps)-1])
+		h.Write(stackedNulPadding[s-5]) // account for 32byte chunks + off-by-one padding tower offset
+		out := h.Sum(make([]byte, 0, 32))
+		out[31] &= 0x3F
+		steps = append(steps, out)
 	}
 
-	out := make([]byte, 32)
-	copy(out, sourceCommP)
+	return steps, nil
+}
+
+// GraftCommP returns the commP of a piece of enclosingPaddedSize consisting of
+// zeroes, with the piece described by sourceCommP placed at offset within it.
+// The offset must be a multiple of sourcePaddedSize, which is how pieces are
+// aligned within aggregates and sectors. PadCommP() is the special case of a
+// graft at offset 0.
+func GraftCommP(sourceCommP []byte, sourcePaddedSize, offset, enclosingPaddedSize uint64) ([]byte, error) {
+	if len(sourceCommP) != 32 {
+		return nil, xerrors.Errorf("provided commP must be exactly 32 bytes long, got %d bytes instead: %w", len(sourceCommP), ErrInvalidCommP)
+	}
+	if bits.OnesCount64(sourcePaddedSize) != 1 || sourcePaddedSize < 128 {
+		return nil, xerrors.Errorf("source padded size %d is not a power of 2 of at least 128: %w", sourcePaddedSize, ErrInvalidPieceSize)
+	}
+	if bits.OnesCount64(enclosingPaddedSize) != 1 || enclosingPaddedSize > MaxPieceSize {
+		return nil, xerrors.Errorf("enclosing padded size %d is not a power of 2 up to %d: %w", enclosingPaddedSize, MaxPieceSize, ErrInvalidPieceSize)
+	}
+	if offset%sourcePaddedSize != 0 {
+		return nil, xerrors.Errorf("offset %d is not a multiple of the source padded size %d: %w", offset, sourcePaddedSize, ErrInvalidPieceSize)
+	}
+	if sourcePaddedSize > enclosingPaddedSize || offset > enclosingPaddedSize-sourcePaddedSize {
+		return nil, xerrors.Errorf("source piece of padded size %d at offset %d does not fit within enclosing padded size %d: %w", sourcePaddedSize, offset, enclosingPaddedSize, ErrInvalidPieceSize)
+	}
 
 	s := bits.TrailingZeros64(sourcePaddedSize)
-	t := bits.TrailingZeros64(targetPaddedSize)
+	t := bits.TrailingZeros64(enclosingPaddedSize)
+	idx := offset / sourcePaddedSize
 
-	h := sha256simd.New()
+	out := append(make([]byte, 0, 32), sourceCommP...)
+	h := newHasher()
 	for ; s < t; s++ {
 		h.Reset()
-		h.Write(out)
-		h.Write(stackedNulPadding[s-5]) // account for 32byte chunks + off-by-one padding tower offset
+		if idx&1 == 0 {
+			h.Write(out)
+			h.Write(stackedNulPadding[s-5])
+		} else {
+			h.Write(stackedNulPadding[s-5])
+			h.Write(out)
+		}
 		out = h.Sum(out[:0])
 		out[31] &= 0x3F
+		idx >>= 1
 	}
 
 	return out, nil
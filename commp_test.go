@@ -3,12 +3,17 @@ package commp
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/base32"
+	"errors"
 	"fmt"
 	"io"
+	"math/bits"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	randmath "math/rand"
@@ -18,30 +23,42 @@ type testCase struct {
 	PayloadSize int64
 	PieceSize   uint64
 	RawCommP    []byte
+	PieceCID    string
 }
 
 const benchSize = 31 << 20 // MiB
 
 func BenchmarkCommP(b *testing.B) {
-	// reuse both the calculator and reader in every loop
-	// the source is rewound explicitly
-	// the calc is reset implicitly on Digest()
-	src := bytes.NewReader(make([]byte, benchSize))
-	cp := &Calc{}
+	random := make([]byte, benchSize)
+	randmath.New(randmath.NewSource(1)).Read(random)
 
-	b.ReportAllocs()
-	b.ResetTimer()
-	b.SetBytes(benchSize)
-	for i := 0; i < b.N; i++ {
-		if _, err := src.Seek(0, 0); err != nil {
-			b.Fatal(err)
-		}
-		if _, err := io.Copy(cp, src); err != nil {
-			b.Fatal(err)
-		}
-		if _, _, err := cp.Digest(); err != nil {
-			b.Fatal(err)
-		}
+	for name, payload := range map[string][]byte{
+		"random": random,
+		"zero":   make([]byte, benchSize),
+	} {
+		payload := payload
+		b.Run(name, func(b *testing.B) {
+			// reuse both the calculator and reader in every loop
+			// both are rewound explicitly
+			src := bytes.NewReader(payload)
+			cp := &Calc{}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.SetBytes(benchSize)
+			for i := 0; i < b.N; i++ {
+				cp.Reset()
+				if _, err := src.Seek(0, 0); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(cp, src); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := cp.Digest(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
 	}
 }
 
@@ -249,8 +266,799 @@ func getTestCases(path string, shortOnly bool) ([]testCase, error) {
 			PayloadSize: payloadSize,
 			PieceSize:   pieceSize,
 			RawCommP:    rawCid[len(rawCid)-32:],
+			PieceCID:    parts[2],
 		})
 	}
 
 	return ret, nil
 }
+
+func TestPanicContainment(t *testing.T) {
+	t.Parallel()
+
+	for _, layer := range []uint{0, 3, 9} {
+		cp := New(WithNodeSink(func(l uint, idx uint64, _ [32]byte) {
+			if l == layer && idx == 5 {
+				panic("sink bailing out")
+			}
+		}))
+		if _, err := cp.Write(make([]byte, 300<<10)); err != nil && !errors.Is(err, ErrInternalFailure) {
+			t.Fatal(err)
+		}
+		_, _, err := cp.Digest()
+		if !errors.Is(err, ErrInternalFailure) {
+			t.Fatalf("unexpected error %v, expected %v", err, ErrInternalFailure)
+		}
+		for _, exp := range []string{"sink bailing out", fmt.Sprintf("layer %d at padded offset %d", layer, uint64(5)<<(5+layer))} {
+			if !strings.Contains(err.Error(), exp) {
+				t.Fatalf("error %q does not mention %q", err, exp)
+			}
+		}
+	}
+}
+
+func TestSnapshotDigest(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 5<<20+17)
+	randmath.New(randmath.NewSource(1337)).Read(payload)
+
+	cp := &Calc{}
+	if _, _, err := cp.SnapshotDigest(); err == nil {
+		t.Fatal("unexpected success digesting an empty accumulator")
+	}
+
+	var written int
+	for _, upTo := range []int{64, 65, 1000, bufferSize, 3<<20 + 1, len(payload)} {
+		if _, err := cp.Write(payload[written:upTo]); err != nil {
+			t.Fatal(err)
+		}
+		written = upTo
+
+		snapCommP, snapSize, err := cp.SnapshotDigest()
+		if upTo < int(MinPiecePayload) {
+			if err == nil {
+				t.Fatalf("unexpected success digesting %d bytes", upTo)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expCommP, expSize := mustDigest(t, &Calc{}, payload[:upTo])
+		if snapSize != expSize {
+			t.Fatalf("snapshot at %d: padded size %d doesn't match expected size %d", upTo, snapSize, expSize)
+		}
+		if !bytes.Equal(snapCommP, expCommP) {
+			t.Fatalf("snapshot at %d: commP 0x%X doesn't match expected 0x%X", upTo, snapCommP, expCommP)
+		}
+		if sum := cp.Sum([]byte{0x42}); !bytes.Equal(sum, append([]byte{0x42}, expCommP...)) {
+			t.Fatalf("snapshot at %d: Sum() 0x%X doesn't match expected 0x42%X", upTo, sum, expCommP)
+		}
+	}
+
+	// the original is still good for a final destructive Digest()
+	finalCommP, _, err := cp.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expCommP, _ := mustDigest(t, &Calc{}, payload); !bytes.Equal(finalCommP, expCommP) {
+		t.Fatalf("final commP 0x%X doesn't match expected 0x%X", finalCommP, expCommP)
+	}
+}
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 3<<20)
+	randmath.New(randmath.NewSource(42)).Read(payload)
+	prefixLen := 1<<20 + 5
+
+	orig := &Calc{}
+	if _, err := orig.Write(payload[:prefixLen]); err != nil {
+		t.Fatal(err)
+	}
+	clone := orig.Clone()
+
+	// diverge: the original takes the rest of the payload, the clone a trailer
+	trailer := bytes.Repeat([]byte{0xCC}, 4096)
+	origCommP, origSize := mustDigest(t, orig, payload[prefixLen:])
+	cloneCommP, cloneSize := mustDigest(t, clone, trailer)
+
+	expCommP, expSize := mustDigest(t, &Calc{}, payload)
+	if origSize != expSize || !bytes.Equal(origCommP, expCommP) {
+		t.Fatalf("original produced 0x%X/%d, expected 0x%X/%d", origCommP, origSize, expCommP, expSize)
+	}
+	expCommP, expSize = mustDigest(t, &Calc{}, append(append([]byte{}, payload[:prefixLen]...), trailer...))
+	if cloneSize != expSize || !bytes.Equal(cloneCommP, expCommP) {
+		t.Fatalf("clone produced 0x%X/%d, expected 0x%X/%d", cloneCommP, cloneSize, expCommP, expSize)
+	}
+
+	// cloning an empty accumulator yields an empty accumulator
+	if _, _, err := (&Calc{}).Clone().Digest(); err == nil {
+		t.Fatal("unexpected success digesting a clone of an empty accumulator")
+	}
+}
+
+func TestAccumulatedCounts(t *testing.T) {
+	t.Parallel()
+
+	cp := &Calc{}
+	var written uint64
+	for _, n := range []int{10, 54, 1, 62, 1000, bufferSize, 3 * bufferSize, 5<<20 + 3} {
+		if _, err := cp.Write(make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+		written += uint64(n)
+
+		if cp.BytesWritten() != written {
+			t.Fatalf("reported %d bytes written, expected %d", cp.BytesWritten(), written)
+		}
+		if q := cp.QuadsEnqueued(); q > written/127 || written-q*127 >= uint64(bufferSize) {
+			t.Fatalf("reported %d quads enqueued, which is inconsistent with %d bytes written", q, written)
+		}
+
+		projected := cp.ProjectedPaddedPieceSize()
+		if written < MinPiecePayload {
+			if projected != 0 {
+				t.Fatalf("reported projected size %d for just %d bytes written", projected, written)
+			}
+			continue
+		}
+		if _, paddedSize, err := cp.Clone().Digest(); err != nil {
+			t.Fatal(err)
+		} else if projected != paddedSize {
+			t.Fatalf("reported projected size %d, but digest is of size %d", projected, paddedSize)
+		}
+	}
+
+	if _, _, err := cp.Digest(); err != nil {
+		t.Fatal(err)
+	}
+	if cp.BytesWritten() != 0 || cp.QuadsEnqueued() != 0 || cp.ProjectedPaddedPieceSize() != 0 {
+		t.Fatal("counters not reset after Digest()")
+	}
+}
+
+func TestCarryBuffer(t *testing.T) {
+	// not parallel: AllocsPerRun() does not support it
+
+	payload := make([]byte, 4*bufferSize)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	exp, _ := mustDigest(t, &Calc{}, payload)
+
+	cp := &Calc{}
+	if _, err := cp.Write(payload[:1]); err != nil {
+		t.Fatal(err)
+	}
+	carry := &cp.buffer[:1][0]
+
+	// short writes only copy into the carry buffer, without allocating
+	pos := 1
+	if allocs := testing.AllocsPerRun(50, func() {
+		cp.Write(payload[pos : pos+13])
+		pos += 13
+	}); allocs != 0 {
+		t.Fatalf("short writes allocated %.1f times", allocs)
+	}
+
+	// nor does crossing slab boundaries
+	for _, n := range []int{bufferSize - 5, 1, bufferSize + 1000, 300, -1} {
+		if n < 0 {
+			n = len(payload) - pos
+		}
+		if _, err := cp.Write(payload[pos : pos+n]); err != nil {
+			t.Fatal(err)
+		}
+		pos += n
+		if &cp.buffer[:1][0] != carry {
+			t.Fatalf("carry buffer reallocated after writing %d bytes", pos)
+		}
+		// carried bytes sit in the ring at their offset, never shifted
+		if end := cp.bufStart + cp.bufLen; cp.bufLen > 0 && end != pos%len(cp.buffer) {
+			t.Fatalf("carried bytes end at %d of the ring after writing %d bytes, expected %d", end, pos, pos%len(cp.buffer))
+		}
+	}
+	if commP, _, err := cp.Digest(); err != nil || !bytes.Equal(commP, exp) {
+		t.Fatalf("commP 0x%X doesn't match expected 0x%X: %v", commP, exp, err)
+	}
+}
+
+func TestLargeWrites(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 24<<20+1000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+
+	// reference: the same payload fed one slab at a time
+	ref := &Calc{}
+	for rest := payload; len(rest) > 0; rest = rest[min(len(rest), bufferSize):] {
+		if _, err := ref.Write(rest[:min(len(rest), bufferSize)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exp, expSize, err := ref.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every leaf must arrive exactly once, in order, regardless of how large
+	// and how aligned the slabs carrying them are
+	var nextLeaf uint64
+	var mu sync.Mutex
+	sink := func(layer uint, idx uint64, _ [32]byte) {
+		if layer != 0 {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if idx != nextLeaf {
+			t.Errorf("leaf %d delivered, expected %d", idx, nextLeaf)
+		}
+		nextLeaf = idx + 1
+	}
+
+	cp := New(WithNodeSink(sink))
+	pos := 0
+	for _, n := range []int{1, 3*bufferSize + 7, 9 << 20, 5, 4<<20 + 1, len(payload)} {
+		n = min(n, len(payload)-pos)
+		if _, err := cp.Write(payload[pos : pos+n]); err != nil {
+			t.Fatal(err)
+		}
+		pos += n
+	}
+	commP, paddedSize, err := cp.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(commP, exp) || paddedSize != expSize {
+		t.Fatalf("commP 0x%X/%d doesn't match expected 0x%X/%d", commP, paddedSize, exp, expSize)
+	}
+	if exp := (uint64(len(payload)) + 126) / 127 * 4; nextLeaf != exp {
+		t.Fatalf("%d leaves delivered, expected %d", nextLeaf, exp)
+	}
+}
+
+func TestTailFlush(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 2*bufferSize)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+
+	// tails of every shape the flush splits into aligned slabs, behind both
+	// a full slab and a lone quad
+	for _, head := range []int{0, 127, bufferSize} {
+		for _, tail := range []int{65, 127, 128, 3*127 + 1, 7 * 127, 100*127 + 5, bufferSize - 1} {
+			if head+tail > len(payload) {
+				continue
+			}
+			commP, _ := mustDigest(t, &Calc{}, payload[:head+tail])
+			if exp := naiveCommP(payload[:head+tail]); !bytes.Equal(commP, exp) {
+				t.Fatalf("%d+%d bytes: commP 0x%X doesn't match expected 0x%X", head, tail, commP, exp)
+			}
+		}
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	t.Parallel()
+
+	cp := &Calc{}
+	if _, _, err := cp.Digest(); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrBelowMinimumPayload)
+	}
+	if _, err := cp.Write(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cp.Digest(); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrBelowMinimumPayload)
+	}
+	cp.Reset()
+
+	cp.quadsEnqueued = MaxPiecePayload / uint64(quadPayload)
+	if _, err := cp.Write(make([]byte, 128)); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrPayloadTooLarge)
+	}
+	cp.Reset()
+
+	if err := cp.UnmarshalBinary([]byte("garbage")); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInvalidState)
+	}
+
+	if _, err := PadCommP(make([]byte, 31), 128, 256); !errors.Is(err, ErrInvalidCommP) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInvalidCommP)
+	}
+	for _, sizes := range [][2]uint64{
+		{129, 256},
+		{128, 257},
+		{256, 128},
+		{64, 128},
+		{128, MaxPieceSize * 2},
+	} {
+		if _, err := PadCommP(make([]byte, 32), sizes[0], sizes[1]); !errors.Is(err, ErrInvalidPieceSize) {
+			t.Fatalf("%d => %d: unexpected error %v, expected %v", sizes[0], sizes[1], err, ErrInvalidPieceSize)
+		}
+	}
+}
+
+func TestInternalFailure(t *testing.T) {
+	t.Parallel()
+
+	cp := &Calc{}
+	if _, err := cp.Write(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a slab not made of whole nodes is rejected before hashSlab254 gets to
+	// slice out of bounds
+	cp.mu.Lock()
+	cp.submit(make([]byte, 33), 0, 0)
+	cp.mu.Unlock()
+	<-cp.failed
+	if msg := cp.failure.Error(); !strings.Contains(msg, "slab of 33 bytes at layer 0") {
+		t.Fatalf("unexpected failure %q", msg)
+	}
+
+	if _, err := cp.Write(make([]byte, 10)); !errors.Is(err, ErrInternalFailure) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInternalFailure)
+	}
+	if _, err := cp.MarshalBinary(); !errors.Is(err, ErrInternalFailure) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInternalFailure)
+	}
+	if _, _, err := cp.Clone().Digest(); !errors.Is(err, ErrInternalFailure) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInternalFailure)
+	}
+	if _, _, err := cp.Digest(); !errors.Is(err, ErrInternalFailure) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInternalFailure)
+	}
+
+	// Digest() reset the failed state, the object is reusable
+	payload := make([]byte, 1<<20)
+	expCommP, _ := mustDigest(t, &Calc{}, payload)
+	if commP, _ := mustDigest(t, cp, payload); !bytes.Equal(commP, expCommP) {
+		t.Fatalf("produced commP 0x%X doesn't match expected 0x%X", commP, expCommP)
+	}
+
+	// same for Reset() after a failure mid-tower
+	cp.Reset()
+	if _, err := cp.Write(make([]byte, 4*bufferSize)); err != nil {
+		t.Fatal(err)
+	}
+	cp.mu.Lock()
+	cp.submit(make([]byte, 65), 1, 0)
+	cp.mu.Unlock()
+	<-cp.failed
+	cp.Reset()
+	if commP, _ := mustDigest(t, cp, payload); !bytes.Equal(commP, expCommP) {
+		t.Fatalf("produced commP 0x%X doesn't match expected 0x%X", commP, expCommP)
+	}
+}
+
+func TestPadCommP(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 1000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	commP, paddedSize := mustDigest(t, &Calc{}, payload)
+
+	steps, err := PadCommPSteps(commP, paddedSize, paddedSize<<4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 5 {
+		t.Fatalf("unexpected %d steps", len(steps))
+	}
+	for i, step := range steps {
+		// the padded piece is the payload followed by zeroes
+		size := paddedSize << i
+		exp, _ := mustDigest(t, &Calc{}, append(append([]byte{}, payload...), make([]byte, int(size/128*127)-len(payload))...))
+		if !bytes.Equal(step, exp) {
+			t.Fatalf("step %d: commP 0x%X doesn't match expected 0x%X", i, step, exp)
+		}
+
+		padded, err := PadCommP(commP, paddedSize, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpadded, err := PadCommPUnpadded(commP, paddedSize, size/128*127)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(padded, exp) || !bytes.Equal(unpadded, exp) {
+			t.Fatalf("size %d: commPs 0x%X / 0x%X don't match expected 0x%X", size, padded, unpadded, exp)
+		}
+	}
+
+	same, err := PadCommP(commP, paddedSize, paddedSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same[0] ^= 1
+	if bytes.Equal(same, commP) {
+		t.Fatal("padded commP aliases the source")
+	}
+
+	if _, err := PadCommPUnpadded(commP, paddedSize, paddedSize*2); !errors.Is(err, ErrInvalidPieceSize) {
+		t.Fatalf("unexpected result for a padded size passed as unpadded: %v", err)
+	}
+}
+
+func TestDigestPadded(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 1000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	commP, paddedSize := mustDigest(t, &Calc{}, payload)
+
+	cp := &Calc{}
+	if _, err := cp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []uint64{0, 3 * paddedSize, paddedSize / 2, MaxPieceSize * 2} {
+		if _, _, _, err := cp.DigestPadded(target); !errors.Is(err, ErrInvalidPieceSize) {
+			t.Fatalf("%d: unexpected result %v", target, err)
+		}
+	}
+	if n := cp.BytesWritten(); n != uint64(len(payload)) {
+		t.Fatalf("rejected target changed the accumulated amount to %d", n)
+	}
+
+	padded, pieceSize, targetSize, err := cp.DigestPadded(paddedSize << 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := PadCommP(commP, paddedSize, paddedSize<<3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(padded, exp) || pieceSize != paddedSize || targetSize != paddedSize<<3 {
+		t.Fatalf("padded commP 0x%X/%d/%d doesn't match expected 0x%X/%d/%d", padded, pieceSize, targetSize, exp, paddedSize, paddedSize<<3)
+	}
+	if n := cp.BytesWritten(); n != 0 {
+		t.Fatalf("accumulator not reset after digesting, still holding %d bytes", n)
+	}
+}
+
+func TestGraftCommP(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 1000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	commP, paddedSize := mustDigest(t, &Calc{}, payload)
+
+	enclosing := paddedSize << 4
+	for offset := uint64(0); offset < enclosing; offset += paddedSize {
+		// the enclosing piece is zeroes, with the payload at the unpadded offset
+		whole := make([]byte, enclosing/128*127)
+		copy(whole[offset/128*127:], payload)
+		exp, _ := mustDigest(t, &Calc{}, whole)
+
+		grafted, err := GraftCommP(commP, paddedSize, offset, enclosing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(grafted, exp) {
+			t.Fatalf("offset %d: commP 0x%X doesn't match expected 0x%X", offset, grafted, exp)
+		}
+	}
+
+	if same, err := GraftCommP(commP, paddedSize, 0, paddedSize); err != nil || !bytes.Equal(same, commP) {
+		t.Fatalf("graft onto itself 0x%X doesn't match 0x%X: %v", same, commP, err)
+	}
+
+	for _, bad := range [][3]uint64{
+		{paddedSize, 0, paddedSize / 2},
+		{paddedSize, paddedSize / 2, enclosing},
+		{paddedSize, enclosing, enclosing},
+		{paddedSize, 0, 3 * paddedSize},
+		{paddedSize, 0, MaxPieceSize * 2},
+		{64, 0, enclosing},
+	} {
+		if _, err := GraftCommP(commP, bad[0], bad[1], bad[2]); !errors.Is(err, ErrInvalidPieceSize) {
+			t.Fatalf("%v: unexpected result %v", bad, err)
+		}
+	}
+	if _, err := GraftCommP(commP[1:], paddedSize, 0, enclosing); !errors.Is(err, ErrInvalidCommP) {
+		t.Fatalf("unexpected result grafting a short commP: %v", err)
+	}
+}
+
+func TestZeroPieceCommP(t *testing.T) {
+	t.Parallel()
+
+	for size := uint64(128); size <= 1<<20; size <<= 1 {
+		exp, _ := mustDigest(t, &Calc{}, make([]byte, size/128*127))
+		commP, err := ZeroPieceCommP(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(commP, exp) {
+			t.Fatalf("zero commP 0x%X of size %d doesn't match expected 0x%X", commP, size, exp)
+		}
+	}
+
+	// the largest size is a single padding step above the one below it
+	top, err := ZeroPieceCommP(MaxPieceSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	below, err := ZeroPieceCommP(MaxPieceSize / 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, err := PadCommP(below, MaxPieceSize/2, MaxPieceSize); err != nil || !bytes.Equal(top, exp) {
+		t.Fatalf("zero commP 0x%X of the maximum size doesn't match expected 0x%X: %v", top, exp, err)
+	}
+
+	for _, size := range []uint64{0, 64, 129, MaxPieceSize * 2} {
+		if _, err := ZeroPieceCommP(size); !errors.Is(err, ErrInvalidPieceSize) {
+			t.Fatalf("%d: unexpected result %v", size, err)
+		}
+	}
+}
+
+func TestZeroRuns(t *testing.T) {
+	t.Parallel()
+
+	rng := randmath.New(randmath.NewSource(1))
+	for _, pos := range []int{-1, 0, 126, 127, 4096, bufferSize - 1, bufferSize, 5*bufferSize + 77} {
+		payload := make([]byte, 8*bufferSize+3)
+		if pos >= 0 {
+			// a short burst of data within an otherwise empty payload
+			rng.Read(payload[pos : pos+1+rng.Intn(300)])
+		}
+
+		commP, _ := mustDigest(t, &Calc{}, payload)
+		if exp := naiveCommP(payload); !bytes.Equal(commP, exp) {
+			t.Fatalf("data at %d: commP 0x%X doesn't match expected 0x%X", pos, commP, exp)
+		}
+	}
+}
+
+// naiveCommP computes the commP of payload by hashing the entire padded tree,
+// without any shortcuts.
+func naiveCommP(payload []byte) []byte {
+	quads := (len(payload) + 126) / 127
+	in := append(append([]byte{}, payload...), make([]byte, quads*127-len(payload))...)
+	leaves := 1
+	for leaves < quads*4 {
+		leaves *= 2
+	}
+	layer := make([]byte, leaves*32)
+	padQuads(layer, in)
+
+	for len(layer) > 32 {
+		for i := 0; i < len(layer)/64; i++ {
+			d := sha256.Sum256(layer[i*64 : i*64+64])
+			d[31] &= 0x3F
+			copy(layer[i*32:], d[:])
+		}
+		layer = layer[:len(layer)/2]
+	}
+	return layer
+}
+
+func TestWriteZeroes(t *testing.T) {
+	t.Parallel()
+
+	rng := randmath.New(randmath.NewSource(1))
+	for _, runs := range [][]int{
+		{0, 127},
+		{0, 8 * bufferSize},
+		{1, 8*bufferSize - 1},
+		{bufferSize, 3 * bufferSize, 5, 4 << 20},
+		{0, 3*bufferSize + 11, 300, 7 * bufferSize, 1},
+		{bufferSize - 1, 1 << 20, bufferSize + 1, 2 << 20, 65},
+	} {
+		// alternating runs of data and zeroes
+		var payload []byte
+		for i, n := range runs {
+			run := make([]byte, n)
+			if i%2 == 0 {
+				rng.Read(run)
+			}
+			payload = append(payload, run...)
+		}
+		exp, expSize := mustDigest(t, &Calc{}, payload)
+
+		nc := &nodeCollector{}
+		for name, cp := range map[string]*Calc{"plain": {}, "sink": New(WithNodeSink(nc.sink))} {
+			var pos int
+			for i, n := range runs {
+				if i%2 == 0 {
+					if _, err := cp.Write(payload[pos : pos+n]); err != nil {
+						t.Fatal(err)
+					}
+				} else if err := cp.WriteZeroes(uint64(n)); err != nil {
+					t.Fatal(err)
+				}
+				pos += n
+
+				// the state after slotting in zero subtrees survives a roundtrip
+				if i == 1 {
+					st, err := cp.MarshalBinary()
+					if err != nil {
+						t.Fatal(err)
+					}
+					cp.Reset()
+					if err := cp.UnmarshalBinary(st); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			commP, paddedSize, err := cp.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(commP, exp) || paddedSize != expSize {
+				t.Fatalf("%v %s: commP 0x%X/%d doesn't match expected 0x%X/%d", runs, name, commP, paddedSize, exp, expSize)
+			}
+		}
+		if root := nc.nodes[[2]uint64{uint64(bits.TrailingZeros64(expSize / 32)), 0}]; !bytes.Equal(root[:], exp) {
+			t.Fatalf("%v: node sink root 0x%X doesn't match expected 0x%X", runs, root, exp)
+		}
+	}
+
+	cp := &Calc{}
+	if err := cp.WriteZeroes(MaxPiecePayload + 1); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("unexpected result writing too many zeroes: %v", err)
+	}
+}
+
+func TestCalcState(t *testing.T) {
+	t.Parallel()
+
+	cp := &Calc{}
+	if s := cp.State(); s != CalcReady {
+		t.Fatalf("fresh accumulator is %s", s)
+	}
+	if _, err := cp.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if s := cp.State(); s != CalcAccumulating {
+		t.Fatalf("written accumulator is %s", s)
+	}
+	state, err := cp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, _, err := cp.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := cp.State(); s != CalcFinalized {
+		t.Fatalf("digested accumulator is %s", s)
+	}
+
+	// anything but a rearm is misuse
+	for name, misuse := range map[string]func() error{
+		"Write":         func() error { _, err := cp.Write(make([]byte, 1000)); return err },
+		"WriteZeroes":   func() error { return cp.WriteZeroes(1000) },
+		"Digest":        func() error { _, _, err := cp.Digest(); return err },
+		"DigestPadded":  func() error { _, _, _, err := cp.DigestPadded(1 << 20); return err },
+		"MarshalBinary": func() error { _, err := cp.MarshalBinary(); return err },
+		"Clone":         func() error { _, _, err := cp.Clone().Digest(); return err },
+	} {
+		if err := misuse(); !errors.Is(err, ErrFinalized) {
+			t.Fatalf("%s: unexpected error %v, expected %v", name, err, ErrFinalized)
+		}
+		if s := cp.State(); s != CalcFinalized {
+			t.Fatalf("%s: accumulator turned %s", name, s)
+		}
+	}
+
+	// restoring a state rearms as well
+	if err := cp.UnmarshalBinary(state); err != nil {
+		t.Fatal(err)
+	}
+	if s := cp.State(); s != CalcAccumulating {
+		t.Fatalf("restored accumulator is %s", s)
+	}
+	if commP, _, err := cp.Digest(); err != nil || !bytes.Equal(commP, exp) {
+		t.Fatalf("restored commP 0x%X doesn't match expected 0x%X: %v", commP, exp, err)
+	}
+
+	cp.Reset()
+	if s := cp.State(); s != CalcReady {
+		t.Fatalf("reset accumulator is %s", s)
+	}
+	if _, err := cp.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	cp.Reset()
+}
+
+func TestWriteChunks(t *testing.T) {
+	t.Parallel()
+
+	rng := randmath.New(randmath.NewSource(1))
+	payload := make([]byte, 5*bufferSize+777)
+	rng.Read(payload)
+	exp, expSize := mustDigest(t, &Calc{}, payload)
+
+	var chunks [][]byte
+	for rest := payload; len(rest) > 0; {
+		n := min(len(rest), rng.Intn(2*bufferSize))
+		chunks = append(chunks, rest[:n])
+		rest = rest[n:]
+	}
+	seq := func(yield func([]byte) bool) {
+		for _, c := range chunks {
+			if !yield(c) {
+				return
+			}
+		}
+	}
+
+	cp := &Calc{}
+	if n, err := cp.WriteChunks(seq); err != nil || n != int64(len(payload)) {
+		t.Fatalf("wrote %d out of %d bytes: %v", n, len(payload), err)
+	}
+	commP, paddedSize, err := cp.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(commP, exp) || paddedSize != expSize {
+		t.Fatalf("produced commP 0x%X/%d doesn't match expected 0x%X/%d", commP, paddedSize, exp, expSize)
+	}
+
+	// the sequence is stopped at the first error
+	var yielded int
+	bad := func(yield func([]byte) bool) {
+		for _, c := range [][]byte{make([]byte, 256), bytes.Repeat([]byte{0xFF}, 128), make([]byte, 128)} {
+			yielded++
+			if !yield(c) {
+				return
+			}
+		}
+	}
+	cp = New(WithPaddedInput())
+	if n, err := cp.WriteChunks(bad); !errors.Is(err, ErrInvalidPadding) || n != 256 || yielded != 2 {
+		t.Fatalf("wrote %d bytes out of %d chunks yielded: %v", n, yielded, err)
+	}
+	cp.Reset()
+}
+
+func TestWriteVec(t *testing.T) {
+	t.Parallel()
+
+	rng := randmath.New(randmath.NewSource(1))
+	payload := make([]byte, 3*bufferSize+777)
+	rng.Read(payload)
+	exp, expSize := mustDigest(t, &Calc{}, payload)
+
+	// mostly tiny buffers, never aligned to quads, and some empty ones
+	var bufs net.Buffers
+	for rest := payload; len(rest) > 0; {
+		n := min(len(rest), rng.Intn(300))
+		if rng.Intn(100) == 0 {
+			n = min(len(rest), rng.Intn(2*bufferSize))
+		}
+		bufs = append(bufs, rest[:n])
+		rest = rest[n:]
+	}
+
+	cp := &Calc{}
+	if n, err := cp.WriteVec(bufs); err != nil || n != int64(len(payload)) {
+		t.Fatalf("wrote %d out of %d bytes: %v", n, len(payload), err)
+	}
+	commP, paddedSize, err := cp.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(commP, exp) || paddedSize != expSize {
+		t.Fatalf("produced commP 0x%X/%d doesn't match expected 0x%X/%d", commP, paddedSize, exp, expSize)
+	}
+
+	// an oversized vector is rejected upfront
+	cp.Reset()
+	huge := make([][]byte, MaxPiecePayload/uint64(len(payload))+1)
+	for i := range huge {
+		huge[i] = payload
+	}
+	if n, err := cp.WriteVec(huge); !errors.Is(err, ErrPayloadTooLarge) || n != 0 || cp.BytesWritten() != 0 {
+		t.Fatalf("wrote %d bytes, accumulated %d: %v", n, cp.BytesWritten(), err)
+	}
+}
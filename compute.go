@@ -0,0 +1,146 @@
+package commp
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+// ComputeCommP reads r until EOF and returns the raw 32 bytes of commP and
+// the padded piece size of everything read. The background workers are
+// always terminated before returning, regardless of outcome.
+func ComputeCommP(r io.Reader) (commP []byte, paddedPieceSize uint64, err error) {
+	cp := &Calc{}
+	defer cp.Reset() // no-op on success, terminates the workers on error
+
+	if _, err := io.Copy(cp, r); err != nil {
+		return nil, 0, xerrors.Errorf("reading input failed: %w", err)
+	}
+
+	return cp.Digest()
+}
+
+// ComputeCommPFromFile is a convenience wrapper around ComputeCommP(),
+// operating on the entire contents of the file at path.
+func ComputeCommPFromFile(path string) (commP []byte, paddedPieceSize uint64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	return ComputeCommP(f)
+}
+
+// DigestFile returns the commP and padded piece size of the contents of the
+// file at path, exactly as ComputeCommPFromFile() would. Holes in sparse files
+// are not read: they are accounted for as runs of zeroes, with aligned runs
+// substituted by precomputed null-padding subtrees without any hashing. This
+// makes digesting mostly-sparse files, such as unsealed sectors, orders of
+// magnitude faster. Hole detection is only available on Linux, elsewhere the
+// entire file is read.
+func DigestFile(path string) (commP []byte, paddedPieceSize uint64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cp := &Calc{}
+	defer cp.Reset() // no-op on success, terminates the workers on error
+
+	var pos int64
+	err = dataExtents(f, st.Size(), func(offset, length int64) error {
+		if err := cp.WriteZeroes(uint64(offset - pos)); err != nil {
+			return err
+		}
+		if _, err := io.Copy(cp, io.NewSectionReader(f, offset, length)); err != nil {
+			return err
+		}
+		pos = offset + length
+		return nil
+	})
+	if err == nil {
+		err = cp.WriteZeroes(uint64(st.Size() - pos))
+	}
+	if err != nil {
+		return nil, 0, xerrors.Errorf("reading input failed: %w", err)
+	}
+
+	return cp.Digest()
+}
+
+// DigestReaderAt returns the commP and padded piece size of the first size
+// bytes of r, exactly as ComputeCommP() would, using up to workers cores or
+// GOMAXPROCS of them when workers is not positive. The input is split into
+// segments of a power of 2 amount of quads, whose subtrees are digested in
+// parallel by independent pipelines and then stitched together.
+func DigestReaderAt(r io.ReaderAt, size int64, workers int) (commP []byte, paddedPieceSize uint64, err error) {
+	return digestSegments(size, workers, func(offset, length int64) ([]byte, uint64, error) {
+		return digestSegment(r, offset, length)
+	})
+}
+
+// DigestFileMmap returns the commP and padded piece size of the contents of
+// the file at path, exactly as ComputeCommPFromFile() would, using up to
+// workers cores or GOMAXPROCS of them when workers is not positive. The file
+// is memory-mapped and every worker builds the subtrees of its segments
+// directly over the mapping, bypassing the channel pipeline of Calc. This is
+// the fastest way to digest a file on fast storage. Where memory-mapping is
+// not available it falls back to DigestReaderAt().
+func DigestFileMmap(path string, workers int) (commP []byte, paddedPieceSize uint64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := st.Size()
+	if err := checkInputSize(size); err != nil {
+		return nil, 0, err
+	}
+
+	data, unmap, err := mmapFile(f, size)
+	if err == errMmapUnsupported {
+		return DigestReaderAt(f, size, workers)
+	} else if err != nil {
+		return nil, 0, xerrors.Errorf("memory-mapping input failed: %w", err)
+	}
+	defer unmap()
+
+	return digestSegments(size, workers, func(offset, length int64) ([]byte, uint64, error) {
+		root, paddedSize := reduceQuads(data[offset : offset+length])
+		return root[:], paddedSize, nil
+	})
+}
+
+// digestSegment returns the root of the subtree covering length bytes of r
+// at offset, and its padded size.
+func digestSegment(r io.ReaderAt, offset, length int64) ([]byte, uint64, error) {
+	cp := &Calc{}
+	defer cp.Reset() // no-op on success, terminates the workers on error
+
+	if n, err := io.Copy(cp, io.NewSectionReader(r, offset, length)); err != nil {
+		return nil, 0, xerrors.Errorf("reading input at offset %d failed: %w", offset, err)
+	} else if n != length {
+		return nil, 0, xerrors.Errorf("input ended %d bytes short of the expected %d at offset %d: %w", length-n, length, offset, io.ErrUnexpectedEOF)
+	}
+	// a trailing segment too short to digest on its own: zero-filling it to
+	// a whole quad is exactly what Digest() would do anyway
+	if length < int64(MinPiecePayload) {
+		if err := cp.WriteZeroes(uint64(127 - length)); err != nil {
+			return nil, 0, err
+		}
+	}
+	return cp.Digest()
+}
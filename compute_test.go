@@ -0,0 +1,198 @@
+package commp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	randmath "math/rand"
+)
+
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	if err == io.EOF {
+		err = fr.err
+	}
+	return n, err
+}
+
+func TestComputeCommP(t *testing.T) {
+	t.Parallel()
+
+	tests, err := getTestCases("testdata/0xCC.txt", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	for _, test := range tests {
+		commP, paddedSize, err := ComputeCommP(io.LimitReader(&repeatedReader{b: 0xCC}, test.PayloadSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paddedSize != test.PieceSize || !bytes.Equal(commP, test.RawCommP) {
+			t.Fatalf("%d: produced 0x%X/%d doesn't match expected 0x%X/%d", test.PayloadSize, commP, paddedSize, test.RawCommP, test.PieceSize)
+		}
+
+		path := filepath.Join(dir, "payload")
+		if err := os.WriteFile(path, bytes.Repeat([]byte{0xCC}, int(test.PayloadSize)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		commP, paddedSize, err = ComputeCommPFromFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paddedSize != test.PieceSize || !bytes.Equal(commP, test.RawCommP) {
+			t.Fatalf("%d: produced from file 0x%X/%d doesn't match expected 0x%X/%d", test.PayloadSize, commP, paddedSize, test.RawCommP, test.PieceSize)
+		}
+	}
+
+	readErr := errors.New("boom")
+	if _, _, err := ComputeCommP(&failingReader{r: bytes.NewReader(make([]byte, 1<<20)), err: readErr}); !errors.Is(err, readErr) {
+		t.Fatalf("unexpected error %v, expected %v", err, readErr)
+	}
+	if _, _, err := ComputeCommP(bytes.NewReader(make([]byte, 64))); err == nil {
+		t.Fatal("unexpected success computing commP of 64 bytes")
+	}
+	if _, _, err := ComputeCommPFromFile(filepath.Join(dir, "nonexistent")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error %v, expected %v", err, os.ErrNotExist)
+	}
+}
+
+func TestDigestFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	rng := randmath.New(randmath.NewSource(1))
+
+	// data regions as offset/length pairs within a sparse file of the given size
+	for i, layout := range []struct {
+		size    int64
+		regions [][2]int64
+	}{
+		{size: 1 << 20},
+		{size: 127, regions: [][2]int64{{0, 127}}},
+		{size: 8 << 20, regions: [][2]int64{{0, 4096}}},
+		{size: 8 << 20, regions: [][2]int64{{5 << 20, 100}}},
+		{size: 8<<20 + 13, regions: [][2]int64{{4096, 1 << 20}, {3 << 20, 5}, {8 << 20, 13}}},
+		{size: 32 << 20, regions: [][2]int64{{1<<20 - 1, 2}, {17 << 20, 64 << 10}}},
+	} {
+		payload := make([]byte, layout.size)
+		path := filepath.Join(dir, fmt.Sprintf("sparse%d", i))
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range layout.regions {
+			rng.Read(payload[r[0] : r[0]+r[1]])
+			if _, err := f.WriteAt(payload[r[0]:r[0]+r[1]], r[0]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := f.Truncate(layout.size); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		exp, expSize := mustDigest(t, &Calc{}, payload)
+		commP, paddedSize, err := DigestFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(commP, exp) || paddedSize != expSize {
+			t.Fatalf("layout %d: produced 0x%X/%d doesn't match expected 0x%X/%d", i, commP, paddedSize, exp, expSize)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "short"), make([]byte, 64), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DigestFile(filepath.Join(dir, "short")); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected result digesting 64 bytes: %v", err)
+	}
+	if _, _, err := DigestFile(filepath.Join(dir, "nonexistent")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error %v, expected %v", err, os.ErrNotExist)
+	}
+}
+
+func TestDigestReaderAt(t *testing.T) {
+	t.Parallel()
+
+	segSize := minSegmentQuads * 127
+	payload := make([]byte, 9*segSize+1000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+
+	for _, size := range []int{65, 1000, segSize, segSize + 1, segSize + 64, 3*segSize + 500, 8 * segSize, len(payload)} {
+		exp, expSize := mustDigest(t, &Calc{}, payload[:size])
+		for _, workers := range []int{0, 1, 3} {
+			commP, paddedSize, err := DigestReaderAt(bytes.NewReader(payload), int64(size), workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(commP, exp) || paddedSize != expSize {
+				t.Fatalf("%d bytes, %d workers: produced 0x%X/%d doesn't match expected 0x%X/%d", size, workers, commP, paddedSize, exp, expSize)
+			}
+		}
+	}
+
+	if _, _, err := DigestReaderAt(bytes.NewReader(payload), 64, 1); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected result digesting 64 bytes: %v", err)
+	}
+	if _, _, err := DigestReaderAt(bytes.NewReader(payload), int64(MaxPiecePayload)+1, 1); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("unexpected result digesting too much: %v", err)
+	}
+	if _, _, err := DigestReaderAt(bytes.NewReader(payload), int64(len(payload))+1, 2); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("unexpected result digesting past the end of the input: %v", err)
+	}
+}
+
+func TestDigestFileMmap(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	segSize := minSegmentQuads * 127
+	payload := make([]byte, 9*segSize+1000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	// runs of zeroes spanning whole slabs
+	clear(payload[bufferSize : 5*bufferSize+7])
+	clear(payload[2*segSize : 4*segSize])
+
+	for _, size := range []int{65, 127, 1000, bufferSize, bufferSize + 1, 3*bufferSize + 200, segSize, segSize + 64, 8 * segSize, len(payload)} {
+		path := filepath.Join(dir, fmt.Sprintf("payload%d", size))
+		if err := os.WriteFile(path, payload[:size], 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		exp, expSize := mustDigest(t, &Calc{}, payload[:size])
+		for _, workers := range []int{0, 1, 3} {
+			commP, paddedSize, err := DigestFileMmap(path, workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(commP, exp) || paddedSize != expSize {
+				t.Fatalf("%d bytes, %d workers: produced 0x%X/%d doesn't match expected 0x%X/%d", size, workers, commP, paddedSize, exp, expSize)
+			}
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "empty"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DigestFileMmap(filepath.Join(dir, "empty"), 1); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected result digesting an empty file: %v", err)
+	}
+	if _, _, err := DigestFileMmap(filepath.Join(dir, "nonexistent"), 1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error %v, expected %v", err, os.ErrNotExist)
+	}
+}
@@ -0,0 +1,58 @@
+package commp
+
+import "errors"
+
+// Sentinel errors returned by this package, always wrapped with additional
+// context. Use errors.Is() to test for them.
+var (
+	// ErrPayloadTooLarge is returned by Write() when accepting the input would
+	// go over MaxPiecePayload.
+	ErrPayloadTooLarge = errors.New("payload too large")
+
+	// ErrBelowMinimumPayload is returned by Digest() and friends when fewer
+	// than MinPiecePayload bytes were written.
+	ErrBelowMinimumPayload = errors.New("insufficient state accumulated")
+
+	// ErrInvalidPieceSize is returned when a supplied piece size is not a
+	// power of two, or is outside of the range supported by Filecoin.
+	ErrInvalidPieceSize = errors.New("invalid piece size")
+
+	// ErrInvalidCommP is returned when a supplied commitment is malformed.
+	ErrInvalidCommP = errors.New("invalid commP")
+
+	// ErrInvalidState is returned by UnmarshalBinary() when the supplied
+	// serialized state is malformed.
+	ErrInvalidState = errors.New("invalid commP state")
+
+	// ErrInvalidPadding is returned by Write() of a Calc constructed
+	// WithPaddedInput() when the input is not valid fr32-padded data.
+	ErrInvalidPadding = errors.New("invalid fr32 padding")
+
+	// ErrInvalidLayout is returned when the segments of an aggregate are
+	// misaligned, overlap, or do not fit within it.
+	ErrInvalidLayout = errors.New("invalid aggregate layout")
+
+	// ErrInvalidProof is returned when an inclusion proof does not check out.
+	ErrInvalidProof = errors.New("invalid inclusion proof")
+
+	// ErrPieceMismatch is returned by a VerifyingReader when the data read
+	// does not match the expected piece.
+	ErrPieceMismatch = errors.New("piece mismatch")
+
+	// ErrMemoryCeiling is returned when a Calc constructed
+	// WithMemoryCeiling() can not honor the ceiling.
+	ErrMemoryCeiling = errors.New("memory ceiling too low")
+
+	// ErrFinalized is returned on any use of a Calc which was Digest()ed
+	// without being Reset() since.
+	ErrFinalized = errors.New("accumulator finalized")
+
+	// ErrInternalFailure is returned when a background layer worker suffered
+	// an unexpected fault, which the error identifies along with the layer
+	// and offset within the tree it occurred at. The accumulator must be
+	// Reset() before reuse.
+	ErrInternalFailure = errors.New("internal commP failure")
+)
+
+// errMmapUnsupported is returned by mmapFile() on platforms without it.
+var errMmapUnsupported = errors.New("memory-mapping is not supported on this platform")
@@ -0,0 +1,46 @@
+package commp
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Linux values of the lseek whence arguments, not exposed by package syscall
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// dataExtents calls fn for every data region of the first size bytes of f,
+// as reported by SEEK_DATA/SEEK_HOLE. Everything not covered by a region is
+// a hole reading back as zeroes. Filesystems without hole support report the
+// entire file as a single region.
+func dataExtents(f *os.File, size int64, fn func(offset, length int64) error) error {
+	for pos := int64(0); pos < size; {
+		data, err := f.Seek(pos, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// nothing but a hole until the end
+			return nil
+		} else if errors.Is(err, syscall.EINVAL) && pos == 0 {
+			return fn(0, size)
+		} else if err != nil {
+			return err
+		}
+		if data >= size {
+			return nil
+		}
+
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return err
+		}
+		hole = min(hole, size)
+
+		if err := fn(data, hole-data); err != nil {
+			return err
+		}
+		pos = hole
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package commp
+
+import "os"
+
+// dataExtents reports the first size bytes of f as a single data region, as
+// hole detection is only implemented on Linux.
+func dataExtents(f *os.File, size int64, fn func(offset, length int64) error) error {
+	if size == 0 {
+		return nil
+	}
+	return fn(0, size)
+}
@@ -0,0 +1,316 @@
+package commp
+
+import (
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// padQuadsGeneric fr32-expands every 127-byte quad of in into the
+// corresponding 128 bytes of out. len(in) must be a multiple of 127, and out
+// must hold at least len(in)/127*128 bytes. It is the portable implementation
+// backing padQuads().
+func padQuadsGeneric(out, in []byte) {
+	for j := 0; j < len(in)/127; j++ {
+		// Cycle over four(4) 31-byte groups, leaving 1 byte in between:
+		// 31 + 1 + 31 + 1 + 31 + 1 + 31 = 127
+		input := in[j*127 : (j+1)*127]
+		expander := out[j*128 : (j+1)*128]
+		inputPlus1, expanderPlus1 := input[1:], expander[1:]
+
+		// First 31 bytes + 6 bits are taken as-is (trimmed later)
+		// Note that copying them into the expansion buffer is mandatory:
+		// we will be feeding it to the workers which reuse the bottom half
+		// of the chunk for the result
+		copy(expander[:], input[:32])
+
+		// first 2-bit "shim" forced into the otherwise identical bitstream
+		expander[31] &= 0x3F
+
+		//  In: {{ C[7] C[6] }} X[7] X[6] X[5] X[4] X[3] X[2] X[1] X[0] Y[7] Y[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] Z[7] Z[6] Z[5]...
+		// Out:                 X[5] X[4] X[3] X[2] X[1] X[0] C[7] C[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] X[7] X[6] Z[5] Z[4] Z[3]...
+		for i := 31; i < 63; i++ {
+			expanderPlus1[i] = inputPlus1[i]<<2 | input[i]>>6
+		}
+
+		// next 2-bit shim
+		expander[63] &= 0x3F
+
+		//  In: {{ C[7] C[6] C[5] C[4] }} X[7] X[6] X[5] X[4] X[3] X[2] X[1] X[0] Y[7] Y[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] Z[7] Z[6] Z[5]...
+		// Out:                           X[3] X[2] X[1] X[0] C[7] C[6] C[5] C[4] Y[3] Y[2] Y[1] Y[0] X[7] X[6] X[5] X[4] Z[3] Z[2] Z[1]...
+		for i := 63; i < 95; i++ {
+			expanderPlus1[i] = inputPlus1[i]<<4 | input[i]>>4
+		}
+
+		// next 2-bit shim
+		expander[95] &= 0x3F
+
+		//  In: {{ C[7] C[6] C[5] C[4] C[3] C[2] }} X[7] X[6] X[5] X[4] X[3] X[2] X[1] X[0] Y[7] Y[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] Z[7] Z[6] Z[5]...
+		// Out:                                     X[1] X[0] C[7] C[6] C[5] C[4] C[3] C[2] Y[1] Y[0] X[7] X[6] X[5] X[4] X[3] X[2] Z[1] Z[0] Y[7]...
+		for i := 95; i < 126; i++ {
+			expanderPlus1[i] = inputPlus1[i]<<6 | input[i]>>2
+		}
+
+		// the final 6 bit remainder is exactly the value of the last expanded byte
+		expander[127] = input[126] >> 2
+	}
+}
+
+func isZero(b []byte) bool {
+	for len(b) >= 8 {
+		if binary.LittleEndian.Uint64(b) != 0 {
+			return false
+		}
+		b = b[8:]
+	}
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// unpadQuads is the inverse of padQuads(), recovering every 127-byte quad of
+// payload from the corresponding 128 bytes of in. len(in) must be a multiple
+// of 128, and out must hold at least len(in)/128*127 bytes. The 2 bits of
+// every padded 32-byte chunk which fr32 keeps clear are ignored.
+func unpadQuads(out, in []byte) {
+	for j := 0; j < len(in)/128; j++ {
+		expanded := in[j*128 : (j+1)*128]
+		output := out[j*127 : (j+1)*127]
+
+		// First 31 bytes are taken as-is
+		copy(output[:31], expanded[:31])
+
+		// Every following byte is reassembled from the top of its expanded
+		// position and the bottom of the next one, with the shift growing by
+		// 2 bits after each 2-bit shim
+		output[31] = expanded[31]&0x3F | expanded[32]<<6
+		for i := 32; i < 63; i++ {
+			output[i] = expanded[i]>>2 | expanded[i+1]<<6
+		}
+
+		output[63] = (expanded[63]&0x3F)>>2 | expanded[64]<<4
+		for i := 64; i < 95; i++ {
+			output[i] = expanded[i]>>4 | expanded[i+1]<<4
+		}
+
+		output[95] = (expanded[95]&0x3F)>>4 | expanded[96]<<2
+		for i := 96; i < 127; i++ {
+			output[i] = expanded[i]>>6 | expanded[i+1]<<2
+		}
+	}
+}
+
+// checkPadding verifies that every 32-byte chunk of fr32-padded data has the
+// top 2 bits of its last byte clear. pos is the offset of in within the
+// padded stream it is part of.
+func checkPadding(in []byte, pos uint64) error {
+	for i := 31 - int(pos%32); i < len(in); i += 32 {
+		if in[i]&0xC0 != 0 {
+			return xerrors.Errorf("byte at padded offset %d has its top 2 bits set: %w", pos+uint64(i), ErrInvalidPadding)
+		}
+	}
+	return nil
+}
+
+// fr32 streams operate on this many quads at a time
+const fr32ChunkQuads = 256
+
+// quadWriter transforms everything written to it quad by quad, retaining any
+// trailing partial quad until more data arrives.
+type quadWriter struct {
+	w         io.Writer
+	inSize    int
+	outSize   int
+	transform func(out, in []byte)
+	buf       []byte
+	out       []byte
+	closed    bool
+}
+
+func newQuadWriter(w io.Writer, inSize, outSize int, transform func(out, in []byte)) quadWriter {
+	return quadWriter{
+		w:         w,
+		inSize:    inSize,
+		outSize:   outSize,
+		transform: transform,
+		buf:       make([]byte, 0, fr32ChunkQuads*inSize),
+		out:       make([]byte, fr32ChunkQuads*outSize),
+	}
+}
+
+func (qw *quadWriter) Write(p []byte) (int, error) {
+	if qw.closed {
+		return 0, xerrors.New("write to a closed fr32 stream")
+	}
+
+	total := len(p)
+	for len(p) > 0 {
+		n := copy(qw.buf[len(qw.buf):cap(qw.buf)], p)
+		qw.buf = qw.buf[:len(qw.buf)+n]
+		p = p[n:]
+
+		if len(qw.buf) == cap(qw.buf) {
+			if err := qw.flush(); err != nil {
+				return total - len(p) - n, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (qw *quadWriter) flush() error {
+	if len(qw.buf) == 0 {
+		return nil
+	}
+	quads := len(qw.buf) / qw.inSize
+	qw.transform(qw.out, qw.buf[:quads*qw.inSize])
+	if _, err := qw.w.Write(qw.out[:quads*qw.outSize]); err != nil {
+		return err
+	}
+	qw.buf = qw.buf[:copy(qw.buf, qw.buf[quads*qw.inSize:])]
+	return nil
+}
+
+// PadWriter fr32-pads everything written to it, writing the 128-byte padded
+// form of every 127-byte quad to the underlying writer. Close() must be called
+// once all payload has been written, to flush the final partial quad.
+type PadWriter struct{ quadWriter }
+
+// NewPadWriter returns a PadWriter writing the padded form of its input to w.
+func NewPadWriter(w io.Writer) *PadWriter {
+	return &PadWriter{newQuadWriter(w, quadPayload, 128, padQuads)}
+}
+
+// Close zero-fills and writes out the final partial quad, if any. It does not
+// close the underlying writer.
+func (pw *PadWriter) Close() error {
+	if pw.closed {
+		return nil
+	}
+	pw.closed = true
+
+	if rem := len(pw.buf) % quadPayload; rem != 0 {
+		pw.buf = append(pw.buf, make([]byte, quadPayload-rem)...)
+	}
+	return pw.flush()
+}
+
+// UnpadWriter reverses fr32 padding of everything written to it, writing the
+// original 127-byte quads to the underlying writer. As the padded form of a
+// final partial quad is zero-filled, the output is always a multiple of 127
+// bytes: truncate it to the known payload size where applicable.
+type UnpadWriter struct{ quadWriter }
+
+// NewUnpadWriter returns an UnpadWriter writing the unpadded form of its input
+// to w.
+func NewUnpadWriter(w io.Writer) *UnpadWriter {
+	return &UnpadWriter{newQuadWriter(w, 128, quadPayload, unpadQuads)}
+}
+
+// Close writes out the remaining buffered quads, verifying the padded input
+// ended on a 128-byte boundary. It does not close the underlying writer.
+func (uw *UnpadWriter) Close() error {
+	if uw.closed {
+		return nil
+	}
+	uw.closed = true
+
+	if rem := len(uw.buf) % 128; rem != 0 {
+		return xerrors.Errorf("padded input ended with a partial chunk of %d bytes: %w", rem, io.ErrUnexpectedEOF)
+	}
+	return uw.flush()
+}
+
+// quadReader transforms the contents of an underlying reader quad by quad.
+type quadReader struct {
+	r         io.Reader
+	inSize    int
+	outSize   int
+	transform func(out, in []byte)
+	zeroFill  bool // whether to zero-fill a final partial quad, or to fail
+	in        []byte
+	out       []byte
+	pos       int
+	err       error
+}
+
+func newQuadReader(r io.Reader, inSize, outSize int, transform func(out, in []byte), zeroFill bool) quadReader {
+	return quadReader{
+		r:         r,
+		inSize:    inSize,
+		outSize:   outSize,
+		transform: transform,
+		zeroFill:  zeroFill,
+		in:        make([]byte, fr32ChunkQuads*inSize),
+	}
+}
+
+func (qr *quadReader) Read(p []byte) (int, error) {
+	for qr.pos == len(qr.out) {
+		if qr.err != nil {
+			return 0, qr.err
+		}
+		qr.fill()
+	}
+
+	n := copy(p, qr.out[qr.pos:])
+	qr.pos += n
+	return n, nil
+}
+
+func (qr *quadReader) fill() {
+	n, err := io.ReadFull(qr.r, qr.in)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		qr.err = io.EOF
+	default:
+		qr.err = err
+		// do not emit anything past a failure: a zero-filled partial quad
+		// would be indistinguishable from a valid end of payload
+		n = n / qr.inSize * qr.inSize
+	}
+
+	if rem := n % qr.inSize; rem != 0 {
+		if qr.zeroFill {
+			clear(qr.in[n : n+qr.inSize-rem])
+			n += qr.inSize - rem
+		} else {
+			qr.err = xerrors.Errorf("input ended with a partial chunk of %d bytes: %w", rem, io.ErrUnexpectedEOF)
+			n -= rem
+		}
+	}
+
+	if qr.out == nil {
+		qr.out = make([]byte, fr32ChunkQuads*qr.outSize)
+	}
+	qr.out = qr.out[:n/qr.inSize*qr.outSize]
+	qr.transform(qr.out, qr.in[:n])
+	qr.pos = 0
+}
+
+// PadReader reads payload from an underlying reader and returns its fr32-padded
+// form. A final partial quad is zero-filled, so the padded output is always a
+// multiple of 128 bytes.
+type PadReader struct{ quadReader }
+
+// NewPadReader returns a PadReader padding the contents of r.
+func NewPadReader(r io.Reader) *PadReader {
+	return &PadReader{newQuadReader(r, quadPayload, 128, padQuads, true)}
+}
+
+// UnpadReader reads fr32-padded data, such as an unsealed sector file, from an
+// underlying reader and returns the original payload. The output is always a
+// multiple of 127 bytes: truncate it to the known payload size where
+// applicable. Padded input not ending on a 128-byte boundary results in an
+// error wrapping io.ErrUnexpectedEOF.
+type UnpadReader struct{ quadReader }
+
+// NewUnpadReader returns an UnpadReader unpadding the contents of r.
+func NewUnpadReader(r io.Reader) *UnpadReader {
+	return &UnpadReader{newQuadReader(r, 128, quadPayload, unpadQuads, false)}
+}
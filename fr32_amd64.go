@@ -0,0 +1,25 @@
+//go:build !purego
+
+package commp
+
+import "golang.org/x/sys/cpu"
+
+var hasAVX2 = cpu.X86.HasAVX2
+
+// padQuadsAVX2 is implemented in fr32_amd64.s. It reads one byte past the end
+// of the last quad, hence padQuads() never hands it the final quad of in.
+//
+//go:noescape
+func padQuadsAVX2(out, in *byte, quads int)
+
+// padQuads fr32-expands every 127-byte quad of in into the corresponding
+// 128 bytes of out. len(in) must be a multiple of 127, and out must hold at
+// least len(in)/127*128 bytes.
+func padQuads(out, in []byte) {
+	if quads := len(in) / 127; hasAVX2 && quads > 1 {
+		_ = out[quads*128-1]
+		padQuadsAVX2(&out[0], &in[0], quads-1)
+		out, in = out[(quads-1)*128:], in[(quads-1)*127:]
+	}
+	padQuadsGeneric(out, in)
+}
@@ -0,0 +1,49 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// Every 32-byte leaf is the input at its offset shifted left by 2, 4 or 6
+// bits, with the vacated low bits of each qword filled from the top of the
+// preceding one, and the top 2 bits of the leaf cleared.
+#define EXPAND(off, shl, shr) \
+	VMOVDQU off(SI), Y1        \
+	VMOVDQU off-8(SI), Y2      \
+	VPSLLQ  $shl, Y1, Y1       \
+	VPSRLQ  $shr, Y2, Y2       \
+	VPOR    Y2, Y1, Y1         \
+	VPAND   Y15, Y1, Y1        \
+	VMOVDQU Y1, off(DI)
+
+// func padQuadsAVX2(out, in *byte, quads int)
+TEXT ·padQuadsAVX2(SB), NOSPLIT, $0-24
+	MOVQ out+0(FP), DI
+	MOVQ in+8(FP), SI
+	MOVQ quads+16(FP), CX
+	VMOVDQU leafMask<>(SB), Y15
+
+loop:
+	TESTQ CX, CX
+	JZ    done
+
+	VMOVDQU 0(SI), Y0
+	VPAND   Y15, Y0, Y0
+	VMOVDQU Y0, 0(DI)
+
+	EXPAND(32, 2, 62)
+	EXPAND(64, 4, 60)
+	EXPAND(96, 6, 58)
+
+	ADDQ $127, SI
+	ADDQ $128, DI
+	DECQ CX
+	JMP  loop
+
+done:
+	VZEROUPPER
+	RET
+
+DATA leafMask<>+0(SB)/8, $0xffffffffffffffff
+DATA leafMask<>+8(SB)/8, $0xffffffffffffffff
+DATA leafMask<>+16(SB)/8, $0xffffffffffffffff
+DATA leafMask<>+24(SB)/8, $0x3fffffffffffffff
+GLOBL leafMask<>(SB), RODATA|NOPTR, $32
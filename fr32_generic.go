@@ -0,0 +1,8 @@
+//go:build !amd64 || purego
+
+package commp
+
+// padQuads fr32-expands every 127-byte quad of in into the corresponding
+// 128 bytes of out. len(in) must be a multiple of 127, and out must hold at
+// least len(in)/127*128 bytes.
+func padQuads(out, in []byte) { padQuadsGeneric(out, in) }
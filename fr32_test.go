@@ -0,0 +1,159 @@
+package commp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	randmath "math/rand"
+)
+
+func TestPadStreams(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{0, 1, 126, 127, 128, 127 * fr32ChunkQuads, 127*fr32ChunkQuads + 1, 1<<20 + 3} {
+		size := size
+		t.Run(fmt.Sprintf("%d", size), func(t *testing.T) {
+			t.Parallel()
+
+			payload := make([]byte, size)
+			rng := randmath.New(randmath.NewSource(int64(size)))
+			rng.Read(payload)
+
+			// the leaves of the tree are exactly the padded payload
+			var exp []byte
+			if size >= int(MinPiecePayload) {
+				tree := &MerkleTree{}
+				mustDigest(t, New(WithNodeSink(tree.AddNode)), payload)
+				for _, l := range tree.layers[0] {
+					exp = append(exp, l[:]...)
+				}
+			} else if size > 0 {
+				exp = make([]byte, 128)
+				padQuads(exp, append(append([]byte{}, payload...), make([]byte, 127-size)...))
+			}
+
+			var written bytes.Buffer
+			pw := NewPadWriter(&written)
+			for rest := payload; len(rest) > 0; {
+				n := 1 + rng.Intn(len(rest))
+				if _, err := pw.Write(rest[:n]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+			}
+			if err := pw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written.Bytes(), exp) {
+				t.Fatalf("PadWriter produced %d bytes not matching the expected %d", written.Len(), len(exp))
+			}
+			if _, err := pw.Write([]byte{1}); err == nil {
+				t.Fatal("unexpected success writing to a closed PadWriter")
+			}
+
+			for _, r := range []io.Reader{
+				bytes.NewReader(payload),
+				iotest.OneByteReader(bytes.NewReader(payload)),
+				iotest.DataErrReader(bytes.NewReader(payload)),
+			} {
+				read, err := io.ReadAll(NewPadReader(r))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(read, exp) {
+					t.Fatalf("PadReader produced %d bytes not matching the expected %d", len(read), len(exp))
+				}
+			}
+
+			if size > 127 {
+				read, err := io.ReadAll(NewPadReader(iotest.TimeoutReader(iotest.HalfReader(bytes.NewReader(payload)))))
+				if err != iotest.ErrTimeout {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if len(read)%128 != 0 || !bytes.HasPrefix(exp, read) {
+					t.Fatalf("PadReader produced %d bytes before failing, not a valid prefix of the padded payload", len(read))
+				}
+			}
+		})
+	}
+}
+
+func TestUnpadStreams(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{0, 1, 127, 128, 127 * fr32ChunkQuads, 127*fr32ChunkQuads + 1, 1<<20 + 3} {
+		payload := make([]byte, size)
+		rng := randmath.New(randmath.NewSource(int64(size)))
+		rng.Read(payload)
+
+		padded, err := io.ReadAll(NewPadReader(bytes.NewReader(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := append(append([]byte{}, payload...), make([]byte, len(padded)/128*127-size)...)
+
+		for _, r := range []io.Reader{
+			bytes.NewReader(padded),
+			iotest.OneByteReader(bytes.NewReader(padded)),
+		} {
+			read, err := io.ReadAll(NewUnpadReader(r))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(read, exp) {
+				t.Fatalf("%d: UnpadReader produced %d bytes not matching the expected %d", size, len(read), len(exp))
+			}
+		}
+
+		var written bytes.Buffer
+		uw := NewUnpadWriter(&written)
+		for rest := padded; len(rest) > 0; {
+			n := 1 + rng.Intn(len(rest))
+			if _, err := uw.Write(rest[:n]); err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		if err := uw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(written.Bytes(), exp) {
+			t.Fatalf("%d: UnpadWriter produced %d bytes not matching the expected %d", size, written.Len(), len(exp))
+		}
+
+		if size > 0 {
+			if _, err := io.ReadAll(NewUnpadReader(bytes.NewReader(padded[:len(padded)-1]))); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("%d: unexpected result unpadding truncated input: %v", size, err)
+			}
+			uw := NewUnpadWriter(io.Discard)
+			uw.Write(padded[:len(padded)-1])
+			if err := uw.Close(); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("%d: unexpected result closing truncated input: %v", size, err)
+			}
+		}
+	}
+}
+
+func TestPadQuads(t *testing.T) {
+	t.Parallel()
+
+	rng := randmath.New(randmath.NewSource(1))
+	for _, quads := range []int{1, 2, 3, 17, fr32ChunkQuads, bufferSize / 127} {
+		in := make([]byte, quads*127)
+		rng.Read(in)
+
+		// the exact amount of input, not followed by anything that could be
+		// read past its end
+		exp := make([]byte, quads*128)
+		padQuadsGeneric(exp, in)
+		out := make([]byte, quads*128)
+		padQuads(out, append([]byte{}, in...)[:len(in):len(in)])
+		if !bytes.Equal(out, exp) {
+			t.Fatalf("%d quads: expansion doesn't match the generic implementation", quads)
+		}
+	}
+}
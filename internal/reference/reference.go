@@ -0,0 +1,63 @@
+// Package reference is a deliberately slow but straightforward implementation
+// of commP, sharing no code with the production path: the payload is
+// fr32-padded one bit at a time, zero-filled up to a power of 2, and the tree
+// is built recursively. It exists to differentially test the concurrent
+// implementation, and is exported as commp.ReferenceCommP.
+package reference
+
+import "crypto/sha256"
+
+// CommP returns the commP and the padded piece size of payload, which must be
+// at least 65 bytes long. The whole tree is held in memory.
+func CommP(payload []byte) (commP [32]byte, paddedPieceSize uint64) {
+	leaves := Pad(payload)
+
+	paddedPieceSize = 128
+	for paddedPieceSize < uint64(len(leaves)) {
+		paddedPieceSize *= 2
+	}
+	leaves = append(leaves, make([]byte, paddedPieceSize-uint64(len(leaves)))...)
+
+	return Root(leaves), paddedPieceSize
+}
+
+// Pad fr32-pads payload, zero-filled to a multiple of 127 bytes: every 254
+// bits of it are followed by 2 zero bits, making for 32-byte leaves with the
+// top 2 bits of their last byte clear. Bits are numbered starting with the
+// least significant bit of the first byte.
+func Pad(payload []byte) []byte {
+	quads := (len(payload) + 126) / 127
+	in := append(append([]byte{}, payload...), make([]byte, quads*127-len(payload))...)
+	out := make([]byte, quads*128)
+
+	var o int
+	for i := 0; i < len(in)*8; i++ {
+		if o%256 == 254 {
+			o += 2
+		}
+		if in[i/8]>>(i%8)&1 == 1 {
+			out[o/8] |= 1 << (o % 8)
+		}
+		o++
+	}
+	return out
+}
+
+// Root returns the root of the tree over leaves, whose amount must be a
+// power of 2.
+func Root(leaves []byte) [32]byte {
+	if len(leaves) == 32 {
+		return [32]byte(leaves)
+	}
+	left := Root(leaves[:len(leaves)/2])
+	right := Root(leaves[len(leaves)/2:])
+	return Node(left, right)
+}
+
+// Node returns the parent of two sibling nodes: their sha256 with the top 2
+// bits of the last byte cleared.
+func Node(left, right [32]byte) [32]byte {
+	parent := sha256.Sum256(append(left[:], right[:]...))
+	parent[31] &= 0x3F
+	return parent
+}
@@ -0,0 +1,76 @@
+package reference
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base32"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var b32dec = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// TestVectors checks against the smaller vectors of the main package, which
+// were produced by filecoin-ffi.
+func TestVectors(t *testing.T) {
+	t.Parallel()
+
+	for _, vec := range []struct {
+		file string
+		fill byte
+	}{
+		{"zero.txt", 0},
+		{"0xCC.txt", 0xCC},
+	} {
+		f, err := os.Open("../../testdata/" + vec.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		lines := bufio.NewScanner(f)
+		for lines.Scan() {
+			parts := strings.Split(lines.Text(), ",")
+			payloadSize, err := strconv.Atoi(parts[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			pieceSize, err := strconv.ParseUint(parts[1], 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pieceSize > 1<<20 {
+				continue
+			}
+			rawCid, err := b32dec.DecodeString(parts[2][1:])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			commP, paddedSize := CommP(bytes.Repeat([]byte{vec.fill}, payloadSize))
+			if !bytes.Equal(commP[:], rawCid[len(rawCid)-32:]) || paddedSize != pieceSize {
+				t.Fatalf("%s %d: commP 0x%X/%d doesn't match expected 0x%X/%d", vec.file, payloadSize, commP, paddedSize, rawCid[len(rawCid)-32:], pieceSize)
+			}
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	t.Parallel()
+
+	// a quad of all ones turns into 4 leaves of all ones, save for the top 2
+	// bits of each
+	out := Pad(bytes.Repeat([]byte{0xFF}, 127))
+	for i, b := range out {
+		if exp := byte(0xFF) >> (2 * (i % 32 / 31)); b != exp {
+			t.Fatalf("byte %d is 0x%02X, expected 0x%02X", i, b, exp)
+		}
+	}
+
+	// partial quads are zero-filled
+	if n := len(Pad(make([]byte, 128))); n != 256 {
+		t.Fatalf("padded 128 bytes into %d, expected 256", n)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build !tinygo
+
+package commp
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+)
+
+// The background goroutines carry pprof labels attributing their CPU time to
+// a stage of the digest, and where applicable a layer of the tree. They
+// replace whatever labels the goroutine starting them had.
+const (
+	labelStage = "commp.stage"
+	labelLayer = "commp.layer"
+)
+
+type profStage int
+
+const (
+	profReduce   profStage = iota // reducing a slab, by a reducer or the folder
+	profFold                      // folding a slab root into the pending stack
+	profCollapse                  // padding the pending stack up to the root
+	profStageCount
+)
+
+var profStageNames = [profStageCount]string{"reduce", "fold", "collapse"}
+
+// profLabels holds a context for every stage and layer, as the labels change
+// with every layer of every slab and switching between them must not
+// allocate.
+var profLabels [profStageCount][MaxLayers + 1]context.Context
+
+func init() {
+	for s := range profLabels {
+		for l := range profLabels[s] {
+			profLabels[s][l] = pprof.WithLabels(context.Background(), pprof.Labels(
+				labelStage, profStageNames[s],
+				labelLayer, strconv.Itoa(l),
+			))
+		}
+	}
+}
+
+// setProfLabels switches the pprof labels of the calling goroutine.
+func setProfLabels(s profStage, layer uint) {
+	pprof.SetGoroutineLabels(profLabels[s][layer])
+}
+
+// withSegmentLabels runs fn with the pprof labels of the workers of
+// digestSegments().
+func withSegmentLabels(fn func()) {
+	pprof.Do(context.Background(), pprof.Labels(labelStage, "segment"), func(context.Context) { fn() })
+}
@@ -0,0 +1,43 @@
+//go:build !tinygo
+
+package commp
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"testing"
+)
+
+func TestProfLabels(t *testing.T) {
+	t.Parallel()
+
+	// park the tower within the node sink, and look at it from the outside
+	parked, resume := make(chan struct{}), make(chan struct{})
+	var once bool
+	cp := New(WithNodeSink(func(layer uint, _ uint64, _ [32]byte) {
+		if layer == 1 && !once {
+			once = true
+			close(parked)
+			<-resume
+		}
+	}))
+	if _, err := cp.Write(make([]byte, 4*bufferSize)); err != nil {
+		t.Fatal(err)
+	}
+	<-parked
+
+	var prof bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&prof, 1); err != nil {
+		t.Fatal(err)
+	}
+	close(resume)
+	if _, _, err := cp.Digest(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, exp := range []string{`"commp.stage":"reduce"`, `"commp.layer":"0"`} {
+		if !bytes.Contains(prof.Bytes(), []byte(exp)) {
+			t.Fatalf("goroutine profile lacks the label %s:\n%s", exp, prof.String())
+		}
+	}
+}
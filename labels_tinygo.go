@@ -0,0 +1,17 @@
+//go:build tinygo
+
+package commp
+
+// TinyGo does not support pprof labels.
+
+type profStage int
+
+const (
+	profReduce profStage = iota
+	profFold
+	profCollapse
+)
+
+func setProfLabels(profStage, uint) {}
+
+func withSegmentLabels(fn func()) { fn() }
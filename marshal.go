@@ -0,0 +1,214 @@
+package commp
+
+import (
+	"encoding"
+	"encoding/binary"
+	"math/bits"
+	"slices"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = &Calc{}
+	_ encoding.BinaryUnmarshaler = &Calc{}
+)
+
+// The serialized state is versioned via the last byte of its magic, like
+// those of the hashes of the standard library. Version 2 added the flags
+// byte, states of version 1 are rejected.
+const (
+	marshaledMagic = "commp\x02"
+	// magic + flags + quadsEnqueued + layer count + twin bitmask + buffer length
+	marshaledHeaderSize = len(marshaledMagic) + 1 + 8 + 1 + 4 + 4
+
+	marshaledFlagPaddedInput = 1 << 0 // the Calc was constructed WithPaddedInput()
+)
+
+// frozenState is a point-in-time copy of everything needed to resume a Calc:
+// the carry buffer, the amount of quads already sent down the pipeline, the
+// amount of layers reached so far and the node each of them is holding while
+// waiting for a twin.
+type frozenState struct {
+	quadsEnqueued uint64
+	layers        int
+	twins         [MaxLayers + 1][]byte
+	buffer        []byte
+}
+
+// freeze captures the current state without disturbing it. Must be called
+// with cp.mu held.
+func (cp *Calc) freeze() (*frozenState, error) {
+	if err := cp.checkFinalized(); err != nil {
+		return nil, err
+	}
+	fs := &frozenState{quadsEnqueued: cp.quadsEnqueued}
+	if cp.buffer == nil {
+		return fs, nil
+	}
+
+	if err := cp.sync(); err != nil {
+		return nil, err
+	}
+
+	fs.buffer = append(make([]byte, 0, cp.bufLen), cp.carried()...)
+	// the topmost layer reached always holds a node: its twin is yet to come
+	fs.layers = 1
+	for i := range cp.layerTwins {
+		if cp.layerTwins[i] != nil {
+			fs.layers = i + 1
+		}
+	}
+	for i := 0; i < fs.layers; i++ {
+		if cp.layerTwins[i] != nil {
+			fs.twins[i] = append(make([]byte, 0, 32), cp.layerTwins[i][0:32]...)
+		}
+	}
+	return fs, nil
+}
+
+// thaw restarts the pipeline from a frozen state. Must be called with cp.mu
+// held, on a Calc that has just been reset.
+func (cp *Calc) thaw(fs *frozenState) error {
+	if fs.layers == 0 {
+		return nil
+	}
+
+	cp.initPipeline()
+	cp.quadsEnqueued = fs.quadsEnqueued
+	for i := 0; i < fs.layers; i++ {
+		if fs.twins[i] != nil {
+			// workers expect to be able to append the twin in-place
+			cp.layerTwins[i] = newTwin(fs.twins[i])
+		}
+	}
+	cp.startTower()
+
+	// a state serialized by a process with larger slabs can carry more than
+	// fits the buffer: write() digests the excess
+	_, err := cp.write(fs.buffer)
+	return err
+}
+
+// MarshalBinary serializes the current state of the accumulator, so that it
+// can be restored via UnmarshalBinary() at a later time, possibly in a
+// different process. The Calc is left intact and can continue to accept
+// Write()s.
+func (cp *Calc) MarshalBinary() ([]byte, error) {
+	return cp.AppendBinary(nil)
+}
+
+// AppendBinary is MarshalBinary() appending to b, as encoding.BinaryAppender
+// calls for.
+func (cp *Calc) AppendBinary(b []byte) ([]byte, error) {
+	cp.mu.Lock()
+	fs, err := cp.freeze()
+	cp.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var twinMask uint32
+	for i := range fs.twins {
+		if fs.twins[i] != nil {
+			twinMask |= 1 << i
+		}
+	}
+	var flags byte
+	if cp.cfg.paddedInput {
+		flags |= marshaledFlagPaddedInput
+	}
+
+	b = slices.Grow(b, marshaledHeaderSize+bits.OnesCount32(twinMask)*32+len(fs.buffer))
+	b = append(b, marshaledMagic...)
+	b = append(b, flags)
+	b = binary.BigEndian.AppendUint64(b, fs.quadsEnqueued)
+	b = append(b, byte(fs.layers))
+	b = binary.BigEndian.AppendUint32(b, twinMask)
+	for i := range fs.twins {
+		b = append(b, fs.twins[i]...)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(fs.buffer)))
+	b = append(b, fs.buffer...)
+
+	return b, nil
+}
+
+// UnmarshalBinary restores a state previously serialized via MarshalBinary().
+// Any state the accumulator had before is discarded, as if Reset() was called.
+// The state must have been serialized by a Calc with the same
+// WithPaddedInput() setting, which is verified.
+func (cp *Calc) UnmarshalBinary(b []byte) error {
+	if len(b) < len(marshaledMagic) || string(b[:len(marshaledMagic)]) != marshaledMagic {
+		return xerrors.Errorf("unknown identifier: %w", ErrInvalidState)
+	}
+	if len(b) < marshaledHeaderSize {
+		return xerrors.Errorf("size of %d bytes shorter than the minimum %d: %w", len(b), marshaledHeaderSize, ErrInvalidState)
+	}
+	b = b[len(marshaledMagic):]
+
+	flags := b[0]
+	b = b[1:]
+	if flags&^marshaledFlagPaddedInput != 0 {
+		return xerrors.Errorf("unknown flags 0x%02X: %w", flags, ErrInvalidState)
+	}
+	if padded := flags&marshaledFlagPaddedInput != 0; padded != cp.cfg.paddedInput {
+		return xerrors.Errorf("state of a Calc with fr32-padded input %t restored into one with %t: %w", padded, cp.cfg.paddedInput, ErrInvalidState)
+	}
+
+	fs := &frozenState{quadsEnqueued: binary.BigEndian.Uint64(b)}
+	fs.layers = int(b[8])
+	twinMask := binary.BigEndian.Uint32(b[9:])
+	b = b[13:]
+
+	if uint(fs.layers) > MaxLayers+1 {
+		return xerrors.Errorf("%d layers exceeds the maximum of %d: %w", fs.layers, MaxLayers+1, ErrInvalidState)
+	}
+	if twinMask>>fs.layers != 0 {
+		return xerrors.Errorf("pending nodes recorded above the topmost layer %d: %w", fs.layers, ErrInvalidState)
+	}
+	if len(b) < bits.OnesCount32(twinMask)*32+4 {
+		return xerrors.Errorf("truncated: %w", ErrInvalidState)
+	}
+	for i := range fs.twins {
+		if twinMask&(1<<i) != 0 {
+			fs.twins[i] = b[:32]
+			b = b[32:]
+		}
+	}
+
+	bufLen := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint64(len(b)) != uint64(bufLen) {
+		return xerrors.Errorf("buffer length %d does not match remaining %d bytes: %w", bufLen, len(b), ErrInvalidState)
+	}
+	if int(bufLen) > cp.maxBufferSize() {
+		return xerrors.Errorf("buffer length %d exceeds the maximum of %d: %w", bufLen, cp.maxBufferSize(), ErrInvalidState)
+	}
+	fs.buffer = b
+
+	switch {
+	case fs.layers == 0 && (fs.quadsEnqueued != 0 || bufLen != 0):
+		return xerrors.Errorf("data accumulated without any layers: %w", ErrInvalidState)
+	case fs.quadsEnqueued != 0 && fs.twins[fs.layers-1] == nil:
+		return xerrors.Errorf("topmost layer %d holds no node: %w", fs.layers-1, ErrInvalidState)
+	case fs.quadsEnqueued > cp.maxInput()/uint64(cp.quadSize()) ||
+		fs.quadsEnqueued*uint64(cp.quadSize())+uint64(bufLen) > cp.maxInput():
+		return xerrors.Errorf("accumulated input exceeds the maximum supported piece input size %d: %w", cp.maxInput(), ErrInvalidState)
+	case uint64(twinMask) != fs.quadsEnqueued*4:
+		// every quad adds 4 nodes to the bottom layer: the layers holding a
+		// pending node are the bits set in their count
+		return xerrors.Errorf("pending nodes 0x%X do not match the %d quads accumulated: %w", twinMask, fs.quadsEnqueued, ErrInvalidState)
+	}
+
+	if err := cp.checkMemoryCeiling(); err != nil {
+		return err
+	}
+
+	cp.mu.Lock()
+	cp.reset()
+	err := cp.thaw(fs)
+	cp.mu.Unlock()
+
+	return err
+}
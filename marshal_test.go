@@ -0,0 +1,241 @@
+package commp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"testing"
+
+	randmath "math/rand"
+)
+
+func TestMarshalRoundtrip(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{96, 1017, bufferSize + 1, 3*bufferSize - 5, 4<<20 + 129, 9 << 20} {
+		size := size
+		t.Run(fmt.Sprintf("%d", size), func(t *testing.T) {
+			t.Parallel()
+
+			payload := make([]byte, size)
+			randmath.New(randmath.NewSource(int64(size))).Read(payload)
+
+			expCommP, expSize := mustDigest(t, &Calc{}, payload)
+
+			// stop at a handful of points: inside the carry buffer, on quad
+			// boundaries and past several full slabs
+			for _, cut := range []int{0, 1, 127, bufferSize, size / 3, size - 1} {
+				if cut > size {
+					continue
+				}
+
+				orig := &Calc{}
+				if _, err := orig.Write(payload[:cut]); err != nil {
+					t.Fatal(err)
+				}
+				st, err := orig.MarshalBinary()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// both the restored and the original must be able to carry on
+				restored := &Calc{}
+				if err := restored.UnmarshalBinary(st); err != nil {
+					t.Fatal(err)
+				}
+				for _, cp := range []*Calc{restored, orig} {
+					commP, paddedSize := mustDigest(t, cp, payload[cut:])
+					if paddedSize != expSize {
+						t.Fatalf("cut at %d: produced padded size %d doesn't match expected size %d", cut, paddedSize, expSize)
+					}
+					if !bytes.Equal(commP, expCommP) {
+						t.Fatalf("cut at %d: produced commP 0x%X doesn't match expected 0x%X", cut, commP, expCommP)
+					}
+				}
+			}
+		})
+	}
+}
+
+func mustDigest(t *testing.T, cp *Calc, payload []byte) ([]byte, uint64) {
+	t.Helper()
+	if _, err := io.Copy(cp, bytes.NewReader(payload)); err != nil {
+		t.Fatal(err)
+	}
+	commP, paddedSize, err := cp.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commP, paddedSize
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	t.Parallel()
+
+	cp := &Calc{}
+	if _, err := cp.Write(make([]byte, 5<<20)); err != nil {
+		t.Fatal(err)
+	}
+	st, err := cp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.Reset()
+
+	for name, b := range map[string][]byte{
+		"empty":       nil,
+		"bad magic":   append([]byte("nope\x01"), st[5:]...),
+		"truncated":   st[:len(st)-1],
+		"trailing":    append(append([]byte{}, st...), 0),
+		"header only": st[:marshaledHeaderSize],
+	} {
+		if err := cp.UnmarshalBinary(b); err == nil {
+			t.Errorf("%s: unexpected success unmarshaling invalid state", name)
+		}
+	}
+
+	// pending nodes moved to other layers, keeping the layout intact
+	maskAt := len(marshaledMagic) + 1 + 8 + 1
+	mask := binary.BigEndian.Uint32(st[maskAt:])
+	lowest := mask & -mask
+	for name, m := range map[string]uint32{
+		"mask bit 0":       mask&^lowest | 1,
+		"mask bit 1":       mask&^lowest | 2,
+		"mask bit swapped": mask&^lowest | lowest<<1,
+		"mask top swapped": mask&^(1<<(bits.Len32(mask)-1)) | 1<<(bits.Len32(mask)-2),
+	} {
+		if m == mask || bits.OnesCount32(m) != bits.OnesCount32(mask) {
+			t.Fatalf("%s: mask 0x%X is not a corruption of 0x%X", name, m, mask)
+		}
+		b := append([]byte{}, st...)
+		binary.BigEndian.PutUint32(b[maskAt:], m)
+		if err := cp.UnmarshalBinary(b); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("%s: unexpected error %v, expected %v", name, err, ErrInvalidState)
+		}
+	}
+
+	// a failed unmarshal leaves the object usable
+	if err := cp.UnmarshalBinary(st); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cp.Digest(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnmarshalForeignSlabSize(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 7*bufferSize+300)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	expCommP, expSize := mustDigest(t, &Calc{}, payload)
+
+	// emulate states serialized by a process with slabs of a quarter of the
+	// local size, holding a misaligned amount of quads, and with slabs of
+	// four times the local size, holding more than a local slab in the buffer
+	small := &Calc{}
+	small.mu.Lock()
+	if _, err := small.write(payload[:bufferSize/4+200]); err != nil {
+		t.Fatal(err)
+	}
+	if err := small.digestQuads(small.carried()[:bufferSize/4]); err != nil {
+		t.Fatal(err)
+	}
+	// the rest stays where it is in the carry ring
+	small.bufStart, small.bufLen = bufferSize/4, 200
+	small.mu.Unlock()
+
+	large := &Calc{}
+	if _, err := large.Write(payload[:bufferSize/4+200]); err != nil {
+		t.Fatal(err)
+	}
+	largeSt, err := large.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	large.Reset()
+	largeSt = append(largeSt[:len(largeSt)-bufferSize/4-204], binary.BigEndian.AppendUint32(nil, uint32(3*bufferSize+11))...)
+	largeSt = append(largeSt, payload[:3*bufferSize+11]...)
+
+	for name, cut := range map[string]int{"small": bufferSize/4 + 200, "large": 3*bufferSize + 11} {
+		var st []byte
+		if name == "small" {
+			if st, err = small.MarshalBinary(); err != nil {
+				t.Fatal(err)
+			}
+			small.Reset()
+		} else {
+			st = largeSt
+		}
+
+		cp := &Calc{}
+		if err := cp.UnmarshalBinary(st); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		commP, paddedSize := mustDigest(t, cp, payload[cut:])
+		if !bytes.Equal(commP, expCommP) || paddedSize != expSize {
+			t.Fatalf("%s: produced commP 0x%X/%d doesn't match expected 0x%X/%d", name, commP, paddedSize, expCommP, expSize)
+		}
+	}
+}
+
+func TestResetAfterShortWrite(t *testing.T) {
+	t.Parallel()
+
+	cp := &Calc{}
+	if _, err := cp.Write(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	cp.Reset()
+}
+
+func TestMarshalFormat(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 3*bufferSize+1000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	expCommP, expSize := mustDigest(t, &Calc{}, payload)
+
+	cp := &Calc{}
+	if _, err := cp.Write(payload[:bufferSize+500]); err != nil {
+		t.Fatal(err)
+	}
+	st, err := cp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appended, err := cp.AppendBinary([]byte("prefix"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.Reset()
+	if !bytes.Equal(appended, append([]byte("prefix"), st...)) {
+		t.Fatal("appended state doesn't match the marshaled one")
+	}
+
+	resumed := &Calc{}
+	if err := resumed.UnmarshalBinary(st); err != nil {
+		t.Fatal(err)
+	}
+	commP, paddedSize := mustDigest(t, resumed, payload[bufferSize+500:])
+	if !bytes.Equal(commP, expCommP) || paddedSize != expSize {
+		t.Fatalf("produced commP 0x%X/%d doesn't match expected 0x%X/%d", commP, paddedSize, expCommP, expSize)
+	}
+
+	unknownFlags := append([]byte{}, st...)
+	unknownFlags[len(marshaledMagic)] = 0x80
+	// states of the previous version lack the flags
+	v1 := append([]byte("commp\x01"), st[len(marshaledMagic)+1:]...)
+	for name, b := range map[string][]byte{"unknown flags": unknownFlags, "v1": v1, "padded mismatch": st} {
+		cp := New(WithPaddedInput())
+		if name != "padded mismatch" {
+			cp = &Calc{}
+		}
+		if err := cp.UnmarshalBinary(b); !errors.Is(err, ErrInvalidState) {
+			t.Fatalf("%s: unexpected error %v, expected %v", name, err, ErrInvalidState)
+		}
+	}
+}
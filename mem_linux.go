@@ -0,0 +1,13 @@
+package commp
+
+import "syscall"
+
+// systemMemory returns the amount of physical memory of the machine, or 0 if
+// it can not be determined.
+func systemMemory() uint64 {
+	var si syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&si); err != nil {
+		return 0
+	}
+	return uint64(si.Totalram) * uint64(si.Unit)
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package commp
+
+// systemMemory is only implemented on Linux, elsewhere the amount of physical
+// memory is treated as unknown.
+func systemMemory() uint64 { return 0 }
@@ -0,0 +1,98 @@
+package commp
+
+import (
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// memLimiter bounds the bytes held by the slabs in flight within the tower of
+// a single Calc. Slabs are only ever acquired by the goroutine feeding the
+// tower, under cp.mu, while any layer worker can release them: a single
+// pending wakeup is therefore enough to never miss one.
+type memLimiter struct {
+	mu        sync.Mutex
+	used, max int
+	freed     chan struct{}
+}
+
+func newMemLimiter(max int) *memLimiter {
+	return &memLimiter{max: max, freed: make(chan struct{}, 1)}
+}
+
+// acquire blocks until n more bytes fit under the limit, or until abort is
+// closed in which case it returns false. A request is always granted when
+// nothing else is in flight, so that a limit below the size of a single slab
+// still lets the tower make progress.
+func (m *memLimiter) acquire(n int, abort <-chan struct{}) bool {
+	for {
+		m.mu.Lock()
+		if m.used == 0 || m.used+n <= m.max {
+			m.used += n
+			m.mu.Unlock()
+			return true
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-m.freed:
+		case <-abort:
+			return false
+		}
+	}
+}
+
+// release hands back n bytes obtained via acquire().
+func (m *memLimiter) release(n int) {
+	m.mu.Lock()
+	m.used -= n
+	m.mu.Unlock()
+
+	select {
+	case m.freed <- struct{}{}:
+	default:
+	}
+}
+
+// pendingNodesSize is the most memory taken up by the pending node of every
+// layer, each held in a 64-byte twin buffer.
+const pendingNodesSize = int(MaxLayers+1) * 64
+
+// slabBudget is the amount of bytes the slabs in flight are allowed to take
+// up. The memLimiter lets a single slab through regardless.
+func (cp *Calc) slabBudget() int {
+	switch {
+	case cp.cfg.maxMemory <= 0:
+		// as many bytes as a full queue of full slabs, regardless of the
+		// size of the slabs actually in flight
+		return (layerQueueDepth + 1) * cp.slabQuads() * 128
+	case cp.cfg.strictMemory:
+		return cp.cfg.maxMemory - cp.slabSize() - pendingNodesSize
+	default:
+		return cp.cfg.maxMemory - cp.slabSize()
+	}
+}
+
+// MemoryCeiling returns the most memory the Calc holds on to while digesting,
+// as determined by its options: the carry buffer, the slabs in flight within
+// the digest tower, and the node pending on each layer of the tree. Not
+// included are the stacks and hash states of the background goroutines and
+// their fixed-size bookkeeping, a few KiB in total. Without
+// WithMemoryCeiling() or WithMaxMemory() the ceiling is a little over 1MiB
+// on most machines.
+func (cp *Calc) MemoryCeiling() int {
+	return cp.slabSize() + max(cp.slabBudget(), cp.slabQuads()*128) + pendingNodesSize
+}
+
+// minMemoryCeiling is the lowest ceiling WithMemoryCeiling() accepts.
+func (cp *Calc) minMemoryCeiling() int {
+	return minSlabQuads*(cp.quadSize()+128) + pendingNodesSize
+}
+
+// checkMemoryCeiling rejects a WithMemoryCeiling() too low to be honored.
+func (cp *Calc) checkMemoryCeiling() error {
+	if cp.cfg.strictMemory && cp.cfg.maxMemory < cp.minMemoryCeiling() {
+		return xerrors.Errorf("memory ceiling of %d bytes is below the minimum of %d: %w", cp.cfg.maxMemory, cp.minMemoryCeiling(), ErrMemoryCeiling)
+	}
+	return nil
+}
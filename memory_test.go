@@ -0,0 +1,117 @@
+package commp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	randmath "math/rand"
+)
+
+func TestMaxMemory(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 8*bufferSize+1000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	exp, expSize := mustDigest(t, &Calc{}, payload)
+
+	for _, limit := range []int{1, 20 << 10, 64 << 10, 1 << 20} {
+		limit := limit
+		t.Run(fmt.Sprintf("%d", limit), func(t *testing.T) {
+			t.Parallel()
+
+			var cp *Calc
+			var carry, peak int
+			// a slow sink keeps the workers behind the writer
+			sink := func(uint, uint64, [32]byte) {
+				cp.mem.mu.Lock()
+				if used := cp.mem.used + carry; used > peak {
+					peak = used
+				}
+				cp.mem.mu.Unlock()
+				time.Sleep(time.Nanosecond)
+			}
+			cp = New(WithMaxMemory(limit), WithNodeSink(sink))
+			carry = cp.slabSize()
+
+			if q := cp.slabQuads(); q*(quadPayload+256) > limit && q != minSlabQuads {
+				t.Fatalf("slabs of %d quads do not fit twice within %d bytes", q, limit)
+			}
+
+			commP, paddedSize := mustDigest(t, cp, payload)
+			if !bytes.Equal(commP, exp) || paddedSize != expSize {
+				t.Fatalf("commP 0x%X/%d doesn't match expected 0x%X/%d", commP, paddedSize, exp, expSize)
+			}
+
+			if floor := minSlabQuads * (quadPayload + 128); peak > max(limit, floor) {
+				t.Fatalf("peak of %d bytes in flight exceeds the limit of %d", peak, limit)
+			}
+		})
+	}
+}
+
+func TestMemoryCeiling(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 8*bufferSize+1000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	exp, expSize := mustDigest(t, &Calc{}, payload)
+
+	if c := (&Calc{}).MemoryCeiling(); c != bufferSize+(layerQueueDepth+1)*bufferSize/quadPayload*128+pendingNodesSize {
+		t.Fatalf("unexpected default ceiling of %d bytes", c)
+	}
+
+	floor := (&Calc{}).minMemoryCeiling()
+	for _, limit := range []int{floor, floor + 5000, 64 << 10, 1 << 20} {
+		limit := limit
+		t.Run(fmt.Sprintf("%d", limit), func(t *testing.T) {
+			t.Parallel()
+
+			var cp *Calc
+			var carry, peak int
+			// a slow sink keeps the workers behind the writer
+			sink := func(uint, uint64, [32]byte) {
+				cp.mem.mu.Lock()
+				if used := cp.mem.used + carry + pendingNodesSize; used > peak {
+					peak = used
+				}
+				cp.mem.mu.Unlock()
+				time.Sleep(time.Nanosecond)
+			}
+			cp = New(WithMemoryCeiling(limit), WithNodeSink(sink))
+			carry = cp.slabSize()
+
+			if c := cp.MemoryCeiling(); c > limit {
+				t.Fatalf("ceiling of %d bytes exceeds the configured %d", c, limit)
+			}
+
+			commP, paddedSize := mustDigest(t, cp, payload)
+			if !bytes.Equal(commP, exp) || paddedSize != expSize {
+				t.Fatalf("commP 0x%X/%d doesn't match expected 0x%X/%d", commP, paddedSize, exp, expSize)
+			}
+			if peak > limit {
+				t.Fatalf("peak of %d bytes exceeds the ceiling of %d", peak, limit)
+			}
+		})
+	}
+
+	// too low to be honored, with or without fr32-padded input
+	for _, opts := range [][]Option{nil, {WithPaddedInput()}} {
+		cp := New(append(opts, WithMemoryCeiling(floor-1))...)
+		if _, err := cp.Write(payload[:128]); !errors.Is(err, ErrMemoryCeiling) {
+			t.Fatalf("unexpected error %v, expected %v", err, ErrMemoryCeiling)
+		}
+		if err := cp.WriteZeroes(128); !errors.Is(err, ErrMemoryCeiling) {
+			t.Fatalf("unexpected error %v, expected %v", err, ErrMemoryCeiling)
+		}
+	}
+	state, err := New().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := New(WithMemoryCeiling(1)).UnmarshalBinary(state); !errors.Is(err, ErrMemoryCeiling) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrMemoryCeiling)
+	}
+}
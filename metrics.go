@@ -0,0 +1,108 @@
+package commp
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics accumulates counters describing the work of every Calc constructed
+// WithMetrics() it, letting embedders surface the health of their hashing
+// without wrapping the writer themselves. A Metrics is safe for concurrent
+// use, and implements expvar.Var: expvar.Publish() it to have it reported as
+// JSON along with the other variables of the process.
+type Metrics struct {
+	bytesIn       atomic.Uint64
+	quads         atomic.Uint64
+	slabsInFlight atomic.Int64
+	blocked       atomic.Int64
+}
+
+// MetricsSnapshot is the state of a Metrics at a point in time.
+type MetricsSnapshot struct {
+	// BytesIn is the amount of payload accepted by Write() and friends,
+	// WriteZeroes() included.
+	BytesIn uint64 `json:"bytes_in"`
+	// QuadsEnqueued is the amount of quads sent down the digest tower, see
+	// (*Calc).QuadsEnqueued().
+	QuadsEnqueued uint64 `json:"quads_enqueued"`
+	// SlabsInFlight is the amount of slabs queued for or being reduced by
+	// the digest tower right now.
+	SlabsInFlight int64 `json:"slabs_in_flight"`
+	// Blocked is the time Write() spent waiting for the digest tower to
+	// catch up, be it for memory WithMaxMemory() or for room in its queue.
+	Blocked time.Duration `json:"blocked_ns"`
+}
+
+// Snapshot returns the current value of every counter. The counters are read
+// one after the other, not atomically as a whole.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		BytesIn:       m.bytesIn.Load(),
+		QuadsEnqueued: m.quads.Load(),
+		SlabsInFlight: m.slabsInFlight.Load(),
+		Blocked:       time.Duration(m.blocked.Load()),
+	}
+}
+
+// String returns the Snapshot() as JSON, as expvar.Var calls for.
+func (m *Metrics) String() string {
+	b, _ := json.Marshal(m.Snapshot())
+	return string(b)
+}
+
+// The methods below are no-ops on a nil receiver, the case of a Calc
+// constructed without WithMetrics().
+
+func (m *Metrics) addBytes(n uint64) {
+	if m != nil {
+		m.bytesIn.Add(n)
+	}
+}
+
+func (m *Metrics) addQuads(n uint64) {
+	if m != nil {
+		m.quads.Add(n)
+	}
+}
+
+func (m *Metrics) addSlabs(n int64) {
+	if m != nil {
+		m.slabsInFlight.Add(n)
+	}
+}
+
+// enqueue accounts for quads sent down the tower.
+func (cp *Calc) enqueue(quads uint64) {
+	cp.quadsEnqueued += quads
+	cp.cfg.metrics.addQuads(quads)
+}
+
+// transferStart and transferStop time a wait of Write() for the tower, for
+// both Bench() and WithMetrics(), without reading the clock for neither.
+func (cp *Calc) transferStart() time.Time {
+	if cp.cfg.stats == nil && cp.cfg.metrics == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (cp *Calc) transferStop(start time.Time) {
+	if cp.cfg.stats == nil && cp.cfg.metrics == nil {
+		return
+	}
+	took := time.Since(start)
+	if cp.cfg.stats != nil {
+		cp.cfg.stats[stageTransfer].Add(int64(took))
+	}
+	if cp.cfg.metrics != nil {
+		cp.cfg.metrics.blocked.Add(int64(took))
+	}
+}
+
+// dropSlabsInFlight takes the slabs of the tower being torn down out of the
+// count of the Metrics, as those never reduced are never recycled either.
+// Must be called once the workers are done, before the state is cleared.
+func (cp *Calc) dropSlabsInFlight() {
+	cp.cfg.metrics.addSlabs(-cp.slabsInFlight.Load())
+}
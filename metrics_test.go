@@ -0,0 +1,61 @@
+package commp
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+)
+
+var _ expvar.Var = (*Metrics)(nil)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	m := new(Metrics)
+	payload := make([]byte, 5*bufferSize+3)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	// two Calcs sharing the metrics, one of them abandoned midway
+	cp := New(WithMetrics(m), WithMaxMemory(16<<10))
+	if _, err := cp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.WriteZeroes(1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cp.SnapshotDigest(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cp.Digest(); err != nil {
+		t.Fatal(err)
+	}
+
+	abandoned := New(WithMetrics(m))
+	if _, err := abandoned.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	abandoned.Reset()
+
+	s := m.Snapshot()
+	if want := uint64(2*len(payload) + 1000); s.BytesIn != want {
+		t.Errorf("expected %d bytes in, not %d", want, s.BytesIn)
+	}
+	// the quads of the abandoned Calc still in its carry buffer never made
+	// it down the tower
+	if min, max := uint64(len(payload)+1000+126)/127, uint64(2*len(payload)+1000+126)/127; s.QuadsEnqueued < min || s.QuadsEnqueued > max {
+		t.Errorf("expected between %d and %d quads, not %d", min, max, s.QuadsEnqueued)
+	}
+	if s.SlabsInFlight != 0 {
+		t.Errorf("expected no slabs in flight, not %d", s.SlabsInFlight)
+	}
+
+	var decoded MetricsSnapshot
+	if err := json.Unmarshal([]byte(m.String()), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != m.Snapshot() {
+		t.Errorf("unexpected JSON %s", m.String())
+	}
+}
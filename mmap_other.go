@@ -0,0 +1,10 @@
+//go:build !unix
+
+package commp
+
+import "os"
+
+// mmapFile is not implemented outside of unix systems.
+func mmapFile(*os.File, int64) ([]byte, func() error, error) {
+	return nil, nil, errMmapUnsupported
+}
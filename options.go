@@ -0,0 +1,111 @@
+package commp
+
+// Option customizes the behavior of a Calc constructed via New().
+type Option func(*config)
+
+type config struct {
+	nodeSink     func(layer uint, index uint64, node [32]byte)
+	paddedInput  bool
+	scheduler    *Scheduler
+	hashBackend  HashBackend
+	tracer       Tracer
+	metrics      *Metrics
+	maxMemory    int
+	strictMemory bool        // maxMemory is a WithMemoryCeiling()
+	stats        *stageTimes // only set by Bench()
+}
+
+// New returns a Calc configured with the supplied options. The zero-value of
+// Calc is equivalent to New() without any options. Options survive Reset()
+// and Digest(), and are inherited by Clone()s.
+func New(opts ...Option) *Calc {
+	cp := &Calc{}
+	for _, o := range opts {
+		o(&cp.cfg)
+	}
+	return cp
+}
+
+// WithNodeSink supplies a callback receiving every node of the merkle tree as
+// it is computed. Layer 0 are the fr32-padded 32-byte leaves, layer 1 their
+// parents and so on up to the commP root, while index is the position of the
+// node within its layer. Nodes of a layer are delivered in ascending index
+// order from a single goroutine per Calc, which then does all of the hashing
+// on its own: the callback should return promptly, as it stalls the digest
+// tower. Clone()s invoke it concurrently with the original. A panic of the
+// callback fails the Calc with an error wrapping ErrInternalFailure, which
+// identifies the node it was handed.
+//
+// Only nodes derived from written data are delivered: the all-zero subtrees
+// implicitly filling a piece up to its power-of-two padded size are not.
+func WithNodeSink(sink func(layer uint, index uint64, node [32]byte)) Option {
+	return func(c *config) { c.nodeSink = sink }
+}
+
+// WithPaddedInput makes the Calc accept input which is already fr32-padded,
+// such as the contents of an unsealed sector file, instead of raw payload.
+// The input is fed into the tree as-is, skipping the expansion step, and the
+// resulting digest is identical to that of the corresponding unpadded
+// payload. Every 32-byte chunk must be a valid fr32 leaf, with the top 2 bits
+// of its last byte clear: Write() rejects anything else with an error wrapping
+// ErrInvalidPadding. A trailing partial 128-byte chunk is zero-filled, and at
+// least 128 bytes must be written before a Digest().
+//
+// Serialized states of such a Calc can only be restored into a Calc
+// constructed with this same option, as UnmarshalBinary() verifies.
+func WithPaddedInput() Option {
+	return func(c *config) { c.paddedInput = true }
+}
+
+// WithScheduler makes the layer workers of the Calc hash only while holding a
+// slot of the supplied Scheduler, bounding the CPU consumed by all Calcs
+// sharing it. A worker never holds on to its slot while waiting for the next
+// layer to accept its results.
+func WithScheduler(s *Scheduler) Option {
+	return func(c *config) { c.scheduler = s }
+}
+
+// WithHashBackend selects the SHA-256 implementation used by the layer
+// workers of the Calc, instead of DefaultHashBackend().
+func WithHashBackend(b HashBackend) Option {
+	return func(c *config) { c.hashBackend = b }
+}
+
+// WithMaxMemory bounds the memory a Calc holds on to while data is in flight
+// within its digest tower: the carry buffer plus every slab queued for or
+// being reduced by a layer worker stay within maxBytes. Write() blocks until
+// the workers free up enough room, instead of going over the limit. The slab
+// size is lowered as needed to fit at least two slabs in flight, but the
+// carry buffer and a single slab are always allowed, making for a floor of
+// about 8KiB. Not accounted for are the 64-byte buffers holding the node
+// pending on each layer, and the internal state of the hash implementation.
+// Without this option the slabs in flight are bounded to about 1MiB, or more
+// on machines tuned for larger slabs. See WithMemoryCeiling() for a hard
+// bound.
+func WithMaxMemory(maxBytes int) Option {
+	return func(c *config) { c.maxMemory, c.strictMemory = maxBytes, false }
+}
+
+// WithTracer has the Calc report spans of its work to t: every write call,
+// the collapse of the tree and every digest, as listed along with SpanWrite.
+// As there is a span for every write call, small writes are best batched via
+// a BatchWriter while tracing. SnapshotDigest() is not traced.
+func WithTracer(t Tracer) Option {
+	return func(c *config) { c.tracer = t }
+}
+
+// WithMetrics has the Calc account for its work in m, which may be shared by
+// any number of Calcs to report on all of them together. SnapshotDigest() is
+// not accounted for.
+func WithMetrics(m *Metrics) Option {
+	return func(c *config) { c.metrics = m }
+}
+
+// WithMemoryCeiling is a stricter WithMaxMemory(): maxBytes bounds everything
+// accounted for by MemoryCeiling(), which is guaranteed to not exceed it.
+// There is no floor, instead Write(), WriteZeroes() and UnmarshalBinary()
+// reject a ceiling too low to be honored with an error wrapping
+// ErrMemoryCeiling: the lowest acceptable one is about 10KiB.
+func WithMemoryCeiling(maxBytes int) Option {
+	return func(c *config) { c.maxMemory, c.strictMemory = maxBytes, true }
+}
@@ -0,0 +1,207 @@
+package commp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+	"testing"
+
+	randmath "math/rand"
+)
+
+type nodeCollector struct {
+	mu    sync.Mutex
+	nodes map[[2]uint64][32]byte
+}
+
+func (nc *nodeCollector) sink(layer uint, index uint64, node [32]byte) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.nodes == nil {
+		nc.nodes = make(map[[2]uint64][32]byte)
+	}
+	k := [2]uint64{uint64(layer), index}
+	if _, exists := nc.nodes[k]; exists {
+		panic(fmt.Sprintf("node %d/%d emitted twice", layer, index))
+	}
+	nc.nodes[k] = node
+}
+
+func TestNodeSink(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{127, 1000, 3*bufferSize + 5, 2<<20 + 1} {
+		size := size
+		t.Run(fmt.Sprintf("%d", size), func(t *testing.T) {
+			t.Parallel()
+
+			payload := make([]byte, size)
+			randmath.New(randmath.NewSource(int64(size))).Read(payload)
+
+			nc := &nodeCollector{}
+			commP, paddedSize := mustDigest(t, New(WithNodeSink(nc.sink)), payload)
+
+			if leaves := uint64(len(nc.nodes)) - uint64(len(nc.nodesAbove(0))); leaves != uint64((size+126)/127*4) {
+				t.Fatalf("received %d leaves, expected %d", leaves, (size+126)/127*4)
+			}
+			height := uint64(bits.TrailingZeros64(paddedSize / 32))
+			if root := nc.nodes[[2]uint64{height, 0}]; !bytes.Equal(root[:], commP) {
+				t.Fatalf("received root 0x%X doesn't match commP 0x%X", root, commP)
+			}
+
+			h := sha256.New()
+			for k, node := range nc.nodesAbove(0) {
+				left, found := nc.nodes[[2]uint64{k[0] - 1, 2 * k[1]}]
+				if !found {
+					t.Fatalf("node %d/%d received without its left child", k[0], k[1])
+				}
+				right, found := nc.nodes[[2]uint64{k[0] - 1, 2*k[1] + 1}]
+				if !found {
+					copy(right[:], stackedNulPadding[k[0]-1])
+				}
+				h.Reset()
+				h.Write(left[:])
+				h.Write(right[:])
+				exp := h.Sum(nil)
+				exp[31] &= 0x3F
+				if !bytes.Equal(node[:], exp) {
+					t.Fatalf("node %d/%d 0x%X is not the hash of its children 0x%X", k[0], k[1], node, exp)
+				}
+			}
+
+			// interrupting via state serialization produces the exact same tree
+			for _, cut := range []int{size / 2, size - 1} {
+				resumed := &nodeCollector{}
+				cp := New(WithNodeSink(resumed.sink))
+				if _, err := cp.Write(payload[:cut]); err != nil {
+					t.Fatal(err)
+				}
+				st, err := cp.MarshalBinary()
+				if err != nil {
+					t.Fatal(err)
+				}
+				cp.Reset()
+				if err := cp.UnmarshalBinary(st); err != nil {
+					t.Fatal(err)
+				}
+				mustDigest(t, cp, payload[cut:])
+
+				if len(resumed.nodes) != len(nc.nodes) {
+					t.Fatalf("cut at %d: received %d nodes, expected %d", cut, len(resumed.nodes), len(nc.nodes))
+				}
+				for k, node := range nc.nodes {
+					if resumed.nodes[k] != node {
+						t.Fatalf("cut at %d: node %d/%d 0x%X doesn't match expected 0x%X", cut, k[0], k[1], resumed.nodes[k], node)
+					}
+				}
+			}
+
+			// snapshots do not leak into the sink
+			quiet := &nodeCollector{}
+			cp := New(WithNodeSink(quiet.sink))
+			if _, err := cp.Write(payload); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := cp.SnapshotDigest(); err != nil {
+				t.Fatal(err)
+			}
+			cp.Reset()
+			for k := range quiet.nodes {
+				if _, found := nc.nodes[k]; !found {
+					t.Fatalf("unexpected node %d/%d received during a snapshot", k[0], k[1])
+				}
+			}
+		})
+	}
+}
+
+func (nc *nodeCollector) nodesAbove(layer uint64) map[[2]uint64][32]byte {
+	ret := make(map[[2]uint64][32]byte)
+	for k, n := range nc.nodes {
+		if k[0] > layer {
+			ret[k] = n
+		}
+	}
+	return ret
+}
+
+func TestPaddedInput(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{65, 127, 1000, 3*bufferSize + 5, 2<<20 + 1} {
+		size := size
+		t.Run(fmt.Sprintf("%d", size), func(t *testing.T) {
+			t.Parallel()
+
+			payload := make([]byte, size)
+			rng := randmath.New(randmath.NewSource(int64(size)))
+			rng.Read(payload)
+			exp, expSize := mustDigest(t, &Calc{}, payload)
+
+			var padded bytes.Buffer
+			pw := NewPadWriter(&padded)
+			pw.Write(payload)
+			pw.Close()
+
+			cp := New(WithPaddedInput())
+			if cp.BlockSize() != 128 {
+				t.Fatalf("unexpected block size %d", cp.BlockSize())
+			}
+			for rest := padded.Bytes(); len(rest) > 0; {
+				n := 1 + rng.Intn(len(rest))
+				if _, err := cp.Write(rest[:n]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+			}
+
+			snap, snapSize, err := cp.SnapshotDigest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			st, err := cp.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored := New(WithPaddedInput())
+			if err := restored.UnmarshalBinary(st); err != nil {
+				t.Fatal(err)
+			}
+			cloned := cp.Clone()
+
+			for name, c := range map[string]*Calc{"direct": cp, "restored": restored, "cloned": cloned} {
+				commP, paddedSize, err := c.Digest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(commP, exp) || paddedSize != expSize {
+					t.Fatalf("%s: padded input digest 0x%X/%d doesn't match 0x%X/%d", name, commP, paddedSize, exp, expSize)
+				}
+			}
+			if !bytes.Equal(snap, exp) || snapSize != expSize {
+				t.Fatalf("padded input snapshot 0x%X/%d doesn't match 0x%X/%d", snap, snapSize, exp, expSize)
+			}
+		})
+	}
+
+	cp := New(WithPaddedInput())
+	good := make([]byte, 100)
+	if _, err := cp.Write(good); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cp.Digest(); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected result digesting less than 128 padded bytes: %v", err)
+	}
+	bad := make([]byte, 64)
+	bad[31-100%32] = 0x40
+	if _, err := cp.Write(bad); !errors.Is(err, ErrInvalidPadding) {
+		t.Fatalf("unexpected result writing invalid padding: %v", err)
+	}
+	if n := cp.BytesWritten(); n != 100 {
+		t.Fatalf("rejected write changed the accumulated amount to %d", n)
+	}
+	cp.Reset()
+}
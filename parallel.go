@@ -0,0 +1,191 @@
+package commp
+
+import (
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/xerrors"
+)
+
+// minSegmentQuads is the smallest amount of quads handed to a single worker
+// by digestSegments(), below which the overhead of stitching dominates.
+const minSegmentQuads = 1 << 13
+
+// checkInputSize validates the size of an input digested in one go.
+func checkInputSize(size int64) error {
+	if size < int64(MinPiecePayload) {
+		return xerrors.Errorf(
+			"commP is not defined for inputs shorter than %d bytes, but only %d supplied: %w",
+			MinPiecePayload, size, ErrBelowMinimumPayload,
+		)
+	}
+	if uint64(size) > MaxPiecePayload {
+		return xerrors.Errorf(
+			"input of %d bytes exceeds the maximum supported piece input size %d: %w",
+			size, MaxPiecePayload, ErrPayloadTooLarge,
+		)
+	}
+	return nil
+}
+
+// digestSegments splits an input of size bytes into segments of a power of 2
+// amount of quads, has up to workers goroutines call digest for each of them,
+// and stitches the resulting subtree roots into the commP of the entire
+// input. The digest callback returns the root of the subtree of the segment
+// at offset, and its padded size. Only the last segment may be shorter than
+// the rest.
+func digestSegments(size int64, workers int, digest func(offset, length int64) ([]byte, uint64, error)) (commP []byte, paddedPieceSize uint64, err error) {
+	if err := checkInputSize(size); err != nil {
+		return nil, 0, err
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	totalQuads := (uint64(size) + 126) / 127
+	paddedPieceSize = paddedSizeForQuads(totalQuads)
+
+	// a few segments per worker keep them all busy until the very end
+	segQuads := uint64(minSegmentQuads)
+	for segQuads*uint64(workers)*4 < totalQuads {
+		segQuads <<= 1
+	}
+	segSize := int64(segQuads * 127)
+	segCount := int((size + segSize - 1) / segSize)
+	if workers > segCount {
+		workers = segCount
+	}
+
+	type segRoot struct {
+		layer uint
+		node  [32]byte
+	}
+	roots := make([]segRoot, segCount)
+
+	var (
+		next     atomic.Int64
+		errOnce  sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			withSegmentLabels(func() {
+				for {
+					i := int(next.Add(1) - 1)
+					if i >= segCount {
+						return
+					}
+					root, segPadded, err := digest(int64(i)*segSize, min(segSize, size-int64(i)*segSize))
+					if err != nil {
+						errOnce.Do(func() { firstErr = err })
+						next.Store(int64(segCount)) // stop the others early
+						return
+					}
+					roots[i] = segRoot{
+						layer: uint(bits.TrailingZeros64(segPadded / 32)),
+						node:  [32]byte(root),
+					}
+				}
+			})
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+
+	// as segments are aligned to their size, the subtree of a shorter last
+	// one sits at the start of its slot
+	st := newSparseTree(uint(bits.TrailingZeros64(paddedPieceSize / 32)))
+	for i, sr := range roots {
+		st.set(sr.layer, uint64(i)*segQuads*4>>sr.layer, sr.node)
+	}
+	st.build()
+	root := st.root()
+
+	return root[:], paddedPieceSize, nil
+}
+
+// reduceQuads returns the commP and padded piece size of in, computed on the
+// calling goroutine without any of the Calc machinery: every full slab is
+// expanded and reduced to its root in place, and the roots are combined as
+// they arrive, holding at most one pending node per layer.
+func reduceQuads(in []byte) (commP [32]byte, paddedPieceSize uint64) {
+	paddedPieceSize = paddedSizeForQuads((uint64(len(in)) + 126) / 127)
+	height := uint(bits.TrailingZeros64(paddedPieceSize / 32))
+
+	h := newHasher()
+	var (
+		pending [MaxLayers + 1][32]byte
+		held    uint64 // bitmask of the layers in pending holding a node
+		pair    [64]byte
+	)
+	hashPair := func(left, right []byte) [32]byte {
+		copy(pair[:32], left)
+		copy(pair[32:], right)
+		hashSlab254(h, 0, pair[:])
+		return [32]byte(pair[:32])
+	}
+	add := func(layer uint, node [32]byte) {
+		for ; held&(1<<layer) != 0; layer++ {
+			node = hashPair(pending[layer][:], node[:])
+			held &^= 1 << layer
+		}
+		pending[layer] = node
+		held |= 1 << layer
+	}
+
+	slab := getSlab(fullSlabSize)
+	defer putSlab(slab)
+	slabLayer := uint(bits.TrailingZeros(uint(fullSlabSize / 32)))
+
+	for ; len(in) >= bufferSize; in = in[bufferSize:] {
+		if isZero(in[:bufferSize]) {
+			add(slabLayer, [32]byte(stackedNulPadding[slabLayer]))
+			continue
+		}
+		padQuads(slab, in[:bufferSize])
+		for l := uint(0); l < slabLayer; l++ {
+			hashSlab254(h, l, slab)
+		}
+		add(slabLayer, [32]byte(slab[:32]))
+	}
+
+	// the few leaves of the trailing partial slab are combined one by one,
+	// with its last quad zero-filled
+	if len(in) > 0 {
+		quads := (len(in) + 126) / 127
+		tail := make([]byte, quads*127)
+		copy(tail, in)
+		padQuads(slab, tail)
+		for i := 0; i < quads*128; i += 32 {
+			add(0, [32]byte(slab[i:i+32]))
+		}
+	}
+
+	// pad every pending node with a zero subtree on its right, all the way up
+	if held == 1<<height {
+		return pending[height], paddedPieceSize
+	}
+	var carry *[32]byte
+	for l := uint(0); l < height; l++ {
+		var n [32]byte
+		switch {
+		case held&(1<<l) != 0 && carry != nil:
+			n = hashPair(pending[l][:], carry[:])
+		case held&(1<<l) != 0:
+			n = hashPair(pending[l][:], stackedNulPadding[l])
+		case carry != nil:
+			n = hashPair(carry[:], stackedNulPadding[l])
+		default:
+			continue
+		}
+		carry = &n
+	}
+	return *carry, paddedPieceSize
+}
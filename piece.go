@@ -0,0 +1,60 @@
+package commp
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+)
+
+const (
+	// multicodec fil-commitment-unsealed
+	filCommitmentUnsealed = 0xf101
+	// multihash sha2-256-trunc254-padded
+	sha256Trunc254Padded = 0x1012
+)
+
+var cidBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// PieceInfo is the self-describing result of a commP calculation, as returned
+// by DigestPiece().
+type PieceInfo struct {
+	// CommP is the raw 32 byte commitment
+	CommP []byte
+	// PaddedPieceSize is the power-of-two size of the fr32-padded piece
+	PaddedPieceSize uint64
+	// UnpaddedPieceSize is the amount of payload the piece can hold, which is
+	// always PaddedPieceSize / 128 * 127
+	UnpaddedPieceSize uint64
+}
+
+// DigestPiece is identical to Digest(), except that it returns the results
+// wrapped in a PieceInfo.
+func (cp *Calc) DigestPiece() (PieceInfo, error) {
+	commP, paddedPieceSize, err := cp.Digest()
+	if err != nil {
+		return PieceInfo{}, err
+	}
+	return PieceInfo{
+		CommP:             commP,
+		PaddedPieceSize:   paddedPieceSize,
+		UnpaddedPieceSize: paddedPieceSize / 128 * 127,
+	}, nil
+}
+
+// CIDBytes returns the binary form of the v1 piece CID (fil-commitment-unsealed
+// codec, sha2-256-trunc254-padded multihash) corresponding to CommP. Use
+// https://pkg.go.dev/github.com/ipfs/go-cid#Cast to turn it into a proper
+// cid.Cid if needed.
+func (pi PieceInfo) CIDBytes() []byte {
+	b := make([]byte, 0, 8+len(pi.CommP))
+	b = binary.AppendUvarint(b, 1) // CIDv1
+	b = binary.AppendUvarint(b, filCommitmentUnsealed)
+	b = binary.AppendUvarint(b, sha256Trunc254Padded)
+	b = binary.AppendUvarint(b, uint64(len(pi.CommP)))
+	return append(b, pi.CommP...)
+}
+
+// CIDString returns the canonical base32 textual form of the v1 piece CID,
+// as would be returned by (cid.Cid).String().
+func (pi PieceInfo) CIDString() string {
+	return "b" + cidBase32.EncodeToString(pi.CIDBytes())
+}
@@ -0,0 +1,45 @@
+package commp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDigestPiece(t *testing.T) {
+	t.Parallel()
+
+	tests, err := getTestCases("testdata/zero.txt", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp := &Calc{}
+	for _, test := range tests {
+		if _, err := io.Copy(cp, io.LimitReader(&repeatedReader{b: 0x00}, test.PayloadSize)); err != nil {
+			t.Fatal(err)
+		}
+		pi, err := cp.DigestPiece()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp.Reset()
+
+		if !bytes.Equal(pi.CommP, test.RawCommP) {
+			t.Fatalf("%d: produced commP 0x%X doesn't match expected 0x%X", test.PayloadSize, pi.CommP, test.RawCommP)
+		}
+		if pi.PaddedPieceSize != test.PieceSize || pi.UnpaddedPieceSize != test.PieceSize/128*127 {
+			t.Fatalf("%d: produced sizes %d/%d don't match expected padded size %d", test.PayloadSize, pi.PaddedPieceSize, pi.UnpaddedPieceSize, test.PieceSize)
+		}
+		if pi.CIDString() != test.PieceCID {
+			t.Fatalf("%d: produced piece CID %s doesn't match expected %s", test.PayloadSize, pi.CIDString(), test.PieceCID)
+		}
+		if expCID, _ := b32dec.DecodeString(test.PieceCID[1:]); !bytes.Equal(pi.CIDBytes(), expCID) {
+			t.Fatalf("%d: produced binary piece CID 0x%X doesn't match expected 0x%X", test.PayloadSize, pi.CIDBytes(), expCID)
+		}
+	}
+
+	if _, err := cp.DigestPiece(); err == nil {
+		t.Fatal("unexpected success digesting an empty accumulator")
+	}
+}
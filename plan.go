@@ -0,0 +1,121 @@
+package commp
+
+import (
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// PlannedPayload is a payload assigned to a piece by PlanPieces().
+type PlannedPayload struct {
+	// Index is the position of the payload among those given to PlanPieces()
+	Index int
+	// Size is the size of the payload
+	Size uint64
+	// Offset is the position of the payload within the payload of the piece,
+	// the payloads of a piece following each other back to back
+	Offset uint64
+}
+
+// PlannedPiece is a piece of the plan returned by PlanPieces().
+type PlannedPiece struct {
+	// Payloads are the payloads making up the piece, by Offset
+	Payloads []PlannedPayload
+	// PayloadSize is the size of all Payloads together
+	PayloadSize uint64
+	// PaddedPieceSize is the size the piece is predicted to be padded to
+	PaddedPieceSize uint64
+	// Oversized is set on a piece larger than any of the allowed sizes,
+	// holding a payload too large for them along with smaller ones
+	Oversized bool
+}
+
+// PlanPieces assigns payloads of the given sizes to pieces so that as few
+// pieces as possible are filled, minimizing the padding they end up with,
+// without any of the payloads being read. Each of pieceSizes is an allowed
+// padded piece size. Pieces are filled by first-fit decreasing up to the
+// largest of them, and the last ones, not filled up, shrunk to the smallest
+// allowed size still holding their payloads. A payload too large for all of
+// pieceSizes gets a piece of its own, the smallest one holding it, which the
+// smaller payloads then fill up like the others: such a piece is marked
+// Oversized.
+//
+// The commP of a piece is that of its Payloads written to a Calc back to back,
+// padded to PaddedPieceSize with PadCommP() where the Calc digests a smaller
+// piece.
+func PlanPieces(payloadSizes []uint64, pieceSizes []uint64) ([]PlannedPiece, error) {
+	if len(pieceSizes) == 0 {
+		return nil, xerrors.Errorf("no piece sizes allowed: %w", ErrInvalidPieceSize)
+	}
+	allowed := make([]uint64, len(pieceSizes))
+	copy(allowed, pieceSizes)
+	sort.Slice(allowed, func(i, j int) bool { return allowed[i] < allowed[j] })
+	for _, size := range allowed {
+		if err := PaddedPieceSize(size).Validate(); err != nil {
+			return nil, err
+		}
+	}
+	capacity := uint64(PaddedPieceSize(allowed[len(allowed)-1]).Unpadded())
+
+	order := make([]int, len(payloadSizes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return payloadSizes[order[i]] > payloadSizes[order[j]] })
+
+	var pieces []PlannedPiece
+	var room []uint64 // the payload every piece may hold
+	for _, idx := range order {
+		size := payloadSizes[idx]
+		if size > MaxPiecePayload {
+			return nil, xerrors.Errorf("payload %d of %d bytes exceeds the maximum piece payload of %d bytes: %w", idx, size, MaxPiecePayload, ErrPayloadTooLarge)
+		}
+
+		i := 0
+		for ; i < len(pieces); i++ {
+			if pieces[i].PayloadSize+size <= room[i] {
+				break
+			}
+		}
+		if i == len(pieces) {
+			pieces = append(pieces, PlannedPiece{})
+			room = append(room, capacity)
+			if size > capacity {
+				unpadded, _, err := ZeroPaddedPieceSize(size)
+				if err != nil {
+					return nil, err
+				}
+				pieces[i].Oversized = true
+				room[i] = uint64(unpadded)
+			}
+		}
+
+		pieces[i].Payloads = append(pieces[i].Payloads, PlannedPayload{
+			Index:  idx,
+			Size:   size,
+			Offset: pieces[i].PayloadSize,
+		})
+		pieces[i].PayloadSize += size
+	}
+
+	for i := range pieces {
+		p := &pieces[i]
+		if p.PayloadSize == 0 {
+			return nil, xerrors.Errorf("the payloads of piece %d are all empty: %w", i, ErrBelowMinimumPayload)
+		}
+		_, padded, err := ZeroPaddedPieceSize(p.PayloadSize)
+		if err != nil {
+			return nil, err
+		}
+		p.PaddedPieceSize = uint64(padded)
+		if !p.Oversized {
+			for _, size := range allowed {
+				if size >= p.PaddedPieceSize {
+					p.PaddedPieceSize = size
+					break
+				}
+			}
+		}
+	}
+	return pieces, nil
+}
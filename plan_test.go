@@ -0,0 +1,98 @@
+package commp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPlanPieces(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name       string
+		payloads   []uint64
+		pieceSizes []uint64
+		expSizes   [][]uint64 // of the payloads of every piece
+		expPadded  []uint64
+		oversized  int // the piece expected to be Oversized, if any
+	}{
+		{
+			name:       "first-fit decreasing",
+			payloads:   []uint64{5000, 9000, 3000, 7000, 2000, 2000, 1000, 12000},
+			pieceSizes: []uint64{16384},
+			expSizes:   [][]uint64{{12000, 3000, 1000}, {9000, 7000}, {5000, 2000, 2000}},
+			expPadded:  []uint64{16384, 16384, 16384},
+			oversized:  -1,
+		},
+		{
+			name:       "shrunk to an allowed size",
+			payloads:   []uint64{300, 16000},
+			pieceSizes: []uint64{16384, 1024},
+			expSizes:   [][]uint64{{16000}, {300}},
+			expPadded:  []uint64{16384, 1024},
+			oversized:  -1,
+		},
+		{
+			name:       "oversized filled up",
+			payloads:   []uint64{400, 1500, 300, 600},
+			pieceSizes: []uint64{1024},
+			expSizes:   [][]uint64{{1500, 400}, {600, 300}},
+			expPadded:  []uint64{2048, 1024},
+			oversized:  0,
+		},
+	} {
+		pieces, err := PlanPieces(tc.payloads, tc.pieceSizes)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if len(pieces) != len(tc.expSizes) {
+			t.Fatalf("%s: planned %d pieces, expected %d", tc.name, len(pieces), len(tc.expSizes))
+		}
+
+		seen := make(map[int]bool)
+		for i, p := range pieces {
+			if p.PaddedPieceSize != tc.expPadded[i] || p.Oversized != (i == tc.oversized) {
+				t.Fatalf("%s: piece %d of padded size %d (oversized %t), expected %d (%t)", tc.name, i, p.PaddedPieceSize, p.Oversized, tc.expPadded[i], i == tc.oversized)
+			}
+			if len(p.Payloads) != len(tc.expSizes[i]) {
+				t.Fatalf("%s: piece %d holds %d payloads, expected %d", tc.name, i, len(p.Payloads), len(tc.expSizes[i]))
+			}
+			var offset uint64
+			for j, pl := range p.Payloads {
+				if pl.Size != tc.expSizes[i][j] || pl.Size != tc.payloads[pl.Index] || pl.Offset != offset {
+					t.Fatalf("%s: piece %d holds payload %d of %d bytes at offset %d, expected %d bytes at offset %d", tc.name, i, pl.Index, pl.Size, pl.Offset, tc.expSizes[i][j], offset)
+				}
+				if seen[pl.Index] {
+					t.Fatalf("%s: payload %d planned twice", tc.name, pl.Index)
+				}
+				seen[pl.Index] = true
+				offset += pl.Size
+			}
+			if p.PayloadSize != offset || offset > p.PaddedPieceSize/128*127 {
+				t.Fatalf("%s: piece %d of %d bytes of payload holds %d bytes, of at most %d", tc.name, i, p.PayloadSize, offset, p.PaddedPieceSize/128*127)
+			}
+		}
+		if len(seen) != len(tc.payloads) {
+			t.Fatalf("%s: planned %d payloads, expected %d", tc.name, len(seen), len(tc.payloads))
+		}
+	}
+}
+
+func TestPlanPiecesInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		payloads   []uint64
+		pieceSizes []uint64
+		exp        error
+	}{
+		{[]uint64{1000}, nil, ErrInvalidPieceSize},
+		{[]uint64{1000}, []uint64{1024, 1000}, ErrInvalidPieceSize},
+		{[]uint64{1000, MaxPiecePayload + 1}, []uint64{1024}, ErrPayloadTooLarge},
+		{[]uint64{0, 0}, []uint64{1024}, ErrBelowMinimumPayload},
+	} {
+		if _, err := PlanPieces(tc.payloads, tc.pieceSizes); !errors.Is(err, tc.exp) {
+			t.Fatalf("%v in %v: unexpected error %v, expected %v", tc.payloads, tc.pieceSizes, err, tc.exp)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package commp
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"golang.org/x/xerrors"
+)
+
+// Layout of the data segment index, as specified by FRC-0058 and implemented
+// by https://github.com/filecoin-project/go-data-segment
+const (
+	segmentIndexEntrySize  = 64
+	segmentChecksumSize    = 16
+	minSegmentIndexEntries = 4
+	// the smallest aggregate fitting a sub-piece alongside the index
+	minAggregateSize = 512
+)
+
+// DataSegment is a sub-piece placed within an aggregate piece.
+type DataSegment struct {
+	// CommP is the commitment of the sub-piece
+	CommP [32]byte
+	// PaddedSize is the power-of-two padded size of the sub-piece
+	PaddedSize uint64
+	// Offset is the position of the sub-piece within the padded aggregate, a
+	// multiple of PaddedSize
+	Offset uint64
+}
+
+// InclusionProof is a Proof of Data Segment Inclusion (PoDSI) as specified by
+// FRC-0058, structurally identical to the InclusionProof of go-data-segment.
+type InclusionProof struct {
+	// ProofSubtree proves the commP of the sub-piece within the aggregate
+	ProofSubtree Proof
+	// ProofIndex proves the data segment index entry describing the
+	// sub-piece, a node on layer 1 of the aggregate
+	ProofIndex Proof
+}
+
+// Aggregate is an aggregate piece, composed of sub-pieces followed by a data
+// segment index describing them, as produced by go-data-segment. It is built
+// solely from the commPs of the sub-pieces, without access to their data.
+type Aggregate struct {
+	paddedSize uint64
+	segments   []DataSegment
+	tree       *sparseTree
+}
+
+// PackDataSegments returns copies of the given segments with their Offset
+// assigned sequentially, each aligned to its own size, matching the default
+// placement of go-data-segment. The returned offsets do not account for the
+// size of any particular aggregate: NewAggregate() validates whether they fit.
+func PackDataSegments(segments []DataSegment) []DataSegment {
+	out := make([]DataSegment, len(segments))
+	var pos uint64
+	for i, s := range segments {
+		if s.PaddedSize != 0 {
+			pos = alignUp(pos, s.PaddedSize)
+		}
+		out[i] = s
+		out[i].Offset = pos
+		pos += s.PaddedSize
+	}
+	return out
+}
+
+// NewAggregate assembles an aggregate piece of the given padded size from the
+// given segments, which must be aligned, must not overlap, and must leave
+// room for the data segment index at the end of the aggregate.
+func NewAggregate(paddedSize uint64, segments []DataSegment) (*Aggregate, error) {
+	if bits.OnesCount64(paddedSize) != 1 || paddedSize < minAggregateSize || paddedSize > MaxPieceSize {
+		return nil, xerrors.Errorf("aggregate padded size %d is not a power of 2 between %d and %d: %w", paddedSize, minAggregateSize, MaxPieceSize, ErrInvalidPieceSize)
+	}
+	if len(segments) == 0 {
+		return nil, xerrors.Errorf("an aggregate must contain at least one segment: %w", ErrInvalidLayout)
+	}
+
+	indexStart := segmentIndexStart(paddedSize)
+	if uint64(len(segments)) > (paddedSize-indexStart)/segmentIndexEntrySize {
+		return nil, xerrors.Errorf("%d segments exceed the capacity of %d index entries of an aggregate of size %d: %w", len(segments), (paddedSize-indexStart)/segmentIndexEntrySize, paddedSize, ErrInvalidLayout)
+	}
+
+	agg := &Aggregate{
+		paddedSize: paddedSize,
+		segments:   append([]DataSegment(nil), segments...),
+		tree:       newSparseTree(uint(bits.TrailingZeros64(paddedSize / 32))),
+	}
+
+	var end uint64
+	for i, s := range agg.segments {
+		if bits.OnesCount64(s.PaddedSize) != 1 || s.PaddedSize < 128 {
+			return nil, xerrors.Errorf("segment %d padded size %d is not a power of 2 of at least 128: %w", i, s.PaddedSize, ErrInvalidPieceSize)
+		}
+		if s.Offset%s.PaddedSize != 0 {
+			return nil, xerrors.Errorf("segment %d offset %d is not aligned to its size %d: %w", i, s.Offset, s.PaddedSize, ErrInvalidLayout)
+		}
+		if s.Offset < end {
+			return nil, xerrors.Errorf("segment %d at offset %d overlaps or precedes the previous segment ending at %d: %w", i, s.Offset, end, ErrInvalidLayout)
+		}
+		end = s.Offset + s.PaddedSize
+		if end > indexStart || end < s.Offset {
+			return nil, xerrors.Errorf("segment %d ending at %d extends into the data segment index starting at %d: %w", i, end, indexStart, ErrInvalidLayout)
+		}
+
+		layer := uint(bits.TrailingZeros64(s.PaddedSize / 32))
+		agg.tree.set(layer, s.Offset/s.PaddedSize, s.CommP)
+		agg.tree.set(1, indexStart/segmentIndexEntrySize+uint64(i), segmentIndexNode(s))
+	}
+	agg.tree.build()
+
+	return agg, nil
+}
+
+// CommP returns the commitment of the entire aggregate, including its data
+// segment index.
+func (agg *Aggregate) CommP() [32]byte { return agg.tree.root() }
+
+// PaddedSize returns the padded size of the aggregate.
+func (agg *Aggregate) PaddedSize() uint64 { return agg.paddedSize }
+
+// ProveInclusion returns the inclusion proof of the segment at the given
+// position within the list the Aggregate was constructed from.
+func (agg *Aggregate) ProveInclusion(segmentIdx int) (InclusionProof, error) {
+	if segmentIdx < 0 || segmentIdx >= len(agg.segments) {
+		return InclusionProof{}, xerrors.Errorf("segment %d out of range of the %d available segments", segmentIdx, len(agg.segments))
+	}
+	s := agg.segments[segmentIdx]
+	return InclusionProof{
+		ProofSubtree: agg.tree.prove(uint(bits.TrailingZeros64(s.PaddedSize/32)), s.Offset/s.PaddedSize),
+		ProofIndex:   agg.tree.prove(1, segmentIndexStart(agg.paddedSize)/segmentIndexEntrySize+uint64(segmentIdx)),
+	}, nil
+}
+
+// AggregateCommP verifies the proof is consistent with the given sub-piece,
+// and returns the commP and padded size of the aggregate it proves inclusion
+// in. It is the equivalent of ComputeExpectedAuxData() of go-data-segment:
+// the caller must compare the results against the aggregate they expect.
+func (ip InclusionProof) AggregateCommP(commP [32]byte, paddedSize uint64) ([32]byte, uint64, error) {
+	var root [32]byte
+	if bits.OnesCount64(paddedSize) != 1 || paddedSize < 128 {
+		return root, 0, xerrors.Errorf("sub-piece padded size %d is not a power of 2 of at least 128: %w", paddedSize, ErrInvalidPieceSize)
+	}
+	if len(ip.ProofIndex.Path) > int(MaxLayers) ||
+		bits.TrailingZeros64(paddedSize)+len(ip.ProofSubtree.Path) > bits.TrailingZeros64(MaxPieceSize) {
+		return root, 0, xerrors.Errorf("proof paths exceed the maximum tree height: %w", ErrInvalidProof)
+	}
+
+	aggSize := paddedSize << len(ip.ProofSubtree.Path)
+	if aggSize < minAggregateSize {
+		return root, 0, xerrors.Errorf("aggregate size %d is below the minimum of %d: %w", aggSize, minAggregateSize, ErrInvalidProof)
+	}
+	if idxSize := uint64(segmentIndexEntrySize) << len(ip.ProofIndex.Path); idxSize != aggSize {
+		return root, 0, xerrors.Errorf("index proof for an aggregate of size %d does not match subtree proof for an aggregate of size %d: %w", idxSize, aggSize, ErrInvalidProof)
+	}
+	if ip.ProofSubtree.Index >= aggSize/paddedSize || ip.ProofIndex.Index >= aggSize/segmentIndexEntrySize {
+		return root, 0, xerrors.Errorf("proof index out of range: %w", ErrInvalidProof)
+	}
+	if ip.ProofIndex.Index < segmentIndexStart(aggSize)/segmentIndexEntrySize {
+		return root, 0, xerrors.Errorf("index entry %d precedes the data segment index: %w", ip.ProofIndex.Index, ErrInvalidProof)
+	}
+
+	root = ip.ProofSubtree.resolve(commP)
+	entry := segmentIndexNode(DataSegment{
+		CommP:      commP,
+		PaddedSize: paddedSize,
+		Offset:     ip.ProofSubtree.Index * paddedSize,
+	})
+	if ip.ProofIndex.resolve(entry) != root {
+		return [32]byte{}, 0, xerrors.Errorf("subtree and index proofs resolve to different roots: %w", ErrInvalidProof)
+	}
+	return root, aggSize, nil
+}
+
+// segmentIndexStart returns the offset at which the data segment index of an
+// aggregate of the given size starts.
+func segmentIndexStart(aggPaddedSize uint64) uint64 {
+	entries := uint64(minSegmentIndexEntries)
+	if n := aggPaddedSize / 2048 / segmentIndexEntrySize; n > entries {
+		entries = 1 << bits.Len64(n-1)
+	}
+	return aggPaddedSize - entries*segmentIndexEntrySize
+}
+
+// segmentIndexEntry returns the index entry describing the segment: its
+// commP, offset and size, followed by their checksum.
+func segmentIndexEntry(s DataSegment) [segmentIndexEntrySize]byte {
+	var entry [segmentIndexEntrySize]byte
+	copy(entry[:32], s.CommP[:])
+	binary.LittleEndian.PutUint64(entry[32:40], s.Offset)
+	binary.LittleEndian.PutUint64(entry[40:48], s.PaddedSize)
+
+	h := newSIMD()
+	h.Write(entry[:])
+	copy(entry[48:], h.Sum(nil)[:segmentChecksumSize])
+	entry[len(entry)-1] &= 0x3F
+	return entry
+}
+
+// segmentIndexNode returns the layer 1 node covering the two leaves of the
+// index entry describing the segment.
+func segmentIndexNode(s DataSegment) [32]byte {
+	entry := segmentIndexEntry(s)
+
+	var n [32]byte
+	h := newSIMD()
+	h.Write(entry[:])
+	h.Sum(n[:0])
+	n[31] &= 0x3F
+	return n
+}
@@ -0,0 +1,248 @@
+package commp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	randmath "math/rand"
+)
+
+func TestAggregateInclusion(t *testing.T) {
+	t.Parallel()
+
+	const aggSize = 1 << 20
+
+	// sub-pieces of various sizes, retaining their leaves to build the
+	// aggregate the hard way
+	var segs []DataSegment
+	var leaves [][][32]byte
+	for i, size := range []int{100, 127 * 20, 65, 5000, 127 * 64} {
+		payload := make([]byte, size)
+		randmath.New(randmath.NewSource(int64(i))).Read(payload)
+
+		tree := &MerkleTree{}
+		commP, paddedSize := mustDigest(t, New(WithNodeSink(tree.AddNode)), payload)
+		seg := DataSegment{PaddedSize: paddedSize}
+		copy(seg.CommP[:], commP)
+		segs = append(segs, seg)
+		leaves = append(leaves, tree.layers[0])
+	}
+
+	segs = PackDataSegments(segs)
+	agg, err := NewAggregate(aggSize, segs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := make([][32]byte, aggSize/32)
+	for i, s := range segs {
+		copy(full[s.Offset/32:], leaves[i])
+	}
+	idx := segmentIndexStart(aggSize) / 32
+	for i, s := range segs {
+		var entry [64]byte
+		copy(entry[:32], s.CommP[:])
+		binary.LittleEndian.PutUint64(entry[32:], s.Offset)
+		binary.LittleEndian.PutUint64(entry[40:], s.PaddedSize)
+		sum := sha256.Sum256(entry[:])
+		copy(entry[48:], sum[:16])
+		entry[63] &= 0x3F
+		copy(full[idx+2*uint64(i)][:], entry[:32])
+		copy(full[idx+2*uint64(i)+1][:], entry[32:])
+	}
+	for len(full) > 1 {
+		for i := range full[:len(full)/2] {
+			full[i] = sha256.Sum256(append(full[2*i][:], full[2*i+1][:]...))
+			full[i][31] &= 0x3F
+		}
+		full = full[:len(full)/2]
+	}
+
+	if agg.CommP() != full[0] {
+		t.Fatalf("aggregate commP 0x%X doesn't match expected 0x%X", agg.CommP(), full[0])
+	}
+
+	for i, s := range segs {
+		ip, err := agg.ProveInclusion(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, size, err := ip.AggregateCommP(s.CommP, s.PaddedSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root != full[0] || size != aggSize {
+			t.Fatalf("segment %d proves inclusion in 0x%X of size %d, expected 0x%X of size %d", i, root, size, full[0], aggSize)
+		}
+
+		ip.ProofSubtree.Index ^= 1
+		if _, _, err := ip.AggregateCommP(s.CommP, s.PaddedSize); !errors.Is(err, ErrInvalidProof) {
+			t.Fatalf("segment %d: unexpected result for a proof at the wrong offset: %v", i, err)
+		}
+	}
+
+	for name, bad := range map[string][]DataSegment{
+		"empty":      nil,
+		"overlap":    {segs[1], segs[1]},
+		"misaligned": {{PaddedSize: 256, Offset: 128}},
+		"index":      {{PaddedSize: aggSize / 2, Offset: aggSize / 2}},
+	} {
+		if _, err := NewAggregate(aggSize, bad); !errors.Is(err, ErrInvalidLayout) {
+			t.Fatalf("%s: unexpected result for an invalid layout: %v", name, err)
+		}
+	}
+}
+
+// TestAggregateKnownAnswer pins a multi-piece aggregate small enough for its
+// index to be held to the floor of 4 entries, the checksums of two of which
+// have their top bits masked off. The sub-piece commPs are the SHA-256 of
+// "seg0" to "seg2", reduced to 254 bits, and the expected values were
+// computed from the FRC-0058 layout apart from this package. They are not
+// yet cross-checked against go-data-segment, whose vectors should replace
+// them once pinned.
+func TestAggregateKnownAnswer(t *testing.T) {
+	t.Parallel()
+
+	const aggSize = 4096
+	root := "837bf315045a2676798d4f064246f50386b6b6becf774c9e0c48b9baaf9c380f"
+	vectors := []struct {
+		commP, entry   string
+		size, offset   uint64
+		subtree, index []string
+	}{
+		{
+			commP:  "8dacc3c93ec64b3033f1390f957322f3bce41113b683e7214ee2672d271cea2e",
+			size:   1024,
+			offset: 0,
+			entry:  "8dacc3c93ec64b3033f1390f957322f3bce41113b683e7214ee2672d271cea2e00000000000000000004000000000000328abbde981f5780d64da62fb84d1818",
+			subtree: []string{
+				"3e457d9559a9c60542209896e8e49af14e905400e6c7ce8a555f875112f3e51e",
+				"e5d43f54216b511e22d5635152634b75a1fccb4c6ef14c6584eb8d2c5da3ab11",
+			},
+			index: []string{
+				"a9628b77dbdb82d5e044e8a23ccbff948b4120eaf100deae165fb0835f7aeb00",
+				"e48b75813a948c2ded809bc9af1499b75fdfc44fdaba28e3db27102b64583728",
+				"642a607ef886b004bf2c1978463ae1d4693ac0f410eb2d1b7a47fe205e5e750f",
+				"57a2381a28652bf47f6bef7aca679be4aede5871ab5cf3eb2c08114488cb8526",
+				"1f7ac9595510e09ea41c460b176430bb322cd6fb412ec57cb17d989a4310372f",
+				"5b09c54852ffcd9488d90c1ae4c7ae71257424c9150da5a80004e3418de92e07",
+			},
+		},
+		{
+			commP:  "a998317e4eeb8beb830519a85f6411369ad39742d350e7a001375b4d421c101d",
+			size:   512,
+			offset: 1024,
+			entry:  "a998317e4eeb8beb830519a85f6411369ad39742d350e7a001375b4d421c101d000400000000000000020000000000003e838a62d73c902d807419380c23de04",
+			subtree: []string{
+				"d2c0aecebf0676ba4997c32b4624294a7d57682ef89f380e6fa47b3e36d2742a",
+				"8dacc3c93ec64b3033f1390f957322f3bce41113b683e7214ee2672d271cea2e",
+				"e5d43f54216b511e22d5635152634b75a1fccb4c6ef14c6584eb8d2c5da3ab11",
+			},
+			index: []string{
+				"59ae9cab44436f66dd123faadbd7747907e30469103d6847a1efff40aab09d2a",
+				"e48b75813a948c2ded809bc9af1499b75fdfc44fdaba28e3db27102b64583728",
+				"642a607ef886b004bf2c1978463ae1d4693ac0f410eb2d1b7a47fe205e5e750f",
+				"57a2381a28652bf47f6bef7aca679be4aede5871ab5cf3eb2c08114488cb8526",
+				"1f7ac9595510e09ea41c460b176430bb322cd6fb412ec57cb17d989a4310372f",
+				"5b09c54852ffcd9488d90c1ae4c7ae71257424c9150da5a80004e3418de92e07",
+			},
+		},
+		{
+			commP:  "b32b515e18d6ed6ca9f8bc5473b15bb2b1c9d67c3860c114bbd1dcb716d76c1d",
+			size:   128,
+			offset: 1536,
+			entry:  "b32b515e18d6ed6ca9f8bc5473b15bb2b1c9d67c3860c114bbd1dcb716d76c1d000600000000000080000000000000007fc6d609c9804726457509fc64f2dd30",
+			subtree: []string{
+				"3731bb99ac689f66eef5973e4a94da188f4ddcae580724fc6f3fd60dfd488333",
+				"642a607ef886b004bf2c1978463ae1d4693ac0f410eb2d1b7a47fe205e5e750f",
+				"a998317e4eeb8beb830519a85f6411369ad39742d350e7a001375b4d421c101d",
+				"8dacc3c93ec64b3033f1390f957322f3bce41113b683e7214ee2672d271cea2e",
+				"e5d43f54216b511e22d5635152634b75a1fccb4c6ef14c6584eb8d2c5da3ab11",
+			},
+			index: []string{
+				"f5a5fd42d16a20302798ef6ed309979b43003d2320d9f0e8ea9831a92759fb0b",
+				"45c67598f87c4b60ed4dfdb62984a835defabd102b96d0ab97de1bd23e308231",
+				"642a607ef886b004bf2c1978463ae1d4693ac0f410eb2d1b7a47fe205e5e750f",
+				"57a2381a28652bf47f6bef7aca679be4aede5871ab5cf3eb2c08114488cb8526",
+				"1f7ac9595510e09ea41c460b176430bb322cd6fb412ec57cb17d989a4310372f",
+				"5b09c54852ffcd9488d90c1ae4c7ae71257424c9150da5a80004e3418de92e07",
+			},
+		},
+	}
+
+	segs := make([]DataSegment, len(vectors))
+	for i, v := range vectors {
+		segs[i] = DataSegment{CommP: mustHex32(t, v.commP), PaddedSize: v.size}
+	}
+	segs = PackDataSegments(segs)
+	agg, err := NewAggregate(aggSize, segs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commP := agg.CommP(); commP != mustHex32(t, root) {
+		t.Fatalf("aggregate commP %x, expected %s", commP, root)
+	}
+
+	for i, v := range vectors {
+		if segs[i].Offset != v.offset {
+			t.Fatalf("segment %d at offset %d, expected %d", i, segs[i].Offset, v.offset)
+		}
+		if entry := segmentIndexEntry(segs[i]); hex.EncodeToString(entry[:]) != v.entry {
+			t.Fatalf("segment %d index entry %x, expected %s", i, entry, v.entry)
+		}
+
+		ip, err := agg.ProveInclusion(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, tc := range map[string]struct {
+			proof Proof
+			exp   []string
+		}{
+			"subtree": {ip.ProofSubtree, v.subtree},
+			"index":   {ip.ProofIndex, v.index},
+		} {
+			if len(tc.proof.Path) != len(tc.exp) {
+				t.Fatalf("segment %d %s proof of %d nodes, expected %d", i, name, len(tc.proof.Path), len(tc.exp))
+			}
+			for j, n := range tc.proof.Path {
+				if n != mustHex32(t, tc.exp[j]) {
+					t.Fatalf("segment %d %s proof node %d %x, expected %s", i, name, j, n, tc.exp[j])
+				}
+			}
+		}
+		if exp := segmentIndexStart(aggSize)/segmentIndexEntrySize + uint64(i); ip.ProofIndex.Index != exp {
+			t.Fatalf("segment %d index proof of entry %d, expected %d", i, ip.ProofIndex.Index, exp)
+		}
+	}
+}
+
+func mustHex32(t *testing.T, s string) [32]byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		t.Fatalf("invalid node %q", s)
+	}
+	return [32]byte(b)
+}
+
+func TestSegmentIndexStart(t *testing.T) {
+	for _, tc := range []struct {
+		aggSize, entries uint64
+	}{
+		{512, 4},
+		{4096, 4},
+		{512 << 10, 4},
+		{1 << 20, 8},
+		{2 << 20, 16},
+		{32 << 30, 1 << 18},
+		{64 << 30, 1 << 19},
+	} {
+		if start := segmentIndexStart(tc.aggSize); start != tc.aggSize-tc.entries*64 {
+			t.Fatalf("index of aggregate of size %d starts at %d, expected %d entries", tc.aggSize, start, tc.entries)
+		}
+	}
+}
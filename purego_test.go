@@ -0,0 +1,39 @@
+//go:build purego || tinygo
+
+package commp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func TestPureGo(t *testing.T) {
+	t.Parallel()
+
+	if b := fastestHashBackend(); b != HashBackendStdlib {
+		t.Fatalf("unexpected fastest backend %q without assembly", b)
+	}
+	if got, exp := fmt.Sprintf("%T", HashBackendSIMD.new()), fmt.Sprintf("%T", sha256.New()); got != exp {
+		t.Fatalf("SIMD backend is a %s, expected a %s", got, exp)
+	}
+
+	payload := bytes.Repeat([]byte{1, 2, 3}, 2*bufferSize)
+	exp, expSize := mustDigest(t, New(WithNodeSink(func(uint, uint64, [32]byte) {})), payload)
+
+	cp := &Calc{}
+	if _, err := cp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if inlineReduce != (cp.work == nil) {
+		t.Fatalf("reducers running: %t, expected %t", cp.work != nil, !inlineReduce)
+	}
+	commP, paddedSize, err := cp.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(commP, exp) || paddedSize != expSize {
+		t.Fatalf("produced commP 0x%X/%d doesn't match expected 0x%X/%d", commP, paddedSize, exp, expSize)
+	}
+}
@@ -0,0 +1,16 @@
+package commp
+
+import "github.com/filecoin-project/go-fil-commp-hashhash/internal/reference"
+
+// ReferenceCommP computes the commP of payload the slow but obviously correct
+// way: fr32-padding it one bit at a time, and building the tree recursively
+// on the calling goroutine, with no code shared with Calc. It is meant for
+// differential testing against the production path, and holds the entire
+// padded piece in memory: keep payloads small.
+func ReferenceCommP(payload []byte) (commP []byte, paddedPieceSize uint64, err error) {
+	if err := checkInputSize(int64(len(payload))); err != nil {
+		return nil, 0, err
+	}
+	root, paddedPieceSize := reference.CommP(payload)
+	return root[:], paddedPieceSize, nil
+}
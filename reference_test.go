@@ -0,0 +1,80 @@
+package commp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	randmath "math/rand"
+)
+
+func TestReferenceCommP(t *testing.T) {
+	t.Parallel()
+
+	rng := randmath.New(randmath.NewSource(1))
+	for _, size := range []int{65, 127, 128, 1000, bufferSize - 1, 2*bufferSize + 1, 1<<20 + 3} {
+		payload := make([]byte, size)
+		rng.Read(payload)
+
+		exp, expSize := mustDigest(t, &Calc{}, payload)
+		commP, paddedSize, err := ReferenceCommP(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(commP, exp) || paddedSize != expSize {
+			t.Fatalf("%d: reference commP 0x%X/%d doesn't match 0x%X/%d", size, commP, paddedSize, exp, expSize)
+		}
+	}
+
+	if _, _, err := ReferenceCommP(make([]byte, 64)); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrBelowMinimumPayload)
+	}
+}
+
+// FuzzCommP feeds the same payload to a Calc in a fuzzed sequence of write
+// sizes and to ReferenceCommP, which must agree.
+func FuzzCommP(f *testing.F) {
+	f.Add([]byte{1, 2, 3}, []byte{0}, uint16(100))
+	f.Add(bytes.Repeat([]byte{0xFF}, 127), []byte{1, 11, 255}, uint16(300))
+	f.Add(make([]byte, 1000), []byte{181, 3, 200}, uint16(64))
+	f.Add([]byte("commP"), []byte{}, uint16(20000))
+
+	f.Fuzz(func(t *testing.T, data, cuts []byte, repeat uint16) {
+		if len(data) == 0 {
+			return
+		}
+		payload := bytes.Repeat(data, 1+int(repeat)%4096)
+		if len(payload) < int(MinPiecePayload) || len(payload) > 256<<10 {
+			return
+		}
+
+		exp, expSize, err := ReferenceCommP(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the second one works with slabs smaller than the default
+		for _, cp := range []*Calc{New(), New(WithMaxMemory(24 << 10))} {
+			for rest, i := payload, 0; len(rest) > 0; i++ {
+				n := len(rest)
+				if len(cuts) > 0 {
+					// anything from a single byte to several slabs
+					c := int(cuts[i%len(cuts)])
+					n = min(n, c*c+1)
+				}
+				if _, err := cp.Write(rest[:n]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+			}
+
+			commP, paddedSize, err := cp.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(commP, exp) || paddedSize != expSize {
+				t.Fatalf("commP 0x%X/%d doesn't match reference 0x%X/%d", commP, paddedSize, exp, expSize)
+			}
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package commp
+
+import "runtime"
+
+// Scheduler caps the amount of layer workers hashing concurrently across all
+// Calcs constructed WithScheduler() it. Every Calc still runs a small pool of
+// goroutines reducing its tree, but these only consume CPU while holding one of
+// the Scheduler's slots, which are handed out in first-come first-served order.
+// This way many concurrent streams share a fixed amount of cores fairly,
+// instead of each of them spreading over all available ones.
+//
+// The fr32 expansion of the input is not subject to the Scheduler, as it
+// takes place on the goroutine calling Write().
+type Scheduler struct {
+	slots chan struct{}
+}
+
+// NewScheduler returns a Scheduler allowing up to maxWorkers layer workers to
+// hash at the same time, or GOMAXPROCS of them when maxWorkers is not
+// positive.
+func NewScheduler(maxWorkers int) *Scheduler {
+	if maxWorkers <= 0 {
+		maxWorkers = runtime.GOMAXPROCS(0)
+	}
+	return &Scheduler{slots: make(chan struct{}, maxWorkers)}
+}
+
+// acquire blocks until a slot is available, or until abort is closed in which
+// case it returns false. A nil Scheduler imposes no limit.
+func (s *Scheduler) acquire(abort <-chan struct{}) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-abort:
+		return false
+	}
+}
+
+// release hands back a slot obtained via acquire().
+func (s *Scheduler) release() {
+	if s != nil {
+		<-s.slots
+	}
+}
@@ -0,0 +1,88 @@
+package commp
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	randmath "math/rand"
+)
+
+func TestScheduler(t *testing.T) {
+	t.Parallel()
+
+	const maxWorkers = 2
+	sched := NewScheduler(maxWorkers)
+
+	// the sink runs while holding a slot, so it never overlaps more than the
+	// scheduler allows
+	var inFlight, peak atomic.Int32
+	sink := func(uint, uint64, [32]byte) {
+		n := inFlight.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Microsecond)
+		inFlight.Add(-1)
+	}
+
+	payload := make([]byte, 4*bufferSize+1000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	exp, expSize := mustDigest(t, &Calc{}, payload)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			opts := []Option{WithScheduler(sched)}
+			if i%2 == 0 {
+				opts = append(opts, WithNodeSink(sink))
+			}
+			cp := New(opts...)
+			if _, err := cp.Write(payload); err != nil {
+				t.Error(err)
+				return
+			}
+			if snap, _, err := cp.SnapshotDigest(); err != nil || !bytes.Equal(snap, exp) {
+				t.Errorf("stream %d: snapshot 0x%X doesn't match expected 0x%X: %v", i, snap, exp, err)
+			}
+			commP, paddedSize, err := cp.Digest()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(commP, exp) || paddedSize != expSize {
+				t.Errorf("stream %d: commP 0x%X/%d doesn't match expected 0x%X/%d", i, commP, paddedSize, exp, expSize)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p > maxWorkers {
+		t.Fatalf("%d layer workers hashed concurrently, exceeding the limit of %d", p, maxWorkers)
+	}
+	if n := len(sched.slots); n != 0 {
+		t.Fatalf("%d slots still held after all streams completed", n)
+	}
+
+	// abandoned streams hand back their slots too
+	cp := New(WithScheduler(sched))
+	if _, err := cp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	cp.Reset()
+	if n := len(sched.slots); n != 0 {
+		t.Fatalf("%d slots still held after a reset", n)
+	}
+
+	if NewScheduler(0) == nil || cap(NewScheduler(-1).slots) < 1 {
+		t.Fatal("unexpected default scheduler")
+	}
+}
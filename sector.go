@@ -0,0 +1,120 @@
+package commp
+
+import (
+	"math/bits"
+
+	"golang.org/x/xerrors"
+)
+
+// SectorPiece is a piece placed within a sector by a SectorBuilder.
+type SectorPiece struct {
+	PieceInfo
+	// Offset is the position of the piece within the padded sector, a
+	// multiple of PaddedPieceSize
+	Offset uint64
+}
+
+// SectorBuilder computes the commPs of a sequence of pieces from their raw
+// payloads, lays them out within a sector exactly like ComputeUnsealedCommD()
+// and filecoin-ffi do, and derives the resulting commD. Write() the payload of
+// a piece, call FinishPiece(), and repeat for every following piece.
+type SectorBuilder struct {
+	sectorPaddedSize uint64
+	opts             []Option
+	cur              *Calc
+	pieces           []SectorPiece
+	nextOffset       uint64
+}
+
+// NewSectorBuilder returns a SectorBuilder for a sector of the given padded
+// size. The supplied options are applied to the Calc of every piece.
+func NewSectorBuilder(sectorPaddedSize uint64, opts ...Option) (*SectorBuilder, error) {
+	if bits.OnesCount64(sectorPaddedSize) != 1 || sectorPaddedSize < 128 || sectorPaddedSize > MaxPieceSize {
+		return nil, xerrors.Errorf("sector padded size %d is not a power of 2 between 128 and %d: %w", sectorPaddedSize, MaxPieceSize, ErrInvalidPieceSize)
+	}
+	return &SectorBuilder{
+		sectorPaddedSize: sectorPaddedSize,
+		opts:             opts,
+	}, nil
+}
+
+// Write adds to the payload of the current piece. It returns an error wrapping
+// ErrPayloadTooLarge if the piece could no longer fit in the remainder of the
+// sector.
+func (sb *SectorBuilder) Write(p []byte) (int, error) {
+	if sb.cur == nil {
+		sb.cur = New(sb.opts...)
+	}
+
+	if limit := sb.maxPiecePayload(); sb.cur.BytesWritten()+uint64(len(p)) > limit {
+		return 0, xerrors.Errorf("writing additional %d bytes would overflow the maximum unpadded piece size %d still fitting in the sector: %w", len(p), limit, ErrPayloadTooLarge)
+	}
+	return sb.cur.Write(p)
+}
+
+// FinishPiece digests the payload written since the previous FinishPiece()
+// and places the resulting piece in the sector.
+func (sb *SectorBuilder) FinishPiece() (SectorPiece, error) {
+	if sb.cur == nil {
+		return SectorPiece{}, xerrors.Errorf("no payload written for piece %d: %w", len(sb.pieces), ErrBelowMinimumPayload)
+	}
+
+	pi, err := sb.cur.DigestPiece()
+	if err != nil {
+		return SectorPiece{}, err
+	}
+	sb.cur = nil
+
+	sp := SectorPiece{
+		PieceInfo: pi,
+		Offset:    alignUp(sb.nextOffset, pi.PaddedPieceSize),
+	}
+	sb.pieces = append(sb.pieces, sp)
+	sb.nextOffset = sp.Offset + pi.PaddedPieceSize
+
+	return sp, nil
+}
+
+// Pieces returns all pieces finished so far, in sector order.
+func (sb *SectorBuilder) Pieces() []SectorPiece {
+	return append([]SectorPiece(nil), sb.pieces...)
+}
+
+// CommD returns the commD of the sector holding all pieces finished so far,
+// with the remainder filled with zeroes. It returns an error if the payload
+// of a piece is written but not yet finished.
+func (sb *SectorBuilder) CommD() ([]byte, error) {
+	if sb.cur != nil && sb.cur.BytesWritten() > 0 {
+		return nil, xerrors.New("the payload of the current piece must be finished before deriving the commD")
+	}
+
+	pis := make([]PieceInfo, len(sb.pieces))
+	for i := range sb.pieces {
+		pis[i] = sb.pieces[i].PieceInfo
+	}
+	return ComputeUnsealedCommD(sb.sectorPaddedSize, pis)
+}
+
+// Reset discards all pieces and any unfinished payload, making the builder
+// ready to start a new sector of the same size.
+func (sb *SectorBuilder) Reset() {
+	if sb.cur != nil {
+		sb.cur.Reset()
+	}
+	sb.cur, sb.pieces, sb.nextOffset = nil, nil, 0
+}
+
+// maxPiecePayload returns the input size of the largest piece which would
+// still fit in the sector once aligned.
+func (sb *SectorBuilder) maxPiecePayload() uint64 {
+	for size := sb.sectorPaddedSize; size >= 128; size >>= 1 {
+		if alignUp(sb.nextOffset, size)+size <= sb.sectorPaddedSize {
+			return size / 128 * uint64(sb.cur.quadSize())
+		}
+	}
+	return 0
+}
+
+func alignUp(pos, alignment uint64) uint64 {
+	return (pos + alignment - 1) / alignment * alignment
+}
@@ -0,0 +1,90 @@
+package commp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	randmath "math/rand"
+)
+
+func TestSectorBuilder(t *testing.T) {
+	t.Parallel()
+
+	const sectorSize = 1 << 16
+
+	sb, err := NewSectorBuilder(sectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sb.FinishPiece(); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected result finishing an empty piece: %v", err)
+	}
+
+	var pieces []PieceInfo
+	for i, size := range []int{127, 1000, 100, 127 * 40, 5000} {
+		payload := make([]byte, size)
+		randmath.New(randmath.NewSource(int64(i))).Read(payload)
+
+		// odd-sized writes
+		for rest := payload; len(rest) > 0; {
+			n := 1 + len(rest)/3
+			if _, err := sb.Write(rest[:n]); err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		sp, err := sb.FinishPiece()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		commP, paddedSize := mustDigest(t, &Calc{}, payload)
+		if !bytes.Equal(sp.CommP, commP) || sp.PaddedPieceSize != paddedSize {
+			t.Fatalf("piece %d: commP 0x%X/%d doesn't match expected 0x%X/%d", i, sp.CommP, sp.PaddedPieceSize, commP, paddedSize)
+		}
+		if sp.Offset%sp.PaddedPieceSize != 0 {
+			t.Fatalf("piece %d placed at unaligned offset %d", i, sp.Offset)
+		}
+		pieces = append(pieces, sp.PieceInfo)
+	}
+
+	if got := sb.Pieces(); len(got) != len(pieces) || got[1].Offset != 1024 || got[2].Offset != 2048 || got[3].Offset != 8192 {
+		t.Fatalf("unexpected piece layout %+v", got)
+	}
+
+	exp, err := ComputeUnsealedCommD(sectorSize, pieces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commD, err := sb.CommD()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(commD, exp) {
+		t.Fatalf("commD 0x%X doesn't match expected 0x%X", commD, exp)
+	}
+
+	if _, err := sb.Write(make([]byte, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sb.CommD(); err == nil {
+		t.Fatal("unexpected success deriving the commD with an unfinished piece")
+	}
+	// with pieces occupying [0, 24KiB) the largest still fitting is 32KiB
+	if _, err := sb.Write(make([]byte, sectorSize/2/128*127)); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("unexpected result writing a piece too large for the sector: %v", err)
+	}
+
+	sb.Reset()
+	if len(sb.Pieces()) != 0 {
+		t.Fatal("pieces retained after a Reset()")
+	}
+	zero, err := ComputeUnsealedCommD(sectorSize, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commD, err := sb.CommD(); err != nil || !bytes.Equal(commD, zero) {
+		t.Fatalf("commD 0x%X after a Reset() doesn't match the empty sector 0x%X: %v", commD, zero, err)
+	}
+}
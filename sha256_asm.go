@@ -0,0 +1,15 @@
+//go:build !purego && !tinygo
+
+package commp
+
+import (
+	"hash"
+
+	sha256simd "github.com/minio/sha256-simd"
+)
+
+// hasSIMD tells whether HashBackendSIMD is available in this build.
+const hasSIMD = true
+
+// newSIMD returns a hasher of HashBackendSIMD.
+func newSIMD() hash.Hash { return sha256simd.New() }
@@ -0,0 +1,15 @@
+//go:build purego || tinygo
+
+package commp
+
+import (
+	"crypto/sha256"
+	"hash"
+)
+
+// hasSIMD tells whether HashBackendSIMD is available in this build: not
+// without assembly, where it falls back to crypto/sha256.
+const hasSIMD = false
+
+// newSIMD returns a hasher of HashBackendSIMD.
+func newSIMD() hash.Hash { return sha256.New() }
@@ -0,0 +1,95 @@
+package commp
+
+import (
+	"math/bits"
+
+	"golang.org/x/xerrors"
+)
+
+// PaddedPieceSize is the size of an fr32-padded piece: a power of 2 between
+// 128 and MaxPieceSize. It is a distinct type from UnpaddedPieceSize, so that
+// the two cannot be mixed up without an explicit conversion.
+type PaddedPieceSize uint64
+
+// UnpaddedPieceSize is the amount of payload a piece holds: 127/128ths of its
+// PaddedPieceSize, or a power of 2 multiple of 127.
+type UnpaddedPieceSize uint64
+
+// Validate returns an error wrapping ErrInvalidPieceSize if p is not a valid
+// padded piece size.
+func (p PaddedPieceSize) Validate() error {
+	if bits.OnesCount64(uint64(p)) != 1 || p < 128 || uint64(p) > MaxPieceSize {
+		return xerrors.Errorf("padded piece size %d is not a power of 2 between 128 and %d: %w", p, MaxPieceSize, ErrInvalidPieceSize)
+	}
+	return nil
+}
+
+// Unpadded returns the unpadded size corresponding to p, which must be
+// valid.
+func (p PaddedPieceSize) Unpadded() UnpaddedPieceSize {
+	return UnpaddedPieceSize(p / 128 * 127)
+}
+
+// RoundUp returns the smallest valid padded piece size not below p, or an
+// error wrapping ErrInvalidPieceSize if p exceeds MaxPieceSize.
+func (p PaddedPieceSize) RoundUp() (PaddedPieceSize, error) {
+	if uint64(p) > MaxPieceSize {
+		return 0, xerrors.Errorf("padded size %d exceeds %d: %w", p, MaxPieceSize, ErrInvalidPieceSize)
+	}
+	if p <= 128 {
+		return 128, nil
+	}
+	return PaddedPieceSize(1) << (64 - bits.LeadingZeros64(uint64(p)-1)), nil
+}
+
+// Validate returns an error wrapping ErrInvalidPieceSize if u is not a valid
+// unpadded piece size.
+func (u UnpaddedPieceSize) Validate() error {
+	if u%127 != 0 || bits.OnesCount64(uint64(u/127)) != 1 || uint64(u) > MaxPiecePayload {
+		return xerrors.Errorf("unpadded piece size %d is not a power of 2 multiple of 127 up to %d: %w", u, MaxPiecePayload, ErrInvalidPieceSize)
+	}
+	return nil
+}
+
+// Padded returns the padded size corresponding to u, which must be valid.
+func (u UnpaddedPieceSize) Padded() PaddedPieceSize {
+	return PaddedPieceSize(u / 127 * 128)
+}
+
+// RoundUp returns the smallest valid unpadded piece size not below u, or an
+// error wrapping ErrInvalidPieceSize if u exceeds MaxPiecePayload.
+func (u UnpaddedPieceSize) RoundUp() (UnpaddedPieceSize, error) {
+	if uint64(u) > MaxPiecePayload {
+		return 0, xerrors.Errorf("unpadded size %d exceeds %d: %w", u, MaxPiecePayload, ErrInvalidPieceSize)
+	}
+	p, err := PaddedPieceSize((uint64(u) + 126) / 127 * 128).RoundUp()
+	if err != nil {
+		return 0, err
+	}
+	return p.Unpadded(), nil
+}
+
+// ZeroPaddedPieceSize returns the unpadded and padded size of the smallest
+// piece able to hold payloadSize bytes, which is what a payload gets
+// zero-padded to before its commP is calculated. Unlike a Calc it accepts
+// payloads shorter than MinPiecePayload, to support the bookkeeping of
+// callers dealing with such pieces.
+func ZeroPaddedPieceSize(payloadSize uint64) (UnpaddedPieceSize, PaddedPieceSize, error) {
+	if payloadSize == 0 || payloadSize > MaxPiecePayload {
+		return 0, 0, xerrors.Errorf("payload size %d is not between 1 and %d: %w", payloadSize, MaxPiecePayload, ErrInvalidPieceSize)
+	}
+	unpadded, err := UnpaddedPieceSize(payloadSize).RoundUp()
+	if err != nil {
+		return 0, 0, err
+	}
+	return unpadded, unpadded.Padded(), nil
+}
+
+// ZeroPieceCommPUnpadded is identical to ZeroPieceCommP(), except that the
+// size is given as an UnpaddedPieceSize.
+func ZeroPieceCommPUnpadded(size UnpaddedPieceSize) ([]byte, error) {
+	if err := size.Validate(); err != nil {
+		return nil, err
+	}
+	return ZeroPieceCommP(uint64(size.Padded()))
+}
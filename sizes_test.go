@@ -0,0 +1,114 @@
+package commp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPieceSizes(t *testing.T) {
+	t.Parallel()
+
+	for padded := PaddedPieceSize(128); uint64(padded) <= MaxPieceSize; padded *= 2 {
+		if err := padded.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		unpadded := padded.Unpadded()
+		if err := unpadded.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if uint64(unpadded) != uint64(padded)/128*127 || unpadded.Padded() != padded {
+			t.Fatalf("padded size %d converted to %d and back to %d", padded, unpadded, unpadded.Padded())
+		}
+
+		zero, err := ZeroPieceCommP(uint64(padded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ZeroPieceCommPUnpadded(unpadded); err != nil || !bytes.Equal(got, zero) {
+			t.Fatalf("%d: zero commP 0x%X (%v), expected 0x%X", unpadded, got, err, zero)
+		}
+	}
+
+	for _, padded := range []PaddedPieceSize{0, 64, 127, 129, 3 << 10, PaddedPieceSize(MaxPieceSize * 2)} {
+		if err := padded.Validate(); !errors.Is(err, ErrInvalidPieceSize) {
+			t.Fatalf("%d: unexpected error %v, expected %v", padded, err, ErrInvalidPieceSize)
+		}
+	}
+	for _, unpadded := range []UnpaddedPieceSize{0, 63, 128, 127 * 3, 1024, UnpaddedPieceSize(MaxPiecePayload * 2)} {
+		if err := unpadded.Validate(); !errors.Is(err, ErrInvalidPieceSize) {
+			t.Fatalf("%d: unexpected error %v, expected %v", unpadded, err, ErrInvalidPieceSize)
+		}
+		if _, err := ZeroPieceCommPUnpadded(unpadded); !errors.Is(err, ErrInvalidPieceSize) {
+			t.Fatalf("%d: unexpected error %v, expected %v", unpadded, err, ErrInvalidPieceSize)
+		}
+	}
+}
+
+func TestPieceSizeRoundUp(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct{ in, exp PaddedPieceSize }{
+		{0, 128}, {1, 128}, {128, 128}, {129, 256}, {1000, 1024}, {1 << 20, 1 << 20}, {1<<20 + 1, 1 << 21}, {PaddedPieceSize(MaxPieceSize), PaddedPieceSize(MaxPieceSize)},
+	} {
+		if got, err := tc.in.RoundUp(); err != nil || got != tc.exp {
+			t.Fatalf("padded %d rounded up to %d (%v), expected %d", tc.in, got, err, tc.exp)
+		}
+	}
+	for _, tc := range []struct{ in, exp UnpaddedPieceSize }{
+		{0, 127}, {1, 127}, {127, 127}, {128, 254}, {1000, 1016}, {127 << 10, 127 << 10}, {UnpaddedPieceSize(MaxPiecePayload), UnpaddedPieceSize(MaxPiecePayload)},
+	} {
+		if got, err := tc.in.RoundUp(); err != nil || got != tc.exp {
+			t.Fatalf("unpadded %d rounded up to %d (%v), expected %d", tc.in, got, err, tc.exp)
+		}
+	}
+
+	if _, err := PaddedPieceSize(MaxPieceSize + 1).RoundUp(); !errors.Is(err, ErrInvalidPieceSize) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInvalidPieceSize)
+	}
+	if _, err := UnpaddedPieceSize(MaxPiecePayload + 1).RoundUp(); !errors.Is(err, ErrInvalidPieceSize) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInvalidPieceSize)
+	}
+}
+
+func TestZeroPaddedPieceSize(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		payload  uint64
+		unpadded UnpaddedPieceSize
+		padded   PaddedPieceSize
+	}{
+		{1, 127, 128},
+		{MinPiecePayload, 127, 128},
+		{127, 127, 128},
+		{128, 254, 256},
+		{1000, 1016, 1024},
+		{1 << 20, 127 << 14, 1 << 21},
+		{MaxPiecePayload, UnpaddedPieceSize(MaxPiecePayload), PaddedPieceSize(MaxPieceSize)},
+	} {
+		unpadded, padded, err := ZeroPaddedPieceSize(tc.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unpadded != tc.unpadded || padded != tc.padded {
+			t.Fatalf("payload %d: sizes %d/%d, expected %d/%d", tc.payload, unpadded, padded, tc.unpadded, tc.padded)
+		}
+	}
+
+	// consistent with what a Calc reports
+	cp := &Calc{}
+	if _, err := cp.Write(make([]byte, 5000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, padded, _ := ZeroPaddedPieceSize(5000); uint64(padded) != cp.ProjectedPaddedPieceSize() {
+		t.Fatalf("padded size %d, calc projects %d", padded, cp.ProjectedPaddedPieceSize())
+	}
+	cp.Reset()
+
+	for _, payload := range []uint64{0, MaxPiecePayload + 1} {
+		if _, _, err := ZeroPaddedPieceSize(payload); !errors.Is(err, ErrInvalidPieceSize) {
+			t.Fatalf("%d: unexpected error %v, expected %v", payload, err, ErrInvalidPieceSize)
+		}
+	}
+}
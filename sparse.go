@@ -0,0 +1,70 @@
+package commp
+
+// sparseTree is a commP tree known only through a handful of nodes placed at
+// arbitrary layers, with everything not covered by them being zeroes. It is
+// used to compose trees out of already computed subtree roots.
+type sparseTree struct {
+	height uint
+	layers []map[uint64][32]byte
+}
+
+func newSparseTree(height uint) *sparseTree {
+	st := &sparseTree{
+		height: height,
+		layers: make([]map[uint64][32]byte, height+1),
+	}
+	for i := range st.layers {
+		st.layers[i] = make(map[uint64][32]byte)
+	}
+	return st
+}
+
+// set places a known node, must be called before build(). Overlapping nodes
+// are the responsibility of the caller.
+func (st *sparseTree) set(layer uint, index uint64, node [32]byte) {
+	st.layers[layer][index] = node
+}
+
+// build derives every node above the ones set.
+func (st *sparseTree) build() {
+	h := newHasher()
+	for l := uint(0); l < st.height; l++ {
+		for idx := range st.layers[l] {
+			parent := idx >> 1
+			if _, done := st.layers[l+1][parent]; done {
+				continue
+			}
+			left, right := st.node(l, parent<<1), st.node(l, parent<<1|1)
+			h.Reset()
+			h.Write(left[:])
+			h.Write(right[:])
+			var n [32]byte
+			h.Sum(n[:0])
+			n[31] &= 0x3F
+			st.layers[l+1][parent] = n
+		}
+	}
+}
+
+func (st *sparseTree) node(layer uint, index uint64) [32]byte {
+	if n, known := st.layers[layer][index]; known {
+		return n
+	}
+	var n [32]byte
+	copy(n[:], stackedNulPadding[layer])
+	return n
+}
+
+func (st *sparseTree) root() [32]byte { return st.node(st.height, 0) }
+
+func (st *sparseTree) prove(layer uint, index uint64) Proof {
+	p := Proof{
+		Layer: layer,
+		Index: index,
+		Path:  make([][32]byte, st.height-layer),
+	}
+	for i := range p.Path {
+		p.Path[i] = st.node(layer+uint(i), (index>>i)^1)
+	}
+	return p
+}
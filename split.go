@@ -0,0 +1,113 @@
+package commp
+
+import (
+	"golang.org/x/xerrors"
+)
+
+// Splitter accumulates a payload of arbitrary length as a sequence of pieces:
+// whenever the current piece reaches the maximum payload size, it is finalized
+// and a new piece is started with the remaining input. This is how datasets
+// larger than a single piece are prepared for storage.
+type Splitter struct {
+	maxPiecePayload uint64
+	onPiece         func(PieceInfo)
+	opts            []Option
+	cur             *Calc
+	pieces          []PieceInfo
+}
+
+// NewSplitter returns a Splitter cutting its input into pieces holding at most
+// maxPiecePayload bytes each, or as much as a single Calc accepts when 0. The
+// onPiece callback, if not nil, receives every piece as soon as it is
+// finalized, from within the Write() or Finish() completing it. The supplied
+// options are applied to the Calc of every piece.
+func NewSplitter(maxPiecePayload uint64, onPiece func(PieceInfo), opts ...Option) (*Splitter, error) {
+	cp := New(opts...)
+	if maxPiecePayload == 0 {
+		maxPiecePayload = cp.maxInput()
+	}
+	if maxPiecePayload < cp.minInput() || maxPiecePayload > cp.maxInput() {
+		return nil, xerrors.Errorf("maximum piece payload %d is not between %d and %d: %w", maxPiecePayload, cp.minInput(), cp.maxInput(), ErrInvalidPieceSize)
+	}
+	return &Splitter{
+		maxPiecePayload: maxPiecePayload,
+		onPiece:         onPiece,
+		opts:            opts,
+	}, nil
+}
+
+// Write adds to the payload, finalizing the current piece and starting the
+// next one whenever the maximum piece payload is reached.
+func (sp *Splitter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if sp.cur == nil {
+			sp.cur = New(sp.opts...)
+		}
+
+		chunk := p
+		if room := sp.maxPiecePayload - sp.cur.BytesWritten(); uint64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		n, err := sp.cur.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+
+		if sp.cur.BytesWritten() == sp.maxPiecePayload {
+			if err := sp.finishPiece(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Finish finalizes the last piece, if any payload was written since the
+// previous one, and returns all pieces in payload order. The Splitter is then
+// ready to accept a new payload. The final piece must hold at least as much
+// payload as Digest() requires, otherwise an error wrapping
+// ErrBelowMinimumPayload is returned and the Splitter is left intact.
+func (sp *Splitter) Finish() ([]PieceInfo, error) {
+	if sp.cur != nil && sp.cur.BytesWritten() > 0 {
+		if err := sp.finishPiece(); err != nil {
+			return nil, err
+		}
+	}
+	if len(sp.pieces) == 0 {
+		return nil, xerrors.Errorf("no payload written: %w", ErrBelowMinimumPayload)
+	}
+
+	pieces := sp.pieces
+	sp.cur, sp.pieces = nil, nil
+	return pieces, nil
+}
+
+// Pieces returns all pieces finalized so far, in payload order.
+func (sp *Splitter) Pieces() []PieceInfo {
+	return append([]PieceInfo(nil), sp.pieces...)
+}
+
+// Reset discards all pieces and any unfinished payload.
+func (sp *Splitter) Reset() {
+	if sp.cur != nil {
+		sp.cur.Reset()
+	}
+	sp.cur, sp.pieces = nil, nil
+}
+
+func (sp *Splitter) finishPiece() error {
+	pi, err := sp.cur.DigestPiece()
+	if err != nil {
+		return err
+	}
+	sp.cur = nil
+
+	sp.pieces = append(sp.pieces, pi)
+	if sp.onPiece != nil {
+		sp.onPiece(pi)
+	}
+	return nil
+}
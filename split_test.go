@@ -0,0 +1,85 @@
+package commp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	randmath "math/rand"
+)
+
+func TestSplitter(t *testing.T) {
+	t.Parallel()
+
+	const maxPayload = 127 * 64
+
+	rng := randmath.New(randmath.NewSource(1))
+	for _, size := range []int{127, maxPayload, maxPayload + 65, 3 * maxPayload, 5*maxPayload + 1000} {
+		payload := make([]byte, size)
+		rng.Read(payload)
+
+		var reported []PieceInfo
+		sp, err := NewSplitter(maxPayload, func(pi PieceInfo) { reported = append(reported, pi) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rest := payload; len(rest) > 0; {
+			n := 1 + rng.Intn(2*maxPayload)
+			if n > len(rest) {
+				n = len(rest)
+			}
+			if w, err := sp.Write(rest[:n]); err != nil || w != n {
+				t.Fatalf("%d: wrote %d out of %d bytes: %v", size, w, n, err)
+			}
+			rest = rest[n:]
+		}
+		if len(sp.Pieces()) != len(reported) {
+			t.Fatalf("%d: %d pieces finalized, but %d reported", size, len(sp.Pieces()), len(reported))
+		}
+
+		pieces, err := sp.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pieces) != (size+maxPayload-1)/maxPayload || len(reported) != len(pieces) {
+			t.Fatalf("%d: unexpected %d pieces, %d reported", size, len(pieces), len(reported))
+		}
+		for i, pi := range pieces {
+			chunk := payload[i*maxPayload:]
+			if len(chunk) > maxPayload {
+				chunk = chunk[:maxPayload]
+			}
+			commP, paddedSize := mustDigest(t, &Calc{}, chunk)
+			if !bytes.Equal(pi.CommP, commP) || pi.PaddedPieceSize != paddedSize || !bytes.Equal(reported[i].CommP, commP) {
+				t.Fatalf("%d: piece %d commP 0x%X/%d doesn't match expected 0x%X/%d", size, i, pi.CommP, pi.PaddedPieceSize, commP, paddedSize)
+			}
+		}
+	}
+
+	sp, err := NewSplitter(maxPayload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sp.Finish(); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected result finishing without payload: %v", err)
+	}
+	if _, err := sp.Write(make([]byte, maxPayload+10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sp.Finish(); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected result finishing with a short last piece: %v", err)
+	}
+	if n := len(sp.Pieces()); n != 1 {
+		t.Fatalf("failed finish changed the amount of pieces to %d", n)
+	}
+	sp.Reset()
+
+	for _, bad := range []uint64{64, MaxPiecePayload + 1} {
+		if _, err := NewSplitter(bad, nil); !errors.Is(err, ErrInvalidPieceSize) {
+			t.Fatalf("%d: unexpected result %v", bad, err)
+		}
+	}
+	if sp, err := NewSplitter(0, nil, WithPaddedInput()); err != nil || sp.maxPiecePayload != MaxPieceSize {
+		t.Fatalf("unexpected default maximum %v: %v", sp, err)
+	}
+}
@@ -0,0 +1,97 @@
+package commp
+
+import "io"
+
+// Reader passes the data of an underlying io.Reader through, accumulating
+// the commP of everything read. Once done reading, Digest() must be invoked
+// to obtain the result and terminate the background goroutines of the Calc.
+type Reader struct {
+	r   io.Reader
+	cp  *Calc
+	err error
+}
+
+// NewReader returns a Reader over r, digesting with a Calc constructed with
+// the supplied options.
+func NewReader(r io.Reader, opts ...Option) *Reader {
+	return &Reader{r: r, cp: New(opts...)}
+}
+
+// Read reads from the underlying reader, digesting whatever it returned.
+// Errors of the Calc, such as ErrPayloadTooLarge, stick: they are returned
+// by every subsequent Read() and by Digest().
+func (tr *Reader) Read(p []byte) (int, error) {
+	if tr.err != nil {
+		return 0, tr.err
+	}
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if _, werr := tr.cp.Write(p[:n]); werr != nil {
+			tr.err = werr
+			tr.cp.Reset()
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Digest returns the commP and padded piece size of everything read so far,
+// exactly as (*Calc).Digest() would. Should it fail, e.g. with
+// ErrBelowMinimumPayload, the Calc is reset and the error sticks.
+func (tr *Reader) Digest() (commP []byte, paddedPieceSize uint64, err error) {
+	if tr.err != nil {
+		return nil, 0, tr.err
+	}
+	if commP, paddedPieceSize, err = tr.cp.Digest(); err != nil {
+		tr.err = err
+		tr.cp.Reset()
+	}
+	return commP, paddedPieceSize, err
+}
+
+// Writer passes data through to an underlying io.Writer, accumulating the
+// commP of everything written. Once done writing, Digest() must be invoked
+// to obtain the result and terminate the background goroutines of the Calc.
+type Writer struct {
+	w   io.Writer
+	cp  *Calc
+	err error
+}
+
+// NewWriter returns a Writer over w, digesting with a Calc constructed with
+// the supplied options.
+func NewWriter(w io.Writer, opts ...Option) *Writer {
+	return &Writer{w: w, cp: New(opts...)}
+}
+
+// Write writes p to the underlying writer, digesting as much of it as was
+// written. Errors of the Calc, such as ErrPayloadTooLarge, stick: they are
+// returned by every subsequent Write() and by Digest().
+func (tw *Writer) Write(p []byte) (int, error) {
+	if tw.err != nil {
+		return 0, tw.err
+	}
+	n, err := tw.w.Write(p)
+	if n > 0 {
+		if _, werr := tw.cp.Write(p[:n]); werr != nil {
+			tw.err = werr
+			tw.cp.Reset()
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Digest returns the commP and padded piece size of everything written so
+// far, exactly as (*Calc).Digest() would. Should it fail, e.g. with
+// ErrBelowMinimumPayload, the Calc is reset and the error sticks.
+func (tw *Writer) Digest() (commP []byte, paddedPieceSize uint64, err error) {
+	if tw.err != nil {
+		return nil, 0, tw.err
+	}
+	if commP, paddedPieceSize, err = tw.cp.Digest(); err != nil {
+		tw.err = err
+		tw.cp.Reset()
+	}
+	return commP, paddedPieceSize, err
+}
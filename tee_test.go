@@ -0,0 +1,112 @@
+package commp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	randmath "math/rand"
+)
+
+func TestTeeReader(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 3*bufferSize+1000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	exp, expSize := mustDigest(t, &Calc{}, payload)
+
+	tr := NewReader(iotest.HalfReader(bytes.NewReader(payload)))
+	got, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("data passed through doesn't match the payload")
+	}
+	commP, paddedSize, err := tr.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(commP, exp) || paddedSize != expSize {
+		t.Fatalf("produced commP 0x%X/%d doesn't match expected 0x%X/%d", commP, paddedSize, exp, expSize)
+	}
+
+	// errors of the Calc stick
+	tr = NewReader(bytes.NewReader(bytes.Repeat([]byte{0xFF}, 256)), WithPaddedInput())
+	if _, err := io.ReadAll(tr); !errors.Is(err, ErrInvalidPadding) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInvalidPadding)
+	}
+	if _, _, err := tr.Digest(); !errors.Is(err, ErrInvalidPadding) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInvalidPadding)
+	}
+}
+
+func TestTeeWriter(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 3*bufferSize+1000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	exp, expSize := mustDigest(t, &Calc{}, payload)
+
+	var buf bytes.Buffer
+	tw := NewWriter(&buf)
+	if _, err := io.Copy(tw, iotest.HalfReader(bytes.NewReader(payload))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), payload) {
+		t.Fatal("data passed through doesn't match the payload")
+	}
+	commP, paddedSize, err := tw.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(commP, exp) || paddedSize != expSize {
+		t.Fatalf("produced commP 0x%X/%d doesn't match expected 0x%X/%d", commP, paddedSize, exp, expSize)
+	}
+
+	// errors of the Calc stick
+	tw = NewWriter(io.Discard, WithPaddedInput())
+	if _, err := tw.Write(bytes.Repeat([]byte{0xFF}, 256)); !errors.Is(err, ErrInvalidPadding) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInvalidPadding)
+	}
+	if _, err := tw.Write(make([]byte, 256)); !errors.Is(err, ErrInvalidPadding) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInvalidPadding)
+	}
+	if _, _, err := tw.Digest(); !errors.Is(err, ErrInvalidPadding) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrInvalidPadding)
+	}
+}
+
+func TestTeeBelowMinimumPayload(t *testing.T) {
+	t.Parallel()
+
+	payload := bytes.Repeat([]byte{0x42}, 64)
+
+	tr := NewReader(bytes.NewReader(payload))
+	if _, err := io.ReadAll(tr); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tr.Digest(); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrBelowMinimumPayload)
+	}
+	if state := tr.cp.State(); state != CalcReady {
+		t.Fatalf("Calc of the Reader left %s after a failed Digest()", state)
+	}
+
+	tw := NewWriter(io.Discard)
+	if _, err := tw.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tw.Digest(); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrBelowMinimumPayload)
+	}
+	if state := tw.cp.State(); state != CalcReady {
+		t.Fatalf("Calc of the Writer left %s after a failed Digest()", state)
+	}
+	// the error sticks
+	if _, err := tw.Write(payload); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrBelowMinimumPayload)
+	}
+}
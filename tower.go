@@ -0,0 +1,333 @@
+package commp
+
+import (
+	"hash"
+	"math/bits"
+	"runtime"
+
+	"golang.org/x/xerrors"
+)
+
+// job is a unit of work travelling through the tower: nodes of the given
+// layer, spaced 32<<layer bytes apart within a slab which started out as
+// leaves, or a single node. The zero value of nodes is the barrier of sync().
+type job struct {
+	nodes   []byte
+	layer   uint
+	index   uint64        // index of the first node within its layer
+	reduced bool          // whether a reducer takes care of it
+	done    chan struct{} // signaled by the reducer once nodes is down to a single node
+}
+
+// The tower consists of a pool of reducers and a single folder. Every slab
+// is handed to whichever reducer is available, which hashes it down to its
+// root. The folder then takes the roots in the order the slabs were
+// submitted, and folds them into an explicit stack holding the node of each
+// layer still waiting for its twin, just like an increment ripples through
+// the bits of a binary counter.
+//
+// The slabs are always aligned to their own size, hence none of the layers
+// a slab spans hold a pending node by the time its root is folded in: the
+// two never need to be combined.
+//
+// With a nodeSink there are no reducers, as the nodes of every layer must be
+// delivered in order: the folder reduces each slab itself instead. The same
+// goes for builds with inlineReduce set.
+
+// startTower starts the folder, and the reducers if any. Must be called
+// after initPipeline(), once layerTwins holds the pending nodes to resume
+// from.
+func (cp *Calc) startTower() {
+	f := &folder{cp: cp, h: cp.cfg.hashBackend.new()}
+	copy(f.pending[:], cp.layerTwins[:])
+	cp.spawn("folder", f.run)
+
+	if cp.work != nil {
+		for range reducerCount() {
+			h := cp.cfg.hashBackend.new()
+			cp.spawn("reducer", func() { cp.reducer(h) })
+		}
+	}
+}
+
+// reducerCount is the amount of reducers of a Calc without a nodeSink.
+func reducerCount() int { return min(runtime.GOMAXPROCS(0), layerQueueDepth) }
+
+func (cp *Calc) spawn(name string, fn func()) {
+	cp.workers.Add(1)
+	go func() {
+		defer cp.workers.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				cp.fail(xerrors.Errorf("%s panicked: %v: %w", name, r, ErrInternalFailure))
+			}
+		}()
+		fn()
+	}()
+}
+
+// submit hands nodes to the tower, unless it is being torn down due to an
+// internal failure. Must be called with cp.mu held.
+func (cp *Calc) submit(nodes []byte, layer uint, index uint64) error {
+	start := cp.transferStart()
+	var j *job
+	select {
+	case j = <-cp.jobs:
+	case <-cp.failed:
+		return cp.failure
+	}
+	cp.transferStop(start)
+	j.nodes, j.layer, j.index = nodes, layer, index
+
+	// n.b. neither of these ever blocks, as there are only as many jobs as
+	// either queue holds
+	j.reduced = cp.work != nil && uint64(len(nodes)) > uint64(1)<<(5+layer) // uint64 cast needed on 32-bit systems
+	if j.reduced {
+		cp.work <- j
+	}
+	cp.order <- j
+	return nil
+}
+
+// closeTower signals the end of the input: the folder collapses the stack
+// into the resultCommP once every job is done.
+func (cp *Calc) closeTower() {
+	close(cp.order)
+	if cp.work != nil {
+		close(cp.work)
+	}
+}
+
+func (cp *Calc) reducer(h hash.Hash) {
+	for {
+		var j *job
+		var queueIsOpen bool
+		select {
+		case j, queueIsOpen = <-cp.work:
+		case <-cp.failed:
+			return
+		}
+		if !queueIsOpen {
+			return
+		}
+		var err error
+		if !cp.scheduled(func() { err = cp.reduce(h, j) }) {
+			return
+		}
+		if err != nil {
+			cp.fail(err)
+			return
+		}
+		j.done <- struct{}{}
+	}
+}
+
+// reduce hashes the nodes of j in place, until only the root is left. Nodes
+// not making up a whole subtree, or a panic while hashing them such as one of
+// the nodeSink, are reported as an internal failure identifying where in the
+// tree it happened.
+func (cp *Calc) reduce(h hash.Hash, j *job) (err error) {
+	l, idx, nodes := j.layer, j.index, j.nodes
+	defer recovered(&err, "reducing", &l, &idx)
+
+	if stride := 1 << (5 + l); len(nodes) < 32 ||
+		len(nodes) > stride && (len(nodes)%stride != 0 || bits.OnesCount(uint(len(nodes)/stride)) != 1) {
+		return xerrors.Errorf("slab of %d bytes at layer %d, padded offset %d is not a subtree of nodes %d bytes apart: %w", len(nodes), l, idx<<(5+l), stride, ErrInternalFailure)
+	}
+
+	for ; uint64(len(nodes)) > uint64(1)<<(5+l); l++ {
+		setProfLabels(profReduce, l)
+		stride := 1 << (5 + l)
+		if l == 0 {
+			cp.emitNodes(0, idx, nodes, stride)
+		}
+		hashSlab254(h, l, nodes)
+		idx /= 2
+		cp.emitNodes(l+1, idx, nodes, 2*stride)
+	}
+	j.layer, j.index = l, idx
+	return nil
+}
+
+// sinkPanic is a panic of the nodeSink, along with the node it was handed.
+type sinkPanic struct {
+	layer uint
+	index uint64
+	value any
+}
+
+// recovered turns a panic in progress into an internal failure stored in err,
+// identifying the layer and padded offset being worked on. Must be deferred
+// directly.
+func recovered(err *error, stage string, layer *uint, index *uint64) {
+	r := recover()
+	if sp, isSinkPanic := r.(sinkPanic); isSinkPanic {
+		*err = xerrors.Errorf("node sink panicked on layer %d at padded offset %d: %v: %w", sp.layer, sp.index<<(5+sp.layer), sp.value, ErrInternalFailure)
+	} else if r != nil {
+		*err = xerrors.Errorf("%s layer %d at padded offset %d panicked: %v: %w", stage, *layer, *index<<(5+*layer), r, ErrInternalFailure)
+	}
+}
+
+type folder struct {
+	cp      *Calc
+	h       hash.Hash
+	pending [MaxLayers + 1][]byte // node of each layer waiting for its twin, in a twin buffer
+}
+
+func (f *folder) run() {
+	cp := f.cp
+	for {
+		var j *job
+		var queueIsOpen bool
+		select {
+		case j, queueIsOpen = <-cp.order:
+		case <-cp.failed:
+			return
+		}
+
+		// the dream is collapsing
+		if !queueIsOpen {
+			f.collapse()
+			return
+		}
+
+		// sync() barrier: publish what we hold
+		if j.nodes == nil {
+			cp.layerTwins = f.pending
+			cp.jobs <- j
+			select {
+			case cp.syncDone <- struct{}{}:
+			case <-cp.failed:
+				return
+			}
+			continue
+		}
+
+		if !j.reduced {
+			var err error
+			if !cp.scheduled(func() { err = cp.reduce(f.h, j) }) {
+				return
+			}
+			if err != nil {
+				cp.fail(err)
+				return
+			}
+		} else {
+			select {
+			case <-j.done:
+			case <-cp.failed:
+				return
+			}
+		}
+
+		if !f.fold(j.nodes, j.layer, j.index) {
+			return
+		}
+		cp.jobs <- j
+	}
+}
+
+// fold adds the single node at the given layer and index to the stack,
+// returning false if the tower failed meanwhile.
+func (f *folder) fold(node []byte, l uint, idx uint64) bool {
+	cp := f.cp
+	for {
+		if f.pending[l] == nil {
+			// hold on to a copy of the node, instead of pinning the entire
+			// slab it arrived in
+			f.pending[l] = newTwin(node[0:32])
+			cp.recycle(node)
+			return true
+		}
+
+		twin := f.pending[l]
+		f.pending[l] = nil
+		setProfLabels(profFold, l)
+		var err error
+		if !cp.scheduled(func() {
+			defer recovered(&err, "folding", &l, &idx)
+			copy(twin[32:64], node[0:32])
+			cp.recycle(node)
+			hashSlab254(f.h, 0, twin[0:64])
+			cp.emitNodes(l+1, idx/2, twin[0:32], 64)
+		}) {
+			return false
+		}
+		if err != nil {
+			cp.fail(err)
+			return false
+		}
+		node = twin[0:32:64]
+		l++
+		idx /= 2
+	}
+}
+
+// collapse pads every pending node with the null subtree of its layer, all
+// the way up to the root of the tree.
+func (f *folder) collapse() {
+	cp := f.cp
+
+	// only determined by the amount of quads, which no longer changes
+	var root uint
+	if cp.quadsEnqueued != 0 {
+		root = uint(bits.TrailingZeros64(paddedSizeForQuads(cp.quadsEnqueued))) - 5
+	}
+
+	// a teardown via Reset() is not worth a span
+	var span Span = noopSpan{}
+	if !cp.aborting.Load() {
+		span = cp.startSpan(SpanCollapse)
+		span.SetAttribute(AttrLayers, int64(root))
+	}
+	defer func() { span.End(cp.err()) }()
+
+	var carry []byte // the node coming up from the layer below, if any
+	for l := uint(0); l < root; l++ {
+		// every complete subtree of this layer made it to the stack, the
+		// carry is the one right after them
+		twin, idx := f.pending[l], (cp.quadsEnqueued*4)>>l
+		switch {
+		case twin != nil && carry != nil:
+			copy(twin[32:64], carry[0:32])
+			putSlab(carry)
+			idx--
+		case twin != nil:
+			copy(twin[32:64], stackedNulPadding[l])
+			idx--
+		case carry != nil:
+			twin = carry[0:64]
+			copy(twin[32:64], stackedNulPadding[l])
+		default:
+			continue
+		}
+		f.pending[l] = nil
+
+		setProfLabels(profCollapse, l)
+		var err error
+		if !cp.scheduled(func() {
+			defer recovered(&err, "collapsing", &l, &idx)
+			hashSlab254(f.h, 0, twin[0:64])
+			cp.emitNodes(l+1, idx/2, twin[0:32], 64)
+		}) {
+			return
+		}
+		if err != nil {
+			cp.fail(err)
+			return
+		}
+		carry = twin[0:32:64]
+	}
+
+	if carry == nil {
+		carry = f.pending[root]
+	}
+	// nothing to hand back when torn down via Reset() before a single slab
+	// made it to us
+	if carry == nil {
+		cp.resultCommP <- nil
+		return
+	}
+	cp.resultCommP <- append(make([]byte, 0, 32), carry[0:32]...)
+	putSlab(carry)
+}
@@ -0,0 +1,8 @@
+//go:build tinygo || wasm
+
+package commp
+
+// inlineReduce makes the folder reduce every slab itself instead of handing
+// them to reducers: on single-threaded targets the latter only add overhead,
+// and goroutines are expensive under TinyGo.
+const inlineReduce = true
@@ -0,0 +1,7 @@
+//go:build !tinygo && !wasm
+
+package commp
+
+// inlineReduce makes the folder reduce every slab itself instead of handing
+// them to reducers.
+const inlineReduce = false
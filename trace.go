@@ -0,0 +1,64 @@
+package commp
+
+// Tracer starts the spans a Calc constructed WithTracer() reports, letting
+// services attribute the latency of their data preparation to hashing. It is
+// meant to be a thin adapter around a tracing library such as OpenTelemetry,
+// which this module does not depend on:
+//
+//	type otelTracer struct {
+//		ctx    context.Context // the parent of every span
+//		tracer trace.Tracer
+//	}
+//
+//	func (t otelTracer) StartSpan(name string) commp.Span {
+//		_, span := t.tracer.Start(t.ctx, name)
+//		return otelSpan{span}
+//	}
+//
+// with otelSpan passing attributes on as attribute.Int64(), and recording the
+// error handed to End() before ending the span. StartSpan is invoked from the
+// goroutine calling into the Calc as well as from its background workers, and
+// concurrently by all Calcs sharing the Tracer.
+type Tracer interface {
+	StartSpan(name string) Span
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value int64)
+	// End ends the span, along with the error the traced operation failed
+	// with, if any.
+	End(err error)
+}
+
+// The spans a Calc reports, with the attributes set on them.
+const (
+	// SpanWrite covers a single Write(), WriteChunks() or WriteVec() call,
+	// setting AttrBytes to the amount of bytes written.
+	SpanWrite = "commp.Write"
+	// SpanCollapse covers the final hashing of every layer of the tree
+	// still holding a node, up to the root, setting AttrLayers to the amount
+	// of layers below the root.
+	SpanCollapse = "commp.collapse"
+	// SpanDigest covers Digest() and DigestPadded() from start to end,
+	// collapse included, setting AttrBytes to the amount of bytes digested and
+	// AttrPaddedPieceSize to the padded size of the piece.
+	SpanDigest = "commp.Digest"
+
+	AttrBytes           = "commp.bytes"
+	AttrLayers          = "commp.layers"
+	AttrPaddedPieceSize = "commp.padded_piece_size"
+)
+
+// noopSpan stands in for the spans of a Calc without a Tracer.
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, int64) {}
+func (noopSpan) End(error)                  {}
+
+func (cp *Calc) startSpan(name string) Span {
+	if cp.cfg.tracer == nil {
+		return noopSpan{}
+	}
+	return cp.cfg.tracer.StartSpan(name)
+}
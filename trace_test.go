@@ -0,0 +1,124 @@
+package commp
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+type recordedSpan struct {
+	name  string
+	attrs map[string]int64
+	err   error
+	ended bool
+}
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (sr *spanRecorder) StartSpan(name string) Span {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	s := &recordedSpan{name: name, attrs: make(map[string]int64)}
+	sr.spans = append(sr.spans, s)
+	return &recordingSpan{sr, s}
+}
+
+func (sr *spanRecorder) named(name string) []*recordedSpan {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	var spans []*recordedSpan
+	for _, s := range sr.spans {
+		if s.name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+type recordingSpan struct {
+	sr *spanRecorder
+	s  *recordedSpan
+}
+
+func (rs *recordingSpan) SetAttribute(key string, value int64) {
+	rs.sr.mu.Lock()
+	defer rs.sr.mu.Unlock()
+	rs.s.attrs[key] = value
+}
+
+func (rs *recordingSpan) End(err error) {
+	rs.sr.mu.Lock()
+	defer rs.sr.mu.Unlock()
+	if rs.s.ended {
+		panic("span " + rs.s.name + " ended twice")
+	}
+	rs.s.err, rs.s.ended = err, true
+}
+
+func TestTracer(t *testing.T) {
+	t.Parallel()
+
+	sr := new(spanRecorder)
+	cp := New(WithTracer(sr))
+	payload := make([]byte, 3*bufferSize+5)
+
+	if _, err := cp.Write(payload[:1000]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cp.WriteVec([][]byte{payload[1000:2000], payload[2000:]}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cp.SnapshotDigest(); err != nil {
+		t.Fatal(err)
+	}
+	_, paddedSize, err := cp.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writes := sr.named(SpanWrite)
+	if len(writes) != 2 || writes[0].attrs[AttrBytes] != 1000 || writes[1].attrs[AttrBytes] != int64(len(payload)-1000) {
+		t.Fatalf("unexpected write spans %+v", writes)
+	}
+	digests := sr.named(SpanDigest)
+	if len(digests) != 1 {
+		t.Fatalf("expected a single digest span, not %d", len(digests))
+	}
+	if d := digests[0]; !d.ended || d.err != nil || d.attrs[AttrBytes] != int64(len(payload)) || d.attrs[AttrPaddedPieceSize] != int64(paddedSize) {
+		t.Fatalf("unexpected digest span %+v", d)
+	}
+	collapses := sr.named(SpanCollapse)
+	if len(collapses) != 1 || !collapses[0].ended || collapses[0].attrs[AttrLayers] == 0 {
+		t.Fatalf("unexpected collapse spans %+v", collapses)
+	}
+}
+
+func TestTracerErrors(t *testing.T) {
+	t.Parallel()
+
+	sr := new(spanRecorder)
+	cp := New(WithTracer(sr))
+	defer cp.Reset()
+
+	if _, err := cp.Write(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cp.Digest(); !errors.Is(err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d := sr.named(SpanDigest); len(d) != 1 || !errors.Is(d[0].err, ErrBelowMinimumPayload) {
+		t.Fatalf("unexpected digest spans %+v", d)
+	}
+
+	// a Reset() tearing down the tower is no collapse
+	if _, err := cp.Write(make([]byte, 3*bufferSize)); err != nil {
+		t.Fatal(err)
+	}
+	cp.Reset()
+	if c := sr.named(SpanCollapse); len(c) != 0 {
+		t.Fatalf("unexpected collapse spans %+v", c)
+	}
+}
@@ -0,0 +1,192 @@
+package commp
+
+import (
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// Proof is a merkle inclusion proof of a single node within a commP tree,
+// typically one of the fr32-padded 32-byte leaves.
+type Proof struct {
+	// Layer is the layer of the proven node: 0 for leaves
+	Layer uint
+	// Index is the position of the proven node within its layer
+	Index uint64
+	// Path holds the siblings encountered on the way from the node to the
+	// root, starting with the sibling of the node itself
+	Path [][32]byte
+}
+
+// resolve returns the root reached by hashing the given node, assumed to be
+// the proven one, along the path.
+func (p Proof) resolve(node [32]byte) [32]byte {
+	h := newHasher()
+	for i, sibling := range p.Path {
+		h.Reset()
+		if (p.Index>>i)&1 == 0 {
+			h.Write(node[:])
+			h.Write(sibling[:])
+		} else {
+			h.Write(sibling[:])
+			h.Write(node[:])
+		}
+		h.Sum(node[:0])
+		node[31] &= 0x3F
+	}
+	return node
+}
+
+// VerifyInclusion checks that the proof places the given node at the given
+// index within a tree with the given root. The node is a leaf for proofs
+// produced by MerkleTree, or a node of the layer recorded in the proof
+// otherwise. A failed verification returns an error wrapping ErrInvalidProof.
+func VerifyInclusion(root [32]byte, proof Proof, node [32]byte, index uint64) error {
+	if proof.Index != index {
+		return xerrors.Errorf("proof is for node index %d, not %d: %w", proof.Index, index, ErrInvalidProof)
+	}
+	if proof.Layer > MaxLayers || uint(len(proof.Path)) > MaxLayers-proof.Layer {
+		return xerrors.Errorf("proof path of length %d from layer %d exceeds the maximum tree height %d: %w", len(proof.Path), proof.Layer, MaxLayers, ErrInvalidProof)
+	}
+	if index>>len(proof.Path) != 0 {
+		return xerrors.Errorf("node index %d out of range for a proof path of length %d: %w", index, len(proof.Path), ErrInvalidProof)
+	}
+	if proof.resolve(node) != root {
+		return xerrors.Errorf("proof of node %d does not resolve to the expected root: %w", index, ErrInvalidProof)
+	}
+	return nil
+}
+
+// MerkleTree retains every node of a commP tree while it is being computed,
+// so that inclusion proofs can be generated afterwards. Hook it up to a Calc
+// by passing its AddNode method to WithNodeSink(). A MerkleTree holds
+// roughly twice the padded piece size in memory: it is only suitable for
+// reasonably small pieces.
+type MerkleTree struct {
+	mu     sync.Mutex
+	layers [][][32]byte
+	err    error
+}
+
+// AddNode records a node of the tree. Its signature matches WithNodeSink(),
+// and it is not meant to be called directly otherwise.
+func (t *MerkleTree) AddNode(layer uint, index uint64, node [32]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.err != nil {
+		return
+	}
+	for uint(len(t.layers)) <= layer {
+		t.layers = append(t.layers, nil)
+	}
+	if index != uint64(len(t.layers[layer])) {
+		t.err = xerrors.Errorf("node %d of layer %d received out of order, expected node %d", index, layer, len(t.layers[layer]))
+		return
+	}
+	t.layers[layer] = append(t.layers[layer], node)
+}
+
+// Root returns the commP the tree collapsed to, available once the Calc
+// feeding it has been Digest()ed.
+func (t *MerkleTree) Root() ([32]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.check(); err != nil {
+		return [32]byte{}, err
+	}
+	return t.layers[len(t.layers)-1][0], nil
+}
+
+// Leaf returns the fr32-padded leaf at the given index.
+func (t *MerkleTree) Leaf(index uint64) ([32]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.check(); err != nil {
+		return [32]byte{}, err
+	}
+	if index >= uint64(len(t.layers[0])) {
+		return [32]byte{}, xerrors.Errorf("leaf index %d out of range of the %d available leaves", index, len(t.layers[0]))
+	}
+	return t.layers[0][index], nil
+}
+
+// Prove returns the inclusion proof of the leaf at the given index.
+func (t *MerkleTree) Prove(leafIndex uint64) (Proof, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.check(); err != nil {
+		return Proof{}, err
+	}
+	if leafIndex >= uint64(len(t.layers[0])) {
+		return Proof{}, xerrors.Errorf("leaf index %d out of range of the %d available leaves", leafIndex, len(t.layers[0]))
+	}
+
+	p := Proof{
+		Index: leafIndex,
+		Path:  make([][32]byte, len(t.layers)-1),
+	}
+	for l := range p.Path {
+		if sibling := (leafIndex >> l) ^ 1; sibling < uint64(len(t.layers[l])) {
+			p.Path[l] = t.layers[l][sibling]
+		} else {
+			// beyond the written data: a subtree of zeroes
+			copy(p.Path[l][:], stackedNulPadding[l])
+		}
+	}
+	return p, nil
+}
+
+// ProveRange returns the inclusion proofs of all leaves holding any part of
+// the payload byte range [offset, offset+length), as mapped by
+// PayloadLeafRange().
+func (t *MerkleTree) ProveRange(offset, length uint64) ([]Proof, error) {
+	first, last, err := PayloadLeafRange(offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	proofs := make([]Proof, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		p, err := t.Prove(i)
+		if err != nil {
+			return nil, err
+		}
+		proofs = append(proofs, p)
+	}
+	return proofs, nil
+}
+
+// check validates the tree is complete, must be called with t.mu held.
+func (t *MerkleTree) check() error {
+	if t.err != nil {
+		return t.err
+	}
+	if len(t.layers) == 0 || len(t.layers[len(t.layers)-1]) != 1 {
+		return xerrors.New("incomplete tree: the feeding Calc has not been successfully Digest()ed")
+	}
+	return nil
+}
+
+// PayloadLeafRange returns the indices of the first and last fr32-padded leaf
+// holding any part of the payload byte range [offset, offset+length). Every
+// 127 bytes of payload are spread over 4 leaves of 254 significant bits
+// each, so a range may partially share its boundary leaves with adjacent
+// data.
+func PayloadLeafRange(offset, length uint64) (firstLeaf, lastLeaf uint64, err error) {
+	if length == 0 {
+		return 0, 0, xerrors.New("a payload range must be at least 1 byte long")
+	}
+	if offset+length > MaxPiecePayload || offset+length < offset {
+		return 0, 0, xerrors.Errorf("payload range %d+%d exceeds the maximum supported unpadded piece size %d: %w", offset, length, MaxPiecePayload, ErrPayloadTooLarge)
+	}
+
+	leafOf := func(bitPos uint64) uint64 {
+		quad, bitInQuad := bitPos/(uint64(quadPayload)*8), bitPos%(uint64(quadPayload)*8)
+		return quad*4 + bitInQuad/254
+	}
+	return leafOf(offset * 8), leafOf((offset+length)*8 - 1), nil
+}
@@ -0,0 +1,161 @@
+package commp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+
+	randmath "math/rand"
+)
+
+func TestMerkleTreeProofs(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{65, 127 * 5, bufferSize*2 + 1, 1<<20 + 3} {
+		size := size
+		t.Run(fmt.Sprintf("%d", size), func(t *testing.T) {
+			t.Parallel()
+
+			payload := make([]byte, size)
+			randmath.New(randmath.NewSource(int64(size))).Read(payload)
+
+			tree := &MerkleTree{}
+			if _, err := tree.Root(); err == nil {
+				t.Fatal("unexpected success retrieving the root of an empty tree")
+			}
+
+			commP, paddedSize := mustDigest(t, New(WithNodeSink(tree.AddNode)), payload)
+			root, err := tree.Root()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(root[:], commP) {
+				t.Fatalf("tree root 0x%X doesn't match commP 0x%X", root, commP)
+			}
+
+			proofs, err := tree.ProveRange(0, uint64(size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(proofs) != (size*8+253)/254 {
+				t.Fatalf("produced %d proofs for a %d byte payload, expected %d", len(proofs), size, (size*8+253)/254)
+			}
+
+			h := sha256.New()
+			for _, p := range proofs {
+				if uint64(1)<<len(p.Path) != paddedSize/32 {
+					t.Fatalf("proof of leaf %d has a path of length %d, expected one matching a piece of %d bytes", p.Index, len(p.Path), paddedSize)
+				}
+				cur, err := tree.Leaf(p.Index)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for l, sibling := range p.Path {
+					h.Reset()
+					if (p.Index>>l)&1 == 0 {
+						h.Write(cur[:])
+						h.Write(sibling[:])
+					} else {
+						h.Write(sibling[:])
+						h.Write(cur[:])
+					}
+					h.Sum(cur[:0])
+					cur[31] &= 0x3F
+				}
+				if cur != root {
+					t.Fatalf("proof of leaf %d resolves to 0x%X instead of root 0x%X", p.Index, cur, root)
+				}
+			}
+
+			if _, err := tree.Prove(paddedSize); err == nil {
+				t.Fatal("unexpected success proving a leaf beyond the end of the tree")
+			}
+		})
+	}
+
+	// a tree fed twice is rejected
+	tree := &MerkleTree{}
+	cp := New(WithNodeSink(tree.AddNode))
+	mustDigest(t, cp, make([]byte, 1000))
+	cp.Reset()
+	mustDigest(t, cp, make([]byte, 1000))
+	if _, err := tree.Prove(0); err == nil {
+		t.Fatal("unexpected success proving a leaf of an inconsistent tree")
+	}
+}
+
+func TestPayloadLeafRange(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		offset, length, first, last uint64
+	}{
+		{0, 1, 0, 0},
+		{0, 31, 0, 0},
+		{0, 32, 0, 1},
+		{31, 1, 0, 1},
+		{126, 1, 3, 3},
+		{127, 1, 4, 4},
+		{0, 127, 0, 3},
+		{100, 200, 3, 9},
+		{MaxPiecePayload - 1, 1, MaxPieceSize/32 - 1, MaxPieceSize/32 - 1},
+	} {
+		first, last, err := PayloadLeafRange(tc.offset, tc.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != tc.first || last != tc.last {
+			t.Errorf("range %d+%d mapped to leaves %d-%d, expected %d-%d", tc.offset, tc.length, first, last, tc.first, tc.last)
+		}
+	}
+
+	if _, _, err := PayloadLeafRange(0, 0); err == nil {
+		t.Error("unexpected success mapping an empty range")
+	}
+	if _, _, err := PayloadLeafRange(MaxPiecePayload, 1); err == nil {
+		t.Error("unexpected success mapping a range past MaxPiecePayload")
+	}
+}
+
+func TestVerifyInclusion(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 127*9)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+
+	tree := &MerkleTree{}
+	mustDigest(t, New(WithNodeSink(tree.AddNode)), payload)
+	root, err := tree.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint64(0); i < 9*4; i++ {
+		p, err := tree.Prove(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := tree.Leaf(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyInclusion(root, p, leaf, i); err != nil {
+			t.Fatalf("leaf %d: %s", i, err)
+		}
+
+		bad := leaf
+		bad[0] ^= 1
+		for name, err := range map[string]error{
+			"leaf":  VerifyInclusion(root, p, bad, i),
+			"index": VerifyInclusion(root, p, leaf, i^1),
+			"root":  VerifyInclusion(bad, p, leaf, i),
+			"path":  VerifyInclusion(root, Proof{Index: i, Path: p.Path[:len(p.Path)-1]}, leaf, i),
+		} {
+			if !errors.Is(err, ErrInvalidProof) {
+				t.Fatalf("leaf %d: unexpected result verifying a proof with a wrong %s: %v", i, name, err)
+			}
+		}
+	}
+}
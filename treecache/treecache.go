@@ -0,0 +1,405 @@
+// Package treecache persists the merkle tree computed by a commp.Calc to a
+// cache file, which can later be reopened to serve inclusion proofs or to
+// re-derive the commP without re-reading the original data.
+//
+// A cache can hold the full tree, or be truncated to only retain the layers
+// at or above a chosen minimum layer: each layer up trades a halving of the
+// file size for having to re-read 2^minLayer leaves worth of data when
+// proving anything below it.
+//
+// The file layout is:
+//
+//	magic       8 bytes "fcpTree\x01"
+//	height      1 byte, the layer of the root
+//	minLayer    1 byte, the lowest layer stored
+//	nodeCounts  8 bytes big-endian per stored layer, lowest layer first
+//	nodes       32 bytes each, layer by layer, lowest layer first
+//
+// Only nodes derived from written data are stored: the all-zero subtrees
+// padding a piece up to its power-of-two size are implied.
+package treecache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	sha256simd "github.com/minio/sha256-simd"
+	"golang.org/x/xerrors"
+)
+
+const (
+	magic      = "fcpTree\x01"
+	headerSize = len(magic) + 2
+)
+
+var zeroNodes [commp.MaxLayers + 1][32]byte
+
+func init() {
+	h := sha256simd.New()
+	for i := 1; i < len(zeroNodes); i++ {
+		h.Reset()
+		h.Write(zeroNodes[i-1][:])
+		h.Write(zeroNodes[i-1][:])
+		h.Sum(zeroNodes[i][:0])
+		zeroNodes[i][31] &= 0x3F
+	}
+}
+
+// Writer receives tree nodes from a commp.Calc and assembles them into a
+// cache file. Hook it up by passing its AddNode method to
+// commp.WithNodeSink(), and call Close() after a successful Digest().
+type Writer struct {
+	path     string
+	minLayer uint
+	// when non-zero, produce a TreeD file for a sector of this height instead
+	// of a cache file
+	sectorHeight uint
+
+	mu     sync.Mutex
+	spills []*os.File
+	bufs   []*bufio.Writer
+	counts []uint64
+	err    error
+
+	// the topmost node seen below minLayer, the root of pieces too small to
+	// reach minLayer at all
+	lowTop      [32]byte
+	lowTopLayer int
+}
+
+// Create returns a Writer which will produce a cache file at path, retaining
+// all layers at or above minLayer. Pass 0 to retain the full tree. Caches of
+// pieces too small to reach minLayer retain just the root.
+func Create(path string, minLayer uint) (*Writer, error) {
+	if minLayer > commp.MaxLayers {
+		return nil, xerrors.Errorf("minimum layer %d is above the maximum tree height %d", minLayer, commp.MaxLayers)
+	}
+	return &Writer{path: path, minLayer: minLayer, lowTopLayer: -1}, nil
+}
+
+// AddNode records a node of the tree. Its signature matches
+// commp.WithNodeSink(), and it is not meant to be called directly otherwise.
+//
+// Nodes of each layer are spilled into temporary files next to the final
+// cache file, as the layers are only known in full at the very end.
+func (w *Writer) AddNode(layer uint, index uint64, node [32]byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return
+	}
+
+	if layer < w.minLayer {
+		if index == 0 && int(layer) > w.lowTopLayer {
+			w.lowTop, w.lowTopLayer = node, int(layer)
+		}
+		return
+	}
+
+	w.record(layer, index, node)
+}
+
+// record appends a node to the spill file of its layer, must be called with
+// w.mu held.
+func (w *Writer) record(layer uint, index uint64, node [32]byte) {
+	l := int(layer - w.minLayer)
+	for len(w.spills) <= l {
+		f, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".layer*")
+		if err != nil {
+			w.err = err
+			return
+		}
+		w.spills = append(w.spills, f)
+		w.bufs = append(w.bufs, bufio.NewWriterSize(f, 1<<20))
+		w.counts = append(w.counts, 0)
+	}
+
+	if index != w.counts[l] {
+		w.err = xerrors.Errorf("node %d of layer %d received out of order, expected node %d", index, layer, w.counts[l])
+		return
+	}
+	if _, err := w.bufs[l].Write(node[:]); err != nil {
+		w.err = err
+		return
+	}
+	w.counts[l]++
+}
+
+// Close assembles the final cache file from the nodes received so far and
+// removes all temporary files. It returns an error if the tree is not
+// complete, which is the case unless the feeding Calc was successfully
+// Digest()ed.
+func (w *Writer) Close() (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	defer func() {
+		for _, f := range w.spills {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		w.spills, w.bufs = nil, nil
+		if w.err == nil && err != nil {
+			w.err = err
+		}
+	}()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if len(w.counts) == 0 && w.lowTopLayer >= 0 {
+		w.minLayer = uint(w.lowTopLayer)
+		w.record(w.minLayer, 0, w.lowTop)
+		if w.err != nil {
+			return w.err
+		}
+	}
+	complete := len(w.counts) > 0 && w.counts[len(w.counts)-1] == 1
+	for l := 1; complete && l < len(w.counts); l++ {
+		complete = w.counts[l] == (w.counts[l-1]+1)/2
+	}
+	if !complete {
+		return xerrors.New("incomplete tree: the feeding Calc has not been successfully Digest()ed")
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		out.Close()
+		if err != nil {
+			os.Remove(out.Name())
+		}
+	}()
+
+	if w.sectorHeight != 0 {
+		err = w.writeTreeD(out)
+	} else {
+		err = w.writeCache(out)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), w.path)
+}
+
+func (w *Writer) writeCache(out io.Writer) error {
+	hdr := make([]byte, 0, headerSize+8*len(w.counts))
+	hdr = append(hdr, magic...)
+	hdr = append(hdr, byte(w.minLayer+uint(len(w.counts))-1), byte(w.minLayer))
+	for _, c := range w.counts {
+		hdr = binary.BigEndian.AppendUint64(hdr, c)
+	}
+	if _, err := out.Write(hdr); err != nil {
+		return err
+	}
+
+	for l := range w.spills {
+		if err := w.copySpill(out, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) copySpill(out io.Writer, l int) error {
+	if err := w.bufs[l].Flush(); err != nil {
+		return err
+	}
+	if _, err := w.spills[l].Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(out, w.spills[l])
+	return err
+}
+
+// Tree is a read-only view of a cache file.
+type Tree struct {
+	f        *os.File
+	height   uint
+	minLayer uint
+	counts   []uint64
+	offsets  []int64
+}
+
+// Open opens a cache file previously written by a Writer.
+func Open(path string) (*Tree, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := load(f)
+	if err != nil {
+		f.Close()
+		return nil, xerrors.Errorf("unable to load tree cache %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func load(f *os.File) (*Tree, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, headerSize)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr[:len(magic)]) != magic {
+		return nil, xerrors.New("invalid file identifier")
+	}
+
+	t := &Tree{
+		f:        f,
+		height:   uint(hdr[len(magic)]),
+		minLayer: uint(hdr[len(magic)+1]),
+	}
+	if t.height > commp.MaxLayers || t.minLayer > t.height {
+		return nil, xerrors.Errorf("invalid tree geometry: minimum layer %d, height %d", t.minLayer, t.height)
+	}
+
+	cnts := make([]byte, 8*(t.height-t.minLayer+1))
+	if _, err := io.ReadFull(f, cnts); err != nil {
+		return nil, err
+	}
+	pos := int64(headerSize + len(cnts))
+	for l := t.minLayer; l <= t.height; l++ {
+		c := binary.BigEndian.Uint64(cnts[8*(l-t.minLayer):])
+		if c == 0 || c > 1<<(t.height-l) {
+			return nil, xerrors.Errorf("invalid node count %d for layer %d of a tree of height %d", c, l, t.height)
+		}
+		t.counts = append(t.counts, c)
+		t.offsets = append(t.offsets, pos)
+		pos += int64(c) * 32
+	}
+	if pos != st.Size() {
+		return nil, xerrors.Errorf("file size %d does not match the expected %d", st.Size(), pos)
+	}
+
+	return t, nil
+}
+
+// Close releases the underlying file.
+func (t *Tree) Close() error { return t.f.Close() }
+
+// Height returns the layer of the root node, which is log2 of the amount of
+// leaves in the piece.
+func (t *Tree) Height() uint { return t.height }
+
+// MinLayer returns the lowest layer retained in the cache.
+func (t *Tree) MinLayer() uint { return t.minLayer }
+
+// PaddedPieceSize returns the padded size of the piece the tree describes.
+func (t *Tree) PaddedPieceSize() uint64 { return 32 << t.height }
+
+// Root returns the commP of the piece.
+func (t *Tree) Root() ([32]byte, error) {
+	return t.Node(t.height, 0)
+}
+
+// Node returns the node at the given index within the given layer. Nodes
+// past the written data are the corresponding all-zero subtree roots.
+func (t *Tree) Node(layer uint, index uint64) ([32]byte, error) {
+	var n [32]byte
+	if layer < t.minLayer || layer > t.height {
+		return n, xerrors.Errorf("layer %d is not retained in a cache covering layers %d through %d", layer, t.minLayer, t.height)
+	}
+	if index >= 1<<(t.height-layer) {
+		return n, xerrors.Errorf("node index %d out of range for layer %d of a tree of height %d", index, layer, t.height)
+	}
+
+	l := layer - t.minLayer
+	if index >= t.counts[l] {
+		return zeroNodes[layer], nil
+	}
+	_, err := t.f.ReadAt(n[:], t.offsets[l]+int64(index)*32)
+	return n, err
+}
+
+// Prove returns the inclusion proof of the node at the given index within the
+// given layer. Layers below MinLayer() can not be proven from the cache.
+func (t *Tree) Prove(layer uint, index uint64) (commp.Proof, error) {
+	if _, err := t.Node(layer, index); err != nil {
+		return commp.Proof{}, err
+	}
+
+	p := commp.Proof{
+		Layer: layer,
+		Index: index,
+		Path:  make([][32]byte, t.height-layer),
+	}
+	for i := range p.Path {
+		l := layer + uint(i)
+		n, err := t.Node(l, (index>>i)^1)
+		if err != nil {
+			return commp.Proof{}, err
+		}
+		p.Path[i] = n
+	}
+	return p, nil
+}
+
+// Verify re-derives every retained layer from the one below it, ensuring the
+// cache is internally consistent, and returns the root. Layers are streamed
+// from disk, memory use is constant regardless of tree size.
+func (t *Tree) Verify() ([32]byte, error) {
+	h := sha256simd.New()
+
+	for layer := t.minLayer; layer < t.height; layer++ {
+		l := layer - t.minLayer
+		if exp := (t.counts[l] + 1) / 2; t.counts[l+1] != exp {
+			return [32]byte{}, xerrors.Errorf("layer %d holds %d nodes, but %d derive from the layer below", layer+1, t.counts[l+1], exp)
+		}
+
+		children := bufio.NewReaderSize(t.layerReader(l), 1<<20)
+		parents := bufio.NewReaderSize(t.layerReader(l+1), 1<<20)
+
+		var left, right, parent, derived [32]byte
+		for i := uint64(0); i < t.counts[l]; i += 2 {
+			right = zeroNodes[layer]
+			if _, err := io.ReadFull(children, left[:]); err != nil {
+				return [32]byte{}, err
+			}
+			if i+1 < t.counts[l] {
+				if _, err := io.ReadFull(children, right[:]); err != nil {
+					return [32]byte{}, err
+				}
+			}
+			if _, err := io.ReadFull(parents, parent[:]); err != nil {
+				return [32]byte{}, err
+			}
+
+			h.Reset()
+			h.Write(left[:])
+			h.Write(right[:])
+			h.Sum(derived[:0])
+			derived[31] &= 0x3F
+			if derived != parent {
+				return [32]byte{}, xerrors.Errorf("node %d of layer %d does not match the hash of its children", i/2, layer+1)
+			}
+		}
+	}
+
+	return t.Root()
+}
+
+func (t *Tree) layerReader(l uint) io.Reader {
+	return io.NewSectionReader(t.f, t.offsets[l], int64(t.counts[l])*32)
+}
@@ -0,0 +1,185 @@
+package treecache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	sha256simd "github.com/minio/sha256-simd"
+	randmath "math/rand"
+)
+
+func TestRoundtrip(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{127, 127 * 9, 1<<20 + 3} {
+		for _, minLayer := range []uint{0, 1, 5, 20} {
+			size, minLayer := size, minLayer
+			t.Run(fmt.Sprintf("%d/%d", size, minLayer), func(t *testing.T) {
+				t.Parallel()
+
+				payload := make([]byte, size)
+				randmath.New(randmath.NewSource(int64(size))).Read(payload)
+
+				path := filepath.Join(t.TempDir(), "tree")
+				w, err := Create(path, minLayer)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				cp := commp.New(commp.WithNodeSink(w.AddNode))
+				if _, err := cp.Write(payload); err != nil {
+					t.Fatal(err)
+				}
+				commP, paddedSize, err := cp.Digest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				tr, err := Open(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer tr.Close()
+
+				if tr.PaddedPieceSize() != paddedSize {
+					t.Fatalf("cached tree padded size %d doesn't match %d", tr.PaddedPieceSize(), paddedSize)
+				}
+				if exp := min(minLayer, tr.Height()); tr.MinLayer() != exp {
+					t.Fatalf("cached tree retains layers from %d, expected %d", tr.MinLayer(), exp)
+				}
+
+				root, err := tr.Verify()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(root[:]) != string(commP) {
+					t.Fatalf("cached tree root 0x%X doesn't match commP 0x%X", root, commP)
+				}
+
+				h := sha256simd.New()
+				for layer := tr.MinLayer(); layer <= tr.Height(); layer++ {
+					for _, idx := range []uint64{0, (1 << (tr.Height() - layer)) - 1} {
+						p, err := tr.Prove(layer, idx)
+						if err != nil {
+							t.Fatal(err)
+						}
+						cur, err := tr.Node(layer, idx)
+						if err != nil {
+							t.Fatal(err)
+						}
+						for i, sibling := range p.Path {
+							h.Reset()
+							if (p.Index>>i)&1 == 0 {
+								h.Write(cur[:])
+								h.Write(sibling[:])
+							} else {
+								h.Write(sibling[:])
+								h.Write(cur[:])
+							}
+							h.Sum(cur[:0])
+							cur[31] &= 0x3F
+						}
+						if cur != root {
+							t.Fatalf("proof of node %d/%d resolves to 0x%X instead of the root 0x%X", layer, idx, cur, root)
+						}
+					}
+				}
+
+				if tr.MinLayer() > 0 {
+					if _, err := tr.Prove(tr.MinLayer()-1, 0); err == nil {
+						t.Fatal("unexpected success proving a layer not retained in the cache")
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 127*33)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+
+	path := filepath.Join(t.TempDir(), "tree")
+	w, err := Create(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := commp.New(commp.WithNodeSink(w.AddNode))
+	if _, err := cp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cp.Digest(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	orig, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a flipped bit in a leaf is only caught by a Verify()
+	flipped := append([]byte{}, orig...)
+	flipped[len(flipped)/3] ^= 1
+	if err := os.WriteFile(path, flipped, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.Verify(); err == nil {
+		t.Fatal("unexpected success verifying a corrupted tree")
+	}
+	tr.Close()
+
+	for name, b := range map[string][]byte{
+		"truncated": orig[:len(orig)-1],
+		"magic":     append([]byte("fcpTree\x00"), orig[len(magic):]...),
+		"geometry":  append(append([]byte(magic), orig[len(magic)+1], orig[len(magic)]+1), orig[headerSize:]...),
+	} {
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if tr, err := Open(path); err == nil {
+			tr.Close()
+			t.Fatalf("%s: unexpected success opening a corrupted tree", name)
+		}
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	w, err := Create(filepath.Join(dir, "tree"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := commp.New(commp.WithNodeSink(w.AddNode))
+	if _, err := cp.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatal("unexpected success closing a writer fed by an undigested Calc")
+	}
+	cp.Reset()
+
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 0 {
+		t.Fatalf("%d files left behind by a failed Close()", len(ents))
+	}
+}
@@ -0,0 +1,82 @@
+package treecache
+
+import (
+	"bufio"
+	"io"
+	"math/bits"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	sha256simd "github.com/minio/sha256-simd"
+	"golang.org/x/xerrors"
+)
+
+// TreeDFilename is the name rust-fil-proofs expects the data tree to have
+// within a sector cache directory.
+const TreeDFilename = "sc-02-data-tree-d.dat"
+
+// CreateTreeD returns a Writer which, instead of a cache file, produces the
+// TreeD of a sector of the given padded size in the on-disk layout used by
+// rust-fil-proofs: every node of the full tree, 32 bytes each, layer by layer
+// starting with the leaves, without any header. The piece fed to the Writer
+// is placed at the start of the sector, the remainder of which is treated as
+// zeroes. Placing the resulting file as TreeDFilename within a sector cache
+// directory allows sealing to skip building the tree.
+//
+// Note that the file always spans twice the sector size, regardless of the
+// size of the piece.
+func CreateTreeD(path string, sectorSize uint64) (*Writer, error) {
+	if sectorSize < 128 || sectorSize > 32<<commp.MaxLayers || bits.OnesCount64(sectorSize) != 1 {
+		return nil, xerrors.Errorf("invalid sector size %d: must be a power of 2 between 128 and %d", sectorSize, uint64(32)<<commp.MaxLayers)
+	}
+	return &Writer{
+		path:         path,
+		sectorHeight: uint(bits.TrailingZeros64(sectorSize / 32)),
+		lowTopLayer:  -1,
+	}, nil
+}
+
+func (w *Writer) writeTreeD(out io.Writer) error {
+	pieceHeight := uint(len(w.counts) - 1)
+	if pieceHeight > w.sectorHeight {
+		return xerrors.Errorf("piece of padded size %d does not fit in a sector of size %d", uint64(32)<<pieceHeight, uint64(32)<<w.sectorHeight)
+	}
+
+	bw := bufio.NewWriterSize(out, 1<<20)
+
+	var top [32]byte
+	h := sha256simd.New()
+	for layer := uint(0); layer <= w.sectorHeight; layer++ {
+		var have uint64
+		if layer <= pieceHeight {
+			if err := w.copySpill(bw, int(layer)); err != nil {
+				return err
+			}
+			have = w.counts[layer]
+		} else {
+			// above the piece root: the leftmost node combines the piece with
+			// the zero subtrees following it
+			if layer == pieceHeight+1 {
+				if _, err := w.spills[pieceHeight].ReadAt(top[:], 0); err != nil {
+					return err
+				}
+			}
+			h.Reset()
+			h.Write(top[:])
+			h.Write(zeroNodes[layer-1][:])
+			h.Sum(top[:0])
+			top[31] &= 0x3F
+			if _, err := bw.Write(top[:]); err != nil {
+				return err
+			}
+			have = 1
+		}
+
+		for i := have; i < 1<<(w.sectorHeight-layer); i++ {
+			if _, err := bw.Write(zeroNodes[layer][:]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,110 @@
+package treecache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	sha256simd "github.com/minio/sha256-simd"
+	randmath "math/rand"
+)
+
+func TestTreeD(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{127, 127 * 9, 1<<16 + 3} {
+		for _, grow := range []uint{0, 1, 3} {
+			size, grow := size, grow
+			t.Run(fmt.Sprintf("%d/%d", size, grow), func(t *testing.T) {
+				t.Parallel()
+
+				payload := make([]byte, size)
+				randmath.New(randmath.NewSource(int64(size))).Read(payload)
+
+				tree := &commp.MerkleTree{}
+				commP, paddedSize := digest(t, commp.New(commp.WithNodeSink(tree.AddNode)), payload)
+				sectorSize := paddedSize << grow
+
+				path := filepath.Join(t.TempDir(), TreeDFilename)
+				w, err := CreateTreeD(path, sectorSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+				digest(t, commp.New(commp.WithNodeSink(w.AddNode)), payload)
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				b, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if uint64(len(b)) != 2*sectorSize-32 {
+					t.Fatalf("TreeD of %d bytes, expected %d for a sector of %d", len(b), 2*sectorSize-32, sectorSize)
+				}
+
+				// leaves are laid out first, followed by every layer above
+				for i := uint64(0); i < paddedSize/32; i++ {
+					leaf, err := tree.Leaf(i)
+					if err != nil {
+						// past the payload
+						leaf = [32]byte{}
+					}
+					if !bytes.Equal(b[i*32:i*32+32], leaf[:]) {
+						t.Fatalf("leaf %d 0x%X doesn't match expected 0x%X", i, b[i*32:i*32+32], leaf)
+					}
+				}
+				h := sha256simd.New()
+				children := b[:sectorSize]
+				for parents := b[sectorSize:]; len(parents) > 0; children, parents = parents[:len(children)/2], parents[len(children)/2:] {
+					for i := 0; i < len(children)/64; i++ {
+						h.Reset()
+						h.Write(children[i*64 : i*64+64])
+						exp := h.Sum(nil)
+						exp[31] &= 0x3F
+						if !bytes.Equal(parents[i*32:i*32+32], exp) {
+							t.Fatalf("node %d of a layer of %d is not the hash of its children", i, len(parents)/32)
+						}
+					}
+				}
+
+				root := b[len(b)-32:]
+				exp, err := commp.PadCommP(commP, paddedSize, sectorSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(root, exp) {
+					t.Fatalf("TreeD root 0x%X doesn't match the padded commP 0x%X", root, exp)
+				}
+			})
+		}
+	}
+
+	if _, err := CreateTreeD("x", 3<<10); err == nil {
+		t.Fatal("unexpected success creating a TreeD for an invalid sector size")
+	}
+
+	w, err := CreateTreeD(filepath.Join(t.TempDir(), TreeDFilename), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest(t, commp.New(commp.WithNodeSink(w.AddNode)), make([]byte, 1000))
+	if err := w.Close(); err == nil {
+		t.Fatal("unexpected success writing a TreeD for a piece larger than the sector")
+	}
+}
+
+func digest(t *testing.T, cp *commp.Calc, payload []byte) ([]byte, uint64) {
+	t.Helper()
+	if _, err := cp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	commP, paddedSize, err := cp.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commP, paddedSize
+}
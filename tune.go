@@ -0,0 +1,68 @@
+package commp
+
+import (
+	"math"
+	"runtime"
+	"runtime/debug"
+)
+
+const (
+	// the static sizes, in use unless tune() finds a reason to deviate
+	defaultSlabQuads  = 256
+	defaultQueueDepth = 32
+
+	// the bounds tune() stays within: maxSlabQuads also bounds the carry
+	// buffer of a serialized state, which must restore on any machine
+	minSlabQuads     = 32
+	maxSlabQuadsLog2 = 12
+	maxSlabQuads     = 1 << maxSlabQuadsLog2
+	minQueueDepth    = 4
+)
+
+// tune sizes the slabs and layer queues for the machine the process runs on.
+func tune() {
+	limit := debug.SetMemoryLimit(-1)
+	if mem := systemMemory(); mem > 0 && mem < uint64(limit) {
+		limit = int64(mem)
+	}
+
+	slabQuads, queueDepth := tunedSizes(runtime.GOMAXPROCS(0), limit)
+	bufferSize = slabQuads * quadPayload
+	fullSlabSize = slabQuads * 128
+	layerQueueDepth = queueDepth
+}
+
+// tunedSizes returns the amount of quads in a full slab and the depth of the
+// layer queues for the given amount of usable cores and bytes of memory, the
+// latter being math.MaxInt64 when unknown.
+func tunedSizes(procs int, memLimit int64) (slabQuads, queueDepth int) {
+	slabQuads, queueDepth = defaultSlabQuads, defaultQueueDepth
+
+	// With enough cores the layers above run concurrently with layer 0, which
+	// is then bound by the per-slab overhead of channel hops and wakeups
+	// rather than by hashing: larger slabs amortize it.
+	for p := procs; p > 4 && slabQuads < maxSlabQuads; p >>= 1 {
+		slabQuads <<= 1
+	}
+
+	// A single Calc fed faster than it can hash pins the carry buffer and a
+	// full queue of slabs at layer 0. Keep that within a small fraction of
+	// the memory available, so that many Calcs can run side by side: give up
+	// queue depth first, as a shallow queue of large slabs still keeps the
+	// workers busy, then slab size, then the rest of the queue depth.
+	if memLimit == math.MaxInt64 {
+		return slabQuads, queueDepth
+	}
+	budget := memLimit / 64
+	pinned := func() int64 { return int64(queueDepth+2) * int64(slabQuads) * 128 }
+	for pinned() > budget && queueDepth > 2*minQueueDepth {
+		queueDepth >>= 1
+	}
+	for pinned() > budget && slabQuads > minSlabQuads {
+		slabQuads >>= 1
+	}
+	for pinned() > budget && queueDepth > minQueueDepth {
+		queueDepth >>= 1
+	}
+	return slabQuads, queueDepth
+}
@@ -0,0 +1,44 @@
+package commp
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTunedSizes(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		procs             int
+		memLimit          int64
+		slabQuads, qDepth int
+	}{
+		// the static sizes on small machines without a memory limit
+		{1, math.MaxInt64, defaultSlabQuads, defaultQueueDepth},
+		{4, math.MaxInt64, defaultSlabQuads, defaultQueueDepth},
+		// larger slabs with more cores
+		{8, math.MaxInt64, 512, defaultQueueDepth},
+		{64, math.MaxInt64, maxSlabQuads, defaultQueueDepth},
+		{1024, math.MaxInt64, maxSlabQuads, defaultQueueDepth},
+		// plenty of memory changes nothing
+		{8, 64 << 30, 512, defaultQueueDepth},
+		// tight memory gives up queue depth, then slab size
+		{1, 128 << 20, defaultSlabQuads, defaultQueueDepth},
+		{1, 64 << 20, defaultSlabQuads, 16},
+		{1, 32 << 20, defaultSlabQuads, 8},
+		{1, 8 << 20, 64, 8},
+		{1, 2 << 20, minSlabQuads, minQueueDepth},
+		// but never below the minimums
+		{64, 1 << 20, minSlabQuads, minQueueDepth},
+	} {
+		slabQuads, qDepth := tunedSizes(tc.procs, tc.memLimit)
+		if slabQuads != tc.slabQuads || qDepth != tc.qDepth {
+			t.Errorf("%d procs, %d bytes: got %d quads per slab and queue depth %d, expected %d and %d", tc.procs, tc.memLimit, slabQuads, qDepth, tc.slabQuads, tc.qDepth)
+		}
+	}
+
+	// whatever this machine ended up with must be usable by the pools
+	if slabClass(fullSlabSize) < 0 || bufferSize != fullSlabSize/128*quadPayload {
+		t.Fatalf("unusable slab size %d", fullSlabSize)
+	}
+}
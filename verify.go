@@ -0,0 +1,102 @@
+package commp
+
+import (
+	"bytes"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// VerifyingReader passes the data of a piece through, while checking it
+// against an expected commP. It is meant to wrap retrievals: the data read is
+// only known good once Read() returned io.EOF, any mismatch surfaces instead
+// as an error wrapping ErrPieceMismatch.
+type VerifyingReader struct {
+	r        io.Reader
+	cp       *Calc
+	commP    []byte
+	size     PaddedPieceSize
+	capacity uint64
+	err      error
+}
+
+// NewVerifyingReader returns a VerifyingReader over r, expecting the commP of
+// the piece of expectedSize holding the data. As with pieces stored in deals,
+// the data may be shorter than the capacity of the piece, with the remainder
+// zero-filled. The options are those of the underlying Calc, use
+// WithPaddedInput() to verify fr32-padded data. Invalid arguments are
+// reported on the first Read().
+func NewVerifyingReader(r io.Reader, expectedCommP []byte, expectedSize PaddedPieceSize, opts ...Option) *VerifyingReader {
+	vr := &VerifyingReader{
+		r:     r,
+		cp:    New(opts...),
+		commP: append([]byte(nil), expectedCommP...),
+		size:  expectedSize,
+	}
+	if err := expectedSize.Validate(); err != nil {
+		vr.err = xerrors.Errorf("invalid expected size: %w", err)
+		return vr
+	}
+	if len(expectedCommP) != commpDigestSize {
+		vr.err = xerrors.Errorf("expected commP is %d bytes long instead of %d: %w", len(expectedCommP), commpDigestSize, ErrInvalidCommP)
+		return vr
+	}
+	vr.capacity = uint64(expectedSize.Unpadded())
+	if vr.cp.cfg.paddedInput {
+		vr.capacity = uint64(expectedSize)
+	}
+	return vr
+}
+
+// Read reads from the underlying reader, digesting whatever it returned. Data
+// beyond the capacity of the expected piece is not returned: the error
+// wrapping ErrPieceMismatch is instead. At EOF the digest is compared with the
+// expected commP, and io.EOF is only returned if they match. Errors stick,
+// and the background goroutines of the Calc are terminated as soon as one
+// occurs or EOF is reached.
+func (vr *VerifyingReader) Read(p []byte) (int, error) {
+	if vr.err != nil {
+		return 0, vr.err
+	}
+
+	n, err := vr.r.Read(p)
+	if n > 0 {
+		if written := vr.cp.BytesWritten(); written+uint64(n) > vr.capacity {
+			n = int(vr.capacity - written)
+			err = xerrors.Errorf("read more than the %d bytes a piece of %d bytes holds: %w", vr.capacity, vr.size, ErrPieceMismatch)
+		}
+		if _, werr := vr.cp.Write(p[:n]); werr != nil {
+			err = werr
+		}
+	}
+
+	switch {
+	case err == io.EOF:
+		err = vr.verify()
+	case err != nil:
+		vr.fail(err)
+	}
+	return n, err
+}
+
+// verify compares the digest with the expected commP, returning io.EOF if
+// they match.
+func (vr *VerifyingReader) verify() error {
+	commP, _, _, err := vr.cp.DigestPadded(uint64(vr.size))
+	if err != nil {
+		vr.fail(err)
+		return err
+	}
+	if !bytes.Equal(commP, vr.commP) {
+		err := xerrors.Errorf("data digests to commP 0x%X instead of the expected 0x%X: %w", commP, vr.commP, ErrPieceMismatch)
+		vr.fail(err)
+		return err
+	}
+	vr.err = io.EOF
+	return io.EOF
+}
+
+func (vr *VerifyingReader) fail(err error) {
+	vr.err = err
+	vr.cp.Reset()
+}
@@ -0,0 +1,85 @@
+package commp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	randmath "math/rand"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	t.Parallel()
+
+	payload := make([]byte, 300000)
+	randmath.New(randmath.NewSource(1)).Read(payload)
+	commP, paddedSize := mustDigest(t, &Calc{}, payload)
+	padded, err := PadCommP(commP, paddedSize, paddedSize*4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		commP []byte
+		size  PaddedPieceSize
+	}{
+		{commP, PaddedPieceSize(paddedSize)},
+		{padded, PaddedPieceSize(paddedSize * 4)}, // as stored in a larger deal
+	} {
+		for _, r := range []io.Reader{
+			bytes.NewReader(payload),
+			iotest.OneByteReader(bytes.NewReader(payload)),
+			iotest.DataErrReader(bytes.NewReader(payload)),
+		} {
+			got, err := io.ReadAll(NewVerifyingReader(r, tc.commP, tc.size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatal("data passed through doesn't match the payload")
+			}
+		}
+	}
+
+	// a flipped bit
+	corrupt := append([]byte{}, payload...)
+	corrupt[12345] ^= 1
+	vr := NewVerifyingReader(bytes.NewReader(corrupt), commP, PaddedPieceSize(paddedSize))
+	if _, err := io.ReadAll(vr); !errors.Is(err, ErrPieceMismatch) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrPieceMismatch)
+	}
+	if _, err := vr.Read(make([]byte, 10)); !errors.Is(err, ErrPieceMismatch) {
+		t.Fatalf("unexpected error %v after a mismatch, expected %v", err, ErrPieceMismatch)
+	}
+
+	// a truncation, digesting to a smaller piece
+	if _, err := io.ReadAll(NewVerifyingReader(bytes.NewReader(payload[:len(payload)/3]), commP, PaddedPieceSize(paddedSize))); !errors.Is(err, ErrPieceMismatch) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrPieceMismatch)
+	}
+
+	// more data than the piece holds, cut short
+	long := append(append([]byte{}, payload...), make([]byte, paddedSize)...)
+	got, err := io.ReadAll(NewVerifyingReader(bytes.NewReader(long), commP, PaddedPieceSize(paddedSize)))
+	if !errors.Is(err, ErrPieceMismatch) {
+		t.Fatalf("unexpected error %v, expected %v", err, ErrPieceMismatch)
+	}
+	if uint64(len(got)) != paddedSize/128*127 {
+		t.Fatalf("passed through %d bytes, more than the %d a piece holds", len(got), paddedSize/128*127)
+	}
+
+	// invalid arguments
+	for _, tc := range []struct {
+		commP []byte
+		size  PaddedPieceSize
+		err   error
+	}{
+		{commP, 1000, ErrInvalidPieceSize},
+		{commP[:31], PaddedPieceSize(paddedSize), ErrInvalidCommP},
+	} {
+		if _, err := NewVerifyingReader(bytes.NewReader(payload), tc.commP, tc.size).Read(make([]byte, 10)); !errors.Is(err, tc.err) {
+			t.Fatalf("unexpected error %v, expected %v", err, tc.err)
+		}
+	}
+}